@@ -0,0 +1,352 @@
+// Package coap encodes and decodes CoAP messages (RFC 7252) and block
+// options of blockwise transfer (RFC 7959). It is just enough CoAP for
+// devices which can't afford HTTP, transport is up to its user.
+//
+// Message format:
+//
+//	Ver(2) T(2) TKL(4) | Code(8) | Message ID(16)
+//	Token (TKL bytes)
+//	Options, each is delta and length nibbles with extended bytes and value
+//	0xFF Payload
+package coap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Type of message
+type Type uint8
+
+const (
+	Confirmable     Type = 0
+	NonConfirmable  Type = 1
+	Acknowledgement Type = 2
+	Reset           Type = 3
+)
+
+// Code is class of code in upper 3 bits and detail in lower 5 bits
+type Code uint8
+
+// Request methods and response codes
+const (
+	Empty  Code = 0
+	GET    Code = 1
+	POST   Code = 2
+	PUT    Code = 3
+	DELETE Code = 4
+
+	Created                  Code = 2<<5 | 1
+	Deleted                  Code = 2<<5 | 2
+	Valid                    Code = 2<<5 | 3
+	Changed                  Code = 2<<5 | 4
+	Content                  Code = 2<<5 | 5
+	BadRequest               Code = 4<<5 | 0
+	Unauthorized             Code = 4<<5 | 1
+	BadOption                Code = 4<<5 | 2
+	Forbidden                Code = 4<<5 | 3
+	NotFound                 Code = 4<<5 | 4
+	MethodNotAllowed         Code = 4<<5 | 5
+	RequestEntityIncomplete  Code = 4<<5 | 8
+	RequestEntityTooLarge    Code = 4<<5 | 13
+	UnsupportedContentFormat Code = 4<<5 | 15
+	InternalServerError      Code = 5<<5 | 0
+	NotImplemented           Code = 5<<5 | 1
+	ServiceUnavailable       Code = 5<<5 | 3
+)
+
+// Class of code, 0 is request, 2 success, 4 client error and 5 server
+// error
+func (c Code) Class() uint8 {
+	return uint8(c) >> 5
+}
+
+func (c Code) Detail() uint8 {
+	return uint8(c) & 0x1f
+}
+
+// String formats code as class and detail like "2.05"
+func (c Code) String() string {
+	return fmt.Sprintf("%d.%02d", c.Class(), c.Detail())
+}
+
+// Option numbers
+const (
+	IfMatch       = 1
+	URIHost       = 3
+	ETag          = 4
+	IfNoneMatch   = 5
+	URIPort       = 7
+	LocationPath  = 8
+	URIPath       = 11
+	ContentFormat = 12
+	MaxAge        = 14
+	URIQuery      = 15
+	Accept        = 17
+	Block2        = 23
+	Block1        = 27
+	Size2         = 28
+	Size1         = 60
+)
+
+// Content formats
+const (
+	TextPlain   = 0
+	OctetStream = 42
+	JSON        = 50
+)
+
+// Critical tells whether option must be understood by receiver
+func Critical(number uint16) bool {
+	return number&1 == 1
+}
+
+const (
+	version       = 1
+	payloadMarker = 0xff
+	maxTokenSize  = 8
+)
+
+var ErrFormat = errors.New("wrong coap message")
+
+type Option struct {
+	Number uint16
+	Value  []byte
+}
+
+type Message struct {
+	Type      Type
+	Code      Code
+	MessageID uint16
+	Token     []byte
+	Options   []Option
+	Payload   []byte
+}
+
+// Option returns value of the first option with number, nil when there
+// is no such option
+func (m *Message) Option(number uint16) []byte {
+	for _, o := range m.Options {
+		if o.Number == number {
+			return o.Value
+		}
+	}
+	return nil
+}
+
+// HasOption tells whether message has option with number
+func (m *Message) HasOption(number uint16) bool {
+	for _, o := range m.Options {
+		if o.Number == number {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Message) AddOption(number uint16, value []byte) {
+	m.Options = append(m.Options, Option{Number: number, Value: value})
+}
+
+func (m *Message) AddUint(number uint16, value uint32) {
+	m.AddOption(number, EncodeUint(value))
+}
+
+// Path joins Uri-Path options with slashes
+func (m *Message) Path() string {
+	parts := []string{}
+	for _, o := range m.Options {
+		if o.Number == URIPath {
+			parts = append(parts, string(o.Value))
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// Query returns value of Uri-Query option "name=value", empty when there
+// is no such option
+func (m *Message) Query(name string) string {
+	for _, o := range m.Options {
+		if o.Number != URIQuery {
+			continue
+		}
+		if pair := strings.SplitN(string(o.Value), "=", 2); pair[0] == name {
+			if len(pair) == 2 {
+				return pair[1]
+			}
+			return ""
+		}
+	}
+	return ""
+}
+
+// Marshal encodes message, options are sorted by number
+func (m *Message) Marshal() ([]byte, error) {
+	if len(m.Token) > maxTokenSize {
+		return nil, ErrFormat
+	}
+	data := []byte{version<<6 | byte(m.Type)<<4 | byte(len(m.Token)), byte(m.Code), 0, 0}
+	binary.BigEndian.PutUint16(data[2:], m.MessageID)
+	data = append(data, m.Token...)
+	options := make([]Option, len(m.Options))
+	copy(options, m.Options)
+	sort.SliceStable(options, func(i, j int) bool {
+		return options[i].Number < options[j].Number
+	})
+	last := uint16(0)
+	for _, o := range options {
+		delta, deltaExt := optionNibble(uint32(o.Number - last))
+		length, lengthExt := optionNibble(uint32(len(o.Value)))
+		data = append(data, delta<<4|length)
+		data = append(data, deltaExt...)
+		data = append(data, lengthExt...)
+		data = append(data, o.Value...)
+		last = o.Number
+	}
+	if len(m.Payload) > 0 {
+		data = append(data, payloadMarker)
+		data = append(data, m.Payload...)
+	}
+	return data, nil
+}
+
+// optionNibble returns nibble of option delta or length and its extended
+// bytes
+func optionNibble(v uint32) (byte, []byte) {
+	switch {
+	case v < 13:
+		return byte(v), nil
+	case v < 269:
+		return 13, []byte{byte(v - 13)}
+	default:
+		ext := make([]byte, 2)
+		binary.BigEndian.PutUint16(ext, uint16(v-269))
+		return 14, ext
+	}
+}
+
+// Unmarshal decodes message
+func Unmarshal(data []byte) (*Message, error) {
+	if len(data) < 4 || data[0]>>6 != version {
+		return nil, ErrFormat
+	}
+	m := &Message{
+		Type:      Type(data[0] >> 4 & 0x3),
+		Code:      Code(data[1]),
+		MessageID: binary.BigEndian.Uint16(data[2:]),
+	}
+	tokenSize := int(data[0] & 0xf)
+	if tokenSize > maxTokenSize || len(data) < 4+tokenSize {
+		return nil, ErrFormat
+	}
+	m.Token = append([]byte(nil), data[4:4+tokenSize]...)
+	data = data[4+tokenSize:]
+	number := uint32(0)
+	for len(data) > 0 {
+		if data[0] == payloadMarker {
+			if len(data) == 1 {
+				return nil, ErrFormat
+			}
+			m.Payload = append([]byte(nil), data[1:]...)
+			break
+		}
+		delta, length := uint32(data[0]>>4), uint32(data[0]&0xf)
+		data = data[1:]
+		var err error
+		if delta, data, err = extendNibble(delta, data); err != nil {
+			return nil, err
+		}
+		if length, data, err = extendNibble(length, data); err != nil {
+			return nil, err
+		}
+		number += delta
+		if number > 0xffff || uint32(len(data)) < length {
+			return nil, ErrFormat
+		}
+		m.AddOption(uint16(number), append([]byte(nil), data[:length]...))
+		data = data[length:]
+	}
+	return m, nil
+}
+
+// extendNibble reads extended bytes of option delta or length
+func extendNibble(v uint32, data []byte) (uint32, []byte, error) {
+	switch v {
+	case 13:
+		if len(data) < 1 {
+			return 0, nil, ErrFormat
+		}
+		return uint32(data[0]) + 13, data[1:], nil
+	case 14:
+		if len(data) < 2 {
+			return 0, nil, ErrFormat
+		}
+		return uint32(binary.BigEndian.Uint16(data)) + 269, data[2:], nil
+	case 15:
+		return 0, nil, ErrFormat
+	}
+	return v, data, nil
+}
+
+// EncodeUint encodes option value in as few bytes as possible, zero has
+// no bytes
+func EncodeUint(v uint32) []byte {
+	data := []byte{}
+	for v > 0 {
+		data = append([]byte{byte(v)}, data...)
+		v >>= 8
+	}
+	return data
+}
+
+func DecodeUint(data []byte) uint32 {
+	v := uint32(0)
+	for _, b := range data {
+		v = v<<8 | uint32(b)
+	}
+	return v
+}
+
+// Block is value of Block1 or Block2 option, block Num of Size bytes
+// starts at Num*Size and More tells that more blocks follow
+type Block struct {
+	Num  uint32
+	More bool
+	Size int
+}
+
+// Block sizes are powers of two from 16 to 1024
+const (
+	MinBlockSize = 16
+	MaxBlockSize = 1024
+	maxBlockNum  = 1<<20 - 1
+)
+
+// ParseBlock decodes block option
+func ParseBlock(data []byte) (Block, error) {
+	if len(data) > 3 {
+		return Block{}, ErrFormat
+	}
+	v := DecodeUint(data)
+	szx := v & 0x7
+	if szx == 7 {
+		return Block{}, ErrFormat
+	}
+	return Block{Num: v >> 4, More: v&0x8 != 0, Size: 1 << (szx + 4)}, nil
+}
+
+// Encode encodes block option, size is rounded down to power of two
+func (b Block) Encode() []byte {
+	szx := uint32(0)
+	for szx < 6 && MinBlockSize<<(szx+1) <= b.Size {
+		szx++
+	}
+	v := b.Num<<4 | szx
+	if b.More {
+		v |= 0x8
+	}
+	return EncodeUint(v)
+}
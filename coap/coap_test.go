@@ -0,0 +1,78 @@
+package coap
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessage(t *testing.T) {
+	// GET /temperature, confirmable with token 0x71
+	data := []byte{0x41, 0x01, 0x12, 0x34, 0x71, 0xbb, 't', 'e', 'm', 'p', 'e', 'r',
+		'a', 't', 'u', 'r', 'e'}
+	m, err := Unmarshal(data)
+	assert.Nil(t, err)
+	assert.Equal(t, Confirmable, m.Type)
+	assert.Equal(t, GET, m.Code)
+	assert.Equal(t, uint16(0x1234), m.MessageID)
+	assert.Equal(t, []byte{0x71}, m.Token)
+	assert.Equal(t, "temperature", m.Path())
+	encoded, err := m.Marshal()
+	assert.Nil(t, err)
+	assert.Equal(t, data, encoded)
+
+	// Options are sorted, large deltas and lengths use extended bytes
+	long := bytes.Repeat([]byte("x"), 300)
+	m = &Message{Type: Acknowledgement, Code: Content, MessageID: 7, Token: []byte("tok"),
+		Payload: []byte(`{"ok":true}`)}
+	m.AddUint(Size1, 1000)
+	m.AddOption(URIPath, []byte("api"))
+	m.AddOption(URIPath, []byte("error"))
+	m.AddOption(URIQuery, []byte("device-number=1"))
+	m.AddOption(URIQuery, []byte("flag"))
+	m.AddOption(2000, long)
+	m.AddUint(ContentFormat, JSON)
+	encoded, err = m.Marshal()
+	assert.Nil(t, err)
+	decoded, err := Unmarshal(encoded)
+	assert.Nil(t, err)
+	assert.Equal(t, "2.05", decoded.Code.String())
+	assert.Equal(t, "api/error", decoded.Path())
+	assert.Equal(t, "1", decoded.Query("device-number"))
+	assert.Equal(t, "", decoded.Query("flag"))
+	assert.Equal(t, uint32(JSON), DecodeUint(decoded.Option(ContentFormat)))
+	assert.Equal(t, uint32(1000), DecodeUint(decoded.Option(Size1)))
+	assert.Equal(t, long, decoded.Option(2000))
+	assert.Equal(t, m.Payload, decoded.Payload)
+	assert.False(t, decoded.HasOption(Block2))
+	assert.True(t, Critical(URIPath))
+	assert.False(t, Critical(ETag))
+
+	// Truncated messages are rejected
+	for _, wrong := range [][]byte{
+		{0x41, 0x01},
+		{0x81, 0x01, 0, 0},
+		{0x44, 0x01, 0, 0, 1},
+		{0x40, 0x01, 0, 0, 0xd3, 1},
+		{0x40, 0x01, 0, 0, 0xf0},
+		{0x40, 0x01, 0, 0, 0xff},
+	} {
+		_, err = Unmarshal(wrong)
+		assert.Equal(t, ErrFormat, err, "%x", wrong)
+	}
+}
+
+func TestBlock(t *testing.T) {
+	b, err := ParseBlock(Block{Num: 5, More: true, Size: 512}.Encode())
+	assert.Nil(t, err)
+	assert.Equal(t, Block{Num: 5, More: true, Size: 512}, b)
+	// Block 0 of 16 bytes is empty option value
+	assert.Empty(t, Block{Size: MinBlockSize}.Encode())
+	b, _ = ParseBlock(nil)
+	assert.Equal(t, Block{Size: MinBlockSize}, b)
+	b, _ = ParseBlock(Block{Num: 70000, Size: 2000}.Encode())
+	assert.Equal(t, Block{Num: 70000, Size: MaxBlockSize}, b)
+	_, err = ParseBlock([]byte{0x07})
+	assert.Equal(t, ErrFormat, err)
+}
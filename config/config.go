@@ -13,14 +13,133 @@ type Mongo struct {
 	Password string `json:"password"`
 }
 
+// Storage selects backend used to keep devices, errors and users.
+// Type is one of "mongo" (default), "memory" or "bolt", Path is
+// database file of bolt storage
+type Storage struct {
+	Type string `json:"type"`
+	Path string `json:"path"`
+}
+
+// Firmware sets directory of firmware images, maximal size of image
+// in megabytes, how often rollouts are checked in seconds and file of
+// key signing manifests
+type Firmware struct {
+	Dir             string `json:"dir"`
+	MaxSize         int64  `json:"max-size"`
+	RolloutInterval int    `json:"rollout-interval"`
+	SigningKey      string `json:"signing-key"`
+}
+
+// Telemetry sets how often samples are rolled up in seconds and how many
+// days samples ("raw") and rollups of each resolution ("1m", "1h", "1d")
+// are kept, data without retention is kept forever
+type Telemetry struct {
+	RollupInterval int            `json:"rollup-interval"`
+	Retention      map[string]int `json:"retention"`
+}
+
+// Heartbeat sets how many seconds of silence make device offline and how
+// often devices are checked in seconds
+type Heartbeat struct {
+	OfflineAfter  int `json:"offline-after"`
+	SweepInterval int `json:"sweep-interval"`
+}
+
+// Attachments sets where contents of error attachments are kept, "disk"
+// (default) keeps them in Dir and "gridfs" in GridFS of mongo storage.
+// MaxSize of attachment is in megabytes, attachments are kept Retention
+// days and old ones are deleted every CleanupInterval seconds, attachments
+// without retention are kept forever
+type Attachments struct {
+	Storage         string `json:"storage"`
+	Dir             string `json:"dir"`
+	MaxSize         int64  `json:"max-size"`
+	Retention       int    `json:"retention"`
+	CleanupInterval int    `json:"cleanup-interval"`
+}
+
+// Alerts sets how often alert rules are evaluated in seconds
+type Alerts struct {
+	CheckInterval int `json:"check-interval"`
+}
+
+// Webhooks sets how often queued events are sent in seconds, timeout of
+// webhook request in seconds, how many times event is attempted and for
+// how many days finished deliveries are kept
+type Webhooks struct {
+	DeliveryInterval int `json:"delivery-interval"`
+	Timeout          int `json:"timeout"`
+	MaxAttempts      int `json:"max-attempts"`
+	Retention        int `json:"retention"`
+}
+
+// Email sets SMTP server alerts and digests are mailed through, user and
+// password are optional. Templates is directory of alert.tmpl and
+// digest.tmpl replacing default templates, mails are sent every
+// CheckInterval seconds and alert mail is attempted MaxAttempts times.
+// Mails are not sent without host
+type Email struct {
+	Host          string `json:"host"`
+	Port          string `json:"port"`
+	User          string `json:"user"`
+	Password      string `json:"password"`
+	From          string `json:"from"`
+	Templates     string `json:"templates"`
+	CheckInterval int    `json:"check-interval"`
+	MaxAttempts   int    `json:"max-attempts"`
+}
+
+// MQTT sets broker devices publish requests to, user and password are
+// optional. Devices publish to Prefix/{number}/{resource}, device topics
+// are subscribed and replies published with QoS (0, 1 or 2). Bridge is not
+// started without broker
+type MQTT struct {
+	Broker   string `json:"broker"`
+	ClientID string `json:"client-id"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+	Prefix   string `json:"prefix"`
+	QoS      int    `json:"qos"`
+}
+
+// CoAP sets UDP port devices send CoAP requests to, DTLS secures them with
+// certificate of server. Listener is not started without port. Without
+// DTLS credentials are refused unless insecure is set
+type CoAP struct {
+	Port     string `json:"port"`
+	DTLS     bool   `json:"dtls"`
+	Insecure bool   `json:"insecure"`
+}
+
+// GRPC sets TCP port of gRPC device service, it uses certificate of
+// server and client CA of https. Service is not started without port
+type GRPC struct {
+	Port string `json:"port"`
+}
+
 type Config struct {
-	Host       string `json:"host"`
-	Port       string `json:"port"`
-	Expiration int    `json:"expiration"`
-	Mongo      Mongo  `json:"mongo"`
-	ApiKey     string `json:"api-key"`
-	Login      string `json:"login"`
-	Password   string `json:"password"`
+	Host                string      `json:"host"`
+	Port                string      `json:"port"`
+	Expiration          int         `json:"expiration"`
+	Mongo               Mongo       `json:"mongo"`
+	Storage             Storage     `json:"storage"`
+	Firmware            Firmware    `json:"firmware"`
+	Telemetry           Telemetry   `json:"telemetry"`
+	Heartbeat           Heartbeat   `json:"heartbeat"`
+	Attachments         Attachments `json:"attachments"`
+	Alerts              Alerts      `json:"alerts"`
+	Webhooks            Webhooks    `json:"webhooks"`
+	Email               Email       `json:"email"`
+	MQTT                MQTT        `json:"mqtt"`
+	CoAP                CoAP        `json:"coap"`
+	GRPC                GRPC        `json:"grpc"`
+	ApiKey              string      `json:"api-key"`
+	RequireDeviceSecret bool        `json:"require-device-secret"`
+	ClientCA            string      `json:"client-ca"`
+	RequireClientCert   bool        `json:"require-client-cert"`
+	Login               string      `json:"login"`
+	Password            string      `json:"password"`
 }
 
 func Configuration(configFile string) (*Config, error) {
@@ -0,0 +1,187 @@
+// Package delta makes binary deltas between firmware images. Delta is
+// sequence of operations which copy ranges of old image or add new
+// bytes, it is small when images share most of their content.
+//
+// Format, all numbers are unsigned varints:
+//
+//	"IOTD1" new-length
+//	'C' old-offset length   copy bytes of old image
+//	'A' length bytes        add bytes
+package delta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Format is name of delta format devices announce they can apply
+const Format = "iotd1"
+
+const (
+	magic     = "IOTD1"
+	opCopy    = 'C'
+	opAdd     = 'A'
+	blockSize = 16
+	// hashBase is multiplier of rolling hash
+	hashBase = 257
+	// maxCandidates limits how many offsets of old image are kept for
+	// the same block hash, images full of repeating bytes would make
+	// search quadratic otherwise
+	maxCandidates = 8
+)
+
+var ErrCorrupt = errors.New("delta is corrupt")
+
+// Diff makes delta which turns old image into new one
+func Diff(old, new []byte) []byte {
+	out := &bytes.Buffer{}
+	out.WriteString(magic)
+	writeUvarint(out, uint64(len(new)))
+	index := indexBlocks(old)
+	pow := uint32(1)
+	for i := 1; i < blockSize; i++ {
+		pow *= hashBase
+	}
+	literal := 0
+	i := 0
+	var h uint32
+	if len(new) >= blockSize {
+		h = hash(new[:blockSize])
+	}
+	for i+blockSize <= len(new) {
+		offset, length := longestMatch(old, new, i, index[h])
+		if length < blockSize {
+			if i+blockSize < len(new) {
+				h = (h-uint32(new[i])*pow)*hashBase + uint32(new[i+blockSize])
+			}
+			i++
+			continue
+		}
+		// Grow match back into pending literal bytes
+		for offset > 0 && i > literal && old[offset-1] == new[i-1] {
+			offset--
+			i--
+			length++
+		}
+		writeAdd(out, new[literal:i])
+		out.WriteByte(opCopy)
+		writeUvarint(out, uint64(offset))
+		writeUvarint(out, uint64(length))
+		i += length
+		literal = i
+		if i+blockSize <= len(new) {
+			h = hash(new[i : i+blockSize])
+		}
+	}
+	writeAdd(out, new[literal:])
+	return out.Bytes()
+}
+
+// Patch applies delta to old image and returns new image
+func Patch(old, delta []byte) ([]byte, error) {
+	in := bytes.NewReader(delta)
+	head := make([]byte, len(magic))
+	if _, err := io.ReadFull(in, head); err != nil || string(head) != magic {
+		return nil, ErrCorrupt
+	}
+	size, err := binary.ReadUvarint(in)
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	// Size comes from delta which may be corrupt, so preallocated buffer
+	// is bounded by inputs and grows when operations need more
+	capacity := uint64(len(old) + len(delta))
+	if size < capacity {
+		capacity = size
+	}
+	out := make([]byte, 0, capacity)
+	for {
+		op, err := in.ReadByte()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, ErrCorrupt
+		}
+		switch op {
+		case opCopy:
+			offset, err1 := binary.ReadUvarint(in)
+			length, err2 := binary.ReadUvarint(in)
+			if err1 != nil || err2 != nil || offset > uint64(len(old)) ||
+				length > uint64(len(old))-offset {
+				return nil, ErrCorrupt
+			}
+			out = append(out, old[offset:offset+length]...)
+		case opAdd:
+			length, err := binary.ReadUvarint(in)
+			if err != nil || length > uint64(in.Len()) {
+				return nil, ErrCorrupt
+			}
+			add := make([]byte, length)
+			in.Read(add)
+			out = append(out, add...)
+		default:
+			return nil, ErrCorrupt
+		}
+		if uint64(len(out)) > size {
+			return nil, ErrCorrupt
+		}
+	}
+	if uint64(len(out)) != size {
+		return nil, ErrCorrupt
+	}
+	return out, nil
+}
+
+// indexBlocks maps hash of every aligned block of old image to offsets
+// of blocks having it
+func indexBlocks(old []byte) map[uint32][]int {
+	index := make(map[uint32][]int, len(old)/blockSize)
+	for offset := 0; offset+blockSize <= len(old); offset += blockSize {
+		h := hash(old[offset : offset+blockSize])
+		if len(index[h]) < maxCandidates {
+			index[h] = append(index[h], offset)
+		}
+	}
+	return index
+}
+
+// longestMatch finds candidate offset of old image sharing the longest
+// prefix with new image at position i
+func longestMatch(old, new []byte, i int, candidates []int) (int, int) {
+	bestOffset, bestLength := 0, 0
+	for _, offset := range candidates {
+		length := 0
+		for offset+length < len(old) && i+length < len(new) &&
+			old[offset+length] == new[i+length] {
+			length++
+		}
+		if length > bestLength {
+			bestOffset, bestLength = offset, length
+		}
+	}
+	return bestOffset, bestLength
+}
+
+func hash(block []byte) uint32 {
+	var h uint32
+	for _, b := range block {
+		h = h*hashBase + uint32(b)
+	}
+	return h
+}
+
+func writeAdd(out *bytes.Buffer, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	out.WriteByte(opAdd)
+	writeUvarint(out, uint64(len(data)))
+	out.Write(data)
+}
+
+func writeUvarint(out *bytes.Buffer, n uint64) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	out.Write(buf[:binary.PutUvarint(buf, n)])
+}
@@ -0,0 +1,66 @@
+package delta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func randomBytes(r *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	r.Read(b)
+	return b
+}
+
+func TestRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	old := randomBytes(r, 64<<10)
+	// New image keeps most of old one with some code changed, inserted
+	// and removed
+	new := append([]byte{}, old[:10000]...)
+	new = append(new, randomBytes(r, 300)...)
+	new = append(new, old[10000:30000]...)
+	new = append(new, old[40000:]...)
+	new[50000] ^= 0xff
+	d := Diff(old, new)
+	assert.True(t, len(d) < len(new)/10, "delta is too big: %d", len(d))
+	patched, err := Patch(old, d)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(new, patched))
+}
+
+func TestEdgeCases(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	cases := [][2][]byte{
+		{nil, nil},
+		{nil, []byte("short")},
+		{randomBytes(r, 100), nil},
+		{randomBytes(r, 100), randomBytes(r, 100)},
+		{bytes.Repeat([]byte{0}, 1000), bytes.Repeat([]byte{0}, 2000)},
+	}
+	for _, c := range cases {
+		patched, err := Patch(c[0], Diff(c[0], c[1]))
+		assert.Nil(t, err)
+		assert.True(t, bytes.Equal(c[1], patched))
+	}
+}
+
+func TestCorrupt(t *testing.T) {
+	old := []byte("0123456789abcdef0123456789abcdef")
+	d := Diff(old, append([]byte("x"), old...))
+	_, err := Patch(old[:10], d)
+	assert.Equal(t, ErrCorrupt, err)
+	_, err = Patch(old, d[:len(d)-1])
+	assert.Equal(t, ErrCorrupt, err)
+	_, err = Patch(old, []byte("garbage"))
+	assert.Equal(t, ErrCorrupt, err)
+	// Size of corrupt header is not allocated
+	for _, size := range []uint64{1 << 62, 1<<64 - 1} {
+		head := append([]byte(magic), binary.AppendUvarint(nil, size)...)
+		_, err = Patch(old, append(head, opAdd, 1, 'x'))
+		assert.Equal(t, ErrCorrupt, err)
+	}
+}
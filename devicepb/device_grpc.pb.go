@@ -0,0 +1,302 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             v4.25.3
+// source: device.proto
+
+package devicepb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Device_RegisterDevice_FullMethodName   = "/iotstats.device.v1.Device/RegisterDevice"
+	Device_ReportError_FullMethodName      = "/iotstats.device.v1.Device/ReportError"
+	Device_ReportErrors_FullMethodName     = "/iotstats.device.v1.Device/ReportErrors"
+	Device_Heartbeat_FullMethodName        = "/iotstats.device.v1.Device/Heartbeat"
+	Device_DownloadFirmware_FullMethodName = "/iotstats.device.v1.Device/DownloadFirmware"
+)
+
+// DeviceClient is the client API for Device service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Device is device API of iot-stats, calls are checked and stored exactly
+// as requests of /api group of REST API. Credentials are metadata
+// "api-key", "device-number" and "device-secret", device which presented
+// verified client certificate needs none of them. Failed call has status
+// matching http status of REST API: INVALID_ARGUMENT for 400,
+// UNAUTHENTICATED for 401, PERMISSION_DENIED for 403, NOT_FOUND for 404
+// and INTERNAL for 500.
+type DeviceClient interface {
+	// RegisterDevice answers new device and device which has no credential
+	// yet with secret to be sent in "device-secret" metadata
+	RegisterDevice(ctx context.Context, in *RegisterRequest, opts ...grpc.CallOption) (*RegisterReply, error)
+	ReportError(ctx context.Context, in *ErrorReport, opts ...grpc.CallOption) (*ErrorReply, error)
+	// ReportErrors stores up to 100 errors device buffered while offline,
+	// reports are checked one by one and the rest are stored together.
+	// Reports belong to authenticated device or to device of the first
+	// report
+	ReportErrors(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[ErrorReport, ErrorBatchReply], error)
+	Heartbeat(ctx context.Context, in *HeartbeatRequest, opts ...grpc.CallOption) (*HeartbeatReply, error)
+	// DownloadFirmware streams image of firmware device should run, the
+	// first chunk describes firmware
+	DownloadFirmware(ctx context.Context, in *FirmwareRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[FirmwareChunk], error)
+}
+
+type deviceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewDeviceClient(cc grpc.ClientConnInterface) DeviceClient {
+	return &deviceClient{cc}
+}
+
+func (c *deviceClient) RegisterDevice(ctx context.Context, in *RegisterRequest, opts ...grpc.CallOption) (*RegisterReply, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(RegisterReply)
+	err := c.cc.Invoke(ctx, Device_RegisterDevice_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *deviceClient) ReportError(ctx context.Context, in *ErrorReport, opts ...grpc.CallOption) (*ErrorReply, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ErrorReply)
+	err := c.cc.Invoke(ctx, Device_ReportError_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *deviceClient) ReportErrors(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[ErrorReport, ErrorBatchReply], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Device_ServiceDesc.Streams[0], Device_ReportErrors_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ErrorReport, ErrorBatchReply]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Device_ReportErrorsClient = grpc.ClientStreamingClient[ErrorReport, ErrorBatchReply]
+
+func (c *deviceClient) Heartbeat(ctx context.Context, in *HeartbeatRequest, opts ...grpc.CallOption) (*HeartbeatReply, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(HeartbeatReply)
+	err := c.cc.Invoke(ctx, Device_Heartbeat_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *deviceClient) DownloadFirmware(ctx context.Context, in *FirmwareRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[FirmwareChunk], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Device_ServiceDesc.Streams[1], Device_DownloadFirmware_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[FirmwareRequest, FirmwareChunk]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Device_DownloadFirmwareClient = grpc.ServerStreamingClient[FirmwareChunk]
+
+// DeviceServer is the server API for Device service.
+// All implementations must embed UnimplementedDeviceServer
+// for forward compatibility.
+//
+// Device is device API of iot-stats, calls are checked and stored exactly
+// as requests of /api group of REST API. Credentials are metadata
+// "api-key", "device-number" and "device-secret", device which presented
+// verified client certificate needs none of them. Failed call has status
+// matching http status of REST API: INVALID_ARGUMENT for 400,
+// UNAUTHENTICATED for 401, PERMISSION_DENIED for 403, NOT_FOUND for 404
+// and INTERNAL for 500.
+type DeviceServer interface {
+	// RegisterDevice answers new device and device which has no credential
+	// yet with secret to be sent in "device-secret" metadata
+	RegisterDevice(context.Context, *RegisterRequest) (*RegisterReply, error)
+	ReportError(context.Context, *ErrorReport) (*ErrorReply, error)
+	// ReportErrors stores up to 100 errors device buffered while offline,
+	// reports are checked one by one and the rest are stored together.
+	// Reports belong to authenticated device or to device of the first
+	// report
+	ReportErrors(grpc.ClientStreamingServer[ErrorReport, ErrorBatchReply]) error
+	Heartbeat(context.Context, *HeartbeatRequest) (*HeartbeatReply, error)
+	// DownloadFirmware streams image of firmware device should run, the
+	// first chunk describes firmware
+	DownloadFirmware(*FirmwareRequest, grpc.ServerStreamingServer[FirmwareChunk]) error
+	mustEmbedUnimplementedDeviceServer()
+}
+
+// UnimplementedDeviceServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedDeviceServer struct{}
+
+func (UnimplementedDeviceServer) RegisterDevice(context.Context, *RegisterRequest) (*RegisterReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RegisterDevice not implemented")
+}
+func (UnimplementedDeviceServer) ReportError(context.Context, *ErrorReport) (*ErrorReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReportError not implemented")
+}
+func (UnimplementedDeviceServer) ReportErrors(grpc.ClientStreamingServer[ErrorReport, ErrorBatchReply]) error {
+	return status.Errorf(codes.Unimplemented, "method ReportErrors not implemented")
+}
+func (UnimplementedDeviceServer) Heartbeat(context.Context, *HeartbeatRequest) (*HeartbeatReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Heartbeat not implemented")
+}
+func (UnimplementedDeviceServer) DownloadFirmware(*FirmwareRequest, grpc.ServerStreamingServer[FirmwareChunk]) error {
+	return status.Errorf(codes.Unimplemented, "method DownloadFirmware not implemented")
+}
+func (UnimplementedDeviceServer) mustEmbedUnimplementedDeviceServer() {}
+func (UnimplementedDeviceServer) testEmbeddedByValue()                {}
+
+// UnsafeDeviceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to DeviceServer will
+// result in compilation errors.
+type UnsafeDeviceServer interface {
+	mustEmbedUnimplementedDeviceServer()
+}
+
+func RegisterDeviceServer(s grpc.ServiceRegistrar, srv DeviceServer) {
+	// If the following call pancis, it indicates UnimplementedDeviceServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Device_ServiceDesc, srv)
+}
+
+func _Device_RegisterDevice_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RegisterRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DeviceServer).RegisterDevice(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Device_RegisterDevice_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DeviceServer).RegisterDevice(ctx, req.(*RegisterRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Device_ReportError_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ErrorReport)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DeviceServer).ReportError(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Device_ReportError_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DeviceServer).ReportError(ctx, req.(*ErrorReport))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Device_ReportErrors_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(DeviceServer).ReportErrors(&grpc.GenericServerStream[ErrorReport, ErrorBatchReply]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Device_ReportErrorsServer = grpc.ClientStreamingServer[ErrorReport, ErrorBatchReply]
+
+func _Device_Heartbeat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(HeartbeatRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DeviceServer).Heartbeat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Device_Heartbeat_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DeviceServer).Heartbeat(ctx, req.(*HeartbeatRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Device_DownloadFirmware_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(FirmwareRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(DeviceServer).DownloadFirmware(m, &grpc.GenericServerStream[FirmwareRequest, FirmwareChunk]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Device_DownloadFirmwareServer = grpc.ServerStreamingServer[FirmwareChunk]
+
+// Device_ServiceDesc is the grpc.ServiceDesc for Device service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Device_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "iotstats.device.v1.Device",
+	HandlerType: (*DeviceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "RegisterDevice",
+			Handler:    _Device_RegisterDevice_Handler,
+		},
+		{
+			MethodName: "ReportError",
+			Handler:    _Device_ReportError_Handler,
+		},
+		{
+			MethodName: "Heartbeat",
+			Handler:    _Device_Heartbeat_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "ReportErrors",
+			Handler:       _Device_ReportErrors_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "DownloadFirmware",
+			Handler:       _Device_DownloadFirmware_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "device.proto",
+}
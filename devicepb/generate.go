@@ -0,0 +1,5 @@
+// Package devicepb is gRPC device service of iot-stats, code is generated
+// from device.proto by protoc-gen-go and protoc-gen-go-grpc
+package devicepb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative device.proto
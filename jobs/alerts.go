@@ -0,0 +1,204 @@
+package jobs
+
+import (
+	"fmt"
+	"iot-stats/model"
+	"iot-stats/service"
+	"iot-stats/utils"
+	"sort"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Evaluator checks alert rules against stored data, it fires alert when
+// rule matches device and resolves alert when rule stops matching
+type Evaluator struct {
+	ms       service.MongoInterface
+	ts       service.TelemetryInterface
+	interval time.Duration
+}
+
+func NewEvaluator(ms service.MongoInterface, ts service.TelemetryInterface,
+	interval time.Duration) *Evaluator {
+	return &Evaluator{ms: ms, ts: ts, interval: interval}
+}
+
+// Run evaluates rules every interval until stop is closed
+func (e *Evaluator) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			e.Check(now)
+		}
+	}
+}
+
+// Check evaluates rules at now. Firing alert of rule and device is
+// updated instead of firing another one. Alerts of deleted and disabled
+// rules are resolved, alerts of rules which failed to evaluate are kept
+func (e *Evaluator) Check(now time.Time) {
+	rules, err := e.ms.GetRules()
+	if err != nil {
+		utils.Log().Infoln("alerts job err", err)
+		return
+	}
+	firing, err := e.ms.GetAlerts(model.AlertFiring, 0)
+	if err != nil {
+		utils.Log().Infoln("alerts job err", err)
+		return
+	}
+	open := make(map[string]*model.Alert, len(*firing))
+	for i := range *firing {
+		a := &(*firing)[i]
+		open[alertKey(a.RuleId, a.DeviceNumber)] = a
+	}
+	for i := range *rules {
+		rule := &(*rules)[i]
+		if rule.Disabled {
+			continue
+		}
+		matches, err := e.evaluate(rule, now)
+		if err != nil {
+			utils.Log().Infoln("alerts job rule", rule.Name, "err", err)
+			for key, a := range open {
+				if a.RuleId == rule.ID {
+					delete(open, key)
+				}
+			}
+			continue
+		}
+		numbers := make([]string, 0, len(matches))
+		for number := range matches {
+			numbers = append(numbers, number)
+		}
+		sort.Strings(numbers)
+		for _, number := range numbers {
+			key := alertKey(rule.ID, number)
+			if a, ok := open[key]; ok {
+				delete(open, key)
+				a.RuleName, a.Value, a.LastDate = rule.Name, matches[number], now
+				if err = e.ms.UpdateAlert(a); err != nil {
+					utils.Log().Infoln("alerts job err", err)
+				}
+				continue
+			}
+			a := &model.Alert{
+				RuleId:       rule.ID,
+				RuleName:     rule.Name,
+				Kind:         rule.Kind,
+				DeviceNumber: number,
+				State:        model.AlertFiring,
+				Value:        matches[number],
+				StartDate:    now,
+				LastDate:     now,
+			}
+			if err = e.ms.AddAlert(a); err != nil {
+				utils.Log().Infoln("alerts job err", err)
+				continue
+			}
+			utils.Log().Infoln("alert", rule.Name, "fired for device", number)
+		}
+	}
+	for _, a := range open {
+		a.State, a.EndDate = model.AlertResolved, now
+		if err = e.ms.UpdateAlert(a); err != nil {
+			utils.Log().Infoln("alerts job err", err)
+			continue
+		}
+		utils.Log().Infoln("alert", a.RuleName, "resolved for device", a.DeviceNumber)
+	}
+}
+
+// evaluate finds devices rule matches at now with values which made them
+// match: error count, minutes offline or metric average. Errors and
+// metric samples are counted in whole minutes of window
+func (e *Evaluator) evaluate(rule *model.Rule, now time.Time) (map[string]float64, error) {
+	from := now.Add(-time.Duration(rule.Window) * time.Minute)
+	matches := make(map[string]float64)
+	switch rule.Kind {
+	case model.RuleErrors:
+		counts, err := e.ms.CountErrors(rule.ErrorName, from.Truncate(time.Minute), now)
+		if err != nil {
+			return nil, err
+		}
+		for number, n := range counts {
+			if float64(n) > rule.Threshold {
+				matches[number] = float64(n)
+			}
+		}
+	case model.RuleOffline:
+		devices, err := e.ms.GetOfflineDevices(from)
+		if err != nil {
+			return nil, err
+		}
+		for _, device := range *devices {
+			matches[device.DeviceNumber] = now.Sub(device.LastSeen).Minutes()
+		}
+	case model.RuleMetric:
+		sums, counts, err := e.sumMetric(rule.Metric, from.Truncate(time.Minute), now)
+		if err != nil {
+			return nil, err
+		}
+		for number, sum := range sums {
+			if avg := sum / float64(counts[number]); avg > rule.Threshold {
+				matches[number] = avg
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown rule kind %q", rule.Kind)
+	}
+	if rule.DeviceNumber != "" {
+		for number := range matches {
+			if number != rule.DeviceNumber {
+				delete(matches, number)
+			}
+		}
+	}
+	return matches, nil
+}
+
+// sumMetric sums values of metric samples of every device taken in
+// [from, to) and counts them. Minutes rolled up already are read from
+// rollups of the finest resolution, the rest from samples
+func (e *Evaluator) sumMetric(metric string, from, to time.Time) (map[string]float64,
+	map[string]int, error) {
+	res := model.Resolutions[0]
+	last, err := e.ts.LastRollup(res.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+	rolled := from
+	if !last.IsZero() && last.Add(res.Duration).After(from) {
+		rolled = last.Add(res.Duration)
+	}
+	if rolled.After(to) {
+		rolled = to
+	}
+	sums, counts := make(map[string]float64), make(map[string]int)
+	rollups, err := e.ts.GetMetricRollups(metric, res.Name, from, rolled)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, r := range *rollups {
+		sums[r.DeviceNumber] += r.Sum
+		counts[r.DeviceNumber] += r.Count
+	}
+	samples, err := e.ts.GetMetricSamples(metric, rolled, to)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, s := range *samples {
+		sums[s.DeviceNumber] += s.Value
+		counts[s.DeviceNumber]++
+	}
+	return sums, counts, nil
+}
+
+func alertKey(ruleID bson.ObjectId, deviceNumber string) string {
+	return ruleID.Hex() + "/" + deviceNumber
+}
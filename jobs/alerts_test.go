@@ -0,0 +1,115 @@
+package jobs
+
+import (
+	"iot-stats/model"
+	"iot-stats/service"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvaluator(t *testing.T) {
+	ms := service.NewMemoryService()
+	job := NewEvaluator(ms, ms, time.Minute)
+	now := time.Now()
+	for _, number := range []string{"1", "2", "3"} {
+		ms.RegisterDevice(number, now.Add(-time.Hour))
+	}
+	crashes := &model.Rule{Name: "crashes", Kind: model.RuleErrors, ErrorName: "crash",
+		Threshold: 1, Window: 10}
+	offline := &model.Rule{Name: "offline", Kind: model.RuleOffline, Window: 30}
+	hot := &model.Rule{Name: "hot", Kind: model.RuleMetric, Metric: "temp",
+		Threshold: 80, Window: 5, DeviceNumber: "2"}
+	for _, rule := range []*model.Rule{crashes, offline, hot} {
+		ms.AddRule(rule)
+	}
+	for i := 0; i < 2; i++ {
+		ms.RegisterError(&model.DeviceErrorDto{ErrorName: "crash", DeviceNumber: "1"})
+	}
+	ms.RegisterError(&model.DeviceErrorDto{ErrorName: "crash", DeviceNumber: "2"})
+	ms.RegisterHeartbeat("3", 0, now.Add(-time.Hour))
+	ms.MarkOffline(now)
+	ms.AddSamples([]model.Sample{
+		{DeviceNumber: "1", Metric: "temp", Value: 90, Date: now.Add(-time.Minute)},
+		{DeviceNumber: "2", Metric: "temp", Value: 85, Date: now.Add(-time.Minute)},
+		{DeviceNumber: "2", Metric: "temp", Value: 79, Date: now.Add(-2 * time.Minute)},
+	})
+	check := now.Add(time.Second)
+	job.Check(check)
+	alerts, _ := ms.GetAlerts(model.AlertFiring, 0)
+	fired := map[string]model.Alert{}
+	for _, a := range *alerts {
+		fired[a.RuleName+"/"+a.DeviceNumber] = a
+	}
+	assert.Len(t, fired, 3)
+	assert.Equal(t, 2.0, fired["crashes/1"].Value)
+	assert.InDelta(t, 60, fired["offline/3"].Value, 1)
+	assert.Equal(t, 82.0, fired["hot/2"].Value)
+	// Matching rule updates firing alert
+	job.Check(check.Add(time.Minute))
+	alerts, _ = ms.GetAlerts("", 0)
+	assert.Len(t, *alerts, 3)
+	for _, a := range *alerts {
+		assert.Equal(t, check.Add(time.Minute), a.LastDate)
+		assert.Equal(t, check, a.StartDate)
+	}
+	// Disabled rule and rule which stops matching are resolved
+	offline.Disabled = true
+	ms.UpdateRule(offline)
+	job.Check(check.Add(20 * time.Minute))
+	alerts, _ = ms.GetAlerts(model.AlertFiring, 0)
+	assert.Len(t, *alerts, 0)
+	alerts, _ = ms.GetAlerts(model.AlertResolved, 0)
+	assert.Len(t, *alerts, 3)
+	for _, a := range *alerts {
+		assert.Equal(t, check.Add(20*time.Minute), a.EndDate)
+	}
+	// Rule matching again fires new alert
+	ms.RegisterHeartbeat("3", 0, now)
+	offline.Disabled = false
+	offline.Window = 1
+	ms.UpdateRule(offline)
+	ms.MarkOffline(now.Add(10 * time.Minute))
+	job.Check(check.Add(20 * time.Minute))
+	alerts, _ = ms.GetAlerts("", 0)
+	assert.Len(t, *alerts, 4)
+	assert.Equal(t, model.AlertFiring, (*alerts)[0].State)
+	assert.Equal(t, "3", (*alerts)[0].DeviceNumber)
+}
+
+func TestEvaluatorWindow(t *testing.T) {
+	ms := service.NewMemoryService()
+	job := NewEvaluator(ms, ms, time.Minute)
+	now := time.Now().Truncate(time.Minute).Add(30 * time.Second)
+	ms.RegisterDevice("1", now.Add(-time.Hour))
+	ms.AddRule(&model.Rule{Name: "crashes", Kind: model.RuleErrors, ErrorName: "crash",
+		Threshold: 125, Window: 10})
+	ms.AddRule(&model.Rule{Name: "hot", Kind: model.RuleMetric, Metric: "temp",
+		Threshold: 30, Window: 5})
+	// Every error counts, not only stored ones
+	for i := 0; i < 130; i++ {
+		ms.RegisterError(&model.DeviceErrorDto{ErrorName: "crash", DeviceNumber: "1"})
+	}
+	// Rolled up minutes are read from rollups, later ones from samples
+	minute := now.Truncate(time.Minute)
+	ms.AddSamples([]model.Sample{
+		{DeviceNumber: "1", Metric: "temp", Value: 0, Date: minute.Add(-2 * time.Minute)},
+		{DeviceNumber: "1", Metric: "temp", Value: 90, Date: minute.Add(10 * time.Second)},
+	})
+	ms.SetRollups([]model.Rollup{
+		{DeviceNumber: "1", Metric: "temp", Resolution: "1m", Date: minute.Add(-2 * time.Minute),
+			Count: 2, Sum: 30},
+		{DeviceNumber: "1", Metric: "other", Resolution: "1m", Date: minute.Add(-time.Minute),
+			Count: 1, Sum: 1000},
+		{DeviceNumber: "1", Metric: "temp", Resolution: "1m", Date: minute.Add(-time.Hour),
+			Count: 1, Sum: 1000},
+	})
+	job.Check(now)
+	alerts, _ := ms.GetAlerts(model.AlertFiring, 0)
+	fired := map[string]float64{}
+	for _, a := range *alerts {
+		fired[a.RuleName] = a.Value
+	}
+	assert.Equal(t, map[string]float64{"crashes": 130, "hot": 40}, fired)
+}
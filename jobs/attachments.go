@@ -0,0 +1,57 @@
+package jobs
+
+import (
+	"iot-stats/service"
+	"iot-stats/utils"
+	"time"
+)
+
+// Cleaner deletes attachments older than retention together with their
+// content
+type Cleaner struct {
+	ms        service.MongoInterface
+	blobs     service.BlobStore
+	interval  time.Duration
+	retention time.Duration
+}
+
+func NewCleaner(ms service.MongoInterface, blobs service.BlobStore, interval,
+	retention time.Duration) *Cleaner {
+	return &Cleaner{ms: ms, blobs: blobs, interval: interval, retention: retention}
+}
+
+// Run deletes old attachments every interval until stop is closed
+func (cl *Cleaner) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(cl.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			if err := cl.Check(now); err != nil {
+				utils.Log().Infoln("cleaner job err", err)
+			}
+		}
+	}
+}
+
+// Check deletes attachments uploaded before now minus retention. Content
+// goes first, so that failure in between leaves the record to be retried
+// next time instead of a blob nothing refers to
+func (cl *Cleaner) Check(now time.Time) error {
+	old, err := cl.ms.GetAttachmentsBefore(now.Add(-cl.retention))
+	if err != nil {
+		return err
+	}
+	for _, a := range *old {
+		if err = cl.blobs.DeleteBlob(a.ID.Hex()); err != nil {
+			return err
+		}
+		if err = cl.ms.DeleteAttachment(a.ID.Hex()); err != nil &&
+			err != service.ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package jobs
+
+import (
+	"iot-stats/model"
+	"iot-stats/service"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestCleaner(t *testing.T) {
+	ms := service.NewMemoryService()
+	blobs := service.NewDiskBlobStore(t.TempDir())
+	job := NewCleaner(ms, blobs, time.Hour, 24*time.Hour)
+	now := time.Now()
+	for _, date := range []time.Time{now.Add(-48 * time.Hour), now.Add(-time.Hour)} {
+		a := &model.Attachment{ID: bson.NewObjectId(), Date: date}
+		blobs.PutBlob(a.ID.Hex(), strings.NewReader("core"))
+		ms.AddAttachment(a)
+	}
+	old, _ := ms.GetAttachmentsBefore(now)
+	assert.Nil(t, job.Check(now))
+	_, err := ms.GetAttachment((*old)[0].ID.Hex())
+	assert.Equal(t, service.ErrNotFound, err)
+	_, err = blobs.OpenBlob((*old)[0].ID.Hex())
+	assert.Equal(t, service.ErrNotFound, err)
+	blob, err := blobs.OpenBlob((*old)[1].ID.Hex())
+	assert.Nil(t, err)
+	blob.Close()
+	_, err = ms.GetAttachment((*old)[1].ID.Hex())
+	assert.Nil(t, err)
+}
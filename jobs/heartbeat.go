@@ -0,0 +1,45 @@
+package jobs
+
+import (
+	"iot-stats/service"
+	"iot-stats/utils"
+	"time"
+)
+
+// Sweeper marks devices offline when they have not sent heartbeat for
+// timeout
+type Sweeper struct {
+	ms       service.MongoInterface
+	interval time.Duration
+	timeout  time.Duration
+}
+
+func NewSweeper(ms service.MongoInterface, interval, timeout time.Duration) *Sweeper {
+	return &Sweeper{ms: ms, interval: interval, timeout: timeout}
+}
+
+// Run sweeps devices every interval until stop is closed
+func (s *Sweeper) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			s.Check(now)
+		}
+	}
+}
+
+// Check marks devices silent since now minus timeout offline
+func (s *Sweeper) Check(now time.Time) {
+	numbers, err := s.ms.MarkOffline(now.Add(-s.timeout))
+	if err != nil {
+		utils.Log().Infoln("sweeper job err", err)
+		return
+	}
+	for _, number := range *numbers {
+		utils.Log().Infoln("device", number, "is offline")
+	}
+}
@@ -0,0 +1,37 @@
+package jobs
+
+import (
+	"iot-stats/model"
+	"iot-stats/service"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSweeper(t *testing.T) {
+	ms := service.NewMemoryService()
+	job := NewSweeper(ms, time.Minute, 5*time.Minute)
+	now := time.Now()
+	for _, number := range []string{"1", "2", "3"} {
+		ms.RegisterDevice(number, now)
+	}
+	ms.RegisterHeartbeat("1", 100, now.Add(-10*time.Minute))
+	ms.RegisterHeartbeat("2", 0, now.Add(-time.Minute))
+	job.Check(now)
+	for number, status := range map[string]string{
+		"1": model.StatusOffline,
+		"2": model.StatusOnline,
+		"3": "",
+	} {
+		device, _ := ms.GetDeviceByNumber(number)
+		assert.Equal(t, status, device.Status, number)
+	}
+	events, _ := ms.GetStatusEvents("1")
+	assert.Len(t, *events, 2)
+	assert.Equal(t, model.StatusOffline, (*events)[0].Status)
+	// Offline device is not swept again
+	job.Check(now.Add(time.Minute))
+	events, _ = ms.GetStatusEvents("1")
+	assert.Len(t, *events, 2)
+}
@@ -0,0 +1,131 @@
+package jobs
+
+import (
+	"encoding/json"
+	"iot-stats/mail"
+	"iot-stats/model"
+	"iot-stats/service"
+	"iot-stats/utils"
+	"time"
+)
+
+// maxDigestIssues limits how many issues single digest lists
+const maxDigestIssues = 500
+
+// digestPeriods maps digest settings to periods
+var digestPeriods = map[string]time.Duration{
+	model.DigestHourly: time.Hour,
+	model.DigestDaily:  24 * time.Hour,
+}
+
+// Mailer sends queued alert mails and digests of issues to subscribed
+// admins. Alert mail which fails is retried like webhook delivery, digest
+// which fails is retried by next check
+type Mailer struct {
+	ms          service.MongoInterface
+	sender      mail.Sender
+	templates   *mail.Templates
+	interval    time.Duration
+	maxAttempts int
+}
+
+func NewMailer(ms service.MongoInterface, sender mail.Sender, templates *mail.Templates,
+	interval time.Duration, maxAttempts int) *Mailer {
+	return &Mailer{ms: ms, sender: sender, templates: templates, interval: interval,
+		maxAttempts: maxAttempts}
+}
+
+// Run sends mails every interval until stop is closed
+func (m *Mailer) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			m.Check(now)
+		}
+	}
+}
+
+// Check sends mails due at now and digests whose period passed
+func (m *Mailer) Check(now time.Time) {
+	m.sendAlerts(now)
+	m.sendDigests(now)
+}
+
+func (m *Mailer) sendAlerts(now time.Time) {
+	mails, err := m.ms.GetDueMails(now, deliveryBatch)
+	if err != nil {
+		utils.Log().Infoln("mailer job err", err)
+		return
+	}
+	for i := range *mails {
+		msg := &(*mails)[i]
+		msg.Attempts++
+		event := mail.AlertEvent{}
+		err = json.Unmarshal([]byte(msg.Payload), &event)
+		var subject, body string
+		if err == nil {
+			subject, body, err = m.templates.Render(mail.AlertTemplate, &event)
+		}
+		if err != nil {
+			// Mail which can't be rendered won't be rendered by next attempt
+			msg.State, msg.Error = model.DeliveryFailed, err.Error()
+		} else if err = m.sender.Send(msg.To, subject, body); err == nil {
+			msg.State, msg.SendDate, msg.Error = model.DeliveryDelivered, now, ""
+		} else if msg.Error = err.Error(); msg.Attempts >= m.maxAttempts {
+			msg.State = model.DeliveryFailed
+			utils.Log().Infoln("mail", msg.ID.Hex(), "failed", err)
+		} else {
+			msg.NextDate = now.Add(backoff(msg.Attempts))
+		}
+		if err = m.ms.UpdateMail(msg); err != nil {
+			utils.Log().Infoln("mailer job err", err)
+		}
+	}
+}
+
+// sendDigests mails issues seen since last digest of every subscriber
+// whose period passed, digest without issues is not mailed. First check
+// of subscription starts its digests
+func (m *Mailer) sendDigests(now time.Time) {
+	subscriptions, err := m.ms.GetSubscriptions()
+	if err != nil {
+		utils.Log().Infoln("mailer job err", err)
+		return
+	}
+	for i := range *subscriptions {
+		s := &(*subscriptions)[i]
+		period, ok := digestPeriods[s.Digest]
+		if !ok || s.Email == "" {
+			continue
+		}
+		if !s.DigestDate.IsZero() {
+			if now.Sub(s.DigestDate) < period {
+				continue
+			}
+			if err = m.sendDigest(s, now); err != nil {
+				utils.Log().Infoln("digest of", s.Login, "err", err)
+				continue
+			}
+		}
+		if err = m.ms.SetDigestDate(s.Login, now); err != nil {
+			utils.Log().Infoln("mailer job err", err)
+		}
+	}
+}
+
+func (m *Mailer) sendDigest(s *model.Subscription, now time.Time) error {
+	issues, err := m.ms.GetIssuesSeen(s.DigestDate, now, maxDigestIssues)
+	if err != nil || len(*issues) == 0 {
+		return err
+	}
+	subject, body, err := m.templates.Render(mail.DigestTemplate,
+		mail.NewDigest(s.DigestDate, now, *issues))
+	if err != nil {
+		return err
+	}
+	return m.sender.Send(s.Email, subject, body)
+}
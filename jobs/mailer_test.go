@@ -0,0 +1,88 @@
+package jobs
+
+import (
+	"errors"
+	"iot-stats/mail"
+	"iot-stats/model"
+	"iot-stats/service"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type sentMail struct {
+	to, subject, body string
+}
+
+// fakeSender records mails, it fails while err is set
+type fakeSender struct {
+	sent []sentMail
+	err  error
+}
+
+func (s *fakeSender) Send(to, subject, body string) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.sent = append(s.sent, sentMail{to, subject, body})
+	return nil
+}
+
+func TestMailerAlerts(t *testing.T) {
+	ms := service.NewMemoryService()
+	es := service.NewEventService(ms, true)
+	sender := &fakeSender{err: errors.New("connection refused")}
+	templates, _ := mail.LoadTemplates("")
+	job := NewMailer(ms, sender, templates, time.Minute, 2)
+	ms.SetSubscription(&model.Subscription{Login: "admin", Email: "admin@example.com",
+		Alerts: true})
+	ms.SetSubscription(&model.Subscription{Login: "quiet", Email: "quiet@example.com"})
+	es.AddAlert(&model.Alert{RuleName: "crashes", DeviceNumber: "1",
+		State: model.AlertFiring})
+	now := time.Now()
+	job.Check(now)
+	assert.Len(t, sender.sent, 0)
+	sender.err = nil
+	job.Check(now.Add(time.Second))
+	assert.Len(t, sender.sent, 0)
+	job.Check(now.Add(minBackoff))
+	assert.Len(t, sender.sent, 1)
+	assert.Equal(t, "admin@example.com", sender.sent[0].to)
+	assert.Equal(t, "[firing] crashes on device 1", sender.sent[0].subject)
+	job.Check(now.Add(time.Hour))
+	assert.Len(t, sender.sent, 1)
+	// Mail is given up after its attempts
+	sender.err = errors.New("connection refused")
+	es.AddAlert(&model.Alert{RuleName: "hot", DeviceNumber: "2", State: model.AlertFiring})
+	job.Check(now.Add(time.Hour))
+	job.Check(now.Add(2 * time.Hour))
+	mails, _ := ms.GetDueMails(now.Add(24*time.Hour), 0)
+	assert.Len(t, *mails, 0)
+}
+
+func TestMailerDigest(t *testing.T) {
+	ms := service.NewMemoryService()
+	sender := &fakeSender{}
+	templates, _ := mail.LoadTemplates("")
+	job := NewMailer(ms, sender, templates, time.Minute, 2)
+	ms.SetSubscription(&model.Subscription{Login: "admin", Email: "admin@example.com",
+		Digest: model.DigestHourly})
+	ms.RegisterDevice("1", time.Now())
+	start := time.Now()
+	// First check starts digest
+	job.Check(start)
+	subscription, _ := ms.GetSubscription("admin")
+	assert.Equal(t, start, subscription.DigestDate)
+	ms.RegisterError(&model.DeviceErrorDto{DeviceNumber: "1", ErrorName: "crash"})
+	job.Check(start.Add(30 * time.Minute))
+	assert.Len(t, sender.sent, 0)
+	job.Check(start.Add(time.Hour))
+	assert.Len(t, sender.sent, 1)
+	assert.Contains(t, sender.sent[0].body, "Device 1\n  crash: 1 total")
+	// Digest without issues is not mailed
+	job.Check(start.Add(2 * time.Hour))
+	assert.Len(t, sender.sent, 1)
+	subscription, _ = ms.GetSubscription("admin")
+	assert.Equal(t, start.Add(2*time.Hour), subscription.DigestDate)
+}
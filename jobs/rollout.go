@@ -0,0 +1,95 @@
+package jobs
+
+import (
+	"fmt"
+	"iot-stats/model"
+	"iot-stats/service"
+	"iot-stats/utils"
+	"time"
+)
+
+// Rollouts widens running rollouts step by step and pauses rollout when
+// devices which got its firmware report too many errors
+type Rollouts struct {
+	ms       service.MongoInterface
+	interval time.Duration
+}
+
+func NewRollouts(ms service.MongoInterface, interval time.Duration) *Rollouts {
+	return &Rollouts{ms: ms, interval: interval}
+}
+
+// Run checks rollouts every interval until stop is closed
+func (r *Rollouts) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			r.Check(now)
+		}
+	}
+}
+
+// Check evaluates every running rollout once
+func (r *Rollouts) Check(now time.Time) {
+	rollouts, err := r.ms.GetRollouts()
+	if err != nil {
+		utils.Log().Infoln("rollout job err", err)
+		return
+	}
+	for i := range *rollouts {
+		rollout := &(*rollouts)[i]
+		if rollout.State != model.RolloutRunning {
+			continue
+		}
+		if err = r.check(rollout, now); err != nil {
+			utils.Log().Infoln("rollout job err", rollout.ID.Hex(), err)
+		}
+	}
+}
+
+// check records progress of current step, then pauses rollout when error
+// rate since start of step is over threshold or moves it to next step when step is over.
+// Firmware is released to everyone when the last step is over. Rollout
+// changed by administrator meanwhile is left for next check
+func (r *Rollouts) check(rollout *model.Rollout, now time.Time) error {
+	step := &rollout.Steps[rollout.Step]
+	updated, errs, err := r.ms.GetRolloutStats(rollout.ID.Hex(), step.StartDate)
+	if err != nil {
+		return err
+	}
+	step.Updated, step.Errors = updated, errs
+	duration := time.Duration(rollout.StepDuration) * time.Minute
+	if rate := errorRate(updated, errs); rollout.ErrorThreshold > 0 &&
+		rate > rollout.ErrorThreshold {
+		rollout.State = model.RolloutPaused
+		rollout.Reason = fmt.Sprintf("error rate %.2f is over threshold %.2f",
+			rate, rollout.ErrorThreshold)
+		utils.Log().Infoln("rollout", rollout.ID.Hex(), "paused,", rollout.Reason)
+	} else if now.Sub(step.StartDate) >= duration {
+		if rollout.Step+1 < len(rollout.Steps) {
+			rollout.Step++
+			rollout.Steps[rollout.Step].StartDate = now
+		} else {
+			rollout.State = model.RolloutCompleted
+		}
+	}
+	if err = r.ms.UpdateRollout(rollout); err != nil {
+		return err
+	}
+	if rollout.State == model.RolloutCompleted {
+		return r.ms.SetFirmwareHeld(rollout.Firmware.Hex(), false)
+	}
+	return nil
+}
+
+// errorRate is number of errors per updated device
+func errorRate(updated, errs int) float64 {
+	if updated == 0 {
+		return 0
+	}
+	return float64(errs) / float64(updated)
+}
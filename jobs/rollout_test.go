@@ -0,0 +1,120 @@
+package jobs
+
+import (
+	"iot-stats/model"
+	"iot-stats/service"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type RolloutsTestSuite struct {
+	suite.Suite
+	ms      *service.MemoryService
+	job     *Rollouts
+	rollout *model.Rollout
+	start   time.Time
+}
+
+func (suite *RolloutsTestSuite) SetupTest() {
+	suite.ms = service.NewMemoryService()
+	suite.job = NewRollouts(suite.ms, time.Minute)
+	suite.start = time.Now()
+	fw := &model.Firmware{Version: "1.0", Held: true}
+	suite.ms.AddFirmware(fw)
+	suite.rollout = &model.Rollout{
+		Firmware: fw.ID,
+		Steps: []model.RolloutStep{
+			{Group: "lab", StartDate: suite.start},
+			{Percent: 100},
+		},
+		StepDuration:   10,
+		ErrorThreshold: 0.5,
+		State:          model.RolloutRunning,
+	}
+	suite.ms.AddRollout(suite.rollout)
+	for _, number := range []string{"1", "2"} {
+		suite.ms.RegisterDevice(number, suite.start)
+		suite.ms.AddRolloutDevice(suite.rollout.ID.Hex(), number)
+	}
+}
+
+func (suite *RolloutsTestSuite) get() *model.Rollout {
+	rollout, err := suite.ms.GetRollout(suite.rollout.ID.Hex())
+	assert.Nil(suite.T(), err)
+	return rollout
+}
+
+func (suite *RolloutsTestSuite) TestWiden() {
+	suite.job.Check(suite.start.Add(time.Minute))
+	rollout := suite.get()
+	assert.Equal(suite.T(), 0, rollout.Step)
+	assert.Equal(suite.T(), 2, rollout.Steps[0].Updated)
+	suite.job.Check(suite.start.Add(11 * time.Minute))
+	rollout = suite.get()
+	assert.Equal(suite.T(), 1, rollout.Step)
+	assert.Equal(suite.T(), model.RolloutRunning, rollout.State)
+	suite.job.Check(suite.start.Add(22 * time.Minute))
+	rollout = suite.get()
+	assert.Equal(suite.T(), model.RolloutCompleted, rollout.State)
+	fw, _ := suite.ms.GetFirmware(rollout.Firmware.Hex())
+	assert.False(suite.T(), fw.Held)
+}
+
+func (suite *RolloutsTestSuite) TestHalt() {
+	suite.ms.RegisterError(&model.DeviceErrorDto{DeviceNumber: "1", ErrorName: "e"})
+	suite.job.Check(suite.start.Add(time.Minute))
+	assert.Equal(suite.T(), model.RolloutRunning, suite.get().State)
+	suite.ms.RegisterError(&model.DeviceErrorDto{DeviceNumber: "2", ErrorName: "e"})
+	suite.job.Check(suite.start.Add(11 * time.Minute))
+	rollout := suite.get()
+	assert.Equal(suite.T(), model.RolloutPaused, rollout.State)
+	assert.Equal(suite.T(), 0, rollout.Step)
+	assert.Equal(suite.T(), 2, rollout.Steps[0].Errors)
+	assert.NotEmpty(suite.T(), rollout.Reason)
+	// Paused rollout is left alone
+	suite.job.Check(suite.start.Add(30 * time.Minute))
+	assert.Equal(suite.T(), 0, suite.get().Step)
+}
+
+func (suite *RolloutsTestSuite) TestResume() {
+	suite.ms.RegisterError(&model.DeviceErrorDto{DeviceNumber: "1", ErrorName: "e"})
+	suite.ms.RegisterError(&model.DeviceErrorDto{DeviceNumber: "2", ErrorName: "e"})
+	suite.job.Check(suite.start.Add(time.Minute))
+	assert.Equal(suite.T(), model.RolloutPaused, suite.get().State)
+	// Admin resumes rollout like server does, errors before resume are
+	// not held against it
+	rollout := suite.get()
+	rollout.State, rollout.Reason = model.RolloutRunning, ""
+	rollout.Steps[0].StartDate = suite.start.Add(5 * time.Minute)
+	assert.Nil(suite.T(), suite.ms.UpdateRollout(rollout))
+	suite.job.Check(suite.start.Add(6 * time.Minute))
+	rollout = suite.get()
+	assert.Equal(suite.T(), model.RolloutRunning, rollout.State)
+	assert.Equal(suite.T(), 0, rollout.Steps[0].Errors)
+	suite.job.Check(suite.start.Add(16 * time.Minute))
+	assert.Equal(suite.T(), 1, suite.get().Step)
+}
+
+func (suite *RolloutsTestSuite) TestAdminChange() {
+	// Rollout is aborted while job evaluates the last step
+	rollout := suite.get()
+	rollout.Step = 1
+	rollout.Steps[1].StartDate = suite.start
+	suite.ms.UpdateRollout(rollout)
+	stale := suite.get()
+	aborted := suite.get()
+	aborted.State = model.RolloutAborted
+	assert.Nil(suite.T(), suite.ms.UpdateRollout(aborted))
+	assert.Equal(suite.T(), service.ErrConflict,
+		suite.job.check(stale, suite.start.Add(11*time.Minute)))
+	assert.Equal(suite.T(), model.RolloutAborted, suite.get().State)
+	fw, _ := suite.ms.GetFirmware(rollout.Firmware.Hex())
+	assert.True(suite.T(), fw.Held)
+}
+
+func TestRolloutsTestSuite(t *testing.T) {
+	suite.Run(t, new(RolloutsTestSuite))
+}
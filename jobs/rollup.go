@@ -0,0 +1,159 @@
+package jobs
+
+import (
+	"iot-stats/model"
+	"iot-stats/service"
+	"iot-stats/utils"
+	"math"
+	"time"
+)
+
+// lateWindow is how late samples may arrive and still be rolled up,
+// devices on poor links send samples in batches
+const lateWindow = time.Hour
+
+// Rollups aggregates telemetry samples into buckets of every resolution
+// and removes samples and rollups older than their retention
+type Rollups struct {
+	ts        service.TelemetryInterface
+	interval  time.Duration
+	retention map[string]time.Duration
+	// done is end of rolled up buckets of each resolution, it is taken
+	// from the latest stored bucket on first run
+	done map[string]time.Time
+}
+
+// NewRollups creates job, retention is keyed by resolution name, zero or
+// missing retention keeps data forever
+func NewRollups(ts service.TelemetryInterface, interval time.Duration,
+	retention map[string]time.Duration) *Rollups {
+	return &Rollups{ts: ts, interval: interval, retention: retention,
+		done: make(map[string]time.Time)}
+}
+
+// Run rolls up telemetry every interval until stop is closed
+func (r *Rollups) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			r.Check(now)
+		}
+	}
+}
+
+// Check rolls up buckets completed by now from finest resolution to
+// coarsest, then removes expired data
+func (r *Rollups) Check(now time.Time) {
+	source := model.ResolutionRaw
+	for _, res := range model.Resolutions {
+		if err := r.rollup(source, res, now); err != nil {
+			utils.Log().Infoln("rollup job err", res.Name, err)
+			return
+		}
+		source = res.Name
+	}
+	if ret := r.retention[model.ResolutionRaw]; ret > 0 {
+		if err := r.ts.DeleteSamples(now.Add(-ret)); err != nil {
+			utils.Log().Infoln("rollup job err", err)
+		}
+	}
+	for _, res := range model.Resolutions {
+		if ret := r.retention[res.Name]; ret > 0 {
+			if err := r.ts.DeleteRollups(res.Name, now.Add(-ret)); err != nil {
+				utils.Log().Infoln("rollup job err", res.Name, err)
+			}
+		}
+	}
+}
+
+// rollup aggregates data of source resolution into buckets of res. Buckets
+// of late window are rolled up again, bucket which source data started
+// to expire from is left as it is
+func (r *Rollups) rollup(source string, res model.Resolution, now time.Time) error {
+	end := now.Truncate(res.Duration)
+	start := time.Unix(0, 0)
+	if _, ok := r.done[res.Name]; !ok {
+		last, err := r.ts.LastRollup(res.Name)
+		if err != nil {
+			return err
+		}
+		if !last.IsZero() {
+			r.done[res.Name] = last.Add(res.Duration)
+		}
+	}
+	if done, ok := r.done[res.Name]; ok {
+		late := lateWindow
+		if late < res.Duration {
+			late = res.Duration
+		}
+		start = done.Add(-late).Truncate(res.Duration)
+	}
+	if ret := r.retention[source]; ret > 0 {
+		expired := now.Add(-ret)
+		if t := expired.Truncate(res.Duration); t.Before(expired) {
+			expired = t.Add(res.Duration)
+		}
+		if start.Before(expired) {
+			start = expired
+		}
+	}
+	if !start.Before(end) {
+		return nil
+	}
+	buckets := make(map[rollupBucket]int)
+	rollups := []model.Rollup{}
+	add := func(deviceNumber, metric string, date time.Time, part model.Rollup) {
+		date = date.Truncate(res.Duration)
+		key := rollupBucket{deviceNumber, metric, date.Unix()}
+		i, ok := buckets[key]
+		if !ok {
+			i = len(rollups)
+			buckets[key] = i
+			rollups = append(rollups, model.Rollup{DeviceNumber: deviceNumber,
+				Metric: metric, Resolution: res.Name, Date: date,
+				Min: math.Inf(1), Max: math.Inf(-1)})
+		}
+		b := &rollups[i]
+		b.Count += part.Count
+		b.Sum += part.Sum
+		b.Min = math.Min(b.Min, part.Min)
+		b.Max = math.Max(b.Max, part.Max)
+	}
+	if source == model.ResolutionRaw {
+		samples, err := r.ts.GetAllSamples(start, end)
+		if err != nil {
+			return err
+		}
+		for _, s := range *samples {
+			add(s.DeviceNumber, s.Metric, s.Date, model.Rollup{Count: 1, Sum: s.Value,
+				Min: s.Value, Max: s.Value})
+		}
+	} else {
+		parts, err := r.ts.GetAllRollups(source, start, end)
+		if err != nil {
+			return err
+		}
+		for _, p := range *parts {
+			add(p.DeviceNumber, p.Metric, p.Date, p)
+		}
+	}
+	for i := range rollups {
+		rollups[i].Avg = rollups[i].Sum / float64(rollups[i].Count)
+	}
+	if err := r.ts.SetRollups(rollups); err != nil {
+		return err
+	}
+	r.done[res.Name] = end
+	return nil
+}
+
+// rollupBucket identifies bucket of device metric
+type rollupBucket struct {
+	deviceNumber string
+	metric       string
+	date         int64
+}
@@ -0,0 +1,105 @@
+package jobs
+
+import (
+	"iot-stats/model"
+	"iot-stats/service"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type RollupsTestSuite struct {
+	suite.Suite
+	ms  *service.MemoryService
+	job *Rollups
+	day time.Time
+}
+
+func (suite *RollupsTestSuite) SetupTest() {
+	suite.ms = service.NewMemoryService()
+	suite.job = NewRollups(suite.ms, time.Minute, map[string]time.Duration{
+		model.ResolutionRaw: 48 * time.Hour,
+	})
+	suite.day = time.Now().UTC().Truncate(24 * time.Hour).Add(-24 * time.Hour)
+	samples := []model.Sample{}
+	// Two samples a minute during first two hours of previous day
+	for i := 0; i < 240; i++ {
+		samples = append(samples, model.Sample{DeviceNumber: "1", Metric: "temperature",
+			Value: float64(i % 4), Date: suite.day.Add(time.Duration(i) * 30 * time.Second)})
+	}
+	suite.ms.AddSamples(samples)
+}
+
+func (suite *RollupsTestSuite) TestRollup() {
+	now := suite.day.Add(25 * time.Hour)
+	suite.job.Check(now)
+	minutes, _ := suite.ms.GetRollups("1", "temperature", "1m", suite.day, now)
+	assert.Len(suite.T(), *minutes, 120)
+	first := (*minutes)[0]
+	assert.Equal(suite.T(), 2, first.Count)
+	assert.Equal(suite.T(), 1.0, first.Sum)
+	assert.Equal(suite.T(), 0.0, first.Min)
+	assert.Equal(suite.T(), 1.0, first.Max)
+	assert.Equal(suite.T(), 0.5, first.Avg)
+	hours, _ := suite.ms.GetRollups("1", "temperature", "1h", suite.day, now)
+	assert.Len(suite.T(), *hours, 2)
+	assert.Equal(suite.T(), 120, (*hours)[0].Count)
+	assert.Equal(suite.T(), 1.5, (*hours)[0].Avg)
+	assert.Equal(suite.T(), 3.0, (*hours)[0].Max)
+	days, _ := suite.ms.GetRollups("1", "temperature", "1d", suite.day, now)
+	assert.Len(suite.T(), *days, 1)
+	assert.Equal(suite.T(), 240, (*days)[0].Count)
+	assert.Equal(suite.T(), suite.day, (*days)[0].Date.UTC())
+}
+
+func (suite *RollupsTestSuite) TestLateSamples() {
+	now := suite.day.Add(3 * time.Hour)
+	suite.job.Check(now)
+	// Late sample of bucket already rolled up is counted on next run
+	suite.ms.AddSamples([]model.Sample{{DeviceNumber: "1", Metric: "temperature",
+		Value: 10, Date: now.Add(-30 * time.Minute)}})
+	suite.job.Check(now.Add(time.Minute))
+	minutes, _ := suite.ms.GetRollups("1", "temperature", "1m",
+		now.Add(-30*time.Minute), now)
+	assert.Len(suite.T(), *minutes, 1)
+	assert.Equal(suite.T(), 10.0, (*minutes)[0].Max)
+}
+
+func (suite *RollupsTestSuite) TestRestart() {
+	now := suite.day.Add(3 * time.Hour)
+	suite.job.Check(now)
+	// Job of restarted server goes on from stored rollups, samples
+	// before late window are not rolled up again
+	suite.ms.AddSamples([]model.Sample{{DeviceNumber: "1", Metric: "temperature",
+		Value: 10, Date: suite.day.Add(time.Minute)}})
+	suite.job = NewRollups(suite.ms, time.Minute, suite.job.retention)
+	suite.job.Check(now.Add(time.Minute))
+	minutes, _ := suite.ms.GetRollups("1", "temperature", "1m",
+		suite.day, suite.day.Add(2*time.Minute))
+	assert.Equal(suite.T(), 3.0, (*minutes)[1].Max)
+}
+
+func (suite *RollupsTestSuite) TestRetention() {
+	suite.job.retention["1m"] = 24 * time.Hour
+	suite.job.Check(suite.day.Add(3 * time.Hour))
+	suite.job.Check(suite.day.Add(50 * time.Hour))
+	samples, _ := suite.ms.GetAllSamples(time.Unix(0, 0), suite.day.Add(50*time.Hour))
+	assert.Len(suite.T(), *samples, 0)
+	minutes, _ := suite.ms.GetAllRollups("1m", time.Unix(0, 0), suite.day.Add(50*time.Hour))
+	assert.Len(suite.T(), *minutes, 0)
+	// Rollups of expired data are kept and not overwritten
+	hours, _ := suite.ms.GetRollups("1", "temperature", "1h", suite.day,
+		suite.day.Add(24*time.Hour))
+	assert.Len(suite.T(), *hours, 2)
+	assert.Equal(suite.T(), 120, (*hours)[1].Count)
+	days, _ := suite.ms.GetRollups("1", "temperature", "1d", suite.day,
+		suite.day.Add(24*time.Hour))
+	assert.Len(suite.T(), *days, 1)
+	assert.Equal(suite.T(), 240, (*days)[0].Count)
+}
+
+func TestRollupsTestSuite(t *testing.T) {
+	suite.Run(t, new(RollupsTestSuite))
+}
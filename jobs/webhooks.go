@@ -0,0 +1,193 @@
+package jobs
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"iot-stats/model"
+	"iot-stats/service"
+	"iot-stats/utils"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Headers of webhook request
+const (
+	WebhookEvent     = "Webhook-Event"
+	WebhookDelivery  = "Webhook-Delivery"
+	WebhookTimestamp = "Webhook-Timestamp"
+	WebhookSignature = "Webhook-Signature"
+)
+
+// deliveryBatch limits how many deliveries are attempted by single check
+const deliveryBatch = 100
+
+// Backoff of failed delivery starts at minBackoff and doubles with every
+// attempt up to maxBackoff
+const (
+	minBackoff = 30 * time.Second
+	maxBackoff = time.Hour
+)
+
+// Dispatcher sends queued events to webhooks. Delivery which fails is
+// retried with exponential backoff until it runs out of attempts
+type Dispatcher struct {
+	ms          service.MongoInterface
+	client      *http.Client
+	interval    time.Duration
+	maxAttempts int
+	retention   time.Duration
+}
+
+// NewDispatcher creates job, deliveries which are done for longer than
+// retention are removed, zero retention keeps them forever
+func NewDispatcher(ms service.MongoInterface, interval, timeout time.Duration,
+	maxAttempts int, retention time.Duration) *Dispatcher {
+	return &Dispatcher{ms: ms, client: &http.Client{Timeout: timeout},
+		interval: interval, maxAttempts: maxAttempts, retention: retention}
+}
+
+// Run sends due deliveries every interval until stop is closed
+func (d *Dispatcher) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			d.Check(now)
+		}
+	}
+}
+
+// Check attempts deliveries due at now. Webhooks are sent to
+// concurrently, deliveries of one webhook in order. Deliveries of deleted
+// and disabled webhooks fail at once
+func (d *Dispatcher) Check(now time.Time) {
+	deliveries, err := d.ms.GetDueDeliveries(now, deliveryBatch)
+	if err != nil {
+		utils.Log().Infoln("webhooks job err", err)
+		return
+	}
+	webhooks := make(map[string]*model.Webhook)
+	queues := make(map[string][]*model.Delivery)
+	for i := range *deliveries {
+		delivery := &(*deliveries)[i]
+		id := delivery.WebhookId.Hex()
+		if _, ok := webhooks[id]; !ok {
+			webhook, err := d.ms.GetWebhook(id)
+			if err != nil && err != service.ErrNotFound {
+				utils.Log().Infoln("webhooks job err", err)
+				return
+			}
+			webhooks[id] = webhook
+		}
+		queues[id] = append(queues[id], delivery)
+	}
+	var wg sync.WaitGroup
+	for id, queue := range queues {
+		wg.Add(1)
+		go func(webhook *model.Webhook, queue []*model.Delivery) {
+			defer wg.Done()
+			d.deliver(webhook, queue, now)
+		}(webhooks[id], queue)
+	}
+	wg.Wait()
+	if d.retention > 0 {
+		if err = d.ms.DeleteDeliveries(now.Add(-d.retention)); err != nil {
+			utils.Log().Infoln("webhooks job err", err)
+		}
+	}
+}
+
+// deliver attempts deliveries of webhook in order. Webhook which can't be
+// reached is not attempted again until the next check, so it doesn't take
+// timeout of each of its deliveries
+func (d *Dispatcher) deliver(webhook *model.Webhook, queue []*model.Delivery, now time.Time) {
+	for _, delivery := range queue {
+		delivery.Attempts++
+		reached := true
+		switch {
+		case webhook == nil:
+			delivery.State, delivery.Error = model.DeliveryFailed, "Webhook deleted"
+		case webhook.Disabled:
+			delivery.State, delivery.Error = model.DeliveryFailed, "Webhook disabled"
+		default:
+			reached = d.send(webhook, delivery, now)
+		}
+		if err := d.ms.UpdateDelivery(delivery); err != nil {
+			utils.Log().Infoln("webhooks job err", err)
+		}
+		if !reached {
+			return
+		}
+	}
+}
+
+// send attempts delivery and sets its state, status and error, it tells
+// whether webhook answered
+func (d *Dispatcher) send(webhook *model.Webhook, delivery *model.Delivery, now time.Time) bool {
+	delivery.Status, delivery.Error = 0, ""
+	req, err := http.NewRequest(http.MethodPost, webhook.URL,
+		bytes.NewReader([]byte(delivery.Payload)))
+	if err == nil {
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(WebhookEvent, delivery.Event)
+		req.Header.Set(WebhookDelivery, delivery.ID.Hex())
+		timestamp := time.Now().Unix()
+		req.Header.Set(WebhookTimestamp, strconv.FormatInt(timestamp, 10))
+		req.Header.Set(WebhookSignature, Signature(webhook.Secret, timestamp,
+			[]byte(delivery.Payload)))
+		var resp *http.Response
+		if resp, err = d.client.Do(req); err == nil {
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+			delivery.Status = resp.StatusCode
+			if resp.StatusCode < 200 || resp.StatusCode > 299 {
+				err = fmt.Errorf("webhook answered %s", resp.Status)
+			}
+		}
+	}
+	if err == nil {
+		delivery.State, delivery.DeliverDate = model.DeliveryDelivered, now
+		return true
+	}
+	delivery.Error = err.Error()
+	if delivery.Attempts >= d.maxAttempts {
+		delivery.State = model.DeliveryFailed
+		utils.Log().Infoln("webhook delivery", delivery.ID.Hex(), "failed", err)
+	} else {
+		delivery.NextDate = now.Add(backoff(delivery.Attempts))
+	}
+	return delivery.Status != 0
+}
+
+// backoff returns delay after failed attempt
+func backoff(attempts int) time.Duration {
+	delay := minBackoff
+	for i := 1; i < attempts && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	return delay
+}
+
+// Signature returns value of signature header of payload sent at unix
+// timestamp, it is hex of HMAC-SHA256 of timestamp, dot and payload with
+// webhook secret prefixed by "sha256=". Receiver rejects old timestamps,
+// so captured request can't be replayed
+func Signature(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
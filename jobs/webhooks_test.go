@@ -0,0 +1,136 @@
+package jobs
+
+import (
+	"io/ioutil"
+	"iot-stats/model"
+	"iot-stats/service"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDispatcher(t *testing.T) {
+	ms := service.NewMemoryService()
+	failing := true
+	received := []*http.Request{}
+	bodies := []string{}
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received = append(received, r)
+		bodies = append(bodies, string(body))
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer hook.Close()
+	job := NewDispatcher(ms, time.Second, time.Second, 3, 0)
+	webhook := &model.Webhook{URL: hook.URL, Secret: "secret"}
+	ms.AddWebhook(webhook)
+	gone := &model.Webhook{URL: hook.URL}
+	ms.AddWebhook(gone)
+	now := time.Now()
+	ms.AddDeliveries([]model.Delivery{
+		{WebhookId: webhook.ID, Event: model.EventAlertFired, Payload: `{"a":1}`,
+			State: model.DeliveryPending, NextDate: now},
+		{WebhookId: gone.ID, Event: model.EventAlertFired, Payload: `{}`,
+			State: model.DeliveryPending, NextDate: now},
+	})
+	ms.DeleteWebhook(gone.ID.Hex())
+	delivery := func(id string) model.Delivery {
+		deliveries, _ := ms.GetDeliveries(id, 1)
+		return (*deliveries)[0]
+	}
+
+	job.Check(now)
+	assert.Len(t, received, 1)
+	assert.Equal(t, `{"a":1}`, bodies[0])
+	assert.Equal(t, model.EventAlertFired, received[0].Header.Get(WebhookEvent))
+	timestamp, _ := strconv.ParseInt(received[0].Header.Get(WebhookTimestamp), 10, 64)
+	assert.InDelta(t, time.Now().Unix(), timestamp, 5)
+	assert.Equal(t, Signature("secret", timestamp, []byte(`{"a":1}`)),
+		received[0].Header.Get(WebhookSignature))
+	assert.NotEqual(t, Signature("secret", timestamp+1, []byte(`{"a":1}`)),
+		received[0].Header.Get(WebhookSignature))
+	d := delivery(webhook.ID.Hex())
+	assert.Equal(t, model.DeliveryPending, d.State)
+	assert.Equal(t, http.StatusServiceUnavailable, d.Status)
+	assert.Equal(t, now.Add(minBackoff), d.NextDate)
+	assert.Equal(t, model.DeliveryFailed, delivery(gone.ID.Hex()).State)
+	// Delivery is not retried before backoff passes, then backoff doubles
+	job.Check(now.Add(time.Second))
+	assert.Len(t, received, 1)
+	job.Check(now.Add(minBackoff))
+	assert.Len(t, received, 2)
+	d = delivery(webhook.ID.Hex())
+	assert.Equal(t, now.Add(3*minBackoff), d.NextDate)
+	failing = false
+	job.Check(d.NextDate)
+	d = delivery(webhook.ID.Hex())
+	assert.Equal(t, model.DeliveryDelivered, d.State)
+	assert.Equal(t, 3, d.Attempts)
+	assert.Equal(t, received[2].Header.Get(WebhookDelivery), d.ID.Hex())
+	assert.Empty(t, d.Error)
+}
+
+func TestBackoff(t *testing.T) {
+	assert.Equal(t, minBackoff, backoff(1))
+	assert.Equal(t, 4*minBackoff, backoff(3))
+	assert.Equal(t, maxBackoff, backoff(20))
+}
+
+func TestDispatcherGivesUp(t *testing.T) {
+	ms := service.NewMemoryService()
+	job := NewDispatcher(ms, time.Second, time.Second, 1, 0)
+	webhook := &model.Webhook{URL: "http://127.0.0.1:1/hook"}
+	ms.AddWebhook(webhook)
+	now := time.Now()
+	ms.AddDeliveries([]model.Delivery{{WebhookId: webhook.ID,
+		State: model.DeliveryPending, NextDate: now}})
+	job.Check(now)
+	deliveries, _ := ms.GetDeliveries(webhook.ID.Hex(), 0)
+	assert.Equal(t, model.DeliveryFailed, (*deliveries)[0].State)
+	assert.NotEmpty(t, (*deliveries)[0].Error)
+}
+
+func TestDispatcherUnreachable(t *testing.T) {
+	ms := service.NewMemoryService()
+	received := 0
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received++
+	}))
+	defer hook.Close()
+	job := NewDispatcher(ms, time.Second, time.Second, 3, time.Hour)
+	dead := &model.Webhook{URL: "http://127.0.0.1:1/hook"}
+	alive := &model.Webhook{URL: hook.URL}
+	ms.AddWebhook(dead)
+	ms.AddWebhook(alive)
+	now := time.Now()
+	deliveries := []model.Delivery{}
+	for i := 0; i < 3; i++ {
+		for _, w := range []*model.Webhook{dead, alive} {
+			deliveries = append(deliveries, model.Delivery{WebhookId: w.ID,
+				State: model.DeliveryPending, NextDate: now, CreateDate: now})
+		}
+	}
+	ms.AddDeliveries(deliveries)
+	job.Check(now)
+	// Webhook which can't be reached is attempted once per check and
+	// doesn't hold up other webhooks
+	assert.Equal(t, 3, received)
+	listed, _ := ms.GetDeliveries(dead.ID.Hex(), 0)
+	attempts := 0
+	for _, d := range *listed {
+		attempts += d.Attempts
+	}
+	assert.Equal(t, 1, attempts)
+	// Finished deliveries are removed after retention
+	job.Check(now.Add(2 * time.Hour))
+	listed, _ = ms.GetDeliveries(alive.ID.Hex(), 0)
+	assert.Len(t, *listed, 0)
+	listed, _ = ms.GetDeliveries(dead.ID.Hex(), 0)
+	assert.Len(t, *listed, 3)
+}
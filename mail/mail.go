@@ -0,0 +1,178 @@
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"iot-stats/model"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Config sets SMTP server mails are sent through, user and password are
+// optional
+type Config struct {
+	Host     string
+	Port     string
+	User     string
+	Password string
+	From     string
+}
+
+// Sender sends plain text mail
+type Sender interface {
+	Send(to, subject, body string) error
+}
+
+// SMTPSender sends mails through SMTP server, STARTTLS is used when
+// server offers it
+type SMTPSender struct {
+	cfg Config
+}
+
+func NewSMTPSender(cfg Config) *SMTPSender {
+	return &SMTPSender{cfg: cfg}
+}
+
+func (s *SMTPSender) Send(to, subject, body string) error {
+	var auth smtp.Auth
+	if s.cfg.User != "" {
+		auth = smtp.PlainAuth("", s.cfg.User, s.cfg.Password, s.cfg.Host)
+	}
+	return smtp.SendMail(net.JoinHostPort(s.cfg.Host, s.cfg.Port), auth, s.cfg.From,
+		[]string{to}, Message(s.cfg.From, to, subject, body, time.Now()))
+}
+
+// Message formats mail with headers, lines end with CRLF
+func Message(from, to, subject, body string, date time.Time) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", to)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	body = strings.ReplaceAll(body, "\r\n", "\n")
+	buf.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return buf.Bytes()
+}
+
+// Template names, template file of the same name with .tmpl extension in
+// templates directory replaces default one
+const (
+	AlertTemplate  = "alert"
+	DigestTemplate = "digest"
+)
+
+// Every template defines "subject" and "body" templates. Alert template
+// gets event of alert, digest template gets digest
+var defaultTemplates = map[string]string{
+	AlertTemplate: `{{define "subject"}}[{{.Data.State}}] {{.Data.RuleName}} on device {{.DeviceNumber}}{{end}}
+{{define "body"}}Alert {{.Data.RuleName}} ({{.Data.Kind}}) is {{.Data.State}} on device {{.DeviceNumber}}.
+
+Value: {{.Data.Value}}
+Started: {{.Data.StartDate.Format "2006-01-02 15:04:05 MST"}}
+{{- if eq .Data.State "resolved"}}
+Resolved: {{.Data.EndDate.Format "2006-01-02 15:04:05 MST"}}
+{{- end}}
+{{end}}`,
+	DigestTemplate: `{{define "subject"}}Errors of {{len .Devices}} devices since {{.From.Format "2006-01-02 15:04 MST"}}{{end}}
+{{define "body"}}Issues seen from {{.From.Format "2006-01-02 15:04 MST"}} to {{.To.Format "2006-01-02 15:04 MST"}}.
+{{range .Devices}}
+Device {{.DeviceNumber}}
+{{- range .Issues}}
+  {{.ErrorName}}{{if .Fingerprint}} [{{.Fingerprint}}]{{end}}: {{.Count}} total, last seen {{.LastSeen.Format "2006-01-02 15:04 MST"}}
+  {{- if not ($.From.After .FirstSeen)}} (new){{end}}
+{{- end}}
+{{end}}{{end}}`,
+}
+
+// AlertEvent is alert event alert mail is rendered from
+type AlertEvent struct {
+	Type         string      `json:"type"`
+	DeviceNumber string      `json:"device-number"`
+	Date         time.Time   `json:"date"`
+	Data         model.Alert `json:"data"`
+}
+
+// Digest lists issues devices reported in [From, To), digest mail is
+// rendered from it
+type Digest struct {
+	From    time.Time
+	To      time.Time
+	Devices []DeviceIssues
+}
+
+type DeviceIssues struct {
+	DeviceNumber string
+	Issues       []model.Issue
+}
+
+// NewDigest groups issues ordered by device number by device
+func NewDigest(from, to time.Time, issues []model.Issue) *Digest {
+	d := &Digest{From: from, To: to, Devices: []DeviceIssues{}}
+	for _, issue := range issues {
+		n := len(d.Devices)
+		if n == 0 || d.Devices[n-1].DeviceNumber != issue.DeviceNumber {
+			d.Devices = append(d.Devices, DeviceIssues{DeviceNumber: issue.DeviceNumber})
+			n++
+		}
+		d.Devices[n-1].Issues = append(d.Devices[n-1].Issues, issue)
+	}
+	return d
+}
+
+// Templates render subjects and bodies of mails
+type Templates struct {
+	templates map[string]*template.Template
+}
+
+// LoadTemplates parses default templates replaced by ones found in dir,
+// dir may be empty
+func LoadTemplates(dir string) (*Templates, error) {
+	t := &Templates{templates: make(map[string]*template.Template)}
+	for name, text := range defaultTemplates {
+		if dir != "" {
+			data, err := ioutil.ReadFile(filepath.Join(dir, name+".tmpl"))
+			if err == nil {
+				text = string(data)
+			} else if !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+		tmpl, err := template.New(name).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("template %s: %v", name, err)
+		}
+		for _, part := range []string{"subject", "body"} {
+			if tmpl.Lookup(part) == nil {
+				return nil, fmt.Errorf("template %s has no %s", name, part)
+			}
+		}
+		t.templates[name] = tmpl
+	}
+	return t, nil
+}
+
+// Render returns subject and body of template executed with data
+func (t *Templates) Render(name string, data interface{}) (string, string, error) {
+	tmpl, ok := t.templates[name]
+	if !ok {
+		return "", "", fmt.Errorf("no template %s", name)
+	}
+	var subject, body bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return "", "", err
+	}
+	if err := tmpl.ExecuteTemplate(&body, "body", data); err != nil {
+		return "", "", err
+	}
+	return strings.TrimSpace(subject.String()), strings.TrimLeft(body.String(), "\n"), nil
+}
@@ -0,0 +1,138 @@
+package mail
+
+import (
+	"bufio"
+	"io/ioutil"
+	"iot-stats/model"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// smtpStandIn accepts mails on local port and passes their recipients and
+// data to channel, it speaks just enough SMTP for net/smtp
+func smtpStandIn(t *testing.T) (string, <-chan []string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	received := make(chan []string, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTP(conn, received)
+		}
+	}()
+	return l.Addr().String(), received
+}
+
+func serveSMTP(conn net.Conn, received chan<- []string) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+	reply("220 localhost ready")
+	mail := []string{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			mail = append(mail, strings.TrimSpace(line[8:]))
+			reply("250 ok")
+		case strings.HasPrefix(cmd, "DATA"):
+			reply("354 go ahead")
+			data := []string{}
+			for {
+				line, err = r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data = append(data, line)
+			}
+			received <- append(mail, strings.Join(data, ""))
+			reply("250 ok")
+		case strings.HasPrefix(cmd, "QUIT"):
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func TestSMTPSender(t *testing.T) {
+	addr, received := smtpStandIn(t)
+	host, port, _ := net.SplitHostPort(addr)
+	sender := NewSMTPSender(Config{Host: host, Port: port, From: "iot@example.com"})
+	assert.Nil(t, sender.Send("admin@example.com", "Ünicode subject", "line 1\nline 2\n"))
+	select {
+	case mail := <-received:
+		assert.Equal(t, "<admin@example.com>", mail[0])
+		data := mail[1]
+		assert.Contains(t, data, "To: admin@example.com\r\n")
+		assert.Contains(t, data, "Subject: =?utf-8?q?=C3=9Cnicode_subject?=\r\n")
+		assert.True(t, strings.HasSuffix(data, "\r\n\r\nline 1\r\nline 2\r\n"), data)
+	case <-time.After(time.Second):
+		t.Fatal("mail was not received")
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	templates, err := LoadTemplates("")
+	assert.Nil(t, err)
+	start := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	subject, body, err := templates.Render(AlertTemplate, &AlertEvent{
+		DeviceNumber: "123",
+		Data: model.Alert{RuleName: "crashes", Kind: model.RuleErrors,
+			State: model.AlertResolved, Value: 5, StartDate: start,
+			EndDate: start.Add(time.Hour)},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "[resolved] crashes on device 123", subject)
+	assert.Contains(t, body, "Value: 5\n")
+	assert.Contains(t, body, "Resolved: 2020-01-01 11:00:00 UTC")
+
+	digest := NewDigest(start, start.Add(time.Hour), []model.Issue{
+		{DeviceNumber: "1", ErrorName: "crash", Count: 7, FirstSeen: start.Add(-time.Hour),
+			LastSeen: start.Add(time.Minute)},
+		{DeviceNumber: "1", ErrorName: "reboot", Count: 1, FirstSeen: start,
+			LastSeen: start},
+		{DeviceNumber: "2", ErrorName: "crash", Count: 2, LastSeen: start},
+	})
+	assert.Len(t, digest.Devices, 2)
+	subject, body, err = templates.Render(DigestTemplate, digest)
+	assert.Nil(t, err)
+	assert.Equal(t, "Errors of 2 devices since 2020-01-01 10:00 UTC", subject)
+	assert.Contains(t, body, "Device 1\n  crash: 7 total")
+	assert.Contains(t, body, "reboot: 1 total, last seen 2020-01-01 10:00 UTC (new)\n")
+	assert.NotContains(t, body, "crash: 7 total, last seen 2020-01-01 10:01 UTC (new)")
+
+	dir := t.TempDir()
+	ioutil.WriteFile(filepath.Join(dir, "alert.tmpl"),
+		[]byte(`{{define "subject"}}{{.Data.RuleName}}{{end}}{{define "body"}}!{{end}}`), 0644)
+	templates, err = LoadTemplates(dir)
+	assert.Nil(t, err)
+	subject, body, _ = templates.Render(AlertTemplate, &AlertEvent{
+		Data: model.Alert{RuleName: "hot"}})
+	assert.Equal(t, "hot", subject)
+	assert.Equal(t, "!", body)
+	ioutil.WriteFile(filepath.Join(dir, "digest.tmpl"), []byte(`{{define "body"}}{{end}}`), 0644)
+	_, err = LoadTemplates(dir)
+	assert.NotNil(t, err)
+}
@@ -1,39 +1,93 @@
 package main
 
 import (
+	"encoding/base64"
 	"flag"
+	"fmt"
 	"iot-stats/config"
+	"iot-stats/jobs"
+	"iot-stats/mail"
 	"iot-stats/model"
 	"iot-stats/server"
 	"iot-stats/service"
 	"iot-stats/utils"
 	"os"
+	"strings"
+	"time"
 )
 
-const defaultConfigFile = "config.json"
+const (
+	defaultConfigFile      = "config.json"
+	defaultRolloutInterval = time.Minute
+	defaultRollupInterval  = time.Minute
+	defaultSweepInterval   = time.Minute
+	defaultOfflineAfter    = 5 * time.Minute
+	defaultCleanupInterval = time.Hour
+	defaultAlertInterval   = time.Minute
+	defaultDeliverInterval = 10 * time.Second
+	defaultWebhookTimeout  = 10 * time.Second
+	defaultMaxAttempts     = 8
+	defaultDeliveryDays    = 30
+	defaultMailInterval    = time.Minute
+	defaultMailAttempts    = 5
+	defaultSMTPPort        = "25"
+	defaultFirmwareSize    = 64
+	defaultFirmwareDir     = "firmware"
+	defaultAttachmentSize  = 16
+	defaultAttachmentDir   = "attachments"
+	defaultMQTTClientID    = "iot-stats"
+	defaultMQTTPrefix      = "devices"
+)
 
 func main() {
 	var configFile string
+	var genSigningKey bool
 	flag.StringVar(&configFile, "config", defaultConfigFile, "Config file")
+	flag.BoolVar(&genSigningKey, "gen-signing-key", false,
+		"Generate or rotate firmware signing key and exit")
 	flag.Parse()
+	if genSigningKey {
+		os.Exit(generateSigningKey(configFile))
+	}
 	os.Exit(run(configFile))
 }
 
+// generateSigningKey writes new firmware signing key to file set in
+// config, server must be restarted to use it
+func generateSigningKey(configFile string) int {
+	cfg, err := config.Configuration(configFile)
+	if err != nil {
+		utils.Log().Infoln("signing key error", err)
+		return 1
+	}
+	if cfg.Firmware.SigningKey == "" {
+		utils.Log().Infoln("signing key error, no signing-key file in config")
+		return 1
+	}
+	pub, err := utils.GenerateSigningKey(cfg.Firmware.SigningKey)
+	if err != nil {
+		utils.Log().Infoln("signing key error", err)
+		return 1
+	}
+	utils.Log().Infoln("signing key", utils.KeyID(pub), "written to",
+		cfg.Firmware.SigningKey, "public key",
+		base64.StdEncoding.EncodeToString(pub))
+	return 0
+}
+
 func run(configFile string) int {
 	cfg, err := config.Configuration(configFile)
 	if err != nil {
 		utils.Log().Infoln("run error", err)
 		return 1
 	}
-	ms := service.NewMongoService(&service.Config{
-		Host:     cfg.Mongo.Host,
-		Port:     cfg.Mongo.Port,
-		User:     cfg.Mongo.User,
-		Password: cfg.Mongo.Password,
-		Database: cfg.Mongo.Database,
-	})
+	ms, ts, err := storage(cfg)
+	if err != nil {
+		utils.Log().Infoln("run error", err)
+		return 1
+	}
 	if err = ms.Connect(); err != nil {
-		utils.Log().Infoln("mongo connection error", err)
+		utils.Log().Infoln("storage connection error", err)
 		return 1
 	}
 	err = bootstrap(cfg.Login, cfg.Password, ms)
@@ -41,12 +95,126 @@ func run(configFile string) int {
 		utils.Log().Infoln("run error", err)
 		return 1
 	}
+	blobs, err := blobStore(cfg, ms)
+	if err != nil {
+		utils.Log().Infoln("run error", err)
+		return 1
+	}
+	// Storage is wrapped once blob store has got mongo service it needs
+	ms = service.NewEventService(ms, cfg.Email.Host != "")
+	stop := make(chan struct{})
+	defer close(stop)
+	rolloutInterval := time.Duration(cfg.Firmware.RolloutInterval) * time.Second
+	if rolloutInterval <= 0 {
+		rolloutInterval = defaultRolloutInterval
+	}
+	go jobs.NewRollouts(ms, rolloutInterval).Run(stop)
+	rollupInterval := time.Duration(cfg.Telemetry.RollupInterval) * time.Second
+	if rollupInterval <= 0 {
+		rollupInterval = defaultRollupInterval
+	}
+	retention := make(map[string]time.Duration)
+	for name, days := range cfg.Telemetry.Retention {
+		retention[name] = time.Duration(days) * 24 * time.Hour
+	}
+	go jobs.NewRollups(ts, rollupInterval, retention).Run(stop)
+	sweepInterval := time.Duration(cfg.Heartbeat.SweepInterval) * time.Second
+	if sweepInterval <= 0 {
+		sweepInterval = defaultSweepInterval
+	}
+	offlineAfter := time.Duration(cfg.Heartbeat.OfflineAfter) * time.Second
+	if offlineAfter <= 0 {
+		offlineAfter = defaultOfflineAfter
+	}
+	go jobs.NewSweeper(ms, sweepInterval, offlineAfter).Run(stop)
+	alertInterval := time.Duration(cfg.Alerts.CheckInterval) * time.Second
+	if alertInterval <= 0 {
+		alertInterval = defaultAlertInterval
+	}
+	go jobs.NewEvaluator(ms, ts, alertInterval).Run(stop)
+	deliverInterval := time.Duration(cfg.Webhooks.DeliveryInterval) * time.Second
+	if deliverInterval <= 0 {
+		deliverInterval = defaultDeliverInterval
+	}
+	webhookTimeout := time.Duration(cfg.Webhooks.Timeout) * time.Second
+	if webhookTimeout <= 0 {
+		webhookTimeout = defaultWebhookTimeout
+	}
+	maxAttempts := cfg.Webhooks.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxAttempts
+	}
+	deliveryDays := cfg.Webhooks.Retention
+	if deliveryDays <= 0 {
+		deliveryDays = defaultDeliveryDays
+	}
+	deliveryRetention := time.Duration(deliveryDays) * 24 * time.Hour
+	go jobs.NewDispatcher(ms, deliverInterval, webhookTimeout, maxAttempts,
+		deliveryRetention).Run(stop)
+	if cfg.Email.Host != "" {
+		mailer, err := newMailer(cfg, ms)
+		if err != nil {
+			utils.Log().Infoln("run error", err)
+			return 1
+		}
+		go mailer.Run(stop)
+	}
+	if cfg.Attachments.Retention > 0 {
+		cleanupInterval := time.Duration(cfg.Attachments.CleanupInterval) * time.Second
+		if cleanupInterval <= 0 {
+			cleanupInterval = defaultCleanupInterval
+		}
+		attachmentRetention := time.Duration(cfg.Attachments.Retention) * 24 * time.Hour
+		go jobs.NewCleaner(ms, blobs, cleanupInterval, attachmentRetention).Run(stop)
+	}
+	firmwareDir := cfg.Firmware.Dir
+	if firmwareDir == "" {
+		firmwareDir = defaultFirmwareDir
+	}
+	firmwareSize := cfg.Firmware.MaxSize
+	if firmwareSize <= 0 {
+		firmwareSize = defaultFirmwareSize
+	}
+	attachmentSize := cfg.Attachments.MaxSize
+	if attachmentSize <= 0 {
+		attachmentSize = defaultAttachmentSize
+	}
+	if cfg.MQTT.QoS < 0 || cfg.MQTT.QoS > 2 {
+		utils.Log().Infoln("run error, mqtt qos must be 0, 1 or 2")
+		return 1
+	}
+	mqttClientID := cfg.MQTT.ClientID
+	if mqttClientID == "" {
+		mqttClientID = defaultMQTTClientID
+	}
+	mqttPrefix := strings.Trim(cfg.MQTT.Prefix, "/")
+	if mqttPrefix == "" {
+		mqttPrefix = defaultMQTTPrefix
+	}
 	srv := server.NewServer(&server.Config{
-		Host:       cfg.Host,
-		Port:       cfg.Port,
-		ApiKey:     cfg.ApiKey,
-		Expiration: cfg.Expiration,
-	}, ms)
+		Host:                cfg.Host,
+		Port:                cfg.Port,
+		ApiKey:              cfg.ApiKey,
+		RequireDeviceSecret: cfg.RequireDeviceSecret,
+		ClientCA:            cfg.ClientCA,
+		RequireClientCert:   cfg.RequireClientCert,
+		FirmwareDir:         firmwareDir,
+		FirmwareMaxSize:     firmwareSize << 20,
+		SigningKey:          cfg.Firmware.SigningKey,
+		TelemetryRetention:  retention,
+		AttachmentMaxSize:   attachmentSize << 20,
+		Expiration:          cfg.Expiration,
+		MQTTBroker:          cfg.MQTT.Broker,
+		MQTTClientID:        mqttClientID,
+		MQTTUser:            cfg.MQTT.User,
+		MQTTPassword:        cfg.MQTT.Password,
+		MQTTPrefix:          mqttPrefix,
+		MQTTQoS:             byte(cfg.MQTT.QoS),
+		CoAPPort:            cfg.CoAP.Port,
+		CoAPDTLS:            cfg.CoAP.DTLS,
+		CoAPInsecure:        cfg.CoAP.Insecure,
+		GRPCPort:            cfg.GRPC.Port,
+	}, ms, ts, blobs)
 	if err := srv.Serve(); err != nil {
 		utils.Log().Infoln("run error", err)
 		return 1
@@ -54,7 +222,82 @@ func run(configFile string) int {
 	return 0
 }
 
-func bootstrap(login, password string, ms *service.MongoService) error {
+// storage creates backend chosen in config, every backend keeps
+// telemetry too
+func storage(cfg *config.Config) (service.MongoInterface,
+	service.TelemetryInterface, error) {
+	switch cfg.Storage.Type {
+	case "", "mongo":
+		ms := service.NewMongoService(&service.Config{
+			Host:     cfg.Mongo.Host,
+			Port:     cfg.Mongo.Port,
+			User:     cfg.Mongo.User,
+			Password: cfg.Mongo.Password,
+			Database: cfg.Mongo.Database,
+		})
+		return ms, ms, nil
+	case "memory":
+		ms := service.NewMemoryService()
+		return ms, ms, nil
+	case "bolt":
+		ms := service.NewBoltService(cfg.Storage.Path)
+		return ms, ms, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown storage type %q", cfg.Storage.Type)
+	}
+}
+
+// blobStore creates store of attachment contents chosen in config, GridFS
+// is available with mongo storage only
+func blobStore(cfg *config.Config, ms service.MongoInterface) (service.BlobStore, error) {
+	switch cfg.Attachments.Storage {
+	case "", "disk":
+		dir := cfg.Attachments.Dir
+		if dir == "" {
+			dir = defaultAttachmentDir
+		}
+		return service.NewDiskBlobStore(dir), nil
+	case "gridfs":
+		mongo, ok := ms.(*service.MongoService)
+		if !ok {
+			return nil, fmt.Errorf("gridfs attachments need mongo storage")
+		}
+		return mongo, nil
+	default:
+		return nil, fmt.Errorf("unknown attachment storage %q", cfg.Attachments.Storage)
+	}
+}
+
+// newMailer creates job mailing alerts and digests through SMTP server
+// set in config
+func newMailer(cfg *config.Config, ms service.MongoInterface) (*jobs.Mailer, error) {
+	templates, err := mail.LoadTemplates(cfg.Email.Templates)
+	if err != nil {
+		return nil, err
+	}
+	port := cfg.Email.Port
+	if port == "" {
+		port = defaultSMTPPort
+	}
+	sender := mail.NewSMTPSender(mail.Config{
+		Host:     cfg.Email.Host,
+		Port:     port,
+		User:     cfg.Email.User,
+		Password: cfg.Email.Password,
+		From:     cfg.Email.From,
+	})
+	interval := time.Duration(cfg.Email.CheckInterval) * time.Second
+	if interval <= 0 {
+		interval = defaultMailInterval
+	}
+	attempts := cfg.Email.MaxAttempts
+	if attempts <= 0 {
+		attempts = defaultMailAttempts
+	}
+	return jobs.NewMailer(ms, sender, templates, interval, attempts), nil
+}
+
+func bootstrap(login, password string, ms service.MongoInterface) error {
 	creds := model.Credentials{
 		Login:    login,
 		Password: utils.GenerateHash(password),
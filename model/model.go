@@ -7,27 +7,170 @@ import (
 )
 
 type Device struct {
-	ID           bson.ObjectId `bson:"_id,omitempty"`
-	DeviceNumber string        `bson:"device_number"`
-	RegisterDate time.Time     `bson:"register_date"`
+	ID              bson.ObjectId `bson:"_id,omitempty"`
+	DeviceNumber    string        `bson:"device_number"`
+	RegisterDate    time.Time     `bson:"register_date"`
+	SecretHash      string        `bson:"secret_hash,omitempty"`
+	SecretRevoked   bool          `bson:"secret_revoked,omitempty"`
+	Firmware        bson.ObjectId `bson:"firmware,omitempty"`
+	Group           string        `bson:"group,omitempty"`
+	FirmwareVersion string        `bson:"firmware_version,omitempty"`
+	UpdateState     string        `bson:"update_state,omitempty"`
+	UpdateDate      time.Time     `bson:"update_date,omitempty"`
+	Status          string        `bson:"status,omitempty"`
+	LastSeen        time.Time     `bson:"last_seen,omitempty"`
+	Uptime          int64         `bson:"uptime,omitempty"`
 }
 
 type DeviceDto struct {
-	DeviceNumber string           `bson:"device_number" json:"device-number"`
-	RegisterDate time.Time        `bson:"register_date" json:"register-date"`
-	Errors       []DeviceErrorDto `bson:"errors" json:"errors"`
+	DeviceNumber    string    `bson:"device_number" json:"device-number"`
+	RegisterDate    time.Time `bson:"register_date" json:"register-date"`
+	FirmwareVersion string    `bson:"firmware_version" json:"firmware-version"`
+	UpdateState     string    `bson:"update_state" json:"update-state"`
+	Status          string    `bson:"status" json:"status"`
+	LastSeen        time.Time `bson:"last_seen" json:"last-seen"`
+	Uptime          int64     `bson:"uptime" json:"uptime"`
+	Issues          []Issue   `bson:"issues" json:"issues"`
+}
+
+// DeviceFilter narrows list of devices, empty fields match every device.
+// Resolved issues of devices are listed only with AllErrors
+type DeviceFilter struct {
+	Status    string
+	AllErrors bool
 }
 
+// DeviceErrorDto is error report of device, everything but error name
+// and device number is optional. Timestamp is time of error by device
+// clock, context is free-form JSON object. Fingerprint tells apart issues
+// with the same error name. Report with attachment is always stored, so
+// that device can upload attachment to it. Date is time of receiving, it
+// is set in listed occurrences only
 type DeviceErrorDto struct {
-	ErrorName    string `bson:"error_name" json:"error-name"`
-	DeviceNumber string `bson:"device_number" json:"device-number"`
+	ID              bson.ObjectId          `bson:"_id,omitempty" json:"id,omitempty"`
+	ErrorName       string                 `bson:"error_name" json:"error-name"`
+	DeviceNumber    string                 `bson:"device_number" json:"device-number"`
+	Fingerprint     string                 `bson:"fingerprint,omitempty" json:"fingerprint,omitempty"`
+	Severity        string                 `bson:"severity,omitempty" json:"severity,omitempty"`
+	Code            int                    `bson:"code,omitempty" json:"code,omitempty"`
+	Timestamp       *time.Time             `bson:"device_date,omitempty" json:"timestamp,omitempty"`
+	FirmwareVersion string                 `bson:"firmware_version,omitempty" json:"firmware-version,omitempty"`
+	Context         map[string]interface{} `bson:"context,omitempty" json:"context,omitempty"`
+	Attachment      bool                   `bson:"-" json:"attachment,omitempty"`
+	Date            time.Time              `bson:"date,omitempty" json:"date,omitempty"`
 }
 
+// ErrorBatchDto is errors device buffered while offline, reports without
+// device number belong to device of batch
+type ErrorBatchDto struct {
+	DeviceNumber string           `json:"device-number"`
+	Errors       []DeviceErrorDto `json:"errors"`
+}
+
+// Severities of device errors from the least severe
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityError    = "error"
+	SeverityCritical = "critical"
+)
+
 type DeviceError struct {
-	ErrorName    string        `bson:"error_name"`
+	ID              bson.ObjectId          `bson:"_id,omitempty"`
+	ErrorName       string                 `bson:"error_name"`
+	DeviceNumber    string                 `bson:"device_number"`
+	Date            time.Time              `bson:"date"`
+	DeviceId        bson.ObjectId          `bson:"device_id"`
+	Severity        string                 `bson:"severity,omitempty"`
+	Code            int                    `bson:"code,omitempty"`
+	DeviceDate      *time.Time             `bson:"device_date,omitempty"`
+	FirmwareVersion string                 `bson:"firmware_version,omitempty"`
+	Context         map[string]interface{} `bson:"context,omitempty"`
+	Fingerprint     string                 `bson:"fingerprint,omitempty"`
+	IssueId         bson.ObjectId          `bson:"issue_id,omitempty"`
+	Sampled         bool                   `bson:"sampled,omitempty"`
+	Attachment      bool                   `bson:"attachment,omitempty"`
+}
+
+// IssueCount counts occurrences of issue in one minute starting at date.
+// Every occurrence is counted, while only sampled ones are stored
+type IssueCount struct {
+	IssueId      bson.ObjectId `bson:"issue_id"`
 	DeviceNumber string        `bson:"device_number"`
+	ErrorName    string        `bson:"error_name"`
 	Date         time.Time     `bson:"date"`
-	DeviceId     bson.ObjectId `bson:"device_id"`
+	Count        int           `bson:"count"`
+}
+
+// Attachment is core dump or log excerpt device uploaded for stored
+// error, its content is kept in blob store under attachment id
+type Attachment struct {
+	ID           bson.ObjectId `bson:"_id,omitempty" json:"id"`
+	ErrorId      bson.ObjectId `bson:"error_id" json:"error-id"`
+	DeviceNumber string        `bson:"device_number" json:"device-number"`
+	Name         string        `bson:"name" json:"name"`
+	ContentType  string        `bson:"content_type" json:"content-type"`
+	Size         int64         `bson:"size" json:"size"`
+	SHA256       string        `bson:"sha256" json:"sha256"`
+	Date         time.Time     `bson:"date" json:"date"`
+}
+
+// Issue groups occurrences of error with the same name and fingerprint on
+// device. Severity, code and firmware version are taken from the last
+// occurrence, only sample of occurrences is stored
+type Issue struct {
+	ID              bson.ObjectId `bson:"_id,omitempty" json:"id"`
+	DeviceId        bson.ObjectId `bson:"device_id" json:"-"`
+	DeviceNumber    string        `bson:"device_number" json:"device-number"`
+	ErrorName       string        `bson:"error_name" json:"error-name"`
+	Fingerprint     string        `bson:"fingerprint" json:"fingerprint,omitempty"`
+	Severity        string        `bson:"severity,omitempty" json:"severity,omitempty"`
+	Code            int           `bson:"code,omitempty" json:"code,omitempty"`
+	FirmwareVersion string        `bson:"firmware_version,omitempty" json:"firmware-version,omitempty"`
+	FirstSeen       time.Time     `bson:"first_seen" json:"first-seen"`
+	LastSeen        time.Time     `bson:"last_seen" json:"last-seen"`
+	Count           int           `bson:"count" json:"count"`
+	State           string        `bson:"state,omitempty" json:"state,omitempty"`
+	Assignee        string        `bson:"assignee,omitempty" json:"assignee,omitempty"`
+	History         []ErrorChange `bson:"history,omitempty" json:"history,omitempty"`
+}
+
+// States of issue, issue without state is open
+const (
+	ErrorOpen         = "open"
+	ErrorAcknowledged = "acknowledged"
+	ErrorResolved     = "resolved"
+)
+
+// Actions changing issue, assign changes assignee only
+const (
+	ActionAcknowledge = "acknowledge"
+	ActionAssign      = "assign"
+	ActionResolve     = "resolve"
+	ActionReopen      = "reopen"
+)
+
+// ErrorActions maps actions to state issue gets
+var ErrorActions = map[string]string{
+	ActionAcknowledge: ErrorAcknowledged,
+	ActionAssign:      "",
+	ActionResolve:     ErrorResolved,
+	ActionReopen:      ErrorOpen,
+}
+
+// ErrorChange records who changed issue and when, login of automatic
+// change is empty
+type ErrorChange struct {
+	Action   string    `bson:"action" json:"action"`
+	Assignee string    `bson:"assignee,omitempty" json:"assignee,omitempty"`
+	Login    string    `bson:"login,omitempty" json:"login,omitempty"`
+	Date     time.Time `bson:"date" json:"date"`
+}
+
+// IssueSelector selects issues of device by id or by error name
+type IssueSelector struct {
+	ID        string
+	ErrorName string
 }
 
 type Devices struct {
@@ -35,6 +178,27 @@ type Devices struct {
 	Total   int          `json:"total"`
 }
 
+// Device status is online while it sends heartbeats
+const (
+	StatusOnline  = "online"
+	StatusOffline = "offline"
+)
+
+// HeartbeatDto is sent by device to tell it is alive, uptime is in
+// seconds and optional
+type HeartbeatDto struct {
+	DeviceNumber string `json:"device-number"`
+	Uptime       int64  `json:"uptime"`
+}
+
+// StatusEvent records transition of device between online and offline
+type StatusEvent struct {
+	DeviceNumber string        `bson:"device_number" json:"device-number"`
+	DeviceId     bson.ObjectId `bson:"device_id" json:"-"`
+	Status       string        `bson:"status" json:"status"`
+	Date         time.Time     `bson:"date" json:"date"`
+}
+
 type Credentials struct {
 	Login    string `json:"login"`
 	Password string `json:"password"`
@@ -49,3 +213,336 @@ type Cookie struct {
 	Login  string    `bson:"login"`
 	Expire time.Time `bson:"expire"`
 }
+
+// Firmware describes uploaded firmware image, image itself is kept in
+// firmware directory
+type Firmware struct {
+	ID            bson.ObjectId `bson:"_id,omitempty" json:"id"`
+	Version       string        `bson:"version" json:"version"`
+	HardwareModel string        `bson:"hardware_model" json:"hardware-model"`
+	Channel       string        `bson:"channel" json:"channel"`
+	SHA256        string        `bson:"sha256" json:"sha256"`
+	Size          int64         `bson:"size" json:"size"`
+	Notes         string        `bson:"notes" json:"notes"`
+	UploadDate    time.Time     `bson:"upload_date" json:"upload-date"`
+	Held          bool          `bson:"held,omitempty" json:"held"`
+}
+
+// Manifest describes firmware image device is going to download, it is
+// signed by server key
+type Manifest struct {
+	Firmware      bson.ObjectId `json:"firmware"`
+	Version       string        `json:"version"`
+	HardwareModel string        `json:"hardware-model"`
+	Channel       string        `json:"channel"`
+	SHA256        string        `json:"sha256"`
+	Size          int64         `json:"size"`
+	KeyID         string        `json:"key-id"`
+	IssueDate     time.Time     `json:"issue-date"`
+}
+
+const (
+	RolloutRunning   = "running"
+	RolloutPaused    = "paused"
+	RolloutAborted   = "aborted"
+	RolloutCompleted = "completed"
+)
+
+// Rollout delivers firmware to growing part of devices. Firmware under
+// rollout is held back from other devices until rollout is completed.
+// Revision grows with every update, so update of stale copy fails
+type Rollout struct {
+	ID             bson.ObjectId `bson:"_id,omitempty" json:"id"`
+	Firmware       bson.ObjectId `bson:"firmware" json:"firmware"`
+	HardwareModel  string        `bson:"hardware_model" json:"hardware-model"`
+	Channel        string        `bson:"channel" json:"channel"`
+	Steps          []RolloutStep `bson:"steps" json:"steps"`
+	Step           int           `bson:"step" json:"step"`
+	StepDuration   int           `bson:"step_duration" json:"step-duration"`
+	ErrorThreshold float64       `bson:"error_threshold" json:"error-threshold"`
+	State          string        `bson:"state" json:"state"`
+	Reason         string        `bson:"reason,omitempty" json:"reason,omitempty"`
+	CreateDate     time.Time     `bson:"create_date" json:"create-date"`
+	Revision       int           `bson:"revision" json:"revision"`
+}
+
+// RolloutStep targets device group or percent of devices, devices
+// targeted by previous steps stay in rollout. Updated and Errors tell
+// how many devices got firmware by the end of step and how many errors
+// they reported since then
+type RolloutStep struct {
+	Percent   int       `bson:"percent" json:"percent"`
+	Group     string    `bson:"group,omitempty" json:"group,omitempty"`
+	StartDate time.Time `bson:"start_date,omitempty" json:"start-date"`
+	Updated   int       `bson:"updated" json:"updated"`
+	Errors    int       `bson:"errors" json:"errors"`
+}
+
+// RolloutDevice records that device got firmware of rollout
+type RolloutDevice struct {
+	Rollout      bson.ObjectId `bson:"rollout"`
+	DeviceNumber string        `bson:"device_number"`
+	Date         time.Time     `bson:"date"`
+}
+
+// Kinds of alert rules
+const (
+	RuleErrors  = "errors"
+	RuleOffline = "offline"
+	RuleMetric  = "metric"
+)
+
+// Rule is condition checked against stored data. Errors rule matches
+// device which reported more than Threshold errors named ErrorName in last
+// Window minutes, offline rule matches device offline longer than Window
+// minutes and metric rule matches device whose Metric averaged over last
+// Window minutes is above Threshold. Rule with device number checks that
+// device only, disabled rule is not checked
+type Rule struct {
+	ID           bson.ObjectId `bson:"_id,omitempty" json:"id"`
+	Name         string        `bson:"name" json:"name"`
+	Kind         string        `bson:"kind" json:"kind"`
+	ErrorName    string        `bson:"error_name,omitempty" json:"error-name,omitempty"`
+	Metric       string        `bson:"metric,omitempty" json:"metric,omitempty"`
+	Threshold    float64       `bson:"threshold" json:"threshold"`
+	Window       int           `bson:"window" json:"window"`
+	DeviceNumber string        `bson:"device_number,omitempty" json:"device-number,omitempty"`
+	Disabled     bool          `bson:"disabled,omitempty" json:"disabled"`
+	CreateDate   time.Time     `bson:"create_date" json:"create-date"`
+}
+
+// States of alert
+const (
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+// Alert is rule matching device. There is single firing alert of rule
+// for device, while rule keeps matching alert is updated with last value
+// and date, alert is resolved when rule stops matching
+type Alert struct {
+	ID           bson.ObjectId `bson:"_id,omitempty" json:"id"`
+	RuleId       bson.ObjectId `bson:"rule_id" json:"rule-id"`
+	RuleName     string        `bson:"rule_name" json:"rule-name"`
+	Kind         string        `bson:"kind" json:"kind"`
+	DeviceNumber string        `bson:"device_number" json:"device-number"`
+	State        string        `bson:"state" json:"state"`
+	Value        float64       `bson:"value" json:"value"`
+	StartDate    time.Time     `bson:"start_date" json:"start-date"`
+	LastDate     time.Time     `bson:"last_date" json:"last-date"`
+	EndDate      time.Time     `bson:"end_date,omitempty" json:"end-date"`
+}
+
+// Types of events sent to webhooks
+const (
+	EventDeviceRegistered = "device.registered"
+	EventErrorReported    = "error.reported"
+	EventAlertFired       = "alert.fired"
+	EventAlertResolved    = "alert.resolved"
+	EventUpdateFinished   = "update.finished"
+)
+
+// Event is JSON body of webhook request, data is document event is about
+type Event struct {
+	ID           bson.ObjectId `json:"id"`
+	Type         string        `json:"type"`
+	DeviceNumber string        `json:"device-number"`
+	Date         time.Time     `json:"date"`
+	Data         interface{}   `json:"data"`
+}
+
+// Webhook receives events of listed types, or every event when there are
+// none. Body is signed by HMAC-SHA256 with secret
+type Webhook struct {
+	ID         bson.ObjectId `bson:"_id,omitempty" json:"id"`
+	URL        string        `bson:"url" json:"url"`
+	Secret     string        `bson:"secret" json:"secret,omitempty"`
+	Events     []string      `bson:"events,omitempty" json:"events"`
+	Disabled   bool          `bson:"disabled,omitempty" json:"disabled"`
+	CreateDate time.Time     `bson:"create_date" json:"create-date"`
+}
+
+// States of webhook delivery
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// Delivery is event queued for webhook, pending delivery is attempted at
+// next date. Payload is JSON of event, status and error are of the last
+// attempt
+type Delivery struct {
+	ID          bson.ObjectId `bson:"_id,omitempty" json:"id"`
+	WebhookId   bson.ObjectId `bson:"webhook_id" json:"webhook-id"`
+	Event       string        `bson:"event" json:"event"`
+	Payload     string        `bson:"payload" json:"payload"`
+	State       string        `bson:"state" json:"state"`
+	Attempts    int           `bson:"attempts" json:"attempts"`
+	NextDate    time.Time     `bson:"next_date" json:"next-date"`
+	Status      int           `bson:"status,omitempty" json:"status,omitempty"`
+	Error       string        `bson:"error,omitempty" json:"error,omitempty"`
+	CreateDate  time.Time     `bson:"create_date" json:"create-date"`
+	DeliverDate time.Time     `bson:"deliver_date,omitempty" json:"deliver-date"`
+}
+
+// Periods of error digest
+const (
+	DigestHourly = "hourly"
+	DigestDaily  = "daily"
+)
+
+// Subscription is email notification settings of admin. Alerts are
+// mailed when they fire and resolve, digest of issues devices reported
+// is mailed every period. Digest date is end of last digest
+type Subscription struct {
+	Login      string    `bson:"_id" json:"login"`
+	Email      string    `bson:"email" json:"email"`
+	Alerts     bool      `bson:"alerts" json:"alerts"`
+	Digest     string    `bson:"digest,omitempty" json:"digest"`
+	DigestDate time.Time `bson:"digest_date,omitempty" json:"digest-date"`
+}
+
+// Mail is event queued for mailing to subscriber, it is rendered by
+// template of event type when it is sent. States are the same as of
+// webhook delivery
+type Mail struct {
+	ID         bson.ObjectId `bson:"_id,omitempty" json:"id"`
+	To         string        `bson:"to" json:"to"`
+	Event      string        `bson:"event" json:"event"`
+	Payload    string        `bson:"payload" json:"payload"`
+	State      string        `bson:"state" json:"state"`
+	Attempts   int           `bson:"attempts" json:"attempts"`
+	NextDate   time.Time     `bson:"next_date" json:"next-date"`
+	Error      string        `bson:"error,omitempty" json:"error,omitempty"`
+	CreateDate time.Time     `bson:"create_date" json:"create-date"`
+	SendDate   time.Time     `bson:"send_date,omitempty" json:"send-date"`
+}
+
+// States of firmware update reported by device
+const (
+	UpdateDownloading = "downloading"
+	UpdateVerifying   = "verifying"
+	UpdateInstalling  = "installing"
+	UpdateSucceeded   = "succeeded"
+	UpdateFailed      = "failed"
+)
+
+// UpdateStatusDto is firmware update event reported by device, current
+// version is firmware device runs at the moment of report
+type UpdateStatusDto struct {
+	DeviceNumber   string `json:"device-number"`
+	State          string `json:"state"`
+	TargetVersion  string `json:"target-version"`
+	CurrentVersion string `json:"current-version"`
+	Reason         string `json:"reason,omitempty"`
+}
+
+type UpdateEvent struct {
+	DeviceNumber   string        `bson:"device_number" json:"device-number"`
+	DeviceId       bson.ObjectId `bson:"device_id" json:"-"`
+	State          string        `bson:"state" json:"state"`
+	TargetVersion  string        `bson:"target_version" json:"target-version"`
+	CurrentVersion string        `bson:"current_version" json:"current-version"`
+	Reason         string        `bson:"reason,omitempty" json:"reason,omitempty"`
+	Date           time.Time     `bson:"date" json:"date"`
+}
+
+// DownloadStats counts firmware downloads of device, every request which
+// served some bytes is counted, so resumed download is counted several
+// times
+type DownloadStats struct {
+	DeviceNumber string        `bson:"device_number" json:"device-number"`
+	Firmware     bson.ObjectId `bson:"firmware" json:"firmware"`
+	Downloads    int           `bson:"downloads" json:"downloads"`
+	Bytes        int64         `bson:"bytes" json:"bytes"`
+	LastDate     time.Time     `bson:"last_date" json:"last-date"`
+}
+
+// TelemetryDto is batch of metric samples sent by device
+type TelemetryDto struct {
+	DeviceNumber string      `json:"device-number"`
+	Samples      []SampleDto `json:"samples"`
+}
+
+// SampleDto is single metric value measured by device, sample without
+// timestamp is taken at the time of receiving
+type SampleDto struct {
+	Metric    string    `json:"metric"`
+	Value     float64   `json:"value"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type Sample struct {
+	DeviceNumber string    `bson:"device_number" json:"device-number"`
+	Metric       string    `bson:"metric" json:"metric"`
+	Value        float64   `bson:"value" json:"value"`
+	Date         time.Time `bson:"date" json:"date"`
+}
+
+// Resolution is bucket size of telemetry rollup
+type Resolution struct {
+	Name     string
+	Duration time.Duration
+}
+
+// ResolutionRaw names samples as they were sent by devices
+const ResolutionRaw = "raw"
+
+// Resolutions of telemetry rollups from finest to coarsest, each one is
+// rolled up from previous one
+var Resolutions = []Resolution{
+	{"1m", time.Minute},
+	{"1h", time.Hour},
+	{"1d", 24 * time.Hour},
+}
+
+// Rollup aggregates samples of device metric taken in bucket starting at
+// date
+type Rollup struct {
+	DeviceNumber string    `bson:"device_number" json:"device-number"`
+	Metric       string    `bson:"metric" json:"metric"`
+	Resolution   string    `bson:"resolution" json:"resolution"`
+	Date         time.Time `bson:"date" json:"date"`
+	Count        int       `bson:"count" json:"count"`
+	Sum          float64   `bson:"sum" json:"sum"`
+	Min          float64   `bson:"min" json:"min"`
+	Max          float64   `bson:"max" json:"max"`
+	Avg          float64   `bson:"avg" json:"avg"`
+}
+
+// Stats describes fleet in time window, days and hours are in UTC
+type Stats struct {
+	From       time.Time          `json:"from"`
+	To         time.Time          `json:"to"`
+	Devices    int                `json:"devices"`
+	Days       []DayStats         `json:"days"`
+	Hours      []HourStats        `json:"hours"`
+	TopErrors  []ErrorNameCount   `json:"top-errors"`
+	TopDevices []DeviceErrorCount `json:"top-devices"`
+}
+
+// DayStats counts devices registered by the end of day, devices which
+// reported errors, update status or telemetry during day and devices
+// registered during day
+type DayStats struct {
+	Date   time.Time `json:"date"`
+	Total  int       `json:"total"`
+	Active int       `json:"active"`
+	New    int       `json:"new"`
+}
+
+type HourStats struct {
+	Date   time.Time `json:"date"`
+	Errors int       `json:"errors"`
+}
+
+type ErrorNameCount struct {
+	ErrorName string `json:"error-name"`
+	Count     int    `json:"count"`
+}
+
+type DeviceErrorCount struct {
+	DeviceNumber string `json:"device-number"`
+	Errors       int    `json:"errors"`
+}
@@ -0,0 +1,245 @@
+package server
+
+import (
+	"encoding/json"
+	"iot-stats/model"
+	"iot-stats/service"
+	"net/http"
+	"net/mail"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxListedAlerts limits how many alerts are listed at once
+const maxListedAlerts = 100
+
+// maxRuleWindow limits window of rule to a week of minutes, so evaluation
+// reads bounded range of data
+const maxRuleWindow = 7 * 24 * 60
+
+// Alerts manages alert rules, rules are checked and alerts are fired by
+// background job
+type Alerts struct {
+	ms service.MongoInterface
+}
+
+func newAlerts(ms service.MongoInterface) *Alerts {
+	return &Alerts{ms: ms}
+}
+
+type PostRule struct {
+	Name         string  `json:"name"`
+	Kind         string  `json:"kind"`
+	ErrorName    string  `json:"error-name"`
+	Metric       string  `json:"metric"`
+	Threshold    float64 `json:"threshold"`
+	Window       int     `json:"window"`
+	DeviceNumber string  `json:"device-number"`
+	Disabled     bool    `json:"disabled"`
+}
+
+// Get list of alert rules
+func (a *Alerts) rules(c *gin.Context) {
+	rules, err := a.ms.GetRules()
+	if err != nil {
+		internalError(c, "database error", "alert err "+err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, rules)
+}
+
+// Create alert rule, it is checked from next evaluation on
+func (a *Alerts) createRule(c *gin.Context) {
+	post, ok := decodeRule(c)
+	if !ok {
+		return
+	}
+	rule := &model.Rule{CreateDate: time.Now()}
+	setRule(rule, post)
+	if err := a.ms.AddRule(rule); err != nil {
+		internalError(c, "database error", "alert err "+err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, rule)
+}
+
+// Replace alert rule, its firing alerts are kept while it matches
+func (a *Alerts) updateRule(c *gin.Context) {
+	rule, err := a.ms.GetRule(c.Param("id"))
+	if err == service.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Rule not found"})
+		return
+	} else if err != nil {
+		internalError(c, "database error", "alert err "+err.Error())
+		return
+	}
+	post, ok := decodeRule(c)
+	if !ok {
+		return
+	}
+	setRule(rule, post)
+	if err = a.ms.UpdateRule(rule); err != nil {
+		internalError(c, "database error", "alert err "+err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, rule)
+}
+
+// Delete alert rule, its firing alerts are resolved by next evaluation
+func (a *Alerts) deleteRule(c *gin.Context) {
+	err := a.ms.DeleteRule(c.Param("id"))
+	if err == service.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Rule not found"})
+		return
+	} else if err != nil {
+		internalError(c, "database error", "alert err "+err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Rule deleted"})
+}
+
+// Get latest alerts, state query parameter selects firing or resolved
+// alerts only
+func (a *Alerts) list(c *gin.Context) {
+	state := c.Query("state")
+	if state != "" && state != model.AlertFiring && state != model.AlertResolved {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Wrong alert state"})
+		return
+	}
+	alerts, err := a.ms.GetAlerts(state, maxListedAlerts)
+	if err != nil {
+		internalError(c, "database error", "alert err "+err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, alerts)
+}
+
+func decodeRule(c *gin.Context) (*PostRule, bool) {
+	decoder := json.NewDecoder(c.Request.Body)
+	defer c.Request.Body.Close()
+	var post PostRule
+	if err := decoder.Decode(&post); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Wrong rule"})
+		return nil, false
+	}
+	if msg := validateRule(&post); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return nil, false
+	}
+	return &post, true
+}
+
+// validateRule returns description of what is wrong with rule
+func validateRule(post *PostRule) string {
+	if post.Name == "" {
+		return "Rule name is missing"
+	}
+	if post.Window <= 0 || post.Window > maxRuleWindow {
+		return "Window must be 1 to 10080 minutes"
+	}
+	switch post.Kind {
+	case model.RuleErrors:
+		if post.ErrorName == "" {
+			return "Error name is missing"
+		}
+		if post.Threshold < 0 {
+			return "Threshold must not be negative"
+		}
+	case model.RuleOffline:
+	case model.RuleMetric:
+		if post.Metric == "" {
+			return "Metric is missing"
+		}
+	default:
+		return "Unknown rule kind"
+	}
+	return ""
+}
+
+// setRule copies posted fields into rule, fields other kinds use are
+// cleared
+func setRule(rule *model.Rule, post *PostRule) {
+	rule.Name, rule.Kind = post.Name, post.Kind
+	rule.ErrorName, rule.Metric, rule.Threshold = "", "", 0
+	switch post.Kind {
+	case model.RuleErrors:
+		rule.ErrorName, rule.Threshold = post.ErrorName, post.Threshold
+	case model.RuleMetric:
+		rule.Metric, rule.Threshold = post.Metric, post.Threshold
+	}
+	rule.Window = post.Window
+	rule.DeviceNumber = post.DeviceNumber
+	rule.Disabled = post.Disabled
+}
+
+type PostSubscription struct {
+	Email  string `json:"email"`
+	Alerts bool   `json:"alerts"`
+	Digest string `json:"digest"`
+}
+
+// Get email notification settings of admin
+func (a *Alerts) getSubscription(c *gin.Context) {
+	login := c.GetString(loginKey)
+	subscription, err := a.ms.GetSubscription(login)
+	if err == service.ErrNotFound {
+		subscription = &model.Subscription{Login: login}
+	} else if err != nil {
+		internalError(c, "database error", "subscription err "+err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, subscription)
+}
+
+// Set email notification settings of admin, digest starts over when its
+// period changes
+func (a *Alerts) setSubscription(c *gin.Context) {
+	decoder := json.NewDecoder(c.Request.Body)
+	defer c.Request.Body.Close()
+	var post PostSubscription
+	if err := decoder.Decode(&post); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Wrong subscription"})
+		return
+	}
+	if msg := validateSubscription(&post); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+	login := c.GetString(loginKey)
+	subscription, err := a.ms.GetSubscription(login)
+	if err == service.ErrNotFound {
+		subscription = &model.Subscription{Login: login}
+	} else if err != nil {
+		internalError(c, "database error", "subscription err "+err.Error())
+		return
+	}
+	if subscription.Digest != post.Digest {
+		subscription.DigestDate = time.Time{}
+	}
+	subscription.Email, subscription.Alerts = post.Email, post.Alerts
+	subscription.Digest = post.Digest
+	if err = a.ms.SetSubscription(subscription); err != nil {
+		internalError(c, "database error", "subscription err "+err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, subscription)
+}
+
+// validateSubscription returns description of what is wrong with
+// subscription
+func validateSubscription(post *PostSubscription) string {
+	if post.Email != "" {
+		if address, err := mail.ParseAddress(post.Email); err != nil ||
+			address.Address != post.Email {
+			return "Wrong email"
+		}
+	} else if post.Alerts || post.Digest != "" {
+		return "Email is missing"
+	}
+	if post.Digest != "" && post.Digest != model.DigestHourly &&
+		post.Digest != model.DigestDaily {
+		return "Digest must be hourly or daily"
+	}
+	return ""
+}
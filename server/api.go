@@ -1,81 +1,619 @@
 package server
 
 import (
+	"crypto/x509"
 	"encoding/json"
+	"io"
 	"iot-stats/model"
 	"iot-stats/service"
 	"iot-stats/utils"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-const ApiKey = "Api-Key"
+const (
+	ApiKey       = "Api-Key"
+	DeviceNumber = "Device-Number"
+	DeviceSecret = "Device-Secret"
+)
+
+// Context keys of authenticated device number and flag telling that
+// device was authenticated by client certificate
+const (
+	deviceKey = "device-number"
+	certKey   = "device-cert"
+)
+
+const secretLength = 32
 
 type Api struct {
-	apiKey string
+	config *Config
 	ms     service.MongoInterface
 }
 
-func newApi(apiKey string, ms service.MongoInterface) *Api {
-	return &Api{apiKey: apiKey, ms: ms}
+func newApi(config *Config, ms service.MongoInterface) *Api {
+	return &Api{config: config, ms: ms}
 }
 
 type PostDevice struct {
 	DeviceNumber string `json:"device-number"`
 }
 
+// deviceCreds are credentials device presents, http requests carry them
+// in headers and other transports in their messages. certNumber is number
+// of device which presented verified client certificate
+type deviceCreds struct {
+	apiKey     string
+	number     string
+	secret     string
+	certNumber string
+}
+
+// deviceAuth tells who sent device request. Number is empty when device
+// did not tell it, cert is set for device authenticated by client
+// certificate and secret is credential device presented
+type deviceAuth struct {
+	number string
+	cert   bool
+	secret string
+}
+
+// reply answers device request, transports other than http tell outcome
+// by http status too
+type reply struct {
+	status int
+	body   gin.H
+}
+
+// deviceHandler handles JSON body device sent, every transport answers
+// device with reply it returns
+type deviceHandler func(auth *deviceAuth, body io.Reader) *reply
+
+// registerResource is resource devices register at, registration checks
+// device credential itself
+const registerResource = "register"
+
+// deviceResources maps resources devices post JSON to over transports
+// other than http to their handlers, names are paths of api group
+func deviceResources(api *Api, telemetry *Telemetry) map[string]deviceHandler {
+	return map[string]deviceHandler{
+		registerResource: api.postRegister,
+		"error":          api.postError,
+		"errors":         api.postErrors,
+		"update":         api.postUpdate,
+		"heartbeat":      api.postHeartbeat,
+		"telemetry":      telemetry.postTelemetry,
+	}
+}
+
+func answer(body gin.H) *reply {
+	return &reply{status: http.StatusOK, body: body}
+}
+
+func rejection(status int, msg string) *reply {
+	return &reply{status: status, body: gin.H{"error": msg}}
+}
+
+// denied logs why device was denied access
+func denied(msg string) *reply {
+	if msg != "" {
+		utils.Log().Infoln(msg)
+	}
+	return rejection(http.StatusUnauthorized, "Access denied")
+}
+
+// failure logs internal error, device gets msgToSend only
+func failure(msgToSend, msgToLog string) *reply {
+	utils.Log().Infoln(msgToLog)
+	return rejection(http.StatusInternalServerError, msgToSend)
+}
+
+// send answers http request with reply
+func send(c *gin.Context, r *reply) {
+	c.JSON(r.status, r.body)
+}
+
+// abort answers http request with reply and skips its other handlers
+func abort(c *gin.Context, r *reply) {
+	c.AbortWithStatusJSON(r.status, r.body)
+}
+
+// httpCreds takes device credentials from request headers and client
+// certificate
+func httpCreds(c *gin.Context) *deviceCreds {
+	return &deviceCreds{
+		apiKey:     c.Request.Header.Get(ApiKey),
+		number:     c.Request.Header.Get(DeviceNumber),
+		secret:     c.Request.Header.Get(DeviceSecret),
+		certNumber: certDevice(c),
+	}
+}
+
+// contextAuth returns device authenticated by middleware
+func contextAuth(c *gin.Context) *deviceAuth {
+	return &deviceAuth{
+		number: c.GetString(deviceKey),
+		cert:   c.GetBool(certKey),
+		secret: c.Request.Header.Get(DeviceSecret),
+	}
+}
+
 // Checking api key in request
 func (a *Api) checkApiKey(c *gin.Context) {
-	ak := c.Request.Header.Get(ApiKey)
-	if ak == "" {
-		pleaseAuth(c, "No api key")
-	} else if ak != a.apiKey {
-		pleaseAuth(c, "Wrong api key")
+	auth, r := a.authenticate(httpCreds(c))
+	if r != nil {
+		abort(c, r)
+		return
+	}
+	if auth.cert {
+		c.Set(deviceKey, auth.number)
+		c.Set(certKey, true)
 	}
 	c.Writer.Header().Add("Content-Type", "application/json")
 	c.Next()
 }
 
+// authenticate checks api key of device. Device which presented verified
+// client certificate is authenticated by it and does not need api key
+func (a *Api) authenticate(cr *deviceCreds) (*deviceAuth, *reply) {
+	auth := &deviceAuth{secret: cr.secret}
+	if cr.certNumber != "" {
+		auth.number, auth.cert = cr.certNumber, true
+	} else if a.config.RequireClientCert {
+		return nil, denied("No client certificate")
+	} else if cr.apiKey == "" {
+		return nil, denied("No api key")
+	} else if cr.apiKey != a.config.ApiKey {
+		return nil, denied("Wrong api key")
+	}
+	return auth, nil
+}
+
+// certDevice returns device number from verified client certificate
+func certDevice(c *gin.Context) string {
+	state := c.Request.TLS
+	if state == nil || len(state.VerifiedChains) == 0 ||
+		len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return certificateNumber(state.VerifiedChains[0][0])
+}
+
+// certificateNumber returns device number certificate was issued for,
+// common name is used or first DNS name when common name is empty
+func certificateNumber(cert *x509.Certificate) string {
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return ""
+}
+
+// Checking device credential in request
+func (a *Api) checkDeviceSecret(c *gin.Context) {
+	auth := contextAuth(c)
+	if r := a.checkSecret(auth, c.Request.Header.Get(DeviceNumber)); r != nil {
+		abort(c, r)
+		return
+	}
+	if auth.number != "" {
+		c.Set(deviceKey, auth.number)
+	}
+	c.Next()
+}
+
+// checkSecret checks credential issued at registration of device with
+// number, number of device which passes is set in auth. Devices which
+// have not got credential yet pass unless secret is required in config
+func (a *Api) checkSecret(auth *deviceAuth, number string) *reply {
+	if auth.cert {
+		return a.revoked(auth.number)
+	}
+	if number == "" {
+		if a.config.RequireDeviceSecret {
+			return denied("No device number")
+		}
+		return nil
+	}
+	device, err := a.ms.GetDeviceByNumber(number)
+	if err == service.ErrNotFound {
+		return denied("Unknown device " + number)
+	} else if err != nil {
+		return failure("database error", "database error "+err.Error())
+	}
+	return a.checkDevice(auth, device)
+}
+
+// checkDevice checks secret presented in auth against credential of
+// device, number of device is set in auth when it passes
+func (a *Api) checkDevice(auth *deviceAuth, device *model.Device) *reply {
+	if device.SecretHash != "" || device.SecretRevoked || a.config.RequireDeviceSecret {
+		if auth.secret == "" {
+			return denied("No device secret")
+		} else if device.SecretHash == "" || !utils.CheckHash(auth.secret, device.SecretHash) {
+			return denied("Wrong device secret " + device.DeviceNumber)
+		}
+	}
+	auth.number = device.DeviceNumber
+	return nil
+}
+
+// deviceAllowed checks that device acts on its own behalf
+func (a *Api) deviceAllowed(c *gin.Context, deviceNumber string) bool {
+	if r := a.allowed(contextAuth(c), deviceNumber); r != nil {
+		abort(c, r)
+		return false
+	}
+	return true
+}
+
+// allowed checks that device acts on its own behalf. Request which did not
+// tell device number in credentials is checked against device it acts
+// for, so device which has secret can't be reported for without it.
+// Unknown device is left to handler
+func (a *Api) allowed(auth *deviceAuth, deviceNumber string) *reply {
+	if auth.number == "" {
+		device, err := a.ms.GetDeviceByNumber(deviceNumber)
+		if err == service.ErrNotFound {
+			return nil
+		} else if err != nil {
+			return failure("database error", "database error "+err.Error())
+		}
+		return a.checkDevice(auth, device)
+	}
+	if auth.number != deviceNumber {
+		utils.Log().Infoln("device", auth.number, "acts as", deviceNumber)
+		return rejection(http.StatusForbidden, "Wrong device number")
+	}
+	return nil
+}
+
 // Report about error in iot device
 func (a *Api) errorReport(c *gin.Context) {
-	decoder := json.NewDecoder(c.Request.Body)
 	defer c.Request.Body.Close()
+	send(c, a.postError(contextAuth(c), c.Request.Body))
+}
+
+func (a *Api) postError(auth *deviceAuth, body io.Reader) *reply {
 	de := &model.DeviceErrorDto{}
-	err := decoder.Decode(&de)
-	if err != nil {
-		internalError(c, "marshalling error",
-			"marshalling error "+err.Error())
+	if err := json.NewDecoder(body).Decode(de); err != nil {
+		return failure("marshalling error", "marshalling error "+err.Error())
+	}
+	return a.reportError(auth, de)
+}
+
+func (a *Api) reportError(auth *deviceAuth, de *model.DeviceErrorDto) *reply {
+	if msg := validateError(de, time.Now()); msg != "" {
+		return rejection(http.StatusBadRequest, msg)
+	}
+	if r := a.allowed(auth, de.DeviceNumber); r != nil {
+		return r
 	}
-	if err = a.ms.RegisterError(de); err != nil {
-		internalError(c, "database error",
-			"database error "+err.Error())
+	id, err := a.ms.RegisterError(de)
+	if err == service.ErrNotFound {
+		return rejection(http.StatusNotFound, "Device not found")
+	} else if err != nil {
+		return failure("database error", "database error "+err.Error())
 	}
-	c.JSON(http.StatusOK, gin.H{"message": "Error registered"})
+	if id == "" {
+		return answer(gin.H{"message": "Error registered"})
+	}
+	return answer(gin.H{"message": "Error registered", "id": id})
+}
+
+// maxBatchErrors limits size of error batch
+const maxBatchErrors = 100
+
+// Statuses of single report of error batch
+const (
+	batchRegistered = "registered"
+	batchRejected   = "rejected"
+)
+
+// BatchResult tells what happened to report of error batch, index is its
+// position in batch. Id of error is set when error is stored
+type BatchResult struct {
+	Index  int    `json:"index"`
+	Status string `json:"status"`
+	ID     string `json:"id,omitempty"`
+	Error  string `json:"error,omitempty"`
 }
 
-// Registering device at server
+// Batch of errors iot device buffered while offline. Reports are validated
+// one by one, wrong ones are rejected with reason and the rest are stored
+// together
+func (a *Api) errorBatch(c *gin.Context) {
+	defer c.Request.Body.Close()
+	send(c, a.postErrors(contextAuth(c), c.Request.Body))
+}
+
+func (a *Api) postErrors(auth *deviceAuth, body io.Reader) *reply {
+	batch := &model.ErrorBatchDto{}
+	if err := json.NewDecoder(body).Decode(batch); err != nil {
+		return rejection(http.StatusBadRequest, "Wrong error batch")
+	}
+	return a.reportErrors(auth, batch)
+}
+
+func (a *Api) reportErrors(auth *deviceAuth, batch *model.ErrorBatchDto) *reply {
+	if len(batch.Errors) == 0 || len(batch.Errors) > maxBatchErrors {
+		return rejection(http.StatusBadRequest, "Batch must have 1 to 100 errors")
+	}
+	if r := a.allowed(auth, batch.DeviceNumber); r != nil {
+		return r
+	}
+	now := time.Now()
+	results := make([]BatchResult, len(batch.Errors))
+	valid := make([]model.DeviceErrorDto, 0, len(batch.Errors))
+	indexes := make([]int, 0, len(batch.Errors))
+	for i := range batch.Errors {
+		de := &batch.Errors[i]
+		results[i] = BatchResult{Index: i, Status: batchRegistered}
+		msg := validateError(de, now)
+		if msg == "" && de.DeviceNumber != "" && de.DeviceNumber != batch.DeviceNumber {
+			msg = "Wrong device number"
+		}
+		if msg != "" {
+			results[i].Status, results[i].Error = batchRejected, msg
+			continue
+		}
+		de.DeviceNumber = batch.DeviceNumber
+		valid = append(valid, *de)
+		indexes = append(indexes, i)
+	}
+	if len(valid) > 0 {
+		ids, err := a.ms.RegisterErrors(batch.DeviceNumber, valid)
+		if err == service.ErrNotFound {
+			return rejection(http.StatusNotFound, "Device not found")
+		} else if err != nil {
+			return failure("database error", "database error "+err.Error())
+		}
+		for j, i := range indexes {
+			results[i].ID = ids[j]
+		}
+	}
+	return answer(gin.H{"message": "Errors registered",
+		"registered": len(valid), "rejected": len(batch.Errors) - len(valid),
+		"results": results})
+}
+
+// Limits of error report fields, context is limited by size of its JSON
+const (
+	maxErrorName   = 128
+	maxFingerprint = 128
+	maxVersion     = 64
+	maxContextSize = 4096
+	// maxClockSkew is how far in future device timestamp may be
+	maxClockSkew = time.Hour
+)
+
+var severities = map[string]bool{
+	model.SeverityInfo:     true,
+	model.SeverityWarning:  true,
+	model.SeverityError:    true,
+	model.SeverityCritical: true,
+}
+
+// validateError returns description of what is wrong with error report,
+// report without severity gets error severity
+func validateError(de *model.DeviceErrorDto, now time.Time) string {
+	if de.ErrorName == "" || len(de.ErrorName) > maxErrorName {
+		return "Error name must have 1 to 128 characters"
+	}
+	if len(de.Fingerprint) > maxFingerprint {
+		return "Fingerprint is too long"
+	}
+	if de.Severity == "" {
+		de.Severity = model.SeverityError
+	} else if !severities[de.Severity] {
+		return "Wrong severity"
+	}
+	if de.Code < 0 {
+		return "Error code must not be negative"
+	}
+	if de.Timestamp != nil && de.Timestamp.After(now.Add(maxClockSkew)) {
+		return "Timestamp is in future"
+	}
+	if len(de.FirmwareVersion) > maxVersion {
+		return "Firmware version is too long"
+	}
+	if de.Context != nil {
+		data, err := json.Marshal(de.Context)
+		if err != nil || len(data) > maxContextSize {
+			return "Context is too big"
+		}
+		if !contextKeysAllowed(de.Context) {
+			return "Context keys must not start with $ or contain dots"
+		}
+	}
+	return ""
+}
+
+// contextKeysAllowed checks that keys of context can be stored in
+// MongoDB document
+func contextKeysAllowed(value interface{}) bool {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			if strings.HasPrefix(key, "$") || strings.Contains(key, ".") ||
+				!contextKeysAllowed(item) {
+				return false
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if !contextKeysAllowed(item) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+var updateStates = map[string]bool{
+	model.UpdateDownloading: true,
+	model.UpdateVerifying:   true,
+	model.UpdateInstalling:  true,
+	model.UpdateSucceeded:   true,
+	model.UpdateFailed:      true,
+}
+
+// Report about firmware update progress in iot device
+func (a *Api) updateStatus(c *gin.Context) {
+	defer c.Request.Body.Close()
+	send(c, a.postUpdate(contextAuth(c), c.Request.Body))
+}
+
+func (a *Api) postUpdate(auth *deviceAuth, body io.Reader) *reply {
+	us := &model.UpdateStatusDto{}
+	if err := json.NewDecoder(body).Decode(us); err != nil {
+		return rejection(http.StatusBadRequest, "Wrong update status")
+	}
+	return a.reportUpdate(auth, us)
+}
+
+func (a *Api) reportUpdate(auth *deviceAuth, us *model.UpdateStatusDto) *reply {
+	if !updateStates[us.State] {
+		return rejection(http.StatusBadRequest, "Wrong update state")
+	}
+	if us.State == model.UpdateFailed && us.Reason == "" {
+		return rejection(http.StatusBadRequest, "No failure reason")
+	}
+	if r := a.allowed(auth, us.DeviceNumber); r != nil {
+		return r
+	}
+	err := a.ms.RegisterUpdate(us)
+	if err == service.ErrNotFound {
+		return rejection(http.StatusNotFound, "Device not found")
+	} else if err != nil {
+		return failure("database error", "database error "+err.Error())
+	}
+	return answer(gin.H{"message": "Update status registered"})
+}
+
+// Heartbeat of iot device, device is online while it sends them
+func (a *Api) heartbeat(c *gin.Context) {
+	defer c.Request.Body.Close()
+	send(c, a.postHeartbeat(contextAuth(c), c.Request.Body))
+}
+
+func (a *Api) postHeartbeat(auth *deviceAuth, body io.Reader) *reply {
+	hb := &model.HeartbeatDto{}
+	if err := json.NewDecoder(body).Decode(hb); err != nil {
+		return rejection(http.StatusBadRequest, "Wrong heartbeat")
+	}
+	return a.reportHeartbeat(auth, hb)
+}
+
+func (a *Api) reportHeartbeat(auth *deviceAuth, hb *model.HeartbeatDto) *reply {
+	if hb.Uptime < 0 {
+		return rejection(http.StatusBadRequest, "Wrong uptime")
+	}
+	if r := a.allowed(auth, hb.DeviceNumber); r != nil {
+		return r
+	}
+	err := a.ms.RegisterHeartbeat(hb.DeviceNumber, hb.Uptime, time.Now())
+	if err == service.ErrNotFound {
+		return rejection(http.StatusNotFound, "Device not found")
+	} else if err != nil {
+		return failure("database error", "database error "+err.Error())
+	}
+	return answer(gin.H{"message": "Heartbeat registered"})
+}
+
+// Registering device at server. New device and device which has no
+// credential yet receive secret to be sent in Device-Secret header
 func (a *Api) registerDevice(c *gin.Context) {
-	decoder := json.NewDecoder(c.Request.Body)
 	defer c.Request.Body.Close()
+	send(c, a.postRegister(contextAuth(c), c.Request.Body))
+}
+
+func (a *Api) postRegister(auth *deviceAuth, body io.Reader) *reply {
 	var postDevice PostDevice
-	err := decoder.Decode(&postDevice)
+	if err := json.NewDecoder(body).Decode(&postDevice); err != nil {
+		return failure("marshalling error", "marshalling error"+err.Error())
+	}
+	return a.register(auth, postDevice.DeviceNumber)
+}
+
+func (a *Api) register(auth *deviceAuth, deviceNumber string) *reply {
+	if deviceNumber == "" {
+		return rejection(http.StatusBadRequest, "No device number")
+	}
+	if auth.cert {
+		return a.registerCertDevice(auth, deviceNumber)
+	}
+	device, err := a.ms.GetDeviceByNumber(deviceNumber)
+	if err != nil && err != service.ErrNotFound {
+		return failure("database error", "database error "+err.Error())
+	}
+	if device != nil && device.SecretRevoked {
+		return denied("Revoked device registers " + device.DeviceNumber)
+	}
+	if device != nil && device.SecretHash != "" &&
+		!utils.CheckHash(auth.secret, device.SecretHash) {
+		return denied("Wrong device secret " + device.DeviceNumber)
+	}
+	if err = a.ms.RegisterDevice(deviceNumber, time.Now()); err != nil {
+		return failure("register err", "register err"+err.Error())
+	}
+	if device != nil && device.SecretHash != "" {
+		return answer(gin.H{"message": "Device registered"})
+	}
+	secret, err := issueSecret(a.ms, deviceNumber)
 	if err != nil {
-		internalError(c, "marshalling error",
-			"marshalling error"+err.Error())
+		return failure("register err", "register err "+err.Error())
+	}
+	return answer(gin.H{"message": "Device registered", "secret": secret})
+}
+
+// registerCertDevice registers device authenticated by client
+// certificate, such device does not need secret
+func (a *Api) registerCertDevice(auth *deviceAuth, deviceNumber string) *reply {
+	if r := a.allowed(auth, deviceNumber); r != nil {
+		return r
+	}
+	if r := a.revoked(deviceNumber); r != nil {
+		return r
 	}
-	if err = a.ms.RegisterDevice(postDevice.DeviceNumber, time.Now()); err != nil {
-		internalError(c, "register err",
-			"register err"+err.Error())
+	if err := a.ms.RegisterDevice(deviceNumber, time.Now()); err != nil {
+		return failure("register err", "register err "+err.Error())
 	}
-	c.JSON(http.StatusOK, gin.H{"message": "Device registered"})
+	return answer(gin.H{"message": "Device registered"})
 }
 
-func pleaseAuth(c *gin.Context, msg string) {
-	if msg != "" {
-		utils.Log().Infoln(msg)
+// revoked rejects request of certificate holder whose access was
+// revoked by administrator
+func (a *Api) revoked(deviceNumber string) *reply {
+	device, err := a.ms.GetDeviceByNumber(deviceNumber)
+	if err == service.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return failure("database error", "database error "+err.Error())
+	}
+	if device.SecretRevoked {
+		return denied("Revoked device " + deviceNumber)
+	}
+	return nil
+}
+
+// issueSecret generates new device credential and stores its hash
+func issueSecret(ms service.MongoInterface, deviceNumber string) (string, error) {
+	secret, err := utils.GenerateSecret(secretLength)
+	if err != nil {
+		return "", err
+	}
+	if err = ms.SetDeviceSecret(deviceNumber, utils.GenerateHash(secret)); err != nil {
+		return "", err
 	}
-	c.JSON(http.StatusUnauthorized, gin.H{"error": "Access denied"})
-	c.Abort()
+	return secret, nil
+}
+
+func pleaseAuth(c *gin.Context, msg string) {
+	abort(c, denied(msg))
 }
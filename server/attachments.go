@@ -0,0 +1,157 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"iot-stats/model"
+	"iot-stats/service"
+	"iot-stats/utils"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// maxAttachments limits how many attachments single error has
+const maxAttachments = 5
+
+// multipartOverhead is room for form headers and boundaries of multipart
+// upload above maximal attachment size
+const multipartOverhead = 64 << 10
+
+// Attachments keeps core dumps and log excerpts devices upload for their
+// errors, metadata is kept in storage and content in blob store
+type Attachments struct {
+	maxSize int64
+	api     *Api
+	ms      service.MongoInterface
+	blobs   service.BlobStore
+}
+
+func newAttachments(maxSize int64, api *Api, ms service.MongoInterface,
+	blobs service.BlobStore) *Attachments {
+	return &Attachments{maxSize: maxSize, api: api, ms: ms, blobs: blobs}
+}
+
+// Upload attachment of error reported by device. Content is sent as
+// "file" of multipart form or as raw body, which may be chunked, with file
+// name in name query parameter
+func (a *Attachments) upload(c *gin.Context) {
+	de, err := a.ms.GetDeviceError(c.Param("id"))
+	if err == service.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Error not found"})
+		return
+	} else if err != nil {
+		internalError(c, "database error", "attachment err "+err.Error())
+		return
+	}
+	if !a.api.deviceAllowed(c, de.DeviceNumber) {
+		return
+	}
+	attachments, err := a.ms.GetAttachments(de.ID.Hex())
+	if err != nil {
+		internalError(c, "database error", "attachment err "+err.Error())
+		return
+	}
+	if len(*attachments) >= maxAttachments {
+		c.JSON(http.StatusConflict, gin.H{"error": "Error has too many attachments"})
+		return
+	}
+	body := io.Reader(c.Request.Body)
+	name, contentType := c.Query("name"), c.ContentType()
+	if strings.HasPrefix(contentType, "multipart/") {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body,
+			a.maxSize+multipartOverhead)
+		file, header, err := c.Request.FormFile("file")
+		if err != nil {
+			utils.Log().Infoln("attachment upload err", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "No attachment file"})
+			return
+		}
+		defer file.Close()
+		body, name = file, header.Filename
+		contentType = header.Header.Get("Content-Type")
+	}
+	if name = filepath.Base(name); name == "." || name == string(filepath.Separator) {
+		name = "attachment"
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	attachment := &model.Attachment{
+		ID:           bson.NewObjectId(),
+		ErrorId:      de.ID,
+		DeviceNumber: de.DeviceNumber,
+		Name:         name,
+		ContentType:  contentType,
+		Date:         time.Now(),
+	}
+	hash := sha256.New()
+	// One byte over limit tells that attachment is too big
+	content := io.TeeReader(io.LimitReader(body, a.maxSize+1), hash)
+	attachment.Size, err = a.blobs.PutBlob(attachment.ID.Hex(), content)
+	if err != nil {
+		internalError(c, "storage error", "attachment err "+err.Error())
+		return
+	}
+	if attachment.Size == 0 || attachment.Size > a.maxSize {
+		a.blobs.DeleteBlob(attachment.ID.Hex())
+		if attachment.Size == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Attachment is empty"})
+		} else {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Attachment is too big"})
+		}
+		return
+	}
+	attachment.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	if err = a.ms.AddAttachment(attachment); err != nil {
+		a.blobs.DeleteBlob(attachment.ID.Hex())
+		internalError(c, "database error", "attachment err "+err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, attachment)
+}
+
+// Get attachments of error
+func (a *Attachments) list(c *gin.Context) {
+	attachments, err := a.ms.GetAttachments(c.Param("id"))
+	if err != nil {
+		internalError(c, "database error", "attachment err "+err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, attachments)
+}
+
+// Download attachment as file, Range requests are supported
+func (a *Attachments) download(c *gin.Context) {
+	attachment, err := a.ms.GetAttachment(c.Param("id"))
+	if err == service.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+		return
+	} else if err != nil {
+		internalError(c, "database error", "attachment err "+err.Error())
+		return
+	}
+	blob, err := a.blobs.OpenBlob(attachment.ID.Hex())
+	if err == service.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+		return
+	} else if err != nil {
+		internalError(c, "storage error", "attachment err "+err.Error())
+		return
+	}
+	defer blob.Close()
+	// Contents come from device, so browser must not render them whatever
+	// type device sent
+	c.Header("Content-Type", "application/octet-stream")
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment",
+		map[string]string{"filename": attachment.Name}))
+	c.Header("ETag", `"`+attachment.SHA256+`"`)
+	http.ServeContent(c.Writer, c.Request, attachment.Name, attachment.Date, blob)
+}
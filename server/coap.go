@@ -0,0 +1,421 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"iot-stats/coap"
+	"iot-stats/service"
+	"iot-stats/utils"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pion/dtls/v2"
+)
+
+// Paths of CoAP resources which are not JSON resources of api group
+const (
+	coapPrefix         = "api/"
+	coapFirmware       = "api/firmware"
+	coapFirmwareLatest = "api/firmware/latest"
+)
+
+const (
+	// exchangeLifetime is how long answer to confirmable request is kept
+	// to answer its retransmissions, EXCHANGE_LIFETIME of RFC 7252
+	exchangeLifetime = 247 * time.Second
+	// maxDatagram is the biggest request read
+	maxDatagram = 64 << 10
+	// etagSize is how many bytes of image digest make firmware ETag
+	etagSize = 8
+	// handshakeTimeout limits DTLS handshake
+	handshakeTimeout = 10 * time.Second
+)
+
+// coapOptions are critical options requests may carry, request with other
+// critical option is rejected
+var coapOptions = map[uint16]bool{
+	coap.URIHost:  true,
+	coap.URIPort:  true,
+	coap.URIPath:  true,
+	coap.URIQuery: true,
+	coap.Accept:   true,
+	coap.Block2:   true,
+}
+
+// CoAP takes device requests over UDP, optionally secured by DTLS. POST to
+// api/register, api/error, api/errors, api/update, api/heartbeat and
+// api/telemetry takes the same JSON body as api group, GET api/firmware
+// sends image in Block2 blocks and GET api/firmware/latest describes it.
+// Credentials http requests carry in headers are api-key, device-number
+// and device-secret query parameters, device which presented verified
+// client certificate over DTLS does not need them
+type CoAP struct {
+	config    *Config
+	api       *Api
+	firmware  *Firmware
+	resources map[string]deviceHandler
+	// cert is server certificate, DTLS is off without it
+	cert      *tls.Certificate
+	messageID uint32
+	// answers keeps answers to confirmable requests by sender and message
+	// id, nil answer tells that request is being served
+	mu        sync.Mutex
+	answers   map[string]*exchange
+	sweepDate time.Time
+	listener  io.Closer
+	done      chan struct{}
+}
+
+type exchange struct {
+	data []byte
+	date time.Time
+}
+
+func newCoAP(config *Config, api *Api, telemetry *Telemetry, firmware *Firmware,
+	cert *tls.Certificate) *CoAP {
+	return &CoAP{
+		config:    config,
+		api:       api,
+		firmware:  firmware,
+		resources: deviceResources(api, telemetry),
+		cert:      cert,
+		answers:   make(map[string]*exchange),
+		done:      make(chan struct{}),
+	}
+}
+
+// listen starts serving requests on UDP port from config
+func (s *CoAP) listen() error {
+	addr := net.JoinHostPort(s.config.Host, s.config.CoAPPort)
+	if s.cert == nil {
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return err
+		}
+		s.listener = conn
+		go s.servePackets(conn)
+		return nil
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	config := &dtls.Config{
+		Certificates:         []tls.Certificate{*s.cert},
+		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+		ConnectContextMaker: func() (context.Context, func()) {
+			return context.WithTimeout(context.Background(), handshakeTimeout)
+		},
+	}
+	if s.config.ClientCA != "" {
+		tlsConfig, err := clientAuthConfig(s.config.ClientCA)
+		if err != nil {
+			return err
+		}
+		config.ClientCAs = tlsConfig.ClientCAs
+		config.ClientAuth = dtls.VerifyClientCertIfGiven
+	}
+	l, err := dtls.Listen("udp", udpAddr, config)
+	if err != nil {
+		return err
+	}
+	s.listener = l
+	go s.serveDTLS(l)
+	return nil
+}
+
+func (s *CoAP) close() error {
+	close(s.done)
+	return s.listener.Close()
+}
+
+func (s *CoAP) servePackets(conn net.PacketConn) {
+	for {
+		buf := make([]byte, maxDatagram)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		go func() {
+			if answer := s.handle(addr.String(), buf[:n], ""); answer != nil {
+				conn.WriteTo(answer, addr)
+			}
+		}()
+	}
+}
+
+// serveDTLS accepts DTLS sessions until listener is closed, handshake
+// which fails does not stop it
+func (s *CoAP) serveDTLS(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			utils.Log().Infoln("coap handshake err", err)
+			continue
+		}
+		go s.serveSession(conn.(*dtls.Conn))
+	}
+}
+
+// serveSession answers requests of DTLS session, session which is idle
+// longer than exchange lifetime is closed
+func (s *CoAP) serveSession(conn *dtls.Conn) {
+	defer conn.Close()
+	certNumber := ""
+	if certs := conn.ConnectionState().PeerCertificates; len(certs) > 0 {
+		// Certificate was verified by handshake when client CA is set
+		if cert, err := x509.ParseCertificate(certs[0]); err == nil &&
+			s.config.ClientCA != "" {
+			certNumber = certificateNumber(cert)
+		}
+	}
+	from := conn.RemoteAddr().String()
+	buf := make([]byte, maxDatagram)
+	for {
+		conn.SetReadDeadline(time.Now().Add(exchangeLifetime))
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		if answer := s.handle(from, buf[:n], certNumber); answer != nil {
+			conn.Write(answer)
+		}
+	}
+}
+
+// handle answers datagram from sender, nothing is returned for messages
+// which are not requests. certNumber is device number from verified
+// client certificate
+func (s *CoAP) handle(from string, data []byte, certNumber string) []byte {
+	req, err := coap.Unmarshal(data)
+	if err != nil || req.Type == coap.Acknowledgement || req.Type == coap.Reset ||
+		req.Code.Class() != 0 {
+		return nil
+	}
+	if req.Code == coap.Empty {
+		// Empty confirmable message is ping answered with reset
+		if req.Type != coap.Confirmable {
+			return nil
+		}
+		data, _ := (&coap.Message{Type: coap.Reset, MessageID: req.MessageID}).Marshal()
+		return data
+	}
+	key := from + "/" + strconv.Itoa(int(req.MessageID))
+	if req.Type == coap.Confirmable {
+		if answer, seen := s.answered(key); seen {
+			return answer
+		}
+	}
+	resp := s.serve(req, certNumber)
+	resp.Token = req.Token
+	if req.Type == coap.Confirmable {
+		resp.Type, resp.MessageID = coap.Acknowledgement, req.MessageID
+	} else {
+		resp.Type = coap.NonConfirmable
+		resp.MessageID = uint16(atomic.AddUint32(&s.messageID, 1))
+	}
+	answer, err := resp.Marshal()
+	if err != nil {
+		utils.Log().Infoln("coap answer err", err)
+		answer = nil
+	}
+	if req.Type == coap.Confirmable {
+		s.remember(key, answer)
+	}
+	return answer
+}
+
+// answered returns answer to request which was seen before, answer is nil
+// while request is being served
+func (s *CoAP) answered(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if now.Sub(s.sweepDate) > exchangeLifetime {
+		for k, e := range s.answers {
+			if now.Sub(e.date) > exchangeLifetime {
+				delete(s.answers, k)
+			}
+		}
+		s.sweepDate = now
+	}
+	if e, ok := s.answers[key]; ok && now.Sub(e.date) <= exchangeLifetime {
+		return e.data, true
+	}
+	s.answers[key] = &exchange{date: now}
+	return nil, false
+}
+
+func (s *CoAP) remember(key string, answer []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.answers[key] = &exchange{data: answer, date: time.Now()}
+}
+
+// serve authenticates device like api middleware does and passes request
+// to resource
+func (s *CoAP) serve(req *coap.Message, certNumber string) *coap.Message {
+	for _, o := range req.Options {
+		if o.Number == coap.Block1 {
+			return coapReject(rejection(http.StatusRequestEntityTooLarge,
+				"Body must fit one message"))
+		}
+		if coap.Critical(o.Number) && !coapOptions[o.Number] {
+			return coapJSON(coap.BadOption, gin.H{"error": "Unknown option " +
+				strconv.Itoa(int(o.Number))})
+		}
+	}
+	path := req.Path()
+	handler, ok := s.resources[strings.TrimPrefix(path, coapPrefix)]
+	ok = ok && strings.HasPrefix(path, coapPrefix)
+	if !ok && path != coapFirmware && path != coapFirmwareLatest {
+		return coapReject(rejection(http.StatusNotFound, "Unknown resource"))
+	}
+	if (ok && req.Code != coap.POST) || (!ok && req.Code != coap.GET) {
+		return coapReject(rejection(http.StatusMethodNotAllowed, "Method not allowed"))
+	}
+	number := req.Query("device-number")
+	cr := &deviceCreds{
+		apiKey:     req.Query("api-key"),
+		number:     number,
+		secret:     req.Query("device-secret"),
+		certNumber: certNumber,
+	}
+	// Credentials sent over plain UDP can be read by anyone on the way
+	if s.cert == nil && !s.config.CoAPInsecure && (cr.apiKey != "" || cr.secret != "") {
+		return coapReject(rejection(http.StatusForbidden, "Credentials need DTLS"))
+	}
+	auth, r := s.api.authenticate(cr)
+	if r != nil {
+		return coapReject(r)
+	}
+	if path == coapPrefix+registerResource {
+		return coapAnswer(handler(auth, bytes.NewReader(req.Payload)), coap.Changed)
+	}
+	if r = s.api.checkSecret(auth, number); r != nil {
+		return coapReject(r)
+	}
+	switch path {
+	case coapFirmware:
+		return s.sendFirmware(req, auth)
+	case coapFirmwareLatest:
+		return s.latestFirmware(req, auth)
+	}
+	return coapAnswer(handler(auth, bytes.NewReader(req.Payload)), coap.Changed)
+}
+
+// coapAnswer turns reply into response with JSON payload, success is
+// answered with code passed
+func coapAnswer(r *reply, success coap.Code) *coap.Message {
+	if r.status >= http.StatusMultipleChoices {
+		return coapReject(r)
+	}
+	return coapJSON(success, r.body)
+}
+
+// coapReject answers request with error of reply, code is made of http
+// status like 4.04 of 404
+func coapReject(r *reply) *coap.Message {
+	return coapJSON(coap.Code(r.status/100<<5|r.status%100), r.body)
+}
+
+func coapJSON(code coap.Code, v interface{}) *coap.Message {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		utils.Log().Infoln("coap answer err", err)
+		return &coap.Message{Code: coap.InternalServerError}
+	}
+	resp := &coap.Message{Code: code, Payload: payload}
+	resp.AddUint(coap.ContentFormat, coap.JSON)
+	return resp
+}
+
+// queryChannel returns channel from query, default channel when there is
+// none
+func queryChannel(req *coap.Message) string {
+	if channel := req.Query("channel"); channel != "" {
+		return channel
+	}
+	return defaultChannel
+}
+
+// Describe firmware device should run
+func (s *CoAP) latestFirmware(req *coap.Message, auth *deviceAuth) *coap.Message {
+	fw, _, err := s.firmware.find(auth.number, req.Query("model"), queryChannel(req))
+	if err == service.ErrNotFound {
+		return coapReject(rejection(http.StatusNotFound, "Firmware not found"))
+	} else if err != nil {
+		return coapReject(failure("database error", "firmware err "+err.Error()))
+	}
+	return coapJSON(coap.Content, fw)
+}
+
+// Send block of firmware image device asked for by Block2 option, the
+// first block is sent without it. Every block has ETag made of image
+// digest and the first one has Size2 of image. Download of device is
+// recorded when its last block is sent
+func (s *CoAP) sendFirmware(req *coap.Message, auth *deviceAuth) *coap.Message {
+	block := coap.Block{Size: coap.MaxBlockSize}
+	if req.HasOption(coap.Block2) {
+		b, err := coap.ParseBlock(req.Option(coap.Block2))
+		if err != nil {
+			return coapReject(rejection(http.StatusBadRequest, "Wrong block"))
+		}
+		block = b
+	}
+	fw, file, err := s.firmware.openImage(auth.number, req.Query("model"),
+		queryChannel(req), block.Num == 0)
+	if err != nil {
+		return coapReject(failure("storage error", "firmware err "+err.Error()))
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return coapReject(failure("storage error", "firmware err "+err.Error()))
+	}
+	offset := int64(block.Num) * int64(block.Size)
+	if offset > 0 && offset >= info.Size() {
+		return coapReject(rejection(http.StatusBadRequest, "Wrong block"))
+	}
+	buf := make([]byte, block.Size)
+	n, err := file.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return coapReject(failure("storage error", "firmware err "+err.Error()))
+	}
+	block.More = offset+int64(n) < info.Size()
+	resp := &coap.Message{Code: coap.Content, Payload: buf[:n]}
+	resp.AddUint(coap.ContentFormat, coap.OctetStream)
+	resp.AddOption(coap.Block2, block.Encode())
+	if block.Num == 0 {
+		resp.AddUint(coap.Size2, uint32(info.Size()))
+	}
+	if fw == nil {
+		return resp
+	}
+	if sum, err := hex.DecodeString(fw.SHA256); err == nil && len(sum) >= etagSize {
+		resp.AddOption(coap.ETag, sum[:etagSize])
+	}
+	if !block.More && auth.number != "" {
+		err = s.firmware.ms.RecordDownload(auth.number, fw.ID.Hex(), info.Size())
+		if err != nil {
+			utils.Log().Infoln("firmware download stats err", err)
+		}
+	}
+	return resp
+}
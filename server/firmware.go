@@ -0,0 +1,456 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"iot-stats/delta"
+	"iot-stats/model"
+	"iot-stats/service"
+	"iot-stats/utils"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	FirmwareVersion   = "Firmware-Version"
+	FirmwareSha256    = "Firmware-Sha256"
+	ManifestSignature = "Manifest-Signature"
+	AcceptDelta       = "Accept-Delta"
+	DeltaBase         = "Delta-Base"
+)
+
+const defaultChannel = "stable"
+
+// legacyFirmware is served to devices when no firmware was uploaded
+// for them
+const legacyFirmware = "././build"
+
+// deltaDir is subdirectory of firmware directory caching deltas
+const deltaDir = "deltas"
+
+// Firmware keeps firmware images in directory, metadata is kept in
+// storage. Manifests are signed when signing key is set
+type Firmware struct {
+	dir        string
+	maxSize    int64
+	signingKey ed25519.PrivateKey
+	ms         service.MongoInterface
+	// deltaLocks keep concurrent downloads from making the same delta,
+	// deltas of other images are made meanwhile
+	deltaMu    sync.Mutex
+	deltaLocks map[string]*deltaLock
+}
+
+// deltaLock is held while delta is made, users counts downloads which
+// hold it or wait for it
+type deltaLock struct {
+	sync.Mutex
+	users int
+}
+
+func newFirmware(dir string, maxSize int64, signingKey ed25519.PrivateKey,
+	ms service.MongoInterface) *Firmware {
+	return &Firmware{dir: dir, maxSize: maxSize, signingKey: signingKey, ms: ms,
+		deltaLocks: make(map[string]*deltaLock)}
+}
+
+// path of firmware image on disk
+func (f *Firmware) path(fw *model.Firmware) string {
+	return filepath.Join(f.dir, fw.ID.Hex()+".bin")
+}
+
+// Upload firmware image, metadata is sent as multipart form fields
+func (f *Firmware) upload(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, f.maxSize)
+	file, _, err := c.Request.FormFile("image")
+	if err != nil {
+		utils.Log().Infoln("firmware upload err", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No firmware image"})
+		return
+	}
+	defer file.Close()
+	fw := &model.Firmware{
+		ID:            bson.NewObjectId(),
+		Version:       c.PostForm("version"),
+		HardwareModel: c.PostForm("hardware-model"),
+		Channel:       c.DefaultPostForm("channel", defaultChannel),
+		Notes:         c.PostForm("notes"),
+		UploadDate:    time.Now(),
+	}
+	if fw.Version == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No firmware version"})
+		return
+	}
+	tmp, err := ioutil.TempFile(f.dir, "upload")
+	if err != nil {
+		internalError(c, "storage error", "firmware upload err "+err.Error())
+		return
+	}
+	defer os.Remove(tmp.Name())
+	hash := sha256.New()
+	fw.Size, err = io.Copy(io.MultiWriter(tmp, hash), file)
+	tmp.Close()
+	if err != nil {
+		internalError(c, "storage error", "firmware upload err "+err.Error())
+		return
+	}
+	fw.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	if sum := c.PostForm("sha256"); sum != "" && !strings.EqualFold(sum, fw.SHA256) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Checksum mismatch"})
+		return
+	}
+	if err = os.Rename(tmp.Name(), f.path(fw)); err != nil {
+		internalError(c, "storage error", "firmware upload err "+err.Error())
+		return
+	}
+	if err = f.ms.AddFirmware(fw); err != nil {
+		os.Remove(f.path(fw))
+		internalError(c, "database error", "firmware upload err "+err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, fw)
+}
+
+// Get list of uploaded firmware
+func (f *Firmware) list(c *gin.Context) {
+	list, err := f.ms.GetFirmwareList()
+	if err != nil {
+		internalError(c, "database error", "firmware list err "+err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+// Assign firmware to single device, without firmware id assignment is
+// removed and device follows its model and channel again
+func (f *Firmware) assign(c *gin.Context) {
+	id := c.Param("id")
+	if id != "" {
+		if _, err := f.ms.GetFirmware(id); err == service.ErrNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Firmware not found"})
+			return
+		} else if err != nil {
+			internalError(c, "database error", "firmware assign err "+err.Error())
+			return
+		}
+	}
+	err := f.ms.AssignFirmware(c.Param("number"), id)
+	if err == service.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	} else if err != nil {
+		internalError(c, "database error", "firmware assign err "+err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Firmware assigned"})
+}
+
+// Describe firmware device should run
+func (f *Firmware) latest(c *gin.Context) {
+	fw, _, err := f.resolve(c)
+	if err == service.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Firmware not found"})
+		return
+	} else if err != nil {
+		internalError(c, "database error", "firmware err "+err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, fw)
+}
+
+// Signed manifest of firmware device should run. Signature of response
+// body is sent in Manifest-Signature header
+func (f *Firmware) manifest(c *gin.Context) {
+	if f.signingKey == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Firmware signing is off"})
+		return
+	}
+	fw, _, err := f.resolve(c)
+	if err == service.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Firmware not found"})
+		return
+	} else if err != nil {
+		internalError(c, "database error", "firmware err "+err.Error())
+		return
+	}
+	body, err := json.Marshal(&model.Manifest{
+		Firmware:      fw.ID,
+		Version:       fw.Version,
+		HardwareModel: fw.HardwareModel,
+		Channel:       fw.Channel,
+		SHA256:        fw.SHA256,
+		Size:          fw.Size,
+		KeyID:         utils.KeyID(f.signingKey.Public().(ed25519.PublicKey)),
+		IssueDate:     time.Now(),
+	})
+	if err != nil {
+		internalError(c, "marshaling error", "marshaling error "+err.Error())
+		return
+	}
+	signature := ed25519.Sign(f.signingKey, body)
+	c.Header(ManifestSignature, base64.StdEncoding.EncodeToString(signature))
+	c.Data(http.StatusOK, "application/json", body)
+}
+
+// Public key devices use to verify manifests
+func (f *Firmware) publicKey(c *gin.Context) {
+	if f.signingKey == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Firmware signing is off"})
+		return
+	}
+	pub := f.signingKey.Public().(ed25519.PublicKey)
+	c.JSON(http.StatusOK, gin.H{
+		"key-id":     utils.KeyID(pub),
+		"algorithm":  "ed25519",
+		"public-key": base64.StdEncoding.EncodeToString(pub),
+	})
+}
+
+// Download firmware device should run, device which gets content of
+// firmware of rollout is counted as updated by it
+func (f *Firmware) download(c *gin.Context) {
+	fw, rollout, err := f.resolve(c)
+	if err == service.ErrNotFound {
+		c.File(legacyFirmware)
+		return
+	} else if err != nil {
+		internalError(c, "database error", "firmware err "+err.Error())
+		return
+	}
+	c.Header(FirmwareVersion, fw.Version)
+	c.Header(FirmwareSha256, fw.SHA256)
+	c.Header("Content-Type", "application/octet-stream")
+	base, patch, err := f.delta(c, fw)
+	if err != nil {
+		utils.Log().Infoln("firmware delta err", err)
+	}
+	if patch != nil {
+		// Delta is resource of its own, device verifies image it gets
+		// after patching with Firmware-Sha256
+		sum := sha256.Sum256(patch)
+		c.Header(DeltaBase, base.Version)
+		f.serve(c, `"`+base.SHA256+"-"+fw.SHA256+`"`, sum[:], fw.UploadDate,
+			bytes.NewReader(patch))
+	} else {
+		file, err := os.Open(f.path(fw))
+		if err != nil {
+			internalError(c, "storage error", "firmware err "+err.Error())
+			return
+		}
+		defer file.Close()
+		sum, _ := hex.DecodeString(fw.SHA256)
+		f.serve(c, `"`+fw.SHA256+`"`, sum, fw.UploadDate, file)
+	}
+	// HEAD and not modified responses carry no content, so device did
+	// not get firmware
+	if number := c.GetString(deviceKey); number != "" && c.Writer.Size() > 0 {
+		if rollout != nil {
+			err = f.ms.AddRolloutDevice(rollout.ID.Hex(), number)
+			if err != nil {
+				utils.Log().Infoln("rollout device err", err)
+			}
+		}
+		err = f.ms.RecordDownload(number, fw.ID.Hex(), int64(c.Writer.Size()))
+		if err != nil {
+			utils.Log().Infoln("firmware download stats err", err)
+		}
+	}
+}
+
+// serve sends content honoring conditional and range requests. ETag lets
+// device skip content it already has and resume download with If-Range,
+// digest of whole content is sent on partial response too
+func (f *Firmware) serve(c *gin.Context, etag string, sum []byte, modtime time.Time,
+	content io.ReadSeeker) {
+	c.Header("ETag", etag)
+	if len(sum) > 0 {
+		digest := "sha-256=:" + base64.StdEncoding.EncodeToString(sum) + ":"
+		c.Header("Repr-Digest", digest)
+		if c.GetHeader("Range") == "" {
+			c.Header("Content-Digest", digest)
+		}
+	}
+	http.ServeContent(c.Writer, c.Request, "", modtime, content)
+}
+
+// delta returns delta from firmware device runs to fw and firmware it
+// applies to. Nothing is returned when device can not apply delta, its
+// firmware is unknown or delta is not smaller than image
+func (f *Firmware) delta(c *gin.Context, fw *model.Firmware) (*model.Firmware, []byte, error) {
+	if c.GetHeader(AcceptDelta) != delta.Format {
+		return nil, nil, nil
+	}
+	current := c.GetHeader(FirmwareVersion)
+	if number := c.GetString(deviceKey); current == "" && number != "" {
+		device, err := f.ms.GetDeviceByNumber(number)
+		if err != nil && err != service.ErrNotFound {
+			return nil, nil, err
+		}
+		if device != nil {
+			current = device.FirmwareVersion
+		}
+	}
+	if current == "" || current == fw.Version {
+		return nil, nil, nil
+	}
+	list, err := f.ms.GetFirmwareList()
+	if err != nil {
+		return nil, nil, err
+	}
+	var base *model.Firmware
+	for i := range *list {
+		other := &(*list)[i]
+		if other.Version == current && other.HardwareModel == fw.HardwareModel &&
+			other.ID != fw.ID {
+			base = other
+			break
+		}
+	}
+	if base == nil {
+		return nil, nil, nil
+	}
+	patch, err := f.cachedDelta(base, fw)
+	if err != nil || int64(len(patch)) >= fw.Size {
+		return nil, nil, err
+	}
+	return base, patch, nil
+}
+
+// cachedDelta reads delta between images from cache, delta is made and
+// cached on first request
+func (f *Firmware) cachedDelta(base, fw *model.Firmware) ([]byte, error) {
+	key := base.ID.Hex() + "-" + fw.ID.Hex()
+	path := filepath.Join(f.dir, deltaDir, key+".delta")
+	defer f.lockDelta(key)()
+	patch, err := ioutil.ReadFile(path)
+	if err == nil || !os.IsNotExist(err) {
+		return patch, err
+	}
+	old, err := ioutil.ReadFile(f.path(base))
+	if err != nil {
+		return nil, err
+	}
+	new, err := ioutil.ReadFile(f.path(fw))
+	if err != nil {
+		return nil, err
+	}
+	patch = delta.Diff(old, new)
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "delta")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(patch)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	return patch, err
+}
+
+// lockDelta locks making of delta with key, it returns unlock
+func (f *Firmware) lockDelta(key string) func() {
+	f.deltaMu.Lock()
+	l, ok := f.deltaLocks[key]
+	if !ok {
+		l = &deltaLock{}
+		f.deltaLocks[key] = l
+	}
+	l.users++
+	f.deltaMu.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		f.deltaMu.Lock()
+		if l.users--; l.users == 0 {
+			delete(f.deltaLocks, key)
+		}
+		f.deltaMu.Unlock()
+	}
+}
+
+// Get firmware download stats of device
+func (f *Firmware) downloads(c *gin.Context) {
+	stats, err := f.ms.GetDownloads(c.Param("number"))
+	if err != nil {
+		internalError(c, "database error", "firmware downloads err "+err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, stats)
+}
+
+// resolve finds firmware for device of request, model and channel are
+// taken from query
+func (f *Firmware) resolve(c *gin.Context) (*model.Firmware, *model.Rollout, error) {
+	return f.find(c.GetString(deviceKey), c.Query("model"),
+		c.DefaultQuery("channel", defaultChannel))
+}
+
+// find finds firmware for device. Firmware assigned to device wins, then
+// firmware of rollout covering device, otherwise latest firmware for
+// model and channel is used
+func (f *Firmware) find(number, hardwareModel, channel string) (*model.Firmware,
+	*model.Rollout, error) {
+	if number != "" {
+		device, err := f.ms.GetDeviceByNumber(number)
+		if err != nil && err != service.ErrNotFound {
+			return nil, nil, err
+		}
+		if device != nil && device.Firmware != "" {
+			fw, err := f.ms.GetFirmware(device.Firmware.Hex())
+			return fw, nil, err
+		}
+		if device != nil {
+			rollout, err := activeRollout(f.ms, device, hardwareModel, channel)
+			if err != nil {
+				return nil, nil, err
+			}
+			if rollout != nil {
+				fw, err := f.ms.GetFirmware(rollout.Firmware.Hex())
+				return fw, rollout, err
+			}
+		}
+	}
+	fw, err := f.ms.GetLatestFirmware(hardwareModel, channel)
+	return fw, nil, err
+}
+
+// openImage opens image of firmware device should run for transports
+// which send it in blocks, legacy firmware is opened with nil firmware when
+// there is none. Device which starts download of rollout firmware is
+// counted as updated by it
+func (f *Firmware) openImage(number, hardwareModel, channel string,
+	start bool) (*model.Firmware, *os.File, error) {
+	fw, rollout, err := f.find(number, hardwareModel, channel)
+	if err == service.ErrNotFound {
+		file, err := os.Open(legacyFirmware)
+		return nil, file, err
+	} else if err != nil {
+		return nil, nil, err
+	}
+	if rollout != nil && start {
+		if err = f.ms.AddRolloutDevice(rollout.ID.Hex(), number); err != nil {
+			utils.Log().Infoln("rollout device err", err)
+		}
+	}
+	file, err := os.Open(f.path(fw))
+	return fw, file, err
+}
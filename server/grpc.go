@@ -0,0 +1,300 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"iot-stats/devicepb"
+	"iot-stats/model"
+	"iot-stats/utils"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpcChunkSize is how many bytes of firmware image one chunk carries
+const grpcChunkSize = 32 << 10
+
+// grpcCodes maps http statuses of replies to status codes of calls
+var grpcCodes = map[int]codes.Code{
+	http.StatusBadRequest:            codes.InvalidArgument,
+	http.StatusUnauthorized:          codes.Unauthenticated,
+	http.StatusForbidden:             codes.PermissionDenied,
+	http.StatusNotFound:              codes.NotFound,
+	http.StatusRequestEntityTooLarge: codes.ResourceExhausted,
+	http.StatusInternalServerError:   codes.Internal,
+}
+
+// GRPC serves device service of devicepb over TLS on its own port. Calls
+// are handled by the same code as requests of api group, credentials http
+// requests carry in headers are metadata "api-key", "device-number" and
+// "device-secret". Device which presented verified client certificate
+// does not need them
+type GRPC struct {
+	devicepb.UnimplementedDeviceServer
+	config   *Config
+	api      *Api
+	firmware *Firmware
+	cert     tls.Certificate
+	server   *grpc.Server
+	listener net.Listener
+}
+
+func newGRPC(config *Config, api *Api, firmware *Firmware, cert tls.Certificate) *GRPC {
+	return &GRPC{config: config, api: api, firmware: firmware, cert: cert}
+}
+
+// listen starts serving calls on gRPC port from config
+func (g *GRPC) listen() error {
+	tlsConfig := &tls.Config{}
+	if g.config.ClientCA != "" {
+		var err error
+		if tlsConfig, err = clientAuthConfig(g.config.ClientCA); err != nil {
+			return err
+		}
+	}
+	tlsConfig.Certificates = []tls.Certificate{g.cert}
+	l, err := net.Listen("tcp", net.JoinHostPort(g.config.Host, g.config.GRPCPort))
+	if err != nil {
+		return err
+	}
+	g.listener = l
+	g.server = grpc.NewServer(grpc.Creds(credentials.NewTLS(tlsConfig)))
+	devicepb.RegisterDeviceServer(g.server, g)
+	go func() {
+		if err := g.server.Serve(l); err != nil {
+			utils.Log().Infoln("grpc serve err", err)
+		}
+	}()
+	return nil
+}
+
+func (g *GRPC) close() {
+	g.server.Stop()
+}
+
+// grpcError turns rejection into status of call
+func grpcError(r *reply) error {
+	code, ok := grpcCodes[r.status]
+	if !ok {
+		code = codes.Unknown
+	}
+	msg, _ := r.body["error"].(string)
+	return status.Error(code, msg)
+}
+
+// authenticate checks credentials of call like api middleware does,
+// registration checks device secret itself
+func (g *GRPC) authenticate(ctx context.Context, checkSecret bool) (*deviceAuth, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	get := func(key string) string {
+		if values := md.Get(strings.ToLower(key)); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	cr := &deviceCreds{apiKey: get(ApiKey), number: get(DeviceNumber),
+		secret: get(DeviceSecret), certNumber: peerDevice(ctx)}
+	auth, r := g.api.authenticate(cr)
+	if r != nil {
+		return nil, grpcError(r)
+	}
+	if checkSecret {
+		if r = g.api.checkSecret(auth, cr.number); r != nil {
+			return nil, grpcError(r)
+		}
+	}
+	return auth, nil
+}
+
+// peerDevice returns device number from verified client certificate of
+// call
+func peerDevice(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 ||
+		len(info.State.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return certificateNumber(info.State.VerifiedChains[0][0])
+}
+
+func (g *GRPC) RegisterDevice(ctx context.Context,
+	req *devicepb.RegisterRequest) (*devicepb.RegisterReply, error) {
+	auth, err := g.authenticate(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	r := g.api.register(auth, req.DeviceNumber)
+	if r.status != http.StatusOK {
+		return nil, grpcError(r)
+	}
+	secret, _ := r.body["secret"].(string)
+	return &devicepb.RegisterReply{Message: r.body["message"].(string), Secret: secret}, nil
+}
+
+// errorDto turns error report into error of api, context which is not
+// JSON object is rejected
+func errorDto(report *devicepb.ErrorReport) (*model.DeviceErrorDto, *reply) {
+	de := &model.DeviceErrorDto{
+		ErrorName:       report.ErrorName,
+		DeviceNumber:    report.DeviceNumber,
+		Fingerprint:     report.Fingerprint,
+		Severity:        report.Severity,
+		Code:            int(report.Code),
+		FirmwareVersion: report.FirmwareVersion,
+		Attachment:      report.Attachment,
+	}
+	if report.TimestampMs != 0 {
+		timestamp := time.Unix(0, report.TimestampMs*int64(time.Millisecond))
+		de.Timestamp = &timestamp
+	}
+	if report.Context != "" {
+		if err := json.Unmarshal([]byte(report.Context), &de.Context); err != nil {
+			return nil, rejection(http.StatusBadRequest, "Wrong context")
+		}
+	}
+	return de, nil
+}
+
+func (g *GRPC) ReportError(ctx context.Context,
+	req *devicepb.ErrorReport) (*devicepb.ErrorReply, error) {
+	auth, err := g.authenticate(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	de, r := errorDto(req)
+	if r == nil {
+		r = g.api.reportError(auth, de)
+	}
+	if r.status != http.StatusOK {
+		return nil, grpcError(r)
+	}
+	id, _ := r.body["id"].(string)
+	return &devicepb.ErrorReply{Message: r.body["message"].(string), Id: id}, nil
+}
+
+// ReportErrors collects reports device streams into batch, batch belongs
+// to authenticated device or to device of the first report
+func (g *GRPC) ReportErrors(stream devicepb.Device_ReportErrorsServer) error {
+	auth, err := g.authenticate(stream.Context(), true)
+	if err != nil {
+		return err
+	}
+	batch := &model.ErrorBatchDto{DeviceNumber: auth.number}
+	for {
+		report, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if len(batch.Errors) == maxBatchErrors {
+			return grpcError(rejection(http.StatusBadRequest, "Batch must have 1 to 100 errors"))
+		}
+		de, r := errorDto(report)
+		if r != nil {
+			return grpcError(r)
+		}
+		if batch.DeviceNumber == "" {
+			batch.DeviceNumber = de.DeviceNumber
+		}
+		batch.Errors = append(batch.Errors, *de)
+	}
+	r := g.api.reportErrors(auth, batch)
+	if r.status != http.StatusOK {
+		return grpcError(r)
+	}
+	results := r.body["results"].([]BatchResult)
+	out := &devicepb.ErrorBatchReply{
+		Message:    r.body["message"].(string),
+		Registered: int32(r.body["registered"].(int)),
+		Rejected:   int32(r.body["rejected"].(int)),
+		Results:    make([]*devicepb.BatchResult, len(results)),
+	}
+	for i, result := range results {
+		out.Results[i] = &devicepb.BatchResult{Index: int32(result.Index),
+			Status: result.Status, Id: result.ID, Error: result.Error}
+	}
+	return stream.SendAndClose(out)
+}
+
+func (g *GRPC) Heartbeat(ctx context.Context,
+	req *devicepb.HeartbeatRequest) (*devicepb.HeartbeatReply, error) {
+	auth, err := g.authenticate(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	r := g.api.reportHeartbeat(auth, &model.HeartbeatDto{DeviceNumber: req.DeviceNumber,
+		Uptime: req.Uptime})
+	if r.status != http.StatusOK {
+		return nil, grpcError(r)
+	}
+	return &devicepb.HeartbeatReply{Message: r.body["message"].(string)}, nil
+}
+
+// DownloadFirmware streams image of firmware device should run from
+// offset device asked for. Download of device is recorded when the last
+// chunk is sent
+func (g *GRPC) DownloadFirmware(req *devicepb.FirmwareRequest,
+	stream devicepb.Device_DownloadFirmwareServer) error {
+	auth, err := g.authenticate(stream.Context(), true)
+	if err != nil {
+		return err
+	}
+	channel := req.Channel
+	if channel == "" {
+		channel = defaultChannel
+	}
+	fw, file, err := g.firmware.openImage(auth.number, req.Model, channel, req.Offset == 0)
+	if err != nil {
+		return grpcError(failure("storage error", "firmware err "+err.Error()))
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return grpcError(failure("storage error", "firmware err "+err.Error()))
+	}
+	if req.Offset < 0 || req.Offset > 0 && req.Offset >= info.Size() {
+		return grpcError(rejection(http.StatusBadRequest, "Wrong offset"))
+	}
+	chunk := &devicepb.FirmwareChunk{Size: info.Size(), Offset: req.Offset}
+	if fw != nil {
+		chunk.Version, chunk.Sha256 = fw.Version, fw.SHA256
+	}
+	buf := make([]byte, grpcChunkSize)
+	for offset := req.Offset; offset < info.Size(); {
+		n, err := file.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return grpcError(failure("storage error", "firmware err "+err.Error()))
+		} else if n == 0 {
+			break
+		}
+		chunk.Offset, chunk.Data = offset, buf[:n]
+		if err = stream.Send(chunk); err != nil {
+			return err
+		}
+		offset += int64(n)
+		chunk = &devicepb.FirmwareChunk{}
+	}
+	if fw != nil && auth.number != "" {
+		err = g.firmware.ms.RecordDownload(auth.number, fw.ID.Hex(),
+			info.Size()-req.Offset)
+		if err != nil {
+			utils.Log().Infoln("firmware download stats err", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"iot-stats/utils"
+	"net/http"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gin-gonic/gin"
+)
+
+// replySuffix ends topic device gets reply on
+const replySuffix = "/reply"
+
+// disconnectWait is how long in milliseconds bridge waits for work in
+// progress on disconnect
+const disconnectWait = 250
+
+// Bridge takes device requests from MQTT broker. Device publishes JSON
+// body of api request to {prefix}/{number}/{resource} and gets reply with
+// http status in "status" field on the same topic ending with /reply.
+// Topic tells device number, credentials http requests carry in headers
+// are "api-key" and "device-secret" fields of body
+type Bridge struct {
+	config    *Config
+	api       *Api
+	resources map[string]deviceHandler
+	client    mqtt.Client
+}
+
+// mqttCreds are credentials device puts into message body
+type mqttCreds struct {
+	ApiKey       string `json:"api-key"`
+	DeviceSecret string `json:"device-secret"`
+}
+
+func newBridge(config *Config, api *Api, telemetry *Telemetry) *Bridge {
+	return &Bridge{config: config, api: api, resources: deviceResources(api, telemetry)}
+}
+
+// connect connects to broker, device topics are subscribed on every
+// connect since session is not kept by broker
+func (b *Bridge) connect() error {
+	opts := mqtt.NewClientOptions().
+		AddBroker(b.config.MQTTBroker).
+		SetClientID(b.config.MQTTClientID).
+		SetUsername(b.config.MQTTUser).
+		SetPassword(b.config.MQTTPassword).
+		SetAutoReconnect(true).
+		SetOrderMatters(false).
+		SetOnConnectHandler(b.subscribe)
+	b.client = mqtt.NewClient(opts)
+	token := b.client.Connect()
+	token.Wait()
+	return token.Error()
+}
+
+func (b *Bridge) disconnect() {
+	b.client.Disconnect(disconnectWait)
+}
+
+func (b *Bridge) subscribe(client mqtt.Client) {
+	token := client.Subscribe(b.config.MQTTPrefix+"/+/+", b.config.MQTTQoS, b.receive)
+	if token.Wait() && token.Error() != nil {
+		utils.Log().Infoln("mqtt subscribe err", token.Error())
+	}
+}
+
+func (b *Bridge) receive(client mqtt.Client, msg mqtt.Message) {
+	topic, payload := b.handle(msg.Topic(), msg.Payload())
+	if topic == "" {
+		return
+	}
+	token := client.Publish(topic, b.config.MQTTQoS, false, payload)
+	if token.Wait() && token.Error() != nil {
+		utils.Log().Infoln("mqtt reply err", token.Error())
+	}
+}
+
+// handle answers message device published to topic, nothing is returned
+// for topic which is not device topic
+func (b *Bridge) handle(topic string, payload []byte) (string, []byte) {
+	parts := strings.Split(strings.TrimPrefix(topic, b.config.MQTTPrefix+"/"), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		return "", nil
+	}
+	r := b.serve(parts[0], parts[1], payload)
+	body := gin.H{"status": r.status}
+	for key, value := range r.body {
+		body[key] = value
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		utils.Log().Infoln("mqtt reply err", err)
+		return "", nil
+	}
+	return topic + replySuffix, data
+}
+
+// serve authenticates device like api middleware does and passes body to
+// handler of resource
+func (b *Bridge) serve(number, resource string, payload []byte) *reply {
+	handler, ok := b.resources[resource]
+	if !ok {
+		return rejection(http.StatusNotFound, "Unknown resource")
+	}
+	// Body which is not JSON is rejected by handler as http body is
+	var creds mqttCreds
+	json.Unmarshal(payload, &creds)
+	auth, r := b.api.authenticate(&deviceCreds{apiKey: creds.ApiKey, number: number,
+		secret: creds.DeviceSecret})
+	if r != nil {
+		return r
+	}
+	if resource != registerResource {
+		if r = b.api.checkSecret(auth, number); r != nil {
+			return r
+		}
+	}
+	return handler(auth, bytes.NewReader(payload))
+}
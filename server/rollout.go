@@ -0,0 +1,257 @@
+package server
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"iot-stats/model"
+	"iot-stats/service"
+	"iot-stats/utils"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Rollouts manages staged firmware rollouts, widening and halting is
+// done by background job
+type Rollouts struct {
+	ms service.MongoInterface
+}
+
+func newRollouts(ms service.MongoInterface) *Rollouts {
+	return &Rollouts{ms: ms}
+}
+
+type PostRollout struct {
+	Firmware       string              `json:"firmware"`
+	Steps          []model.RolloutStep `json:"steps"`
+	StepDuration   int                 `json:"step-duration"`
+	ErrorThreshold float64             `json:"error-threshold"`
+}
+
+// Create rollout of uploaded firmware, it starts at first step at once
+func (r *Rollouts) create(c *gin.Context) {
+	decoder := json.NewDecoder(c.Request.Body)
+	defer c.Request.Body.Close()
+	var post PostRollout
+	if err := decoder.Decode(&post); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Wrong rollout"})
+		return
+	}
+	if msg := validateRollout(&post); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+	fw, err := r.ms.GetFirmware(post.Firmware)
+	if err == service.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Firmware not found"})
+		return
+	} else if err != nil {
+		internalError(c, "database error", "rollout err "+err.Error())
+		return
+	}
+	rollouts, err := r.ms.GetRollouts()
+	if err != nil {
+		internalError(c, "database error", "rollout err "+err.Error())
+		return
+	}
+	for _, other := range *rollouts {
+		if other.HardwareModel == fw.HardwareModel && other.Channel == fw.Channel &&
+			(other.State == model.RolloutRunning || other.State == model.RolloutPaused) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Rollout is in progress",
+				"rollout": other.ID})
+			return
+		}
+	}
+	now := time.Now()
+	rollout := &model.Rollout{
+		Firmware:       fw.ID,
+		HardwareModel:  fw.HardwareModel,
+		Channel:        fw.Channel,
+		Steps:          post.Steps,
+		StepDuration:   post.StepDuration,
+		ErrorThreshold: post.ErrorThreshold,
+		State:          model.RolloutRunning,
+		CreateDate:     now,
+	}
+	for i := range rollout.Steps {
+		rollout.Steps[i].StartDate = time.Time{}
+		rollout.Steps[i].Updated, rollout.Steps[i].Errors = 0, 0
+	}
+	rollout.Steps[0].StartDate = now
+	if err = r.ms.SetFirmwareHeld(post.Firmware, true); err != nil {
+		internalError(c, "database error", "rollout err "+err.Error())
+		return
+	}
+	if err = r.ms.AddRollout(rollout); err != nil {
+		if err := r.ms.SetFirmwareHeld(post.Firmware, false); err != nil {
+			utils.Log().Infoln("rollout firmware release err", err)
+		}
+		internalError(c, "database error", "rollout err "+err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, rollout)
+}
+
+// validateRollout returns description of what is wrong with rollout
+func validateRollout(post *PostRollout) string {
+	if len(post.Steps) == 0 {
+		return "No rollout steps"
+	}
+	if post.StepDuration <= 0 {
+		return "Step duration must be positive"
+	}
+	if post.ErrorThreshold < 0 {
+		return "Error threshold must not be negative"
+	}
+	for _, step := range post.Steps {
+		if step.Percent < 0 || step.Percent > 100 {
+			return "Step percent must be between 0 and 100"
+		}
+		if step.Percent == 0 && step.Group == "" {
+			return "Step must target percent of devices or group"
+		}
+	}
+	return ""
+}
+
+// Get list of rollouts with progress of their steps
+func (r *Rollouts) list(c *gin.Context) {
+	rollouts, err := r.ms.GetRollouts()
+	if err != nil {
+		internalError(c, "database error", "rollout err "+err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, rollouts)
+}
+
+// Get single rollout with progress of its steps
+func (r *Rollouts) get(c *gin.Context) {
+	rollout, ok := r.rollout(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, rollout)
+}
+
+func (r *Rollouts) pause(c *gin.Context) {
+	r.change(c, model.RolloutPaused, model.RolloutRunning)
+}
+
+func (r *Rollouts) resume(c *gin.Context) {
+	r.change(c, model.RolloutRunning, model.RolloutPaused)
+}
+
+func (r *Rollouts) abort(c *gin.Context) {
+	r.change(c, model.RolloutAborted, model.RolloutRunning, model.RolloutPaused)
+}
+
+// change moves rollout to state if it is in one of from states. Resumed
+// step starts over, so it is watched for full duration again
+func (r *Rollouts) change(c *gin.Context, state string, from ...string) {
+	rollout, ok := r.rollout(c)
+	if !ok {
+		return
+	}
+	allowed := false
+	for _, f := range from {
+		allowed = allowed || rollout.State == f
+	}
+	if !allowed {
+		c.JSON(http.StatusConflict, gin.H{"error": "Rollout is " + rollout.State})
+		return
+	}
+	rollout.State = state
+	rollout.Reason = ""
+	if state == model.RolloutRunning {
+		rollout.Steps[rollout.Step].StartDate = time.Now()
+	}
+	if err := r.ms.UpdateRollout(rollout); err == service.ErrConflict {
+		c.JSON(http.StatusConflict, gin.H{"error": "Rollout was changed meanwhile"})
+		return
+	} else if err != nil {
+		internalError(c, "database error", "rollout err "+err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, rollout)
+}
+
+func (r *Rollouts) rollout(c *gin.Context) (*model.Rollout, bool) {
+	rollout, err := r.ms.GetRollout(c.Param("id"))
+	if err == service.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Rollout not found"})
+		return nil, false
+	} else if err != nil {
+		internalError(c, "database error", "rollout err "+err.Error())
+		return nil, false
+	}
+	return rollout, true
+}
+
+// Put device into group targeted by rollout steps, without group device
+// is removed from its group
+func (r *Rollouts) setGroup(c *gin.Context) {
+	err := r.ms.SetDeviceGroup(c.Param("number"), c.Param("group"))
+	if err == service.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	} else if err != nil {
+		internalError(c, "database error", "group err "+err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Device group set"})
+}
+
+// activeRollout finds rollout which delivers its firmware to device.
+// Running rollout covers devices targeted by steps done so far, paused
+// one only devices which already got firmware
+func activeRollout(ms service.MongoInterface, device *model.Device,
+	hardwareModel, channel string) (*model.Rollout, error) {
+	rollouts, err := ms.GetRollouts()
+	if err != nil {
+		return nil, err
+	}
+	for i := range *rollouts {
+		rollout := &(*rollouts)[i]
+		if rollout.HardwareModel != hardwareModel || rollout.Channel != channel {
+			continue
+		}
+		if rollout.State == model.RolloutRunning && inRollout(rollout, device) {
+			return rollout, nil
+		}
+		if rollout.State == model.RolloutRunning || rollout.State == model.RolloutPaused {
+			member, err := ms.IsRolloutDevice(rollout.ID.Hex(), device.DeviceNumber)
+			if err != nil {
+				return nil, err
+			}
+			if member {
+				return rollout, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// inRollout tells whether device is targeted by current or previous
+// steps of rollout
+func inRollout(rollout *model.Rollout, device *model.Device) bool {
+	for i := 0; i <= rollout.Step && i < len(rollout.Steps); i++ {
+		step := rollout.Steps[i]
+		if step.Group != "" {
+			if step.Group == device.Group {
+				return true
+			}
+		} else if rolloutBucket(rollout, device.DeviceNumber) < step.Percent {
+			return true
+		}
+	}
+	return false
+}
+
+// rolloutBucket places device into one of hundred buckets, device stays
+// in the same bucket while rollout widens
+func rolloutBucket(rollout *model.Rollout, deviceNumber string) int {
+	h := fnv.New32a()
+	h.Write([]byte(rollout.ID.Hex() + "/" + deviceNumber))
+	return int(h.Sum32() % 100)
+}
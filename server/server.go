@@ -1,20 +1,57 @@
 package server
 
 import (
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
 	"iot-stats/service"
+	"iot-stats/utils"
 	"net"
+	"net/http"
+	"os"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 // Config Server configuration parameters
 type Config struct {
-	Port       string
-	Host       string
-	ApiKey     string
-	Expiration int
+	Port                string
+	Host                string
+	ApiKey              string
+	RequireDeviceSecret bool
+	ClientCA            string
+	RequireClientCert   bool
+	FirmwareDir         string
+	FirmwareMaxSize     int64
+	SigningKey          string
+	TelemetryRetention  map[string]time.Duration
+	AttachmentMaxSize   int64
+	Expiration          int
+	// MQTT bridge is started when broker is set
+	MQTTBroker   string
+	MQTTClientID string
+	MQTTUser     string
+	MQTTPassword string
+	MQTTPrefix   string
+	MQTTQoS      byte
+	// CoAP listener is started when port is set, without DTLS requests
+	// with credentials are refused unless CoAPInsecure is set
+	CoAPPort     string
+	CoAPDTLS     bool
+	CoAPInsecure bool
+	// gRPC device service is started when port is set
+	GRPCPort string
 }
 
+// Certificate and key of server, DTLS of CoAP and gRPC use them too
+const (
+	certFile = "server.pem"
+	keyFile  = "server.key"
+)
+
 func (c Config) GetAddr() string {
 	return net.JoinHostPort(c.Host, c.Port)
 }
@@ -23,31 +60,162 @@ func (c Config) GetAddr() string {
 type Server struct {
 	config *Config
 	ms     service.MongoInterface
+	ts     service.TelemetryInterface
+	blobs  service.BlobStore
 }
 
 // NewServer return new instance of Server
-func NewServer(c *Config, ms service.MongoInterface) *Server {
-	return &Server{config: c, ms: ms}
+func NewServer(c *Config, ms service.MongoInterface, ts service.TelemetryInterface,
+	blobs service.BlobStore) *Server {
+	return &Server{config: c, ms: ms, ts: ts, blobs: blobs}
 }
 
 func (s *Server) Serve() error {
-	api := newApi(s.config.ApiKey, s.ms)
+	api := newApi(s.config, s.ms)
 	web := newWeb(s.config.Expiration, s.ms)
 	login := newLogin(s.config.Expiration, s.ms)
+	var signingKey ed25519.PrivateKey
+	if s.config.SigningKey != "" {
+		key, err := utils.LoadSigningKey(s.config.SigningKey)
+		if err != nil {
+			return fmt.Errorf("firmware signing key: %v, "+
+				"it is generated with -gen-signing-key", err)
+		}
+		signingKey = key
+	}
+	firmware := newFirmware(s.config.FirmwareDir, s.config.FirmwareMaxSize,
+		signingKey, s.ms)
+	rollouts := newRollouts(s.ms)
+	telemetry := newTelemetry(s.config.TelemetryRetention, api, s.ms, s.ts)
+	attachments := newAttachments(s.config.AttachmentMaxSize, api, s.ms, s.blobs)
+	alerts := newAlerts(s.ms)
+	webhooks := newWebhooks(s.ms)
+	if err := os.MkdirAll(s.config.FirmwareDir, 0755); err != nil {
+		return err
+	}
+	if s.config.MQTTBroker != "" {
+		bridge := newBridge(s.config, api, telemetry)
+		if err := bridge.connect(); err != nil {
+			return fmt.Errorf("mqtt broker %s: %v", s.config.MQTTBroker, err)
+		}
+		defer bridge.disconnect()
+	}
+	if s.config.CoAPPort != "" {
+		var cert *tls.Certificate
+		if s.config.CoAPDTLS {
+			pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return err
+			}
+			cert = &pair
+		} else if s.config.CoAPInsecure {
+			utils.Log().Infoln("coap without dtls, device credentials are sent in clear text")
+		} else {
+			utils.Log().Infoln("coap without dtls, requests with credentials are refused")
+		}
+		listener := newCoAP(s.config, api, telemetry, firmware, cert)
+		if err := listener.listen(); err != nil {
+			return fmt.Errorf("coap port %s: %v", s.config.CoAPPort, err)
+		}
+		defer listener.close()
+	}
+	if s.config.GRPCPort != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		devices := newGRPC(s.config, api, firmware, cert)
+		if err := devices.listen(); err != nil {
+			return fmt.Errorf("grpc port %s: %v", s.config.GRPCPort, err)
+		}
+		defer devices.close()
+	}
 	router := gin.Default()
 	router.Use(gin.Recovery())
 	router.POST("/login", login.loginHandler)
 	a := router.Group("/api")
 	a.Use(api.checkApiKey)
 	a.POST("/register", api.registerDevice)
-	a.POST("/error", api.errorReport)
-	a.StaticFile("/firmware", "././build")
+	a.GET("/firmware/key", firmware.publicKey)
+	d := a.Group("", api.checkDeviceSecret)
+	d.POST("/error", api.errorReport)
+	d.POST("/errors", api.errorBatch)
+	d.POST("/error/:id/attachment", attachments.upload)
+	d.POST("/update", api.updateStatus)
+	d.POST("/heartbeat", api.heartbeat)
+	d.POST("/telemetry", telemetry.report)
+	d.GET("/firmware", firmware.download)
+	d.HEAD("/firmware", firmware.download)
+	d.GET("/firmware/latest", firmware.latest)
+	d.GET("/firmware/manifest", firmware.manifest)
 	w := router.Group("/web")
 	w.Use(web.checkSession)
 	w.GET("/list/:skip/:limit", web.getDevices)
-	err := router.RunTLS(s.config.GetAddr(), "server.pem", "server.key")
+	w.GET("/stats", web.getStats)
+	w.POST("/device/:number/revoke", web.revokeDevice)
+	w.POST("/device/:number/rotate", web.rotateDevice)
+	w.GET("/device/:number/updates", web.getUpdates)
+	w.GET("/device/:number/status", web.getStatusEvents)
+	w.GET("/device/:number/issues", web.getIssues)
+	w.GET("/device/:number/issue/:id/occurrences", web.getOccurrences)
+	w.POST("/device/:number/issue/:id/:action", web.changeIssues)
+	w.POST("/device/:number/issues/:name/:action", web.changeIssues)
+	w.GET("/error/:id/attachments", attachments.list)
+	w.GET("/attachment/:id", attachments.download)
+	w.POST("/device/:number/firmware/:id", firmware.assign)
+	w.GET("/device/:number/downloads", firmware.downloads)
+	w.GET("/device/:number/telemetry/:metric", telemetry.query)
+	w.DELETE("/device/:number/firmware", firmware.assign)
+	w.GET("/firmware", firmware.list)
+	w.POST("/firmware", firmware.upload)
+	w.POST("/device/:number/group/:group", rollouts.setGroup)
+	w.DELETE("/device/:number/group", rollouts.setGroup)
+	w.GET("/rollout", rollouts.list)
+	w.POST("/rollout", rollouts.create)
+	w.GET("/rollout/:id", rollouts.get)
+	w.POST("/rollout/:id/pause", rollouts.pause)
+	w.POST("/rollout/:id/resume", rollouts.resume)
+	w.POST("/rollout/:id/abort", rollouts.abort)
+	w.GET("/rule", alerts.rules)
+	w.POST("/rule", alerts.createRule)
+	w.POST("/rule/:id", alerts.updateRule)
+	w.DELETE("/rule/:id", alerts.deleteRule)
+	w.GET("/alert", alerts.list)
+	w.GET("/subscription", alerts.getSubscription)
+	w.POST("/subscription", alerts.setSubscription)
+	w.GET("/webhook", webhooks.list)
+	w.POST("/webhook", webhooks.create)
+	w.DELETE("/webhook/:id", webhooks.delete)
+	w.GET("/webhook/:id/deliveries", webhooks.deliveries)
+	srv := &http.Server{Addr: s.config.GetAddr(), Handler: router}
+	if s.config.ClientCA != "" {
+		tlsConfig, err := clientAuthConfig(s.config.ClientCA)
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig = tlsConfig
+	}
+	err := srv.ListenAndServeTLS(certFile, keyFile)
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+// clientAuthConfig makes TLS config verifying client certificates by CA
+// bundle. Certificate is optional on handshake since admin panel shares
+// listener with devices, api middleware decides whether it is required
+func clientAuthConfig(caFile string) (*tls.Config, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s", caFile)
+	}
+	return &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.VerifyClientCertIfGiven,
+	}, nil
+}
@@ -2,17 +2,48 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"iot-stats/coap"
+	"iot-stats/delta"
+	"iot-stats/devicepb"
 	"iot-stats/model"
+	"iot-stats/service"
 	"iot-stats/utils"
+	"math/big"
+	"math/rand"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/pion/dtls/v2"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"gopkg.in/mgo.v2/bson"
 )
 
 const (
@@ -29,12 +60,12 @@ var (
 		model.DeviceDto{
 			DeviceNumber: "1234",
 			RegisterDate: time.Now(),
-			Errors:       []model.DeviceErrorDto{},
+			Issues:       []model.Issue{},
 		},
 		model.DeviceDto{
 			DeviceNumber: "1234",
 			RegisterDate: time.Now(),
-			Errors:       []model.DeviceErrorDto{},
+			Issues:       []model.Issue{},
 		},
 	}
 	devicesAnswer = model.Devices{
@@ -54,20 +85,22 @@ var (
 	}
 )
 
-type FakeMongoService struct{}
+// FakeMongoService returns canned data, methods which are not overridden
+// fall through to in-memory storage
+type FakeMongoService struct {
+	*service.MemoryService
+}
 
 func (m *FakeMongoService) Connect() error { return nil }
-func (m *FakeMongoService) GetAllDevices(skip int, limit int) (*[]model.DeviceDto, error) {
+func (m *FakeMongoService) GetAllDevices(skip int, limit int,
+	filter model.DeviceFilter) (*[]model.DeviceDto, error) {
 	return &devicesFromMongo, nil
 }
-func (m *FakeMongoService) GetDevicesCount() (int, error) { return deviceCount, nil }
-func (m *FakeMongoService) RegisterDevice(deviceNumber string,
-	registerDate time.Time) error {
-	return nil
+func (m *FakeMongoService) GetDevicesCount(filter model.DeviceFilter) (int, error) {
+	return deviceCount, nil
 }
-func (m *FakeMongoService) RegisterError(de *model.DeviceErrorDto) error { return nil }
-func (m *FakeMongoService) GetDeviceByNumber(deviceNumber string) (*model.Device, error) {
-	return nil, nil
+func (m *FakeMongoService) RegisterError(de *model.DeviceErrorDto) (string, error) {
+	return "", nil
 }
 func (m *FakeMongoService) GetCookieExp(login string) (*time.Time, error) {
 	expDuration := time.Duration(expiration) * time.Hour
@@ -90,7 +123,7 @@ func fakeHandler(c *gin.Context) {
 
 func testCookies(login string) *http.Cookie {
 	value := map[string]string{
-		"name": login,
+		"login": login,
 	}
 	if encoded, err := cookieHandler.Encode("session", value); err == nil {
 		expDuration := time.Duration(expiration) * time.Hour
@@ -114,8 +147,8 @@ type ServerTestSuite struct {
 }
 
 func (suite *ServerTestSuite) SetupTest() {
-	suite.ms = &FakeMongoService{}
-	suite.api = newApi(apiKey, suite.ms)
+	suite.ms = &FakeMongoService{service.NewMemoryService()}
+	suite.api = newApi(&Config{ApiKey: apiKey}, suite.ms)
 	suite.web = newWeb(expiration, suite.ms)
 	suite.login = newLogin(expiration, suite.ms)
 }
@@ -201,6 +234,1270 @@ func (suite *ServerTestSuite) TestCheckApiKey() {
 	assert.Equal(suite.T(), http.StatusOK, rw.Code)
 }
 
+func (suite *ServerTestSuite) TestDeviceSecret() {
+	testRouter := gin.Default()
+	testRouter.POST("/register", suite.api.registerDevice)
+	testRouter.POST("/error", suite.api.checkDeviceSecret, suite.api.errorReport)
+	testRouter.POST("/revoke/:number", suite.web.revokeDevice)
+	testRouter.POST("/rotate/:number", suite.web.rotateDevice)
+	post := func(path string, body interface{}, secret string) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		req, _ := http.NewRequest("POST", path, bytes.NewReader(data))
+		req.Header.Add(DeviceNumber, deviceDto.DeviceNumber)
+		if secret != "" {
+			req.Header.Add(DeviceSecret, secret)
+		}
+		rw := httptest.NewRecorder()
+		testRouter.ServeHTTP(rw, req)
+		return rw
+	}
+	answer := struct {
+		Secret string `json:"secret"`
+	}{}
+	// Registration issues credential
+	rw := post("/register", deviceDto, "")
+	assert.Equal(suite.T(), http.StatusOK, rw.Code)
+	json.Unmarshal(rw.Body.Bytes(), &answer)
+	assert.NotEmpty(suite.T(), answer.Secret)
+	secret := answer.Secret
+	// Registered device can't be taken over without credential
+	rw = post("/register", deviceDto, "")
+	assert.Equal(suite.T(), http.StatusUnauthorized, rw.Code)
+	rw = post("/register", deviceDto, secret)
+	assert.Equal(suite.T(), http.StatusOK, rw.Code)
+	rw = post("/error", deviceError, "wrong")
+	assert.Equal(suite.T(), http.StatusUnauthorized, rw.Code)
+	rw = post("/error", deviceError, secret)
+	assert.Equal(suite.T(), http.StatusOK, rw.Code)
+	// Device reports only its own errors
+	rw = post("/error", model.DeviceErrorDto{DeviceNumber: "other",
+		ErrorName: "electricity"}, secret)
+	assert.Equal(suite.T(), http.StatusForbidden, rw.Code)
+	// Device of body is checked when request does not tell device number
+	data, _ := json.Marshal(deviceError)
+	for s, code := range map[string]int{"": http.StatusUnauthorized,
+		"wrong": http.StatusUnauthorized, secret: http.StatusOK} {
+		req, _ := http.NewRequest("POST", "/error", bytes.NewReader(data))
+		req.Header.Add(DeviceSecret, s)
+		rw = httptest.NewRecorder()
+		testRouter.ServeHTTP(rw, req)
+		assert.Equal(suite.T(), code, rw.Code, s)
+	}
+	// Revoked device is rejected until credential is rotated
+	rw = post("/revoke/"+deviceDto.DeviceNumber, nil, "")
+	assert.Equal(suite.T(), http.StatusOK, rw.Code)
+	rw = post("/error", deviceError, secret)
+	assert.Equal(suite.T(), http.StatusUnauthorized, rw.Code)
+	rw = post("/register", deviceDto, secret)
+	assert.Equal(suite.T(), http.StatusUnauthorized, rw.Code)
+	rw = post("/rotate/"+deviceDto.DeviceNumber, nil, "")
+	assert.Equal(suite.T(), http.StatusOK, rw.Code)
+	json.Unmarshal(rw.Body.Bytes(), &answer)
+	assert.NotEqual(suite.T(), secret, answer.Secret)
+	rw = post("/error", deviceError, answer.Secret)
+	assert.Equal(suite.T(), http.StatusOK, rw.Code)
+	rw = post("/rotate/unknown", nil, "")
+	assert.Equal(suite.T(), http.StatusNotFound, rw.Code)
+}
+
+func (suite *ServerTestSuite) TestClientCert() {
+	testRouter := gin.Default()
+	testRouter.Use(suite.api.checkApiKey, suite.api.checkDeviceSecret)
+	testRouter.POST("/error", suite.api.errorReport)
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: deviceError.DeviceNumber}}
+	post := func(body interface{}, withCert bool) int {
+		data, _ := json.Marshal(body)
+		req, _ := http.NewRequest("POST", "/error", bytes.NewReader(data))
+		if withCert {
+			req.TLS = &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{cert},
+				VerifiedChains:   [][]*x509.Certificate{{cert}},
+			}
+		}
+		rw := httptest.NewRecorder()
+		testRouter.ServeHTTP(rw, req)
+		return rw.Code
+	}
+	// Certificate replaces api key
+	assert.Equal(suite.T(), http.StatusUnauthorized, post(deviceError, false))
+	assert.Equal(suite.T(), http.StatusOK, post(deviceError, true))
+	// Device may report only for number from certificate
+	assert.Equal(suite.T(), http.StatusForbidden, post(model.DeviceErrorDto{
+		DeviceNumber: "other", ErrorName: "electricity"}, true))
+	// Api key is not accepted when certificate is required
+	suite.api.config.RequireClientCert = true
+	assert.Equal(suite.T(), http.StatusOK, post(deviceError, true))
+	data, _ := json.Marshal(deviceError)
+	req, _ := http.NewRequest("POST", "/error", bytes.NewReader(data))
+	req.Header.Add(apiHeader, apiKey)
+	rw := httptest.NewRecorder()
+	testRouter.ServeHTTP(rw, req)
+	assert.Equal(suite.T(), http.StatusUnauthorized, rw.Code)
+}
+
+func (suite *ServerTestSuite) TestFirmware() {
+	firmware := newFirmware(suite.T().TempDir(), 1<<20, nil, suite.ms)
+	testRouter := gin.Default()
+	testRouter.Use(suite.api.checkDeviceSecret)
+	testRouter.POST("/upload", firmware.upload)
+	testRouter.GET("/firmware", firmware.download)
+	testRouter.GET("/latest", firmware.latest)
+	testRouter.POST("/assign/:number/:id", firmware.assign)
+	upload := func(version, sum string, image []byte) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		form := multipart.NewWriter(body)
+		form.WriteField("version", version)
+		form.WriteField("hardware-model", "m1")
+		form.WriteField("sha256", sum)
+		part, _ := form.CreateFormFile("image", "image.bin")
+		part.Write(image)
+		form.Close()
+		req, _ := http.NewRequest("POST", "/upload", body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		rw := httptest.NewRecorder()
+		testRouter.ServeHTTP(rw, req)
+		return rw
+	}
+	get := func(path, number string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		if number != "" {
+			req.Header.Add(DeviceNumber, number)
+		}
+		rw := httptest.NewRecorder()
+		testRouter.ServeHTTP(rw, req)
+		return rw
+	}
+	image := []byte("firmware 1.0")
+	sum := sha256.Sum256(image)
+	assert.Equal(suite.T(), http.StatusBadRequest, upload("1.0", "00", image).Code)
+	rw := upload("1.0", hex.EncodeToString(sum[:]), image)
+	assert.Equal(suite.T(), http.StatusOK, rw.Code)
+	first := model.Firmware{}
+	json.Unmarshal(rw.Body.Bytes(), &first)
+	assert.Equal(suite.T(), int64(len(image)), first.Size)
+	assert.Equal(suite.T(), http.StatusOK, upload("1.1", "", []byte("firmware 1.1")).Code)
+	// Latest firmware for model is served
+	rw = get("/firmware?model=m1", "")
+	assert.Equal(suite.T(), http.StatusOK, rw.Code)
+	assert.Equal(suite.T(), "firmware 1.1", rw.Body.String())
+	assert.Equal(suite.T(), "1.1", rw.Header().Get(FirmwareVersion))
+	assert.Equal(suite.T(), http.StatusNotFound, get("/latest?model=m2", "").Code)
+	// Assigned firmware wins over latest
+	suite.ms.RegisterDevice("123", time.Now())
+	req, _ := http.NewRequest("POST", "/assign/123/"+first.ID.Hex(), nil)
+	rw = httptest.NewRecorder()
+	testRouter.ServeHTTP(rw, req)
+	assert.Equal(suite.T(), http.StatusOK, rw.Code)
+	rw = get("/firmware?model=m1", "123")
+	assert.Equal(suite.T(), "firmware 1.0", rw.Body.String())
+	digest := "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+	assert.Equal(suite.T(), digest, rw.Header().Get("Content-Digest"))
+	etag := rw.Header().Get("ETag")
+	// Interrupted download is resumed from offset
+	req, _ = http.NewRequest("GET", "/firmware?model=m1", nil)
+	req.Header.Add(DeviceNumber, "123")
+	req.Header.Add("Range", "bytes=9-")
+	req.Header.Add("If-Range", etag)
+	rw = httptest.NewRecorder()
+	testRouter.ServeHTTP(rw, req)
+	assert.Equal(suite.T(), http.StatusPartialContent, rw.Code)
+	assert.Equal(suite.T(), "1.0", rw.Body.String())
+	assert.Equal(suite.T(), digest, rw.Header().Get("Repr-Digest"))
+	assert.Empty(suite.T(), rw.Header().Get("Content-Digest"))
+	// Image device already has is not sent again
+	req, _ = http.NewRequest("GET", "/firmware?model=m1", nil)
+	req.Header.Add(DeviceNumber, "123")
+	req.Header.Add("If-None-Match", etag)
+	rw = httptest.NewRecorder()
+	testRouter.ServeHTTP(rw, req)
+	assert.Equal(suite.T(), http.StatusNotModified, rw.Code)
+	stats, _ := suite.ms.GetDownloads("123")
+	assert.Len(suite.T(), *stats, 1)
+	assert.Equal(suite.T(), 2, (*stats)[0].Downloads)
+	assert.Equal(suite.T(), int64(len(image)+3), (*stats)[0].Bytes)
+}
+
+func (suite *ServerTestSuite) TestFirmwareDelta() {
+	dir := suite.T().TempDir()
+	firmware := newFirmware(dir, 1<<20, nil, suite.ms)
+	testRouter := gin.Default()
+	testRouter.Use(suite.api.checkDeviceSecret)
+	testRouter.GET("/firmware", firmware.download)
+	old := make([]byte, 8192)
+	rand.New(rand.NewSource(1)).Read(old)
+	new := append(append([]byte{}, old[:4096]...), []byte("fix")...)
+	new = append(new, old[4096:]...)
+	for i, image := range [][]byte{old, new} {
+		fw := &model.Firmware{ID: bson.NewObjectId(), Version: []string{"1.0", "1.1"}[i],
+			HardwareModel: "m1", Channel: defaultChannel, Size: int64(len(image))}
+		sum := sha256.Sum256(image)
+		fw.SHA256 = hex.EncodeToString(sum[:])
+		ioutil.WriteFile(firmware.path(fw), image, 0644)
+		suite.ms.AddFirmware(fw)
+	}
+	get := func(accept, version string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/firmware?model=m1", nil)
+		req.Header.Add(AcceptDelta, accept)
+		req.Header.Add(FirmwareVersion, version)
+		rw := httptest.NewRecorder()
+		testRouter.ServeHTTP(rw, req)
+		return rw
+	}
+	rw := get(delta.Format, "1.0")
+	assert.Equal(suite.T(), http.StatusOK, rw.Code)
+	assert.Equal(suite.T(), "1.0", rw.Header().Get(DeltaBase))
+	assert.True(suite.T(), rw.Body.Len() < len(new)/10)
+	patched, err := delta.Patch(old, rw.Body.Bytes())
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), new, patched)
+	deltas, _ := ioutil.ReadDir(filepath.Join(dir, deltaDir))
+	assert.Len(suite.T(), deltas, 1)
+	// Cached delta is served again
+	assert.Equal(suite.T(), rw.Body.Bytes(), get(delta.Format, "1.0").Body.Bytes())
+	// Full image goes to device which can not apply delta or whose
+	// firmware is unknown
+	for _, rw := range []*httptest.ResponseRecorder{get("", "1.0"),
+		get(delta.Format, "0.9"), get(delta.Format, "")} {
+		assert.Empty(suite.T(), rw.Header().Get(DeltaBase))
+		assert.Equal(suite.T(), new, rw.Body.Bytes())
+	}
+	// Delta of other images is not waited for
+	unlock := firmware.lockDelta("a-b")
+	firmware.lockDelta("a-c")()
+	unlock()
+	assert.Empty(suite.T(), firmware.deltaLocks)
+}
+
+func (suite *ServerTestSuite) TestTelemetry() {
+	telemetry := newTelemetry(nil, suite.api, suite.ms, suite.ms)
+	testRouter := gin.Default()
+	testRouter.Use(suite.api.checkDeviceSecret)
+	testRouter.POST("/telemetry", telemetry.report)
+	testRouter.GET("/telemetry/:number/:metric", telemetry.query)
+	post := func(body interface{}) int {
+		data, _ := json.Marshal(body)
+		req, _ := http.NewRequest("POST", "/telemetry", bytes.NewReader(data))
+		rw := httptest.NewRecorder()
+		testRouter.ServeHTTP(rw, req)
+		return rw.Code
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	batch := model.TelemetryDto{DeviceNumber: "123", Samples: []model.SampleDto{
+		{Metric: "temperature", Value: 21.5, Timestamp: now.Add(-time.Minute)},
+		{Metric: "battery", Value: 80, Timestamp: now.Add(-time.Minute)},
+		{Metric: "temperature", Value: 22},
+	}}
+	assert.Equal(suite.T(), http.StatusNotFound, post(batch))
+	suite.ms.RegisterDevice("123", time.Now())
+	assert.Equal(suite.T(), http.StatusOK, post(batch))
+	assert.Equal(suite.T(), http.StatusBadRequest, post(model.TelemetryDto{
+		DeviceNumber: "123"}))
+	assert.Equal(suite.T(), http.StatusBadRequest, post(model.TelemetryDto{
+		DeviceNumber: "123", Samples: []model.SampleDto{{Value: 1}}}))
+	for _, sample := range []model.SampleDto{
+		{Metric: strings.Repeat("m", maxMetricName+1), Value: 1},
+		{Metric: "temp/1", Value: 1},
+		{Metric: "temperature", Value: 1, Timestamp: time.Unix(-1, 0)},
+		{Metric: "temperature", Value: 1, Timestamp: now.Add(2 * maxClockSkew)},
+	} {
+		assert.Equal(suite.T(), http.StatusBadRequest, post(model.TelemetryDto{
+			DeviceNumber: "123", Samples: []model.SampleDto{sample}}), sample.Metric)
+	}
+	assert.Equal(suite.T(), http.StatusOK, post(model.TelemetryDto{
+		DeviceNumber: "123", Samples: []model.SampleDto{
+			{Metric: "cpu.load_1-m", Value: 1, Timestamp: now.Add(maxClockSkew / 2)}}}))
+	query := func(path string) (int, []model.Sample) {
+		req, _ := http.NewRequest("GET", path, nil)
+		rw := httptest.NewRecorder()
+		testRouter.ServeHTTP(rw, req)
+		answer := struct {
+			Resolution string
+			Samples    []model.Sample
+		}{}
+		json.Unmarshal(rw.Body.Bytes(), &answer)
+		return rw.Code, answer.Samples
+	}
+	// Samples are returned for narrow window
+	path := "/telemetry/123/temperature?from=" + now.Add(-time.Hour).Format(time.RFC3339)
+	code, samples := query(path)
+	assert.Equal(suite.T(), http.StatusOK, code)
+	assert.Len(suite.T(), samples, 2)
+	assert.Equal(suite.T(), 21.5, samples[0].Value)
+	_, samples = query(path + "&to=" + now.Add(-30*time.Second).Format(time.RFC3339))
+	assert.Len(suite.T(), samples, 1)
+	code, _ = query("/telemetry/123/temperature?from=yesterday")
+	assert.Equal(suite.T(), http.StatusBadRequest, code)
+	// Rollups are returned for wide window
+	suite.ms.SetRollups([]model.Rollup{{DeviceNumber: "123", Metric: "temperature",
+		Resolution: "1h", Date: now.Truncate(time.Hour), Count: 2, Avg: 21.75}})
+	req, _ := http.NewRequest("GET", "/telemetry/123/temperature?step=2h", nil)
+	rw := httptest.NewRecorder()
+	testRouter.ServeHTTP(rw, req)
+	answer := struct {
+		Resolution string
+		Rollups    []model.Rollup
+	}{}
+	json.Unmarshal(rw.Body.Bytes(), &answer)
+	assert.Equal(suite.T(), "1h", answer.Resolution)
+	assert.Len(suite.T(), answer.Rollups, 1)
+}
+
+func (suite *ServerTestSuite) TestTelemetryResolution() {
+	telemetry := newTelemetry(map[string]time.Duration{
+		model.ResolutionRaw: 7 * 24 * time.Hour,
+		"1m":                30 * 24 * time.Hour,
+	}, suite.api, suite.ms, suite.ms)
+	now := time.Now()
+	day := 24 * time.Hour
+	cases := []struct {
+		window, step time.Duration
+		resolution   string
+	}{
+		{time.Hour, 0, model.ResolutionRaw},
+		{day, 0, "1m"},
+		{day, 30 * time.Second, model.ResolutionRaw},
+		{day, 90 * time.Minute, "1h"},
+		{90 * day, 0, "1h"},
+		{3 * 365 * day, 0, "1d"},
+		// Samples and minute rollups have expired
+		{60 * day, time.Second, "1h"},
+	}
+	for _, tc := range cases {
+		assert.Equal(suite.T(), tc.resolution,
+			telemetry.resolution(now.Add(-tc.window), now, tc.step, now), tc)
+	}
+}
+
+func (suite *ServerTestSuite) TestStats() {
+	testRouter := gin.Default()
+	testRouter.GET("/stats", suite.web.getStats)
+	get := func(query string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/stats"+query, nil)
+		rw := httptest.NewRecorder()
+		testRouter.ServeHTTP(rw, req)
+		return rw
+	}
+	suite.ms.RegisterDevice("123", time.Now())
+	rw := get("")
+	assert.Equal(suite.T(), http.StatusOK, rw.Code)
+	stats := model.Stats{}
+	json.Unmarshal(rw.Body.Bytes(), &stats)
+	assert.Equal(suite.T(), 1, stats.Devices)
+	// Week is covered by default
+	assert.Len(suite.T(), stats.Days, 8)
+	assert.Equal(suite.T(), 1, stats.Days[7].New)
+	assert.Equal(suite.T(), http.StatusBadRequest, get("?top=0").Code)
+	assert.Equal(suite.T(), http.StatusBadRequest, get("?from=2000-01-01T00:00:00Z").Code)
+}
+
+func (suite *ServerTestSuite) TestHeartbeat() {
+	testRouter := gin.Default()
+	testRouter.Use(suite.api.checkDeviceSecret)
+	testRouter.POST("/heartbeat", suite.api.heartbeat)
+	testRouter.GET("/list/:skip/:limit", suite.web.getDevices)
+	testRouter.GET("/status/:number", suite.web.getStatusEvents)
+	post := func(body interface{}) int {
+		data, _ := json.Marshal(body)
+		req, _ := http.NewRequest("POST", "/heartbeat", bytes.NewReader(data))
+		rw := httptest.NewRecorder()
+		testRouter.ServeHTTP(rw, req)
+		return rw.Code
+	}
+	hb := model.HeartbeatDto{DeviceNumber: "123", Uptime: 3600}
+	assert.Equal(suite.T(), http.StatusNotFound, post(hb))
+	suite.ms.RegisterDevice("123", time.Now())
+	assert.Equal(suite.T(), http.StatusOK, post(hb))
+	assert.Equal(suite.T(), http.StatusBadRequest, post(model.HeartbeatDto{
+		DeviceNumber: "123", Uptime: -1}))
+	assert.Equal(suite.T(), http.StatusBadRequest, post("not heartbeat"))
+	device, _ := suite.ms.GetDeviceByNumber("123")
+	assert.Equal(suite.T(), model.StatusOnline, device.Status)
+	assert.Equal(suite.T(), int64(3600), device.Uptime)
+	req, _ := http.NewRequest("GET", "/status/123", nil)
+	rw := httptest.NewRecorder()
+	testRouter.ServeHTTP(rw, req)
+	events := []model.StatusEvent{}
+	json.Unmarshal(rw.Body.Bytes(), &events)
+	assert.Len(suite.T(), events, 1)
+	req, _ = http.NewRequest("GET", "/list/0/10?status=sleeping", nil)
+	rw = httptest.NewRecorder()
+	testRouter.ServeHTTP(rw, req)
+	assert.Equal(suite.T(), http.StatusBadRequest, rw.Code)
+}
+
+func (suite *ServerTestSuite) TestErrorBatch() {
+	testRouter := gin.Default()
+	testRouter.Use(suite.api.checkDeviceSecret)
+	testRouter.POST("/errors", suite.api.errorBatch)
+	post := func(body interface{}) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		req, _ := http.NewRequest("POST", "/errors", bytes.NewReader(data))
+		rw := httptest.NewRecorder()
+		testRouter.ServeHTTP(rw, req)
+		return rw
+	}
+	// Single report of unknown device is answered like batch, fake storage
+	// accepts every single report
+	api := newApi(&Config{ApiKey: apiKey}, service.NewMemoryService())
+	assert.Equal(suite.T(), http.StatusNotFound, api.reportError(&deviceAuth{},
+		&model.DeviceErrorDto{ErrorName: "electricity", DeviceNumber: "123"}).status)
+	past := time.Now().Add(-time.Hour)
+	batch := model.ErrorBatchDto{DeviceNumber: "123", Errors: []model.DeviceErrorDto{
+		{ErrorName: "electricity", Timestamp: &past},
+		{ErrorName: "water", Severity: "fatal"},
+		{ErrorName: "electricity", DeviceNumber: "456"},
+		{ErrorName: "water", DeviceNumber: "123", Timestamp: &past},
+	}}
+	assert.Equal(suite.T(), http.StatusNotFound, post(batch).Code)
+	assert.Equal(suite.T(), http.StatusBadRequest,
+		post(model.ErrorBatchDto{DeviceNumber: "123"}).Code)
+	suite.ms.RegisterDevice("123", time.Now())
+	rw := post(batch)
+	assert.Equal(suite.T(), http.StatusOK, rw.Code)
+	answer := struct {
+		Registered int           `json:"registered"`
+		Rejected   int           `json:"rejected"`
+		Results    []BatchResult `json:"results"`
+	}{}
+	json.Unmarshal(rw.Body.Bytes(), &answer)
+	assert.Equal(suite.T(), 2, answer.Registered)
+	assert.Equal(suite.T(), 2, answer.Rejected)
+	assert.Len(suite.T(), answer.Results, 4)
+	assert.Equal(suite.T(), BatchResult{Index: 1, Status: batchRejected,
+		Error: "Wrong severity"}, answer.Results[1])
+	assert.Equal(suite.T(), batchRejected, answer.Results[2].Status)
+	assert.Equal(suite.T(), batchRegistered, answer.Results[3].Status)
+	issues, _ := suite.ms.GetIssues("123", model.DeviceFilter{})
+	assert.Len(suite.T(), *issues, 2)
+}
+
+func (suite *ServerTestSuite) TestAttachments() {
+	attachments := newAttachments(8, suite.api, suite.ms,
+		service.NewDiskBlobStore(suite.T().TempDir()))
+	testRouter := gin.Default()
+	testRouter.Use(suite.api.checkDeviceSecret)
+	testRouter.POST("/error/:id/attachment", attachments.upload)
+	testRouter.GET("/error/:id/attachments", attachments.list)
+	testRouter.GET("/attachment/:id", attachments.download)
+	send := func(req *http.Request) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		testRouter.ServeHTTP(rw, req)
+		return rw
+	}
+	upload := func(id string, body io.Reader, contentType string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/error/"+id+"/attachment?name=log.txt", body)
+		req.Header.Set("Content-Type", contentType)
+		return send(req)
+	}
+	suite.ms.RegisterDevice("123", time.Now())
+	id, _ := suite.ms.MemoryService.RegisterError(&model.DeviceErrorDto{
+		DeviceNumber: "123", ErrorName: "crash", Attachment: true})
+	assert.Equal(suite.T(), http.StatusNotFound,
+		upload("unknown", strings.NewReader("log"), "text/plain").Code)
+	assert.Equal(suite.T(), http.StatusRequestEntityTooLarge,
+		upload(id, strings.NewReader("long log line"), "text/plain").Code)
+	assert.Equal(suite.T(), http.StatusBadRequest,
+		upload(id, strings.NewReader(""), "text/plain").Code)
+	rw := upload(id, strings.NewReader("log"), "text/plain")
+	assert.Equal(suite.T(), http.StatusOK, rw.Code)
+	attachment := model.Attachment{}
+	json.Unmarshal(rw.Body.Bytes(), &attachment)
+	assert.Equal(suite.T(), "log.txt", attachment.Name)
+	assert.Equal(suite.T(), int64(3), attachment.Size)
+	// Multipart upload takes name and type of file
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	part, _ := form.CreateFormFile("file", "core")
+	part.Write([]byte{0x7f, 'E', 'L', 'F'})
+	form.Close()
+	assert.Equal(suite.T(), http.StatusOK, upload(id, body, form.FormDataContentType()).Code)
+	req, _ := http.NewRequest("GET", "/error/"+id+"/attachments", nil)
+	list := []model.Attachment{}
+	json.Unmarshal(send(req).Body.Bytes(), &list)
+	assert.Len(suite.T(), list, 2)
+	assert.Equal(suite.T(), "core", list[1].Name)
+	req, _ = http.NewRequest("GET", "/attachment/"+attachment.ID.Hex(), nil)
+	rw = send(req)
+	assert.Equal(suite.T(), http.StatusOK, rw.Code)
+	assert.Equal(suite.T(), "log", rw.Body.String())
+	assert.Equal(suite.T(), "application/octet-stream", rw.Header().Get("Content-Type"))
+	assert.Equal(suite.T(), "nosniff", rw.Header().Get("X-Content-Type-Options"))
+	assert.Equal(suite.T(), `attachment; filename=log.txt`,
+		rw.Header().Get("Content-Disposition"))
+	req, _ = http.NewRequest("GET", "/attachment/unknown", nil)
+	assert.Equal(suite.T(), http.StatusNotFound, send(req).Code)
+	// Attachment which content is gone is not found either
+	attachments.blobs.DeleteBlob(attachment.ID.Hex())
+	req, _ = http.NewRequest("GET", "/attachment/"+attachment.ID.Hex(), nil)
+	assert.Equal(suite.T(), http.StatusNotFound, send(req).Code)
+}
+
+func TestValidateError(t *testing.T) {
+	now := time.Now()
+	future := now.Add(2 * time.Hour)
+	past := now.Add(-time.Minute)
+	de := &model.DeviceErrorDto{DeviceNumber: "123", ErrorName: "electricity"}
+	assert.Empty(t, validateError(de, now))
+	assert.Equal(t, model.SeverityError, de.Severity)
+	for _, wrong := range []model.DeviceErrorDto{
+		{ErrorName: ""},
+		{ErrorName: "electricity", Severity: "fatal"},
+		{ErrorName: "electricity", Fingerprint: strings.Repeat("f", 129)},
+		{ErrorName: "electricity", Code: -1},
+		{ErrorName: "electricity", Timestamp: &future},
+		{ErrorName: "electricity", FirmwareVersion: strings.Repeat("1", 65)},
+		{ErrorName: "electricity", Context: map[string]interface{}{"a.b": 1}},
+		{ErrorName: "electricity", Context: map[string]interface{}{
+			"nested": []interface{}{map[string]interface{}{"$set": 1}}}},
+		{ErrorName: "electricity", Context: map[string]interface{}{
+			"big": strings.Repeat("x", 5000)}},
+	} {
+		assert.NotEmpty(t, validateError(&wrong, now), wrong)
+	}
+	de = &model.DeviceErrorDto{ErrorName: "overheat", Severity: model.SeverityCritical,
+		Code: 17, Timestamp: &past, FirmwareVersion: "1.2",
+		Context: map[string]interface{}{"temperature": 92.5}}
+	assert.Empty(t, validateError(de, now))
+}
+
+func (suite *ServerTestSuite) TestIssueLifecycle() {
+	testRouter := gin.Default()
+	testRouter.Use(suite.web.checkSession)
+	testRouter.GET("/device/:number/issues", suite.web.getIssues)
+	testRouter.GET("/device/:number/issue/:id/occurrences", suite.web.getOccurrences)
+	testRouter.POST("/device/:number/issue/:id/:action", suite.web.changeIssues)
+	testRouter.POST("/device/:number/issues/:name/:action", suite.web.changeIssues)
+	send := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		req, _ := http.NewRequest(method, path, bytes.NewReader(data))
+		req.Header.Add("Cookie", testCookies(login).String())
+		rw := httptest.NewRecorder()
+		testRouter.ServeHTTP(rw, req)
+		return rw
+	}
+	post := func(path string, body interface{}) int {
+		return send("POST", path, body).Code
+	}
+	suite.ms.RegisterDevice("123", time.Now())
+	suite.ms.MemoryService.RegisterError(&deviceError)
+	suite.ms.MemoryService.RegisterError(&deviceError)
+	assert.Equal(suite.T(), http.StatusNotFound,
+		post("/device/456/issues/electricity/resolve", nil))
+	assert.Equal(suite.T(), http.StatusNotFound,
+		post("/device/123/issues/water/resolve", nil))
+	assert.Equal(suite.T(), http.StatusBadRequest,
+		post("/device/123/issues/electricity/ignore", nil))
+	assert.Equal(suite.T(), http.StatusOK,
+		post("/device/123/issues/electricity/assign", PostErrorChange{Assignee: "bob"}))
+	assert.Equal(suite.T(), http.StatusOK,
+		post("/device/123/issues/electricity/acknowledge", nil))
+	rw := send("GET", "/device/123/issues", nil)
+	assert.Equal(suite.T(), http.StatusOK, rw.Code)
+	issues := []model.Issue{}
+	json.Unmarshal(rw.Body.Bytes(), &issues)
+	assert.Len(suite.T(), issues, 1)
+	issue := issues[0]
+	assert.Equal(suite.T(), 2, issue.Count)
+	assert.Equal(suite.T(), model.ErrorAcknowledged, issue.State)
+	assert.Equal(suite.T(), "bob", issue.Assignee)
+	// Change is recorded with login of admin
+	assert.Equal(suite.T(), login, issue.History[1].Login)
+	rw = send("GET", "/device/123/issue/"+issue.ID.Hex()+"/occurrences", nil)
+	assert.Equal(suite.T(), http.StatusOK, rw.Code)
+	occurrences := []model.DeviceErrorDto{}
+	json.Unmarshal(rw.Body.Bytes(), &occurrences)
+	assert.Len(suite.T(), occurrences, 2)
+	assert.Equal(suite.T(), http.StatusNotFound,
+		send("GET", "/device/123/issue/unknown/occurrences", nil).Code)
+	assert.Equal(suite.T(), http.StatusOK,
+		post("/device/123/issue/"+issue.ID.Hex()+"/resolve", nil))
+	devices, _ := suite.ms.MemoryService.GetAllDevices(0, 1, model.DeviceFilter{})
+	assert.Len(suite.T(), (*devices)[0].Issues, 0)
+	rw = send("GET", "/device/123/issues?errors=all", nil)
+	json.Unmarshal(rw.Body.Bytes(), &issues)
+	assert.Len(suite.T(), issues, 1)
+}
+
+func (suite *ServerTestSuite) TestRollout() {
+	firmware := newFirmware(suite.T().TempDir(), 1<<20, nil, suite.ms)
+	rollouts := newRollouts(suite.ms)
+	testRouter := gin.Default()
+	testRouter.Use(suite.api.checkDeviceSecret)
+	testRouter.GET("/firmware", firmware.latest)
+	testRouter.GET("/download", firmware.download)
+	testRouter.HEAD("/download", firmware.download)
+	testRouter.POST("/rollout", rollouts.create)
+	testRouter.POST("/rollout/:id/abort", rollouts.abort)
+	for _, version := range []string{"1.0", "2.0"} {
+		suite.ms.AddFirmware(&model.Firmware{Version: version, Channel: defaultChannel})
+	}
+	list, _ := suite.ms.GetFirmwareList()
+	target := (*list)[0]
+	for _, number := range []string{"123", "456"} {
+		suite.ms.RegisterDevice(number, time.Now())
+	}
+	suite.ms.SetDeviceGroup("123", "lab")
+	version := func(number string) string {
+		req, _ := http.NewRequest("GET", "/firmware", nil)
+		if number != "" {
+			req.Header.Add(DeviceNumber, number)
+		}
+		rw := httptest.NewRecorder()
+		testRouter.ServeHTTP(rw, req)
+		fw := model.Firmware{}
+		json.Unmarshal(rw.Body.Bytes(), &fw)
+		return fw.Version
+	}
+	post := func(path string, body interface{}) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		req, _ := http.NewRequest("POST", path, bytes.NewReader(data))
+		rw := httptest.NewRecorder()
+		testRouter.ServeHTTP(rw, req)
+		return rw
+	}
+	rollout := PostRollout{
+		Firmware:     target.ID.Hex(),
+		Steps:        []model.RolloutStep{{Group: "lab"}, {Percent: 100}},
+		StepDuration: 60,
+	}
+	rw := post("/rollout", rollout)
+	assert.Equal(suite.T(), http.StatusOK, rw.Code)
+	created := model.Rollout{}
+	json.Unmarshal(rw.Body.Bytes(), &created)
+	assert.Equal(suite.T(), http.StatusConflict, post("/rollout", rollout).Code)
+	// Only group of first step gets firmware under rollout
+	assert.Equal(suite.T(), "2.0", version("123"))
+	assert.Equal(suite.T(), "1.0", version("456"))
+	assert.Equal(suite.T(), "1.0", version(""))
+	// Device which only asked about image is not updated by rollout
+	ioutil.WriteFile(firmware.path(&target), []byte("image"), 0644)
+	req, _ := http.NewRequest("HEAD", "/download", nil)
+	req.Header.Add(DeviceNumber, "123")
+	testRouter.ServeHTTP(httptest.NewRecorder(), req)
+	member, _ := suite.ms.IsRolloutDevice(created.ID.Hex(), "123")
+	assert.False(suite.T(), member)
+	req, _ = http.NewRequest("GET", "/download", nil)
+	req.Header.Add(DeviceNumber, "123")
+	rw = httptest.NewRecorder()
+	testRouter.ServeHTTP(rw, req)
+	assert.Equal(suite.T(), "image", rw.Body.String())
+	member, _ = suite.ms.IsRolloutDevice(created.ID.Hex(), "123")
+	assert.True(suite.T(), member)
+	// Aborted rollout stops delivering firmware
+	rw = post("/rollout/"+created.ID.Hex()+"/abort", nil)
+	assert.Equal(suite.T(), http.StatusOK, rw.Code)
+	assert.Equal(suite.T(), "1.0", version("123"))
+	assert.Equal(suite.T(), http.StatusConflict,
+		post("/rollout/"+created.ID.Hex()+"/abort", nil).Code)
+}
+
+func (suite *ServerTestSuite) TestAlertRules() {
+	alerts := newAlerts(suite.ms)
+	testRouter := gin.Default()
+	testRouter.GET("/rule", alerts.rules)
+	testRouter.POST("/rule", alerts.createRule)
+	testRouter.POST("/rule/:id", alerts.updateRule)
+	testRouter.DELETE("/rule/:id", alerts.deleteRule)
+	testRouter.GET("/alert", alerts.list)
+	request := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		req, _ := http.NewRequest(method, path, bytes.NewReader(data))
+		rw := httptest.NewRecorder()
+		testRouter.ServeHTTP(rw, req)
+		return rw
+	}
+	for _, post := range []PostRule{
+		{Kind: model.RuleOffline, Window: 5},
+		{Name: "offline", Kind: model.RuleOffline},
+		{Name: "offline", Kind: model.RuleOffline, Window: maxRuleWindow + 1},
+		{Name: "crashes", Kind: model.RuleErrors, Window: 5},
+		{Name: "crashes", Kind: model.RuleErrors, ErrorName: "crash", Threshold: -1, Window: 5},
+		{Name: "hot", Kind: model.RuleMetric, Window: 5},
+		{Name: "other", Kind: "other", Window: 5},
+	} {
+		assert.Equal(suite.T(), http.StatusBadRequest, request("POST", "/rule", post).Code,
+			post.Name)
+	}
+	rw := request("POST", "/rule", PostRule{Name: "hot", Kind: model.RuleMetric,
+		Metric: "temp", Threshold: 80, Window: 5, ErrorName: "ignored"})
+	assert.Equal(suite.T(), http.StatusOK, rw.Code)
+	rule := model.Rule{}
+	json.Unmarshal(rw.Body.Bytes(), &rule)
+	assert.Equal(suite.T(), "temp", rule.Metric)
+	assert.Empty(suite.T(), rule.ErrorName)
+	rw = request("POST", "/rule/"+rule.ID.Hex(), PostRule{Name: "crashes",
+		Kind: model.RuleErrors, ErrorName: "crash", Threshold: 3, Window: 10})
+	assert.Equal(suite.T(), http.StatusOK, rw.Code)
+	rules, _ := suite.ms.GetRules()
+	assert.Len(suite.T(), *rules, 1)
+	assert.Equal(suite.T(), "crash", (*rules)[0].ErrorName)
+	assert.Empty(suite.T(), (*rules)[0].Metric)
+	assert.Equal(suite.T(), rule.CreateDate.Unix(), (*rules)[0].CreateDate.Unix())
+	assert.Equal(suite.T(), http.StatusOK, request("GET", "/rule", nil).Code)
+	assert.Equal(suite.T(), http.StatusOK,
+		request("DELETE", "/rule/"+rule.ID.Hex(), nil).Code)
+	assert.Equal(suite.T(), http.StatusNotFound,
+		request("DELETE", "/rule/"+rule.ID.Hex(), nil).Code)
+	assert.Equal(suite.T(), http.StatusNotFound,
+		request("POST", "/rule/"+rule.ID.Hex(), PostRule{}).Code)
+
+	suite.ms.AddAlert(&model.Alert{RuleId: rule.ID, DeviceNumber: "123",
+		State: model.AlertResolved})
+	suite.ms.AddAlert(&model.Alert{RuleId: rule.ID, DeviceNumber: "456",
+		State: model.AlertFiring})
+	rw = request("GET", "/alert?state=firing", nil)
+	assert.Equal(suite.T(), http.StatusOK, rw.Code)
+	listed := []model.Alert{}
+	json.Unmarshal(rw.Body.Bytes(), &listed)
+	assert.Len(suite.T(), listed, 1)
+	assert.Equal(suite.T(), "456", listed[0].DeviceNumber)
+	assert.Equal(suite.T(), http.StatusBadRequest, request("GET", "/alert?state=open", nil).Code)
+}
+
+func (suite *ServerTestSuite) TestWebhooks() {
+	webhooks := newWebhooks(suite.ms)
+	testRouter := gin.Default()
+	testRouter.GET("/webhook", webhooks.list)
+	testRouter.POST("/webhook", webhooks.create)
+	testRouter.DELETE("/webhook/:id", webhooks.delete)
+	testRouter.GET("/webhook/:id/deliveries", webhooks.deliveries)
+	request := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		req, _ := http.NewRequest(method, path, bytes.NewReader(data))
+		rw := httptest.NewRecorder()
+		testRouter.ServeHTTP(rw, req)
+		return rw
+	}
+	for _, post := range []PostWebhook{
+		{URL: "ftp://example.com"},
+		{URL: "example.com/hook"},
+		{URL: "https://example.com/hook", Events: []string{"device.deleted"}},
+	} {
+		assert.Equal(suite.T(), http.StatusBadRequest, request("POST", "/webhook", post).Code,
+			post.URL)
+	}
+	rw := request("POST", "/webhook", PostWebhook{URL: "https://example.com/hook",
+		Events: []string{model.EventAlertFired}})
+	assert.Equal(suite.T(), http.StatusOK, rw.Code)
+	webhook := model.Webhook{}
+	json.Unmarshal(rw.Body.Bytes(), &webhook)
+	assert.NotEmpty(suite.T(), webhook.Secret)
+	rw = request("GET", "/webhook", nil)
+	listed := []model.Webhook{}
+	json.Unmarshal(rw.Body.Bytes(), &listed)
+	assert.Len(suite.T(), listed, 1)
+	assert.Empty(suite.T(), listed[0].Secret)
+
+	suite.ms.AddDeliveries([]model.Delivery{{WebhookId: webhook.ID,
+		Event: model.EventAlertFired, State: model.DeliveryFailed, Attempts: 8}})
+	rw = request("GET", "/webhook/"+webhook.ID.Hex()+"/deliveries", nil)
+	assert.Equal(suite.T(), http.StatusOK, rw.Code)
+	deliveries := []model.Delivery{}
+	json.Unmarshal(rw.Body.Bytes(), &deliveries)
+	assert.Len(suite.T(), deliveries, 1)
+	assert.Equal(suite.T(), 8, deliveries[0].Attempts)
+	assert.Equal(suite.T(), http.StatusOK,
+		request("DELETE", "/webhook/"+webhook.ID.Hex(), nil).Code)
+	assert.Equal(suite.T(), http.StatusNotFound,
+		request("GET", "/webhook/"+webhook.ID.Hex()+"/deliveries", nil).Code)
+	assert.Equal(suite.T(), http.StatusNotFound,
+		request("DELETE", "/webhook/"+webhook.ID.Hex(), nil).Code)
+}
+
+func (suite *ServerTestSuite) TestSubscription() {
+	alerts := newAlerts(suite.ms)
+	testRouter := gin.Default()
+	testRouter.Use(func(c *gin.Context) { c.Set(loginKey, "admin") })
+	testRouter.GET("/subscription", alerts.getSubscription)
+	testRouter.POST("/subscription", alerts.setSubscription)
+	post := func(body interface{}) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		req, _ := http.NewRequest("POST", "/subscription", bytes.NewReader(data))
+		rw := httptest.NewRecorder()
+		testRouter.ServeHTTP(rw, req)
+		return rw
+	}
+	req, _ := http.NewRequest("GET", "/subscription", nil)
+	rw := httptest.NewRecorder()
+	testRouter.ServeHTTP(rw, req)
+	assert.Equal(suite.T(), http.StatusOK, rw.Code)
+	for _, s := range []PostSubscription{
+		{Email: "admin", Alerts: true},
+		{Email: "Admin <admin@example.com>"},
+		{Alerts: true},
+		{Email: "admin@example.com", Digest: "weekly"},
+	} {
+		assert.Equal(suite.T(), http.StatusBadRequest, post(s).Code, s.Email)
+	}
+	rw = post(PostSubscription{Email: "admin@example.com", Alerts: true,
+		Digest: model.DigestDaily})
+	assert.Equal(suite.T(), http.StatusOK, rw.Code)
+	now := time.Now()
+	s, _ := suite.ms.GetSubscription("admin")
+	assert.True(suite.T(), s.Alerts)
+	s.DigestDate = now
+	suite.ms.SetSubscription(s)
+	// Digest starts over when its period changes only
+	post(PostSubscription{Email: "admin@example.com", Digest: model.DigestDaily})
+	s, _ = suite.ms.GetSubscription("admin")
+	assert.False(suite.T(), s.Alerts)
+	assert.Equal(suite.T(), now, s.DigestDate)
+	post(PostSubscription{Email: "admin@example.com", Digest: model.DigestHourly})
+	s, _ = suite.ms.GetSubscription("admin")
+	assert.True(suite.T(), s.DigestDate.IsZero())
+}
+
+func (suite *ServerTestSuite) TestMQTTBridge() {
+	config := &Config{ApiKey: apiKey, MQTTPrefix: "devices"}
+	api := newApi(config, suite.ms)
+	bridge := newBridge(config, api, newTelemetry(nil, api, suite.ms, suite.ms))
+	type answer struct {
+		Status int    `json:"status"`
+		Secret string `json:"secret"`
+		Error  string `json:"error"`
+	}
+	publish := func(resource string, body interface{}) answer {
+		data, _ := json.Marshal(body)
+		topic := "devices/" + deviceDto.DeviceNumber + "/" + resource
+		replyTopic, payload := bridge.handle(topic, data)
+		assert.Equal(suite.T(), topic+"/reply", replyTopic)
+		got := answer{}
+		json.Unmarshal(payload, &got)
+		return got
+	}
+	// Api key and device secret are fields of body
+	got := publish("register", gin.H{"device-number": deviceDto.DeviceNumber})
+	assert.Equal(suite.T(), http.StatusUnauthorized, got.Status)
+	got = publish("register", gin.H{"api-key": apiKey,
+		"device-number": deviceDto.DeviceNumber})
+	assert.Equal(suite.T(), http.StatusOK, got.Status)
+	secret := got.Secret
+	assert.NotEmpty(suite.T(), secret)
+	got = publish("error", gin.H{"api-key": apiKey, "device-number": deviceDto.DeviceNumber,
+		"error-name": "electricity"})
+	assert.Equal(suite.T(), http.StatusUnauthorized, got.Status)
+	got = publish("error", gin.H{"api-key": apiKey, "device-secret": secret,
+		"device-number": deviceDto.DeviceNumber, "error-name": "electricity"})
+	assert.Equal(suite.T(), http.StatusOK, got.Status)
+	got = publish("error", gin.H{"api-key": apiKey, "device-secret": secret,
+		"device-number": "other", "error-name": "electricity"})
+	assert.Equal(suite.T(), http.StatusForbidden, got.Status)
+	got = publish("heartbeat", gin.H{"api-key": apiKey, "device-secret": secret,
+		"device-number": deviceDto.DeviceNumber, "uptime": 60})
+	assert.Equal(suite.T(), http.StatusOK, got.Status)
+	samples := []gin.H{{"metric": "temperature", "value": 21.5}}
+	got = publish("telemetry", gin.H{"api-key": apiKey, "device-secret": secret,
+		"device-number": deviceDto.DeviceNumber, "samples": samples})
+	assert.Equal(suite.T(), http.StatusOK, got.Status)
+	stored, _ := suite.ms.GetSamples(deviceDto.DeviceNumber, "temperature",
+		time.Now().Add(-time.Minute), time.Now().Add(time.Minute))
+	assert.Len(suite.T(), *stored, 1)
+	got = publish("firmware", gin.H{"api-key": apiKey})
+	assert.Equal(suite.T(), http.StatusNotFound, got.Status)
+	// Replies and other topics are not answered
+	replyTopic, _ := bridge.handle("devices/"+deviceDto.DeviceNumber+"/error/reply", nil)
+	assert.Empty(suite.T(), replyTopic)
+
+	// Report of device with secret is answered the same way over http
+	testRouter := gin.Default()
+	testRouter.Use(api.checkApiKey, api.checkDeviceSecret)
+	testRouter.POST("/error", api.errorReport)
+	for _, c := range []struct {
+		secret    string
+		errorName string
+		status    int
+	}{
+		{secret, "electricity", http.StatusOK},
+		{secret, "", http.StatusBadRequest},
+		{"wrong", "electricity", http.StatusUnauthorized},
+		{"", "electricity", http.StatusUnauthorized},
+	} {
+		data, _ := json.Marshal(model.DeviceErrorDto{
+			DeviceNumber: deviceDto.DeviceNumber, ErrorName: c.errorName})
+		req, _ := http.NewRequest("POST", "/error", bytes.NewReader(data))
+		req.Header.Add(apiHeader, apiKey)
+		req.Header.Add(DeviceNumber, deviceDto.DeviceNumber)
+		req.Header.Add(DeviceSecret, c.secret)
+		rw := httptest.NewRecorder()
+		testRouter.ServeHTTP(rw, req)
+		httpAnswer := answer{}
+		json.Unmarshal(rw.Body.Bytes(), &httpAnswer)
+		got = publish("error", gin.H{"api-key": apiKey, "device-secret": c.secret,
+			"device-number": deviceDto.DeviceNumber, "error-name": c.errorName})
+		assert.Equal(suite.T(), c.status, rw.Code, c)
+		assert.Equal(suite.T(), rw.Code, got.Status, c)
+		assert.Equal(suite.T(), httpAnswer.Error, got.Error, c)
+	}
+}
+
+// coapRequest makes confirmable request with path and query parameters
+func coapRequest(id uint16, code coap.Code, path string, query []string,
+	payload string, options ...coap.Option) []byte {
+	req := &coap.Message{Type: coap.Confirmable, Code: code, MessageID: id,
+		Token: []byte{0xca, 0xfe}, Options: options, Payload: []byte(payload)}
+	for _, part := range strings.Split(path, "/") {
+		req.AddOption(coap.URIPath, []byte(part))
+	}
+	for _, q := range query {
+		req.AddOption(coap.URIQuery, []byte(q))
+	}
+	data, _ := req.Marshal()
+	return data
+}
+
+// testCertificate makes self-signed certificate for common name, it may
+// be used as its own CA
+func testCertificate(t *testing.T, cn string) (tls.Certificate, []byte) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(cryptorand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func (suite *ServerTestSuite) TestCoAP() {
+	config := &Config{ApiKey: apiKey, CoAPInsecure: true}
+	api := newApi(config, suite.ms)
+	firmware := newFirmware(suite.T().TempDir(), 1<<20, nil, suite.ms)
+	listener := newCoAP(config, api, newTelemetry(nil, api, suite.ms, suite.ms), firmware, nil)
+	id := uint16(0)
+	request := func(code coap.Code, path string, query []string, payload string,
+		options ...coap.Option) *coap.Message {
+		id++
+		resp, err := coap.Unmarshal(listener.handle("device",
+			coapRequest(id, code, path, query, payload, options...), ""))
+		assert.Nil(suite.T(), err)
+		assert.Equal(suite.T(), coap.Acknowledgement, resp.Type)
+		assert.Equal(suite.T(), id, resp.MessageID)
+		assert.Equal(suite.T(), []byte{0xca, 0xfe}, resp.Token)
+		return resp
+	}
+	key := "api-key=" + apiKey
+	number := "device-number=" + deviceDto.DeviceNumber
+	registration, _ := json.Marshal(deviceDto)
+	report, _ := json.Marshal(deviceError)
+	// Credentials are query parameters, they are refused without DTLS
+	// unless insecure CoAP is allowed
+	config.CoAPInsecure = false
+	resp := request(coap.POST, "api/register", []string{key}, string(registration))
+	assert.Equal(suite.T(), coap.Forbidden, resp.Code)
+	config.CoAPInsecure = true
+	resp = request(coap.POST, "api/register", nil, string(registration))
+	assert.Equal(suite.T(), coap.Unauthorized, resp.Code)
+	resp = request(coap.POST, "api/register", []string{key}, string(registration))
+	assert.Equal(suite.T(), coap.Changed, resp.Code)
+	answer := struct {
+		Secret  string `json:"secret"`
+		Version string `json:"version"`
+	}{}
+	json.Unmarshal(resp.Payload, &answer)
+	assert.NotEmpty(suite.T(), answer.Secret)
+	secret := "device-secret=" + answer.Secret
+	resp = request(coap.POST, "api/error", []string{key, number}, string(report))
+	assert.Equal(suite.T(), coap.Unauthorized, resp.Code)
+	resp = request(coap.POST, "api/error", []string{key, number, secret}, string(report))
+	assert.Equal(suite.T(), coap.Changed, resp.Code)
+	resp = request(coap.POST, "api/error", []string{key, number, secret}, `{"device-number": "123"}`)
+	assert.Equal(suite.T(), coap.BadRequest, resp.Code)
+	assert.Equal(suite.T(), uint32(coap.JSON), coap.DecodeUint(resp.Option(coap.ContentFormat)))
+	resp = request(coap.GET, "api/error", []string{key, number, secret}, "")
+	assert.Equal(suite.T(), coap.MethodNotAllowed, resp.Code)
+	resp = request(coap.POST, "api/unknown", []string{key}, "")
+	assert.Equal(suite.T(), coap.NotFound, resp.Code)
+	resp = request(coap.POST, "api/error", []string{key, number, secret}, string(report),
+		coap.Option{Number: coap.Block1, Value: coap.Block{More: true, Size: 64}.Encode()})
+	assert.Equal(suite.T(), coap.RequestEntityTooLarge, resp.Code)
+	resp = request(coap.POST, "api/error", []string{key, number, secret}, string(report),
+		coap.Option{Number: 9})
+	assert.Equal(suite.T(), coap.BadOption, resp.Code)
+
+	// Firmware is sent in blocks device asks for
+	image := bytes.Repeat([]byte("0123456789"), 5)
+	sum := sha256.Sum256(image)
+	fw := &model.Firmware{ID: bson.NewObjectId(), Version: "1.0", HardwareModel: "m1",
+		Channel: defaultChannel, SHA256: hex.EncodeToString(sum[:]),
+		Size: int64(len(image)), UploadDate: time.Now()}
+	ioutil.WriteFile(firmware.path(fw), image, 0644)
+	suite.ms.AddFirmware(fw)
+	query := []string{key, number, secret, "model=m1"}
+	downloaded := []byte{}
+	for num := uint32(0); ; num++ {
+		resp = request(coap.GET, "api/firmware", query, "", coap.Option{
+			Number: coap.Block2, Value: coap.Block{Num: num, Size: 16}.Encode()})
+		assert.Equal(suite.T(), coap.Content, resp.Code)
+		block, _ := coap.ParseBlock(resp.Option(coap.Block2))
+		assert.Equal(suite.T(), num, block.Num)
+		assert.Equal(suite.T(), sum[:etagSize], resp.Option(coap.ETag))
+		if num == 0 {
+			assert.Equal(suite.T(), uint32(len(image)), coap.DecodeUint(resp.Option(coap.Size2)))
+		}
+		downloaded = append(downloaded, resp.Payload...)
+		if !block.More {
+			break
+		}
+	}
+	assert.Equal(suite.T(), image, downloaded)
+	stats, _ := suite.ms.GetDownloads(deviceDto.DeviceNumber)
+	assert.Len(suite.T(), *stats, 1)
+	assert.Equal(suite.T(), int64(len(image)), (*stats)[0].Bytes)
+	resp = request(coap.GET, "api/firmware", query, "", coap.Option{
+		Number: coap.Block2, Value: coap.Block{Num: 4, Size: 16}.Encode()})
+	assert.Equal(suite.T(), coap.BadRequest, resp.Code)
+	resp = request(coap.GET, "api/firmware/latest", query, "")
+	assert.Equal(suite.T(), coap.Content, resp.Code)
+	json.Unmarshal(resp.Payload, &answer)
+	assert.Equal(suite.T(), "1.0", answer.Version)
+
+	// Retransmission gets the same answer, ping gets reset
+	data := coapRequest(1000, coap.POST, "api/register", []string{key},
+		`{"device-number": "456"}`)
+	first := listener.handle("device", data, "")
+	assert.Equal(suite.T(), first, listener.handle("device", data, ""))
+	assert.NotEqual(suite.T(), first, listener.handle("other", data, ""))
+	ping, _ := (&coap.Message{Type: coap.Confirmable, MessageID: 1001}).Marshal()
+	resp, _ = coap.Unmarshal(listener.handle("device", ping, ""))
+	assert.Equal(suite.T(), coap.Reset, resp.Type)
+
+	// Device with client certificate needs no api key over DTLS
+	serverCert, _ := testCertificate(suite.T(), "localhost")
+	clientCert, caPEM := testCertificate(suite.T(), "789")
+	config.Host, config.CoAPPort = "127.0.0.1", "0"
+	config.ClientCA = filepath.Join(suite.T().TempDir(), "ca.pem")
+	ioutil.WriteFile(config.ClientCA, caPEM, 0644)
+	listener = newCoAP(config, api, newTelemetry(nil, api, suite.ms, suite.ms), firmware, &serverCert)
+	assert.Nil(suite.T(), listener.listen())
+	defer listener.close()
+	addr := listener.listener.(net.Listener).Addr().(*net.UDPAddr)
+	conn, err := dtls.Dial("udp", addr, &dtls.Config{
+		Certificates:         []tls.Certificate{clientCert},
+		InsecureSkipVerify:   true,
+		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+	})
+	if !assert.Nil(suite.T(), err) {
+		return
+	}
+	defer conn.Close()
+	exchange := func(data []byte) *coap.Message {
+		conn.Write(data)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, maxDatagram)
+		n, err := conn.Read(buf)
+		assert.Nil(suite.T(), err)
+		resp, _ := coap.Unmarshal(buf[:n])
+		return resp
+	}
+	resp = exchange(coapRequest(1, coap.POST, "api/register", nil, `{"device-number": "789"}`))
+	assert.Equal(suite.T(), coap.Changed, resp.Code)
+	resp = exchange(coapRequest(2, coap.POST, "api/error", nil,
+		`{"device-number": "789", "error-name": "electricity"}`))
+	assert.Equal(suite.T(), coap.Changed, resp.Code)
+	resp = exchange(coapRequest(3, coap.POST, "api/error", nil, string(report)))
+	assert.Equal(suite.T(), coap.Forbidden, resp.Code)
+}
+
+func (suite *ServerTestSuite) TestGRPC() {
+	serverCert, _ := testCertificate(suite.T(), "localhost")
+	clientCert, caPEM := testCertificate(suite.T(), "789")
+	config := &Config{ApiKey: apiKey, Host: "127.0.0.1", GRPCPort: "0",
+		ClientCA: filepath.Join(suite.T().TempDir(), "ca.pem")}
+	ioutil.WriteFile(config.ClientCA, caPEM, 0644)
+	firmware := newFirmware(suite.T().TempDir(), 1<<20, nil, suite.ms)
+	devices := newGRPC(config, newApi(config, suite.ms), firmware, serverCert)
+	if !assert.Nil(suite.T(), devices.listen()) {
+		return
+	}
+	defer devices.close()
+	dial := func(certs ...tls.Certificate) devicepb.DeviceClient {
+		conn, err := grpc.NewClient(devices.listener.Addr().String(),
+			grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
+				Certificates: certs, InsecureSkipVerify: true})))
+		if err != nil {
+			suite.T().Fatal(err)
+		}
+		suite.T().Cleanup(func() { conn.Close() })
+		return devicepb.NewDeviceClient(conn)
+	}
+	client := dial()
+	ctx := context.Background()
+	code := func(err error) codes.Code {
+		return status.Code(err)
+	}
+
+	// Credentials are metadata
+	register := &devicepb.RegisterRequest{DeviceNumber: deviceDto.DeviceNumber}
+	_, err := client.RegisterDevice(ctx, register)
+	assert.Equal(suite.T(), codes.Unauthenticated, code(err))
+	keyCtx := metadata.AppendToOutgoingContext(ctx, "api-key", apiKey,
+		"device-number", deviceDto.DeviceNumber)
+	registered, err := client.RegisterDevice(keyCtx, register)
+	if !assert.Nil(suite.T(), err) {
+		return
+	}
+	assert.NotEmpty(suite.T(), registered.Secret)
+	report := &devicepb.ErrorReport{DeviceNumber: deviceDto.DeviceNumber,
+		ErrorName: "electricity", Context: `{"voltage": 3}`}
+	_, err = client.ReportError(keyCtx, report)
+	assert.Equal(suite.T(), codes.Unauthenticated, code(err))
+	deviceCtx := metadata.AppendToOutgoingContext(keyCtx, "device-secret", registered.Secret)
+	reported, err := client.ReportError(deviceCtx, report)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "Error registered", reported.Message)
+	_, err = client.ReportError(deviceCtx, &devicepb.ErrorReport{
+		DeviceNumber: deviceDto.DeviceNumber, ErrorName: "electricity", Context: "[]"})
+	assert.Equal(suite.T(), codes.InvalidArgument, code(err))
+	_, err = client.ReportError(deviceCtx, &devicepb.ErrorReport{DeviceNumber: "456",
+		ErrorName: "electricity"})
+	assert.Equal(suite.T(), codes.PermissionDenied, code(err))
+	heartbeat, err := client.Heartbeat(deviceCtx, &devicepb.HeartbeatRequest{
+		DeviceNumber: deviceDto.DeviceNumber, Uptime: 60})
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "Heartbeat registered", heartbeat.Message)
+
+	// Streamed reports are stored as batch
+	stream, err := client.ReportErrors(deviceCtx)
+	assert.Nil(suite.T(), err)
+	stream.Send(&devicepb.ErrorReport{ErrorName: "electricity", TimestampMs: 1000})
+	stream.Send(&devicepb.ErrorReport{DeviceNumber: deviceDto.DeviceNumber})
+	batch, err := stream.CloseAndRecv()
+	if assert.Nil(suite.T(), err) {
+		assert.Equal(suite.T(), int32(1), batch.Registered)
+		assert.Equal(suite.T(), int32(1), batch.Rejected)
+		assert.Equal(suite.T(), batchRegistered, batch.Results[0].Status)
+		assert.Equal(suite.T(), batchRejected, batch.Results[1].Status)
+	}
+
+	// Firmware is streamed in chunks from offset device asks for
+	image := bytes.Repeat([]byte("0123456789"), 5000)
+	sum := sha256.Sum256(image)
+	fw := &model.Firmware{ID: bson.NewObjectId(), Version: "1.0", HardwareModel: "m1",
+		Channel: defaultChannel, SHA256: hex.EncodeToString(sum[:]),
+		Size: int64(len(image)), UploadDate: time.Now()}
+	ioutil.WriteFile(firmware.path(fw), image, 0644)
+	suite.ms.AddFirmware(fw)
+	download := func(offset int64) ([]*devicepb.FirmwareChunk, error) {
+		chunks := []*devicepb.FirmwareChunk{}
+		stream, err := client.DownloadFirmware(deviceCtx,
+			&devicepb.FirmwareRequest{Model: "m1", Offset: offset})
+		if err != nil {
+			return nil, err
+		}
+		for {
+			chunk, err := stream.Recv()
+			if err == io.EOF {
+				return chunks, nil
+			} else if err != nil {
+				return chunks, err
+			}
+			chunks = append(chunks, chunk)
+		}
+	}
+	chunks, err := download(0)
+	assert.Nil(suite.T(), err)
+	if assert.Len(suite.T(), chunks, 2) {
+		assert.Equal(suite.T(), "1.0", chunks[0].Version)
+		assert.Equal(suite.T(), fw.SHA256, chunks[0].Sha256)
+		assert.Equal(suite.T(), int64(len(image)), chunks[0].Size)
+		assert.Equal(suite.T(), int64(grpcChunkSize), chunks[1].Offset)
+		assert.Equal(suite.T(), image, append(chunks[0].Data, chunks[1].Data...))
+	}
+	stats, _ := suite.ms.GetDownloads(deviceDto.DeviceNumber)
+	assert.Len(suite.T(), *stats, 1)
+	chunks, err = download(int64(len(image) - 10))
+	assert.Nil(suite.T(), err)
+	if assert.Len(suite.T(), chunks, 1) {
+		assert.Equal(suite.T(), image[len(image)-10:], chunks[0].Data)
+	}
+	// Resumed download counts only bytes sent
+	stats, _ = suite.ms.GetDownloads(deviceDto.DeviceNumber)
+	assert.Equal(suite.T(), 2, (*stats)[0].Downloads)
+	assert.Equal(suite.T(), int64(len(image)+10), (*stats)[0].Bytes)
+	_, err = download(int64(len(image)))
+	assert.Equal(suite.T(), codes.InvalidArgument, code(err))
+
+	// Device with client certificate needs no api key
+	certClient := dial(clientCert)
+	_, err = certClient.RegisterDevice(ctx, &devicepb.RegisterRequest{DeviceNumber: "789"})
+	assert.Nil(suite.T(), err)
+	_, err = certClient.Heartbeat(ctx, &devicepb.HeartbeatRequest{DeviceNumber: "789"})
+	assert.Nil(suite.T(), err)
+	_, err = certClient.Heartbeat(ctx, &devicepb.HeartbeatRequest{
+		DeviceNumber: deviceDto.DeviceNumber})
+	assert.Equal(suite.T(), codes.PermissionDenied, code(err))
+}
+
+func (suite *ServerTestSuite) TestUpdateStatus() {
+	testRouter := gin.Default()
+	testRouter.POST("/update", suite.api.updateStatus)
+	post := func(us model.UpdateStatusDto) int {
+		data, _ := json.Marshal(us)
+		req, _ := http.NewRequest("POST", "/update", bytes.NewReader(data))
+		rw := httptest.NewRecorder()
+		testRouter.ServeHTTP(rw, req)
+		return rw.Code
+	}
+	us := model.UpdateStatusDto{DeviceNumber: "123", State: "rebooting"}
+	assert.Equal(suite.T(), http.StatusBadRequest, post(us))
+	us.State = model.UpdateFailed
+	assert.Equal(suite.T(), http.StatusBadRequest, post(us))
+	us.Reason = "checksum mismatch"
+	assert.Equal(suite.T(), http.StatusNotFound, post(us))
+	suite.ms.RegisterDevice("123", time.Now())
+	assert.Equal(suite.T(), http.StatusOK, post(us))
+	// Body which is not update status is rejected
+	assert.Equal(suite.T(), http.StatusBadRequest,
+		suite.api.postUpdate(&deviceAuth{}, strings.NewReader("{")).status)
+}
+
+func (suite *ServerTestSuite) TestManifest() {
+	keyFile := filepath.Join(suite.T().TempDir(), "signing.key")
+	pub, err := utils.GenerateSigningKey(keyFile)
+	assert.Nil(suite.T(), err)
+	key, err := utils.LoadSigningKey(keyFile)
+	assert.Nil(suite.T(), err)
+	firmware := newFirmware(suite.T().TempDir(), 1<<20, key, suite.ms)
+	testRouter := gin.Default()
+	testRouter.GET("/manifest", firmware.manifest)
+	testRouter.GET("/key", firmware.publicKey)
+	suite.ms.AddFirmware(&model.Firmware{Version: "1.0", Channel: defaultChannel,
+		SHA256: "abc", Size: 3})
+	req, _ := http.NewRequest("GET", "/manifest", nil)
+	rw := httptest.NewRecorder()
+	testRouter.ServeHTTP(rw, req)
+	assert.Equal(suite.T(), http.StatusOK, rw.Code)
+	signature, _ := base64.StdEncoding.DecodeString(rw.Header().Get(ManifestSignature))
+	assert.True(suite.T(), ed25519.Verify(pub, rw.Body.Bytes(), signature))
+	manifest := model.Manifest{}
+	json.Unmarshal(rw.Body.Bytes(), &manifest)
+	assert.Equal(suite.T(), "1.0", manifest.Version)
+	assert.Equal(suite.T(), utils.KeyID(pub), manifest.KeyID)
+
+	req, _ = http.NewRequest("GET", "/key", nil)
+	rw = httptest.NewRecorder()
+	testRouter.ServeHTTP(rw, req)
+	answer := map[string]string{}
+	json.Unmarshal(rw.Body.Bytes(), &answer)
+	assert.Equal(suite.T(), base64.StdEncoding.EncodeToString(pub), answer["public-key"])
+	// Rotated key replaces previous one
+	rotated, err := utils.GenerateSigningKey(keyFile)
+	assert.Nil(suite.T(), err)
+	assert.NotEqual(suite.T(), pub, rotated)
+	key, _ = utils.LoadSigningKey(keyFile)
+	assert.Equal(suite.T(), rotated, key.Public())
+}
+
 func TestServerTestSuite(t *testing.T) {
 	suite.Run(t, new(ServerTestSuite))
 }
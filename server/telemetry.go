@@ -0,0 +1,220 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"iot-stats/model"
+	"iot-stats/service"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxSamples limits size of telemetry batch
+const maxSamples = 1000
+
+// maxMetricName limits length of metric name
+const maxMetricName = 64
+
+// defaultWindow is time window of telemetry query without start
+const defaultWindow = 24 * time.Hour
+
+// maxPoints is how many points query returns at most when step is not
+// set, resolution is chosen to fit them
+const maxPoints = 1000
+
+// Telemetry takes metric samples from devices and returns them to admin
+// in resolution fitting query
+type Telemetry struct {
+	retention map[string]time.Duration
+	api       *Api
+	ms        service.MongoInterface
+	ts        service.TelemetryInterface
+}
+
+func newTelemetry(retention map[string]time.Duration, api *Api, ms service.MongoInterface,
+	ts service.TelemetryInterface) *Telemetry {
+	return &Telemetry{retention: retention, api: api, ms: ms, ts: ts}
+}
+
+// Batch of metric samples from iot device
+func (t *Telemetry) report(c *gin.Context) {
+	defer c.Request.Body.Close()
+	send(c, t.postTelemetry(contextAuth(c), c.Request.Body))
+}
+
+func (t *Telemetry) postTelemetry(auth *deviceAuth, body io.Reader) *reply {
+	td := &model.TelemetryDto{}
+	if err := json.NewDecoder(body).Decode(td); err != nil {
+		return rejection(http.StatusBadRequest, "Wrong telemetry")
+	}
+	return t.reportSamples(auth, td)
+}
+
+func (t *Telemetry) reportSamples(auth *deviceAuth, td *model.TelemetryDto) *reply {
+	if len(td.Samples) == 0 || len(td.Samples) > maxSamples {
+		return rejection(http.StatusBadRequest, "Batch must have 1 to 1000 samples")
+	}
+	if r := t.api.allowed(auth, td.DeviceNumber); r != nil {
+		return r
+	}
+	if _, err := t.ms.GetDeviceByNumber(td.DeviceNumber); err == service.ErrNotFound {
+		return rejection(http.StatusNotFound, "Device not found")
+	} else if err != nil {
+		return failure("database error", "telemetry err "+err.Error())
+	}
+	now := time.Now()
+	samples := make([]model.Sample, len(td.Samples))
+	for i, s := range td.Samples {
+		if !validMetric(s.Metric) {
+			return rejection(http.StatusBadRequest,
+				"Metric name must have 1 to 64 letters, digits, '_', '-' or '.'")
+		}
+		if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+			return rejection(http.StatusBadRequest, "Wrong metric value")
+		}
+		if s.Timestamp.IsZero() {
+			s.Timestamp = now
+		} else if s.Timestamp.Before(time.Unix(0, 0)) {
+			return rejection(http.StatusBadRequest, "Timestamp is before epoch")
+		} else if s.Timestamp.After(now.Add(maxClockSkew)) {
+			return rejection(http.StatusBadRequest, "Timestamp is in future")
+		}
+		samples[i] = model.Sample{
+			DeviceNumber: td.DeviceNumber,
+			Metric:       s.Metric,
+			Value:        s.Value,
+			Date:         s.Timestamp,
+		}
+	}
+	if err := t.ts.AddSamples(samples); err != nil {
+		return failure("database error", "telemetry err "+err.Error())
+	}
+	return answer(gin.H{"message": "Telemetry registered", "samples": len(samples)})
+}
+
+// validMetric checks metric name is not empty, not too long and made of
+// characters safe in storage keys and query paths
+func validMetric(name string) bool {
+	if name == "" || len(name) > maxMetricName {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' ||
+			r == '_' || r == '-' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// Get metric of device in time window set by from and to query
+// parameters in RFC 3339 format, last day is returned by default. Raw
+// samples or rollups are returned depending on step query parameter, it
+// is duration like "5m". Resolution is chosen by window when step is not
+// set and may be forced by resolution query parameter
+func (t *Telemetry) query(c *gin.Context) {
+	from, to, ok := queryWindow(c, defaultWindow)
+	if !ok {
+		return
+	}
+	var step time.Duration
+	if s := c.Query("step"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Wrong step"})
+			return
+		}
+		step = d
+	}
+	resolution := c.Query("resolution")
+	if resolution == "" {
+		resolution = t.resolution(from, to, step, time.Now())
+	} else if !knownResolution(resolution) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Wrong resolution"})
+		return
+	}
+	number, metric := c.Param("number"), c.Param("metric")
+	if resolution == model.ResolutionRaw {
+		samples, err := t.ts.GetSamples(number, metric, from, to)
+		if err != nil {
+			internalError(c, "database error", "telemetry err "+err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"resolution": resolution, "samples": samples})
+		return
+	}
+	rollups, err := t.ts.GetRollups(number, metric, resolution, from, to)
+	if err != nil {
+		internalError(c, "database error", "telemetry err "+err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"resolution": resolution, "rollups": rollups})
+}
+
+// resolution picks the coarsest resolution not coarser than step, step of
+// query without one fits window into maxPoints. Coarser resolution is
+// taken when data of picked one has expired at start of window
+func (t *Telemetry) resolution(from, to time.Time, step time.Duration,
+	now time.Time) string {
+	if step <= 0 {
+		step = to.Sub(from) / maxPoints
+	}
+	names := []string{model.ResolutionRaw}
+	i := 0
+	for _, res := range model.Resolutions {
+		names = append(names, res.Name)
+		if res.Duration <= step {
+			i = len(names) - 1
+		}
+	}
+	for ; i < len(names)-1; i++ {
+		ret := t.retention[names[i]]
+		if ret <= 0 || !from.Before(now.Add(-ret)) {
+			break
+		}
+	}
+	return names[i]
+}
+
+func knownResolution(name string) bool {
+	if name == model.ResolutionRaw {
+		return true
+	}
+	for _, res := range model.Resolutions {
+		if res.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// queryWindow parses time window of query, window of given length up to
+// now is used by default. Bad request is answered when it is wrong
+func queryWindow(c *gin.Context, window time.Duration) (time.Time, time.Time, bool) {
+	to := time.Now()
+	if s := c.Query("to"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Wrong end of time window"})
+			return time.Time{}, time.Time{}, false
+		}
+		to = t
+	}
+	from := to.Add(-window)
+	if s := c.Query("from"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Wrong start of time window"})
+			return time.Time{}, time.Time{}, false
+		}
+		from = t
+	}
+	if !from.Before(to) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Empty time window"})
+		return time.Time{}, time.Time{}, false
+	}
+	return from, to, true
+}
@@ -15,6 +15,18 @@ import (
 
 var authenticated bool = false
 
+// Default and maximal time window of fleet stats and length of their top
+// lists
+const (
+	statsWindow    = 7 * 24 * time.Hour
+	maxStatsWindow = 92 * 24 * time.Hour
+	defaultTop     = 10
+	maxTop         = 100
+)
+
+// loginKey is context key of admin login from session
+const loginKey = "login"
+
 type Web struct {
 	ms  service.MongoInterface
 	exp int
@@ -33,10 +45,13 @@ func (w *Web) checkSession(c *gin.Context) {
 			if err != nil {
 				internalError(c, "databse error",
 					"mongo web err "+err.Error())
+				return
 			}
 			if (*expire).Sub(time.Now().Local()) < 0 {
 				pleaseAuth(c, "")
+				return
 			}
+			c.Set(loginKey, login)
 			w.setSession(login, c.Writer)
 			c.Writer.Header().Add("Content-Type", "application/json")
 			c.Next()
@@ -50,7 +65,7 @@ func (w *Web) checkSession(c *gin.Context) {
 
 func (w *Web) setSession(login string, response http.ResponseWriter) {
 	value := map[string]string{
-		"name": login,
+		"login": login,
 	}
 	if encoded, err := cookieHandler.Encode("session", value); err == nil {
 		expDuration := time.Duration(w.exp) * time.Hour
@@ -74,11 +89,18 @@ func (w *Web) getDevices(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		c.Abort()
 	}
-	total, err := w.ms.GetDevicesCount()
+	filter := model.DeviceFilter{Status: c.Query("status"),
+		AllErrors: c.Query("errors") == "all"}
+	if filter.Status != "" && filter.Status != model.StatusOnline &&
+		filter.Status != model.StatusOffline {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Wrong status"})
+		return
+	}
+	total, err := w.ms.GetDevicesCount(filter)
 	if err != nil {
 		internalError(c, "databse error", "web err "+err.Error())
 	}
-	devices, err := w.ms.GetAllDevices(skip, limit)
+	devices, err := w.ms.GetAllDevices(skip, limit, filter)
 	jDev := model.Devices{}
 	if err != nil {
 		internalError(c, "databse error", "web err "+err.Error())
@@ -93,6 +115,150 @@ func (w *Web) getDevices(c *gin.Context) {
 	c.String(http.StatusOK, string(jsonM))
 }
 
+// Revoke credential of single device
+func (w *Web) revokeDevice(c *gin.Context) {
+	number := c.Param("number")
+	err := w.ms.RevokeDeviceSecret(number)
+	if err == service.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	} else if err != nil {
+		internalError(c, "databse error", "web err "+err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Device credential revoked"})
+}
+
+// Issue new credential for single device, previous one stops working
+func (w *Web) rotateDevice(c *gin.Context) {
+	number := c.Param("number")
+	secret, err := issueSecret(w.ms, number)
+	if err == service.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	} else if err != nil {
+		internalError(c, "databse error", "web err "+err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Device credential rotated",
+		"secret": secret})
+}
+
+// Get firmware update events reported by device
+func (w *Web) getUpdates(c *gin.Context) {
+	events, err := w.ms.GetUpdateEvents(c.Param("number"))
+	if err != nil {
+		internalError(c, "databse error", "web err "+err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, events)
+}
+
+// Get fleet stats in time window set by from and to query parameters in
+// RFC 3339 format, last week by default. Top query parameter limits lists
+// of most frequent errors and devices with most errors
+func (w *Web) getStats(c *gin.Context) {
+	from, to, ok := queryWindow(c, statsWindow)
+	if !ok {
+		return
+	}
+	if to.Sub(from) > maxStatsWindow {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Time window is too long"})
+		return
+	}
+	top := defaultTop
+	if s := c.Query("top"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxTop {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Wrong top"})
+			return
+		}
+		top = n
+	}
+	stats, err := w.ms.GetStats(from, to, top)
+	if err != nil {
+		internalError(c, "databse error", "web err "+err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, stats)
+}
+
+// Get online and offline transitions of device
+func (w *Web) getStatusEvents(c *gin.Context) {
+	events, err := w.ms.GetStatusEvents(c.Param("number"))
+	if err != nil {
+		internalError(c, "databse error", "web err "+err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, events)
+}
+
+type PostErrorChange struct {
+	Assignee string `json:"assignee"`
+}
+
+// Get issues of device, resolved ones only with errors=all query parameter
+func (w *Web) getIssues(c *gin.Context) {
+	issues, err := w.ms.GetIssues(c.Param("number"),
+		model.DeviceFilter{AllErrors: c.Query("errors") == "all"})
+	if err == service.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	} else if err != nil {
+		internalError(c, "databse error", "web err "+err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, issues)
+}
+
+// Get stored occurrences of issue, the latest first
+func (w *Web) getOccurrences(c *gin.Context) {
+	occurrences, err := w.ms.GetOccurrences(c.Param("number"), c.Param("id"))
+	if err == service.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Issue not found"})
+		return
+	} else if err != nil {
+		internalError(c, "databse error", "web err "+err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, occurrences)
+}
+
+// Acknowledge, assign, resolve or reopen single issue of device or every
+// issue of device with the same error name, change is recorded with login
+// of admin. Assignee is sent in body of assign, empty assignee unassigns
+func (w *Web) changeIssues(c *gin.Context) {
+	action := c.Param("action")
+	if _, ok := model.ErrorActions[action]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Wrong action"})
+		return
+	}
+	change := model.ErrorChange{Action: action, Login: c.GetString(loginKey),
+		Date: time.Now()}
+	if action == model.ActionAssign {
+		var post PostErrorChange
+		if err := json.NewDecoder(c.Request.Body).Decode(&post); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Wrong assignee"})
+			return
+		}
+		change.Assignee = post.Assignee
+	}
+	sel := model.IssueSelector{ID: c.Param("id"), ErrorName: c.Param("name")}
+	n, err := w.ms.ChangeIssues(c.Param("number"), sel, change)
+	if err == service.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	} else if err != nil {
+		internalError(c, "databse error", "web err "+err.Error())
+		return
+	}
+	if n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Issue not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Issues changed", "changed": n})
+}
+
 func internalError(c *gin.Context, msgToSend, msgToLog string) {
 	utils.Log().Infoln(msgToLog)
 	c.JSON(http.StatusInternalServerError, gin.H{"error": msgToSend})
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"encoding/json"
+	"iot-stats/model"
+	"iot-stats/service"
+	"iot-stats/utils"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxListedDeliveries limits how many deliveries of webhook are listed
+const maxListedDeliveries = 100
+
+// webhookEvents are event types webhook subscribes to
+var webhookEvents = map[string]bool{
+	model.EventDeviceRegistered: true,
+	model.EventErrorReported:    true,
+	model.EventAlertFired:       true,
+	model.EventAlertResolved:    true,
+	model.EventUpdateFinished:   true,
+}
+
+// Webhooks manages webhooks, events are queued by storage and sent by
+// background job
+type Webhooks struct {
+	ms service.MongoInterface
+}
+
+func newWebhooks(ms service.MongoInterface) *Webhooks {
+	return &Webhooks{ms: ms}
+}
+
+type PostWebhook struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+}
+
+// Get list of webhooks, secrets are not shown
+func (w *Webhooks) list(c *gin.Context) {
+	webhooks, err := w.ms.GetWebhooks()
+	if err != nil {
+		internalError(c, "database error", "webhook err "+err.Error())
+		return
+	}
+	for i := range *webhooks {
+		(*webhooks)[i].Secret = ""
+	}
+	c.JSON(http.StatusOK, webhooks)
+}
+
+// Create webhook, secret is generated unless it is posted and shown in
+// answer only
+func (w *Webhooks) create(c *gin.Context) {
+	decoder := json.NewDecoder(c.Request.Body)
+	defer c.Request.Body.Close()
+	var post PostWebhook
+	if err := decoder.Decode(&post); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Wrong webhook"})
+		return
+	}
+	if msg := validateWebhook(&post); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+	if post.Secret == "" {
+		secret, err := utils.GenerateSecret(32)
+		if err != nil {
+			internalError(c, "secret error", "webhook err "+err.Error())
+			return
+		}
+		post.Secret = secret
+	}
+	webhook := &model.Webhook{
+		URL:        post.URL,
+		Secret:     post.Secret,
+		Events:     post.Events,
+		CreateDate: time.Now(),
+	}
+	if err := w.ms.AddWebhook(webhook); err != nil {
+		internalError(c, "database error", "webhook err "+err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, webhook)
+}
+
+// validateWebhook returns description of what is wrong with webhook
+func validateWebhook(post *PostWebhook) string {
+	u, err := url.Parse(post.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "Wrong webhook url"
+	}
+	for _, event := range post.Events {
+		if !webhookEvents[event] {
+			return "Unknown event " + event
+		}
+	}
+	return ""
+}
+
+// Delete webhook, its pending deliveries fail
+func (w *Webhooks) delete(c *gin.Context) {
+	err := w.ms.DeleteWebhook(c.Param("id"))
+	if err == service.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	} else if err != nil {
+		internalError(c, "database error", "webhook err "+err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Webhook deleted"})
+}
+
+// Get latest deliveries of webhook with their state and last attempt
+func (w *Webhooks) deliveries(c *gin.Context) {
+	if _, err := w.ms.GetWebhook(c.Param("id")); err == service.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	} else if err != nil {
+		internalError(c, "database error", "webhook err "+err.Error())
+		return
+	}
+	deliveries, err := w.ms.GetDeliveries(c.Param("id"), maxListedDeliveries)
+	if err != nil {
+		internalError(c, "database error", "webhook err "+err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, deliveries)
+}
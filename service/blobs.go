@@ -0,0 +1,75 @@
+package service
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Blob is stored content of attachment
+type Blob interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// BlobStore keeps contents of attachments by name. MongoService keeps
+// them in GridFS, DiskBlobStore in directory
+type BlobStore interface {
+	PutBlob(name string, r io.Reader) (int64, error)
+	OpenBlob(name string) (Blob, error)
+	DeleteBlob(name string) error
+}
+
+// DiskBlobStore keeps blobs as files in directory, directory is created on
+// first write
+type DiskBlobStore struct {
+	dir string
+}
+
+func NewDiskBlobStore(dir string) *DiskBlobStore {
+	return &DiskBlobStore{dir: dir}
+}
+
+// PutBlob writes content to temporary file first, so that blob is never
+// seen half written
+func (d *DiskBlobStore) PutBlob(name string, r io.Reader) (int64, error) {
+	if err := os.MkdirAll(d.dir, 0755); err != nil {
+		return 0, err
+	}
+	tmp, err := ioutil.TempFile(d.dir, "upload")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	n, err := io.Copy(tmp, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return n, os.Rename(tmp.Name(), d.path(name))
+}
+
+func (d *DiskBlobStore) OpenBlob(name string) (Blob, error) {
+	file, err := os.Open(d.path(name))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// DeleteBlob removes blob, missing blob is not an error
+func (d *DiskBlobStore) DeleteBlob(name string) error {
+	if err := os.Remove(d.path(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (d *DiskBlobStore) path(name string) string {
+	return filepath.Join(d.dir, filepath.Base(name))
+}
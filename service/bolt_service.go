@@ -0,0 +1,2059 @@
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"iot-stats/model"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// BoltService keeps data in embedded BoltDB file, it is used on small
+// deployments where MongoDB can't be run. Documents are stored bson
+// encoded, so they have the same shape as in MongoDB.
+//
+// Buckets:
+//
+//	devices        device id (hex) -> Device, ids grow in insertion order
+//	device_numbers device number -> device id
+//	errors         device id -> nested bucket of sequence -> DeviceError
+//	error_ids      error id (hex) -> device id
+//	issues         device id -> nested bucket of issue id (hex) -> Issue
+//	issue_counts   device number -> nested bucket of time and issue id -> IssueCount
+//	attachments    attachment id (hex) -> Attachment
+//	cookies        login -> Cookie
+//	users          login -> Credentials
+//	firmware       firmware id (hex) -> Firmware
+//	rollouts       rollout id (hex) -> Rollout
+//	rollout_devices rollout id -> nested bucket of device number -> RolloutDevice
+//	updates        device id -> nested bucket of sequence -> UpdateEvent
+//	downloads      device number -> nested bucket of firmware id -> DownloadStats
+//	telemetry      device number -> nested bucket of metric -> nested bucket of
+//	               time and sequence -> Sample
+//	rollups        resolution -> nested bucket of device number -> nested bucket
+//	               of metric -> nested bucket of time -> Rollup
+//	status_events  device id -> nested bucket of sequence -> StatusEvent
+//	rules          rule id (hex) -> Rule
+//	alerts         alert id (hex) -> Alert
+//	webhooks       webhook id (hex) -> Webhook
+//	deliveries     delivery id (hex) -> Delivery
+//	subscriptions  login -> Subscription
+//	mails          mail id (hex) -> Mail
+type BoltService struct {
+	path string
+	db   *bolt.DB
+}
+
+const (
+	deviceNumberBucket = "device_numbers"
+	errorIDBucket      = "error_ids"
+)
+
+var boltBuckets = []string{
+	deviceCollection,
+	deviceNumberBucket,
+	errorCollection,
+	errorIDBucket,
+	issueCollection,
+	issueCountCollection,
+	attachmentCollection,
+	cookieCollection,
+	userCollection,
+	firmwareCollection,
+	rolloutCollection,
+	rolloutDevices,
+	updateCollection,
+	downloadCollection,
+	sampleCollection,
+	rollupCollection,
+	statusCollection,
+	ruleCollection,
+	alertCollection,
+	webhookCollection,
+	deliveryCollection,
+	subscriptionCollection,
+	mailCollection,
+}
+
+func NewBoltService(path string) *BoltService {
+	b := &BoltService{path: path}
+	return b
+}
+
+// Connect opens database file, creates missing buckets and groups errors
+// stored before issues were introduced into issues
+func (b *BoltService) Connect() error {
+	db, err := bolt.Open(b.path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range boltBuckets {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return boltMigrateErrors(tx)
+	})
+	if err != nil {
+		db.Close()
+		return err
+	}
+	b.db = db
+	return nil
+}
+
+// GetAllDevices find list of devices matching filter joined with their
+// issues
+func (b *BoltService) GetAllDevices(skip int, limit int,
+	filter model.DeviceFilter) (*[]model.DeviceDto, error) {
+	if skip < 0 || limit < 0 {
+		return nil, errors.New("skip and limit must not be negative")
+	}
+	info := []model.DeviceDto{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(deviceCollection)).Cursor()
+		matched := 0
+		for k, v := c.First(); k != nil && len(info) < limit; k, v = c.Next() {
+			device := model.Device{}
+			if err := bson.Unmarshal(v, &device); err != nil {
+				return err
+			}
+			if !matchDevice(&device, filter) {
+				continue
+			}
+			if matched++; matched <= skip {
+				continue
+			}
+			dto := model.DeviceDto{
+				DeviceNumber:    device.DeviceNumber,
+				RegisterDate:    device.RegisterDate,
+				FirmwareVersion: device.FirmwareVersion,
+				UpdateState:     device.UpdateState,
+				Status:          device.Status,
+				LastSeen:        device.LastSeen,
+				Uptime:          device.Uptime,
+			}
+			issues, err := b.deviceIssues(tx, &device, filter, maxListedIssues)
+			if err != nil {
+				return err
+			}
+			dto.Issues = issues
+			info = append(info, dto)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (b *BoltService) GetDevicesCount(filter model.DeviceFilter) (int, error) {
+	n := 0
+	err := b.db.View(func(tx *bolt.Tx) error {
+		if filter == (model.DeviceFilter{}) {
+			n = tx.Bucket([]byte(deviceCollection)).Stats().KeyN
+			return nil
+		}
+		return tx.Bucket([]byte(deviceCollection)).ForEach(func(_, v []byte) error {
+			device := model.Device{}
+			if err := bson.Unmarshal(v, &device); err != nil {
+				return err
+			}
+			if matchDevice(&device, filter) {
+				n++
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return -1, err
+	}
+	return n, nil
+}
+
+// GetStats aggregates fleet stats in time window, top limits lists of
+// most frequent errors and devices with most errors
+func (b *BoltService) GetStats(from, to time.Time, top int) (*model.Stats, error) {
+	sb := newStatsBuilder(from, to)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		lastSeen := make(map[string]time.Time)
+		err := tx.Bucket([]byte(deviceCollection)).ForEach(func(_, v []byte) error {
+			device := model.Device{}
+			if err := bson.Unmarshal(v, &device); err != nil {
+				return err
+			}
+			sb.device(device.RegisterDate)
+			if !device.LastSeen.Before(from) {
+				lastSeen[device.DeviceNumber] = device.LastSeen
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		events := []model.StatusEvent{}
+		err = boltEachDoc(tx.Bucket([]byte(statusCollection)), func(v []byte) error {
+			event := model.StatusEvent{}
+			if err := bson.Unmarshal(v, &event); err != nil {
+				return err
+			}
+			if sb.inWindow(event.Date) {
+				events = append(events, event)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		sb.presence(lastSeen, events)
+		err = boltEachCount(tx, from, to, func(c *model.IssueCount) error {
+			sb.issueCount(c)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = boltEachDoc(tx.Bucket([]byte(updateCollection)), func(v []byte) error {
+			event := model.UpdateEvent{}
+			if err := bson.Unmarshal(v, &event); err != nil {
+				return err
+			}
+			sb.activity(event.DeviceNumber, event.Date)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return boltEachSeries(tx.Bucket([]byte(sampleCollection)), func(series *bolt.Bucket) error {
+			return boltRange(series, from, to, func(v []byte) error {
+				s := model.Sample{}
+				if err := bson.Unmarshal(v, &s); err != nil {
+					return err
+				}
+				sb.activity(s.DeviceNumber, s.Date)
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sb.build(top), nil
+}
+
+func (b *BoltService) RegisterDevice(deviceNumber string,
+	registerDate time.Time) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		device, err := b.deviceByNumber(tx, deviceNumber)
+		if err == ErrNotFound {
+			device = &model.Device{
+				ID:           bson.NewObjectId(),
+				DeviceNumber: deviceNumber,
+			}
+			err = tx.Bucket([]byte(deviceNumberBucket)).Put([]byte(deviceNumber),
+				[]byte(device.ID.Hex()))
+		}
+		if err != nil {
+			return err
+		}
+		device.RegisterDate = registerDate
+		return boltPut(tx, deviceCollection, device.ID.Hex(), device)
+	})
+}
+
+// RegisterError counts error in its issue, id of error is returned when
+// it is stored
+func (b *BoltService) RegisterError(de *model.DeviceErrorDto) (string, error) {
+	ids, err := b.RegisterErrors(de.DeviceNumber, []model.DeviceErrorDto{*de})
+	if err != nil {
+		return "", err
+	}
+	return ids[0], nil
+}
+
+// RegisterErrors counts errors of device in their issues and stores
+// sampled errors in single transaction. Ids of stored errors are returned
+// in order of reports
+func (b *BoltService) RegisterErrors(deviceNumber string,
+	des []model.DeviceErrorDto) ([]string, error) {
+	ids, _, err := b.registerErrors(deviceNumber, des)
+	return ids, err
+}
+
+func (b *BoltService) registerErrors(deviceNumber string,
+	des []model.DeviceErrorDto) ([]string, []model.Issue, error) {
+	var ids []string
+	opened := []*model.Issue{}
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		device, err := b.deviceByNumber(tx, deviceNumber)
+		if err != nil {
+			return err
+		}
+		bucket, err := tx.Bucket([]byte(issueCollection)).
+			CreateBucketIfNotExists([]byte(device.ID.Hex()))
+		if err != nil {
+			return err
+		}
+		issues := []*model.Issue{}
+		err = bucket.ForEach(func(_, v []byte) error {
+			issue := &model.Issue{}
+			if err := bson.Unmarshal(v, issue); err != nil {
+				return err
+			}
+			issues = append(issues, issue)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		changed := map[*model.Issue]bool{}
+		errs := newDeviceErrors(des, device)
+		for _, deviceError := range errs {
+			var issue *model.Issue
+			for _, other := range issues {
+				if issueOf(other, deviceError) {
+					issue = other
+				}
+			}
+			created := issue == nil
+			if created {
+				issue = newIssue(deviceError)
+				issues = append(issues, issue)
+			}
+			if addOccurrence(issue, deviceError) || created {
+				opened = append(opened, issue)
+			}
+			changed[issue] = true
+			if !storedError(deviceError) {
+				continue
+			}
+			if err = boltAppend(tx, errorCollection, device.ID.Hex(), deviceError); err != nil {
+				return err
+			}
+			err = tx.Bucket([]byte(errorIDBucket)).Put([]byte(deviceError.ID.Hex()),
+				[]byte(device.ID.Hex()))
+			if err != nil {
+				return err
+			}
+		}
+		for issue := range changed {
+			data, err := bson.Marshal(issue)
+			if err != nil {
+				return err
+			}
+			if err = bucket.Put([]byte(issue.ID.Hex()), data); err != nil {
+				return err
+			}
+		}
+		ids = storedIDs(errs)
+		return boltAddIssueCounts(tx, countOccurrences(errs))
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	issues := make([]model.Issue, len(opened))
+	for i, issue := range opened {
+		issues[i] = *issue
+	}
+	return ids, issues, nil
+}
+
+// GetDeviceError finds stored error by id
+func (b *BoltService) GetDeviceError(id string) (*model.DeviceError, error) {
+	var found *model.DeviceError
+	err := b.db.View(func(tx *bolt.Tx) error {
+		deviceID := tx.Bucket([]byte(errorIDBucket)).Get([]byte(id))
+		if deviceID == nil {
+			return ErrNotFound
+		}
+		errs := tx.Bucket([]byte(errorCollection)).Bucket(deviceID)
+		if errs == nil {
+			return ErrNotFound
+		}
+		err := errs.ForEach(func(_, v []byte) error {
+			de := model.DeviceError{}
+			if err := bson.Unmarshal(v, &de); err != nil {
+				return err
+			}
+			if de.ID.Hex() == id {
+				found = &de
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if found == nil {
+			return ErrNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+// ChangeIssues applies change to selected issues of device and records
+// it, number of changed issues is returned
+func (b *BoltService) ChangeIssues(deviceNumber string, sel model.IssueSelector,
+	change model.ErrorChange) (int, error) {
+	n := 0
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		device, err := b.deviceByNumber(tx, deviceNumber)
+		if err != nil {
+			return err
+		}
+		issues := tx.Bucket([]byte(issueCollection)).Bucket([]byte(device.ID.Hex()))
+		if issues == nil {
+			return nil
+		}
+		changed := map[string][]byte{}
+		err = issues.ForEach(func(k, v []byte) error {
+			issue := model.Issue{}
+			if err := bson.Unmarshal(v, &issue); err != nil {
+				return err
+			}
+			if !selectIssue(&issue, sel) {
+				return nil
+			}
+			applyErrorChange(&issue, change)
+			data, err := bson.Marshal(&issue)
+			if err != nil {
+				return err
+			}
+			changed[string(k)] = data
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for k, data := range changed {
+			if err = issues.Put([]byte(k), data); err != nil {
+				return err
+			}
+		}
+		n = len(changed)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// GetIssues finds issues of device matching filter, the latest seen first
+func (b *BoltService) GetIssues(deviceNumber string,
+	filter model.DeviceFilter) (*[]model.Issue, error) {
+	var issues []model.Issue
+	err := b.db.View(func(tx *bolt.Tx) error {
+		device, err := b.deviceByNumber(tx, deviceNumber)
+		if err != nil {
+			return err
+		}
+		issues, err = b.deviceIssues(tx, device, filter, 0)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &issues, nil
+}
+
+// deviceIssues lists issues of device matching filter, the latest seen
+// first
+func (b *BoltService) deviceIssues(tx *bolt.Tx, device *model.Device,
+	filter model.DeviceFilter, limit int) ([]model.Issue, error) {
+	issues := []model.Issue{}
+	bucket := tx.Bucket([]byte(issueCollection)).Bucket([]byte(device.ID.Hex()))
+	if bucket == nil {
+		return issues, nil
+	}
+	err := bucket.ForEach(func(_, v []byte) error {
+		issue := model.Issue{}
+		if err := bson.Unmarshal(v, &issue); err != nil {
+			return err
+		}
+		if listedIssue(&issue, filter) {
+			issues = append(issues, issue)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sortIssues(issues, limit), nil
+}
+
+// GetOccurrences finds stored occurrences of issue of device, the latest
+// first
+func (b *BoltService) GetOccurrences(deviceNumber string,
+	issueID string) (*[]model.DeviceErrorDto, error) {
+	occurrences := []model.DeviceErrorDto{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		device, err := b.deviceByNumber(tx, deviceNumber)
+		if err != nil {
+			return err
+		}
+		issues := tx.Bucket([]byte(issueCollection)).Bucket([]byte(device.ID.Hex()))
+		if issues == nil || issues.Get([]byte(issueID)) == nil {
+			return ErrNotFound
+		}
+		errs := tx.Bucket([]byte(errorCollection)).Bucket([]byte(device.ID.Hex()))
+		if errs == nil {
+			return nil
+		}
+		c := errs.Cursor()
+		for k, v := c.Last(); k != nil && len(occurrences) < maxListedOccurrences; k, v = c.Prev() {
+			de := model.DeviceError{}
+			if err := bson.Unmarshal(v, &de); err != nil {
+				return err
+			}
+			if de.IssueId.Hex() == issueID {
+				occurrences = append(occurrences, errorDto(&de))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &occurrences, nil
+}
+
+func (b *BoltService) AddAttachment(a *model.Attachment) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return boltPut(tx, attachmentCollection, a.ID.Hex(), a)
+	})
+}
+
+func (b *BoltService) GetAttachment(id string) (*model.Attachment, error) {
+	a := &model.Attachment{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return boltGet(tx, attachmentCollection, id, a)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// GetAttachments finds attachments of error in order of upload
+func (b *BoltService) GetAttachments(errorID string) (*[]model.Attachment, error) {
+	return b.findAttachments(func(a *model.Attachment) bool {
+		return a.ErrorId.Hex() == errorID
+	})
+}
+
+// GetAttachmentsBefore finds attachments uploaded before date
+func (b *BoltService) GetAttachmentsBefore(before time.Time) (*[]model.Attachment,
+	error) {
+	return b.findAttachments(func(a *model.Attachment) bool {
+		return a.Date.Before(before)
+	})
+}
+
+func (b *BoltService) findAttachments(match func(a *model.Attachment) bool) (
+	*[]model.Attachment, error) {
+	attachments := []model.Attachment{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(attachmentCollection)).ForEach(func(_, v []byte) error {
+			a := model.Attachment{}
+			if err := bson.Unmarshal(v, &a); err != nil {
+				return err
+			}
+			if match(&a) {
+				attachments = append(attachments, a)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &attachments, nil
+}
+
+func (b *BoltService) DeleteAttachment(id string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		attachments := tx.Bucket([]byte(attachmentCollection))
+		if attachments.Get([]byte(id)) == nil {
+			return ErrNotFound
+		}
+		return attachments.Delete([]byte(id))
+	})
+}
+
+// RegisterUpdate stores firmware update event and keeps last state and
+// running firmware version on device
+func (b *BoltService) RegisterUpdate(us *model.UpdateStatusDto) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		device, err := b.deviceByNumber(tx, us.DeviceNumber)
+		if err != nil {
+			return err
+		}
+		event := &model.UpdateEvent{
+			DeviceNumber:   us.DeviceNumber,
+			DeviceId:       device.ID,
+			State:          us.State,
+			TargetVersion:  us.TargetVersion,
+			CurrentVersion: us.CurrentVersion,
+			Reason:         us.Reason,
+			Date:           time.Now(),
+		}
+		if err = boltAppend(tx, updateCollection, device.ID.Hex(), event); err != nil {
+			return err
+		}
+		device.UpdateState = event.State
+		device.UpdateDate = event.Date
+		if event.CurrentVersion != "" {
+			device.FirmwareVersion = event.CurrentVersion
+		}
+		return boltPut(tx, deviceCollection, device.ID.Hex(), device)
+	})
+}
+
+// GetUpdateEvents returns firmware update events of device, newest first
+func (b *BoltService) GetUpdateEvents(deviceNumber string) (*[]model.UpdateEvent,
+	error) {
+	events := []model.UpdateEvent{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		device, err := b.deviceByNumber(tx, deviceNumber)
+		if err == ErrNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		updates := tx.Bucket([]byte(updateCollection)).Bucket([]byte(device.ID.Hex()))
+		if updates == nil {
+			return nil
+		}
+		c := updates.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			event := model.UpdateEvent{}
+			if err := bson.Unmarshal(v, &event); err != nil {
+				return err
+			}
+			events = append(events, event)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &events, nil
+}
+
+// RegisterHeartbeat marks device online and records transition when it
+// was not online before
+func (b *BoltService) RegisterHeartbeat(deviceNumber string, uptime int64,
+	date time.Time) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		device, err := b.deviceByNumber(tx, deviceNumber)
+		if err != nil {
+			return err
+		}
+		if device.Status != model.StatusOnline {
+			err = boltAppend(tx, statusCollection, device.ID.Hex(), &model.StatusEvent{
+				DeviceNumber: deviceNumber,
+				DeviceId:     device.ID,
+				Status:       model.StatusOnline,
+				Date:         date,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		device.Status = model.StatusOnline
+		device.LastSeen = date
+		if uptime > 0 {
+			device.Uptime = uptime
+		}
+		return boltPut(tx, deviceCollection, device.ID.Hex(), device)
+	})
+}
+
+// MarkOffline marks online devices not seen since time offline, numbers
+// of marked devices are returned
+func (b *BoltService) MarkOffline(before time.Time) (*[]string, error) {
+	numbers := []string{}
+	now := time.Now()
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		offline := []*model.Device{}
+		err := tx.Bucket([]byte(deviceCollection)).ForEach(func(_, v []byte) error {
+			device := &model.Device{}
+			if err := bson.Unmarshal(v, device); err != nil {
+				return err
+			}
+			if device.Status == model.StatusOnline && device.LastSeen.Before(before) {
+				offline = append(offline, device)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, device := range offline {
+			device.Status = model.StatusOffline
+			if err = boltPut(tx, deviceCollection, device.ID.Hex(), device); err != nil {
+				return err
+			}
+			err = boltAppend(tx, statusCollection, device.ID.Hex(), &model.StatusEvent{
+				DeviceNumber: device.DeviceNumber,
+				DeviceId:     device.ID,
+				Status:       model.StatusOffline,
+				Date:         now,
+			})
+			if err != nil {
+				return err
+			}
+			numbers = append(numbers, device.DeviceNumber)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &numbers, nil
+}
+
+// GetStatusEvents returns online and offline transitions of device,
+// newest first
+func (b *BoltService) GetStatusEvents(deviceNumber string) (*[]model.StatusEvent,
+	error) {
+	events := []model.StatusEvent{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		device, err := b.deviceByNumber(tx, deviceNumber)
+		if err == ErrNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		docs := tx.Bucket([]byte(statusCollection)).Bucket([]byte(device.ID.Hex()))
+		if docs == nil {
+			return nil
+		}
+		c := docs.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			event := model.StatusEvent{}
+			if err := bson.Unmarshal(v, &event); err != nil {
+				return err
+			}
+			events = append(events, event)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &events, nil
+}
+
+func (b *BoltService) GetDeviceByNumber(deviceNumber string) (*model.Device, error) {
+	var device *model.Device
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		device, err = b.deviceByNumber(tx, deviceNumber)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+// SetDeviceSecret stores hash of device credential and lifts revocation
+func (b *BoltService) SetDeviceSecret(deviceNumber string, secretHash string) error {
+	return b.updateDevice(deviceNumber, func(device *model.Device) {
+		device.SecretHash = secretHash
+		device.SecretRevoked = false
+	})
+}
+
+// RevokeDeviceSecret drops device credential, device can't register again
+// until credential is rotated
+func (b *BoltService) RevokeDeviceSecret(deviceNumber string) error {
+	return b.updateDevice(deviceNumber, func(device *model.Device) {
+		device.SecretHash = ""
+		device.SecretRevoked = true
+	})
+}
+
+// AssignFirmware pins device to firmware, empty id removes assignment
+func (b *BoltService) AssignFirmware(deviceNumber string, firmwareID string) error {
+	if firmwareID != "" && !bson.IsObjectIdHex(firmwareID) {
+		return ErrNotFound
+	}
+	return b.updateDevice(deviceNumber, func(device *model.Device) {
+		device.Firmware = ""
+		if firmwareID != "" {
+			device.Firmware = bson.ObjectIdHex(firmwareID)
+		}
+	})
+}
+
+func (b *BoltService) AddFirmware(fw *model.Firmware) error {
+	if fw.ID == "" {
+		fw.ID = bson.NewObjectId()
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return boltPut(tx, firmwareCollection, fw.ID.Hex(), fw)
+	})
+}
+
+func (b *BoltService) GetFirmware(id string) (*model.Firmware, error) {
+	fw := &model.Firmware{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return boltGet(tx, firmwareCollection, id, fw)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fw, nil
+}
+
+// GetFirmwareList returns all firmware, newest first
+func (b *BoltService) GetFirmwareList() (*[]model.Firmware, error) {
+	list := []model.Firmware{}
+	err := b.eachFirmware(func(fw *model.Firmware) bool {
+		list = append(list, *fw)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// GetLatestFirmware returns last uploaded firmware for hardware model
+// and channel
+func (b *BoltService) GetLatestFirmware(hardwareModel, channel string) (*model.Firmware,
+	error) {
+	var latest *model.Firmware
+	err := b.eachFirmware(func(fw *model.Firmware) bool {
+		if fw.HardwareModel == hardwareModel && fw.Channel == channel && !fw.Held {
+			latest = fw
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if latest == nil {
+		return nil, ErrNotFound
+	}
+	return latest, nil
+}
+
+// RecordDownload adds served bytes to download stats of device
+func (b *BoltService) RecordDownload(deviceNumber string, firmwareID string,
+	bytes int64) error {
+	if !bson.IsObjectIdHex(firmwareID) {
+		return ErrNotFound
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		downloads, err := tx.Bucket([]byte(downloadCollection)).
+			CreateBucketIfNotExists([]byte(deviceNumber))
+		if err != nil {
+			return err
+		}
+		stats := model.DownloadStats{
+			DeviceNumber: deviceNumber,
+			Firmware:     bson.ObjectIdHex(firmwareID),
+		}
+		if data := downloads.Get([]byte(firmwareID)); data != nil {
+			if err = bson.Unmarshal(data, &stats); err != nil {
+				return err
+			}
+		}
+		stats.Downloads++
+		stats.Bytes += bytes
+		stats.LastDate = time.Now()
+		data, err := bson.Marshal(&stats)
+		if err != nil {
+			return err
+		}
+		return downloads.Put([]byte(firmwareID), data)
+	})
+}
+
+// GetDownloads returns download stats of device, latest first
+func (b *BoltService) GetDownloads(deviceNumber string) (*[]model.DownloadStats,
+	error) {
+	stats := []model.DownloadStats{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		downloads := tx.Bucket([]byte(downloadCollection)).Bucket([]byte(deviceNumber))
+		if downloads == nil {
+			return nil
+		}
+		return downloads.ForEach(func(_, v []byte) error {
+			ds := model.DownloadStats{}
+			if err := bson.Unmarshal(v, &ds); err != nil {
+				return err
+			}
+			stats = append(stats, ds)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].LastDate.After(stats[j].LastDate)
+	})
+	return &stats, nil
+}
+
+func (b *BoltService) SetFirmwareHeld(id string, held bool) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		fw := &model.Firmware{}
+		if err := boltGet(tx, firmwareCollection, id, fw); err != nil {
+			return err
+		}
+		fw.Held = held
+		return boltPut(tx, firmwareCollection, id, fw)
+	})
+}
+
+func (b *BoltService) SetDeviceGroup(deviceNumber string, group string) error {
+	return b.updateDevice(deviceNumber, func(device *model.Device) {
+		device.Group = group
+	})
+}
+
+func (b *BoltService) AddRollout(r *model.Rollout) error {
+	if r.ID == "" {
+		r.ID = bson.NewObjectId()
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return boltPut(tx, rolloutCollection, r.ID.Hex(), r)
+	})
+}
+
+// UpdateRollout stores rollout unless it was updated since it was read
+func (b *BoltService) UpdateRollout(r *model.Rollout) error {
+	next := *r
+	next.Revision++
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		stored := &model.Rollout{}
+		if err := boltGet(tx, rolloutCollection, r.ID.Hex(), stored); err != nil {
+			return err
+		}
+		if stored.Revision != r.Revision {
+			return ErrConflict
+		}
+		return boltPut(tx, rolloutCollection, r.ID.Hex(), &next)
+	})
+	if err == nil {
+		r.Revision = next.Revision
+	}
+	return err
+}
+
+func (b *BoltService) GetRollout(id string) (*model.Rollout, error) {
+	r := &model.Rollout{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return boltGet(tx, rolloutCollection, id, r)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetRollouts returns all rollouts, newest first
+func (b *BoltService) GetRollouts() (*[]model.Rollout, error) {
+	list := []model.Rollout{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(rolloutCollection)).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			r := model.Rollout{}
+			if err := bson.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			list = append(list, r)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// AddRolloutDevice records device as updated by rollout, date of first
+// record is kept
+func (b *BoltService) AddRolloutDevice(rolloutID string, deviceNumber string) error {
+	if !bson.IsObjectIdHex(rolloutID) || deviceNumber == "" {
+		return ErrNotFound
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		members, err := tx.Bucket([]byte(rolloutDevices)).
+			CreateBucketIfNotExists([]byte(rolloutID))
+		if err != nil {
+			return err
+		}
+		if members.Get([]byte(deviceNumber)) != nil {
+			return nil
+		}
+		data, err := bson.Marshal(&model.RolloutDevice{
+			Rollout:      bson.ObjectIdHex(rolloutID),
+			DeviceNumber: deviceNumber,
+			Date:         time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+		return members.Put([]byte(deviceNumber), data)
+	})
+}
+
+func (b *BoltService) IsRolloutDevice(rolloutID string, deviceNumber string) (bool,
+	error) {
+	found := false
+	err := b.db.View(func(tx *bolt.Tx) error {
+		members := tx.Bucket([]byte(rolloutDevices)).Bucket([]byte(rolloutID))
+		found = members != nil && members.Get([]byte(deviceNumber)) != nil
+		return nil
+	})
+	return found, err
+}
+
+// GetRolloutStats counts devices updated by rollout and errors they
+// reported since minute of update or of since, whichever is later
+func (b *BoltService) GetRolloutStats(rolloutID string, since time.Time) (int, int, error) {
+	updated, errs := 0, 0
+	err := b.db.View(func(tx *bolt.Tx) error {
+		members := tx.Bucket([]byte(rolloutDevices)).Bucket([]byte(rolloutID))
+		if members == nil {
+			return nil
+		}
+		return members.ForEach(func(_, v []byte) error {
+			member := model.RolloutDevice{}
+			if err := bson.Unmarshal(v, &member); err != nil {
+				return err
+			}
+			updated++
+			counts := tx.Bucket([]byte(issueCountCollection)).
+				Bucket([]byte(member.DeviceNumber))
+			if counts == nil {
+				return nil
+			}
+			c := counts.Cursor()
+			start := boltTimeKey(laterDate(member.Date, since).Truncate(countPeriod))
+			for k, v := c.Seek(start); k != nil; k, v = c.Next() {
+				count := model.IssueCount{}
+				if err := bson.Unmarshal(v, &count); err != nil {
+					return err
+				}
+				errs += count.Count
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return updated, errs, nil
+}
+
+// CountErrors counts errors named errorName each device reported in
+// minutes starting in [from, to), occurrences which were not stored are
+// counted too
+func (b *BoltService) CountErrors(errorName string, from, to time.Time) (map[string]int,
+	error) {
+	counts := make(map[string]int)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return boltEachCount(tx, from, to, func(c *model.IssueCount) error {
+			if c.ErrorName == errorName {
+				counts[c.DeviceNumber] += c.Count
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// GetOfflineDevices finds offline devices last seen before time
+func (b *BoltService) GetOfflineDevices(before time.Time) (*[]model.Device, error) {
+	devices := []model.Device{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(deviceCollection)).ForEach(func(_, v []byte) error {
+			device := model.Device{}
+			if err := bson.Unmarshal(v, &device); err != nil {
+				return err
+			}
+			if device.Status == model.StatusOffline && device.LastSeen.Before(before) {
+				devices = append(devices, device)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &devices, nil
+}
+
+func (b *BoltService) AddRule(r *model.Rule) error {
+	if r.ID == "" {
+		r.ID = bson.NewObjectId()
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return boltPut(tx, ruleCollection, r.ID.Hex(), r)
+	})
+}
+
+func (b *BoltService) UpdateRule(r *model.Rule) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(ruleCollection)).Get([]byte(r.ID.Hex())) == nil {
+			return ErrNotFound
+		}
+		return boltPut(tx, ruleCollection, r.ID.Hex(), r)
+	})
+}
+
+func (b *BoltService) GetRule(id string) (*model.Rule, error) {
+	r := &model.Rule{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return boltGet(tx, ruleCollection, id, r)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetRules returns all rules, oldest first
+func (b *BoltService) GetRules() (*[]model.Rule, error) {
+	rules := []model.Rule{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(ruleCollection)).ForEach(func(_, v []byte) error {
+			r := model.Rule{}
+			if err := bson.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			rules = append(rules, r)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &rules, nil
+}
+
+func (b *BoltService) DeleteRule(id string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		rules := tx.Bucket([]byte(ruleCollection))
+		if rules.Get([]byte(id)) == nil {
+			return ErrNotFound
+		}
+		return rules.Delete([]byte(id))
+	})
+}
+
+func (b *BoltService) AddAlert(a *model.Alert) error {
+	if a.ID == "" {
+		a.ID = bson.NewObjectId()
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return boltPut(tx, alertCollection, a.ID.Hex(), a)
+	})
+}
+
+func (b *BoltService) UpdateAlert(a *model.Alert) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(alertCollection)).Get([]byte(a.ID.Hex())) == nil {
+			return ErrNotFound
+		}
+		return boltPut(tx, alertCollection, a.ID.Hex(), a)
+	})
+}
+
+// GetAlerts returns alerts in state, or in any state when it is empty,
+// newest first. Limit 0 returns every alert
+func (b *BoltService) GetAlerts(state string, limit int) (*[]model.Alert, error) {
+	alerts := []model.Alert{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(alertCollection)).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			if limit > 0 && len(alerts) == limit {
+				break
+			}
+			a := model.Alert{}
+			if err := bson.Unmarshal(v, &a); err != nil {
+				return err
+			}
+			if state == "" || a.State == state {
+				alerts = append(alerts, a)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &alerts, nil
+}
+
+func (b *BoltService) AddWebhook(w *model.Webhook) error {
+	if w.ID == "" {
+		w.ID = bson.NewObjectId()
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return boltPut(tx, webhookCollection, w.ID.Hex(), w)
+	})
+}
+
+func (b *BoltService) GetWebhook(id string) (*model.Webhook, error) {
+	w := &model.Webhook{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return boltGet(tx, webhookCollection, id, w)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// GetWebhooks returns all webhooks, oldest first
+func (b *BoltService) GetWebhooks() (*[]model.Webhook, error) {
+	webhooks := []model.Webhook{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(webhookCollection)).ForEach(func(_, v []byte) error {
+			w := model.Webhook{}
+			if err := bson.Unmarshal(v, &w); err != nil {
+				return err
+			}
+			webhooks = append(webhooks, w)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &webhooks, nil
+}
+
+func (b *BoltService) DeleteWebhook(id string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		webhooks := tx.Bucket([]byte(webhookCollection))
+		if webhooks.Get([]byte(id)) == nil {
+			return ErrNotFound
+		}
+		return webhooks.Delete([]byte(id))
+	})
+}
+
+// AddDeliveries queues deliveries of events
+func (b *BoltService) AddDeliveries(deliveries []model.Delivery) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		for i := range deliveries {
+			if deliveries[i].ID == "" {
+				deliveries[i].ID = bson.NewObjectId()
+			}
+			err := boltPut(tx, deliveryCollection, deliveries[i].ID.Hex(), &deliveries[i])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BoltService) UpdateDelivery(d *model.Delivery) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(deliveryCollection)).Get([]byte(d.ID.Hex())) == nil {
+			return ErrNotFound
+		}
+		return boltPut(tx, deliveryCollection, d.ID.Hex(), d)
+	})
+}
+
+// GetDueDeliveries returns pending deliveries to attempt at now, the
+// longest waiting first
+func (b *BoltService) GetDueDeliveries(now time.Time, limit int) (*[]model.Delivery,
+	error) {
+	deliveries := []model.Delivery{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(deliveryCollection)).ForEach(func(_, v []byte) error {
+			d := model.Delivery{}
+			if err := bson.Unmarshal(v, &d); err != nil {
+				return err
+			}
+			if d.State == model.DeliveryPending && !d.NextDate.After(now) {
+				deliveries = append(deliveries, d)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(deliveries, func(i, j int) bool {
+		return deliveries[i].NextDate.Before(deliveries[j].NextDate)
+	})
+	if limit > 0 && len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+	return &deliveries, nil
+}
+
+// GetDeliveries returns deliveries of webhook, newest first
+func (b *BoltService) GetDeliveries(webhookID string, limit int) (*[]model.Delivery,
+	error) {
+	deliveries := []model.Delivery{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(deliveryCollection)).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			if limit > 0 && len(deliveries) == limit {
+				break
+			}
+			d := model.Delivery{}
+			if err := bson.Unmarshal(v, &d); err != nil {
+				return err
+			}
+			if d.WebhookId.Hex() == webhookID {
+				deliveries = append(deliveries, d)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &deliveries, nil
+}
+
+// DeleteDeliveries removes delivered and failed deliveries queued before
+// time
+func (b *BoltService) DeleteDeliveries(before time.Time) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		deliveries := tx.Bucket([]byte(deliveryCollection))
+		expired := [][]byte{}
+		err := deliveries.ForEach(func(k, v []byte) error {
+			d := model.Delivery{}
+			if err := bson.Unmarshal(v, &d); err != nil {
+				return err
+			}
+			if d.State != model.DeliveryPending && d.CreateDate.Before(before) {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err = deliveries.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SetSubscription stores subscription of admin replacing previous one
+func (b *BoltService) SetSubscription(s *model.Subscription) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return boltPut(tx, subscriptionCollection, s.Login, s)
+	})
+}
+
+func (b *BoltService) GetSubscription(login string) (*model.Subscription, error) {
+	s := &model.Subscription{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return boltGet(tx, subscriptionCollection, login, s)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// GetSubscriptions returns subscriptions of all admins ordered by login
+func (b *BoltService) GetSubscriptions() (*[]model.Subscription, error) {
+	subscriptions := []model.Subscription{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(subscriptionCollection)).ForEach(func(_, v []byte) error {
+			s := model.Subscription{}
+			if err := bson.Unmarshal(v, &s); err != nil {
+				return err
+			}
+			subscriptions = append(subscriptions, s)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &subscriptions, nil
+}
+
+// SetDigestDate sets when digest was last mailed to admin keeping the
+// rest of subscription as it is
+func (b *BoltService) SetDigestDate(login string, date time.Time) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		s := &model.Subscription{}
+		if err := boltGet(tx, subscriptionCollection, login, s); err != nil {
+			return err
+		}
+		s.DigestDate = date
+		return boltPut(tx, subscriptionCollection, login, s)
+	})
+}
+
+// AddMails queues mails
+func (b *BoltService) AddMails(mails []model.Mail) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		for i := range mails {
+			if mails[i].ID == "" {
+				mails[i].ID = bson.NewObjectId()
+			}
+			if err := boltPut(tx, mailCollection, mails[i].ID.Hex(), &mails[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BoltService) UpdateMail(mail *model.Mail) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(mailCollection)).Get([]byte(mail.ID.Hex())) == nil {
+			return ErrNotFound
+		}
+		return boltPut(tx, mailCollection, mail.ID.Hex(), mail)
+	})
+}
+
+// GetDueMails returns pending mails to send at now, the longest waiting
+// first
+func (b *BoltService) GetDueMails(now time.Time, limit int) (*[]model.Mail, error) {
+	mails := []model.Mail{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(mailCollection)).ForEach(func(_, v []byte) error {
+			mail := model.Mail{}
+			if err := bson.Unmarshal(v, &mail); err != nil {
+				return err
+			}
+			if mail.State == model.DeliveryPending && !mail.NextDate.After(now) {
+				mails = append(mails, mail)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(mails, func(i, j int) bool {
+		return mails[i].NextDate.Before(mails[j].NextDate)
+	})
+	if limit > 0 && len(mails) > limit {
+		mails = mails[:limit]
+	}
+	return &mails, nil
+}
+
+// GetIssuesSeen finds issues of every device last seen in [from, to)
+// ordered by device number, issues of device are ordered by last seen,
+// the latest first
+func (b *BoltService) GetIssuesSeen(from, to time.Time, limit int) (*[]model.Issue, error) {
+	issues := []model.Issue{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return boltEachDoc(tx.Bucket([]byte(issueCollection)), func(v []byte) error {
+			issue := model.Issue{}
+			if err := bson.Unmarshal(v, &issue); err != nil {
+				return err
+			}
+			if !issue.LastSeen.Before(from) && issue.LastSeen.Before(to) {
+				issues = append(issues, issue)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	issues = sortIssuesSeen(issues, limit)
+	return &issues, nil
+}
+
+// eachFirmware walks firmware from newest to oldest until fn returns false
+func (b *BoltService) eachFirmware(fn func(fw *model.Firmware) bool) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(firmwareCollection)).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			fw := &model.Firmware{}
+			if err := bson.Unmarshal(v, fw); err != nil {
+				return err
+			}
+			if !fn(fw) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+// AddSamples stores batch of metric samples, samples are keyed by time
+// so range of them is read by cursor seek
+func (b *BoltService) AddSamples(samples []model.Sample) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		for i := range samples {
+			s := &samples[i]
+			device, err := tx.Bucket([]byte(sampleCollection)).
+				CreateBucketIfNotExists([]byte(s.DeviceNumber))
+			if err != nil {
+				return err
+			}
+			metric, err := device.CreateBucketIfNotExists([]byte(s.Metric))
+			if err != nil {
+				return err
+			}
+			seq, err := metric.NextSequence()
+			if err != nil {
+				return err
+			}
+			data, err := bson.Marshal(s)
+			if err != nil {
+				return err
+			}
+			if err = metric.Put(append(boltTimeKey(s.Date), boltSeqKey(seq)...),
+				data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetSamples finds samples of device metric taken in [from, to)
+func (b *BoltService) GetSamples(deviceNumber, metric string, from,
+	to time.Time) (*[]model.Sample, error) {
+	samples := []model.Sample{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		device := tx.Bucket([]byte(sampleCollection)).Bucket([]byte(deviceNumber))
+		if device == nil {
+			return nil
+		}
+		return boltRange(device.Bucket([]byte(metric)), from, to, func(v []byte) error {
+			s := model.Sample{}
+			if err := bson.Unmarshal(v, &s); err != nil {
+				return err
+			}
+			samples = append(samples, s)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &samples, nil
+}
+
+// GetAllSamples finds samples of every device and metric taken in
+// [from, to)
+func (b *BoltService) GetAllSamples(from, to time.Time) (*[]model.Sample, error) {
+	samples := []model.Sample{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return boltEachSeries(tx.Bucket([]byte(sampleCollection)), func(series *bolt.Bucket) error {
+			return boltRange(series, from, to, func(v []byte) error {
+				s := model.Sample{}
+				if err := bson.Unmarshal(v, &s); err != nil {
+					return err
+				}
+				samples = append(samples, s)
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].Date.Before(samples[j].Date)
+	})
+	return &samples, nil
+}
+
+// GetMetricSamples finds samples of metric of every device taken in
+// [from, to)
+func (b *BoltService) GetMetricSamples(metric string, from,
+	to time.Time) (*[]model.Sample, error) {
+	samples := []model.Sample{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return boltEachMetric(tx.Bucket([]byte(sampleCollection)), metric, func(series *bolt.Bucket) error {
+			return boltRange(series, from, to, func(v []byte) error {
+				s := model.Sample{}
+				if err := bson.Unmarshal(v, &s); err != nil {
+					return err
+				}
+				samples = append(samples, s)
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].Date.Before(samples[j].Date)
+	})
+	return &samples, nil
+}
+
+// DeleteSamples removes samples taken before time
+func (b *BoltService) DeleteSamples(before time.Time) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return boltEachSeries(tx.Bucket([]byte(sampleCollection)), func(series *bolt.Bucket) error {
+			return boltDeleteBefore(series, before)
+		})
+	})
+}
+
+// SetRollups stores rollups replacing ones of the same bucket
+func (b *BoltService) SetRollups(rollups []model.Rollup) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		for i := range rollups {
+			r := &rollups[i]
+			series := tx.Bucket([]byte(rollupCollection))
+			var err error
+			for _, name := range []string{r.Resolution, r.DeviceNumber, r.Metric} {
+				if series, err = series.CreateBucketIfNotExists([]byte(name)); err != nil {
+					return err
+				}
+			}
+			data, err := bson.Marshal(r)
+			if err != nil {
+				return err
+			}
+			if err = series.Put(boltTimeKey(r.Date), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetRollups finds rollups of device metric with buckets starting in
+// [from, to)
+func (b *BoltService) GetRollups(deviceNumber, metric, resolution string, from,
+	to time.Time) (*[]model.Rollup, error) {
+	rollups := []model.Rollup{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		series := tx.Bucket([]byte(rollupCollection))
+		for _, name := range []string{resolution, deviceNumber, metric} {
+			if series = series.Bucket([]byte(name)); series == nil {
+				return nil
+			}
+		}
+		return boltRange(series, from, to, func(v []byte) error {
+			r := model.Rollup{}
+			if err := bson.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			rollups = append(rollups, r)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &rollups, nil
+}
+
+// GetAllRollups finds rollups of every device and metric with buckets
+// starting in [from, to)
+func (b *BoltService) GetAllRollups(resolution string, from,
+	to time.Time) (*[]model.Rollup, error) {
+	rollups := []model.Rollup{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		devices := tx.Bucket([]byte(rollupCollection)).Bucket([]byte(resolution))
+		return boltEachSeries(devices, func(series *bolt.Bucket) error {
+			return boltRange(series, from, to, func(v []byte) error {
+				r := model.Rollup{}
+				if err := bson.Unmarshal(v, &r); err != nil {
+					return err
+				}
+				rollups = append(rollups, r)
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(rollups, func(i, j int) bool {
+		return rollups[i].Date.Before(rollups[j].Date)
+	})
+	return &rollups, nil
+}
+
+// GetMetricRollups finds rollups of metric of every device with buckets
+// starting in [from, to)
+func (b *BoltService) GetMetricRollups(metric, resolution string, from,
+	to time.Time) (*[]model.Rollup, error) {
+	rollups := []model.Rollup{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		devices := tx.Bucket([]byte(rollupCollection)).Bucket([]byte(resolution))
+		return boltEachMetric(devices, metric, func(series *bolt.Bucket) error {
+			return boltRange(series, from, to, func(v []byte) error {
+				r := model.Rollup{}
+				if err := bson.Unmarshal(v, &r); err != nil {
+					return err
+				}
+				rollups = append(rollups, r)
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(rollups, func(i, j int) bool {
+		return rollups[i].Date.Before(rollups[j].Date)
+	})
+	return &rollups, nil
+}
+
+// LastRollup returns start of the latest bucket of resolution, zero time
+// when there are no rollups of resolution
+func (b *BoltService) LastRollup(resolution string) (time.Time, error) {
+	last := time.Time{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		devices := tx.Bucket([]byte(rollupCollection)).Bucket([]byte(resolution))
+		return boltEachSeries(devices, func(series *bolt.Bucket) error {
+			if k, _ := series.Cursor().Last(); k != nil {
+				date := time.Unix(0, int64(binary.BigEndian.Uint64(k[:8])))
+				if date.After(last) {
+					last = date
+				}
+			}
+			return nil
+		})
+	})
+	return last, err
+}
+
+// DeleteRollups removes rollups of resolution with buckets starting
+// before time
+func (b *BoltService) DeleteRollups(resolution string, before time.Time) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		devices := tx.Bucket([]byte(rollupCollection)).Bucket([]byte(resolution))
+		return boltEachSeries(devices, func(series *bolt.Bucket) error {
+			return boltDeleteBefore(series, before)
+		})
+	})
+}
+
+func (b *BoltService) GetCookieExp(login string) (*time.Time, error) {
+	cookie := model.Cookie{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return boltGet(tx, cookieCollection, login, &cookie)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &cookie.Expire, nil
+}
+
+func (b *BoltService) SetCookieExp(login string, expireTime time.Time) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		cookie := &model.Cookie{Login: login, Expire: expireTime}
+		return boltPut(tx, cookieCollection, login, cookie)
+	})
+}
+
+func (b *BoltService) SetCreds(creds model.Credentials) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return boltPut(tx, userCollection, creds.Login, &creds)
+	})
+}
+
+func (b *BoltService) GetCreds(login string) (*model.Credentials, error) {
+	creds := model.Credentials{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return boltGet(tx, userCollection, login, &creds)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &creds, nil
+}
+
+func (b *BoltService) deviceByNumber(tx *bolt.Tx, deviceNumber string) (*model.Device,
+	error) {
+	id := tx.Bucket([]byte(deviceNumberBucket)).Get([]byte(deviceNumber))
+	if id == nil {
+		return nil, ErrNotFound
+	}
+	device := &model.Device{}
+	if err := boltGet(tx, deviceCollection, string(id), device); err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+// updateDevice applies change to stored device document
+func (b *BoltService) updateDevice(deviceNumber string,
+	change func(device *model.Device)) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		device, err := b.deviceByNumber(tx, deviceNumber)
+		if err != nil {
+			return err
+		}
+		change(device)
+		return boltPut(tx, deviceCollection, device.ID.Hex(), device)
+	})
+}
+
+// boltPut stores bson encoded document under key
+func boltPut(tx *bolt.Tx, bucket, key string, doc interface{}) error {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(bucket)).Put([]byte(key), data)
+}
+
+// boltGet decodes document stored under key, ErrNotFound is returned
+// when there is no such key
+func boltGet(tx *bolt.Tx, bucket, key string, doc interface{}) error {
+	data := tx.Bucket([]byte(bucket)).Get([]byte(key))
+	if data == nil {
+		return ErrNotFound
+	}
+	return bson.Unmarshal(data, doc)
+}
+
+// boltAppend stores bson encoded document in nested bucket under next
+// sequence number
+func boltAppend(tx *bolt.Tx, bucket, nested string, doc interface{}) error {
+	docs, err := tx.Bucket([]byte(bucket)).CreateBucketIfNotExists([]byte(nested))
+	if err != nil {
+		return err
+	}
+	seq, err := docs.NextSequence()
+	if err != nil {
+		return err
+	}
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return docs.Put(boltSeqKey(seq), data)
+}
+
+// boltAddIssueCounts adds counts to stored counts of the same issue and
+// minute
+func boltAddIssueCounts(tx *bolt.Tx, counts []model.IssueCount) error {
+	for _, c := range counts {
+		series, err := tx.Bucket([]byte(issueCountCollection)).
+			CreateBucketIfNotExists([]byte(c.DeviceNumber))
+		if err != nil {
+			return err
+		}
+		key := append(boltTimeKey(c.Date), []byte(c.IssueId)...)
+		if v := series.Get(key); v != nil {
+			stored := model.IssueCount{}
+			if err = bson.Unmarshal(v, &stored); err != nil {
+				return err
+			}
+			c.Count += stored.Count
+		}
+		data, err := bson.Marshal(&c)
+		if err != nil {
+			return err
+		}
+		if err = series.Put(key, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// boltEachCount calls fn for issue counts of every device with minutes
+// starting in [from, to)
+func boltEachCount(tx *bolt.Tx, from, to time.Time, fn func(c *model.IssueCount) error) error {
+	root := tx.Bucket([]byte(issueCountCollection))
+	return root.ForEach(func(device, _ []byte) error {
+		return boltRange(root.Bucket(device), from, to, func(v []byte) error {
+			c := model.IssueCount{}
+			if err := bson.Unmarshal(v, &c); err != nil {
+				return err
+			}
+			return fn(&c)
+		})
+	})
+}
+
+// boltMigrateErrors groups errors stored before issues were introduced
+// into issues, each of them is counted as occurrence of open issue
+func boltMigrateErrors(tx *bolt.Tx) error {
+	root := tx.Bucket([]byte(errorCollection))
+	return root.ForEach(func(deviceID, _ []byte) error {
+		docs := root.Bucket(deviceID)
+		issues, err := tx.Bucket([]byte(issueCollection)).CreateBucketIfNotExists(deviceID)
+		if err != nil {
+			return err
+		}
+		migrated := map[string][]byte{}
+		err = docs.ForEach(func(k, v []byte) error {
+			de := &model.DeviceError{}
+			if err := bson.Unmarshal(v, de); err != nil {
+				return err
+			}
+			if de.IssueId != "" {
+				return nil
+			}
+			var issue *model.Issue
+			err := issues.ForEach(func(_, v []byte) error {
+				other := &model.Issue{}
+				if err := bson.Unmarshal(v, other); err != nil {
+					return err
+				}
+				if issueOf(other, de) {
+					issue = other
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if issue == nil {
+				issue = newIssue(de)
+			}
+			if de.Date.Before(issue.FirstSeen) {
+				issue.FirstSeen = de.Date
+			}
+			if de.Date.After(issue.LastSeen) {
+				issue.LastSeen = de.Date
+			}
+			issue.Count++
+			de.IssueId, de.Sampled = issue.ID, true
+			if de.ID == "" {
+				de.ID = bson.NewObjectId()
+			}
+			data, err := bson.Marshal(issue)
+			if err != nil {
+				return err
+			}
+			if err = issues.Put([]byte(issue.ID.Hex()), data); err != nil {
+				return err
+			}
+			err = tx.Bucket([]byte(errorIDBucket)).Put([]byte(de.ID.Hex()), deviceID)
+			if err != nil {
+				return err
+			}
+			if data, err = bson.Marshal(de); err != nil {
+				return err
+			}
+			migrated[string(k)] = data
+			return boltAddIssueCounts(tx, countOccurrences([]*model.DeviceError{de}))
+		})
+		if err != nil {
+			return err
+		}
+		for k, data := range migrated {
+			if err = docs.Put([]byte(k), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// boltEachDoc calls fn for every document in nested buckets of root
+func boltEachDoc(root *bolt.Bucket, fn func(v []byte) error) error {
+	return root.ForEach(func(nested, _ []byte) error {
+		return root.Bucket(nested).ForEach(func(_, v []byte) error {
+			return fn(v)
+		})
+	})
+}
+
+// boltEachSeries calls fn for every metric bucket nested in device
+// buckets of root, root may be nil
+func boltEachSeries(root *bolt.Bucket, fn func(series *bolt.Bucket) error) error {
+	if root == nil {
+		return nil
+	}
+	return root.ForEach(func(device, _ []byte) error {
+		return root.Bucket(device).ForEach(func(metric, _ []byte) error {
+			return fn(root.Bucket(device).Bucket(metric))
+		})
+	})
+}
+
+// boltEachMetric calls fn for series of metric of every device of root,
+// root may be nil
+func boltEachMetric(root *bolt.Bucket, metric string, fn func(series *bolt.Bucket) error) error {
+	if root == nil {
+		return nil
+	}
+	return root.ForEach(func(device, _ []byte) error {
+		if series := root.Bucket(device).Bucket([]byte(metric)); series != nil {
+			return fn(series)
+		}
+		return nil
+	})
+}
+
+// boltRange calls fn for documents of time keyed bucket in [from, to),
+// series may be nil
+func boltRange(series *bolt.Bucket, from, to time.Time, fn func(v []byte) error) error {
+	if series == nil {
+		return nil
+	}
+	end := boltTimeKey(to)
+	c := series.Cursor()
+	for k, v := c.Seek(boltTimeKey(from)); k != nil && bytes.Compare(k[:8], end) < 0; k, v = c.Next() {
+		if err := fn(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// boltDeleteBefore removes documents of time keyed bucket before time
+func boltDeleteBefore(series *bolt.Bucket, before time.Time) error {
+	end := boltTimeKey(before)
+	keys := [][]byte{}
+	c := series.Cursor()
+	for k, _ := c.First(); k != nil && bytes.Compare(k[:8], end) < 0; k, _ = c.Next() {
+		keys = append(keys, append([]byte{}, k...))
+	}
+	for _, k := range keys {
+		if err := series.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// boltTimeKey encodes time so keys sort in time order, times before
+// epoch are not expected
+func boltTimeKey(t time.Time) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	return key
+}
+
+// boltSeqKey encodes sequence number so keys sort in insertion order
+func boltSeqKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
@@ -0,0 +1,240 @@
+package service
+
+import (
+	"iot-stats/model"
+	"sort"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// First occurrenceCap occurrences of issue are all stored, later only each
+// occurrenceSample-th is stored. Every occurrence is counted in issue
+// counts of countPeriod. Device list shows at most maxListedIssues issues
+// seen last, at most maxListedOccurrences latest occurrences of issue are
+// listed
+const (
+	occurrenceCap        = 20
+	occurrenceSample     = 100
+	countPeriod          = time.Minute
+	maxListedIssues      = 50
+	maxListedOccurrences = 100
+)
+
+// newDeviceError makes stored error from report, firmware device runs is
+// taken when report does not tell it
+func newDeviceError(de *model.DeviceErrorDto, device *model.Device) *model.DeviceError {
+	deviceError := &model.DeviceError{
+		ID:              bson.NewObjectId(),
+		ErrorName:       de.ErrorName,
+		DeviceNumber:    device.DeviceNumber,
+		Date:            time.Now(),
+		DeviceId:        device.ID,
+		Severity:        de.Severity,
+		Code:            de.Code,
+		DeviceDate:      de.Timestamp,
+		FirmwareVersion: de.FirmwareVersion,
+		Context:         de.Context,
+		Fingerprint:     de.Fingerprint,
+		Attachment:      de.Attachment,
+	}
+	if deviceError.FirmwareVersion == "" {
+		deviceError.FirmwareVersion = device.FirmwareVersion
+	}
+	return deviceError
+}
+
+// newDeviceErrors makes stored errors from reports of device
+func newDeviceErrors(des []model.DeviceErrorDto, device *model.Device) []*model.DeviceError {
+	errs := make([]*model.DeviceError, len(des))
+	for i := range des {
+		errs[i] = newDeviceError(&des[i], device)
+	}
+	return errs
+}
+
+// groupByIssue splits errors of device into occurrences of the same issue,
+// groups go in order of their first error
+func groupByIssue(errs []*model.DeviceError) [][]*model.DeviceError {
+	groups := [][]*model.DeviceError{}
+	for _, de := range errs {
+		i := 0
+		for i < len(groups) && (groups[i][0].ErrorName != de.ErrorName ||
+			groups[i][0].Fingerprint != de.Fingerprint) {
+			i++
+		}
+		if i == len(groups) {
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], de)
+	}
+	return groups
+}
+
+// errorDto makes listed occurrence from stored error
+func errorDto(de *model.DeviceError) model.DeviceErrorDto {
+	return model.DeviceErrorDto{
+		ID:              de.ID,
+		ErrorName:       de.ErrorName,
+		DeviceNumber:    de.DeviceNumber,
+		Fingerprint:     de.Fingerprint,
+		Severity:        de.Severity,
+		Code:            de.Code,
+		Timestamp:       de.DeviceDate,
+		FirmwareVersion: de.FirmwareVersion,
+		Context:         de.Context,
+		Date:            de.Date,
+	}
+}
+
+// newIssue makes open issue of error before its first occurrence is
+// counted
+func newIssue(de *model.DeviceError) *model.Issue {
+	return &model.Issue{
+		ID:           bson.NewObjectId(),
+		DeviceId:     de.DeviceId,
+		DeviceNumber: de.DeviceNumber,
+		ErrorName:    de.ErrorName,
+		Fingerprint:  de.Fingerprint,
+		FirstSeen:    de.Date,
+		State:        model.ErrorOpen,
+	}
+}
+
+// issueOf tells whether error is occurrence of issue
+func issueOf(issue *model.Issue, de *model.DeviceError) bool {
+	return issue.DeviceId == de.DeviceId && issue.ErrorName == de.ErrorName &&
+		issue.Fingerprint == de.Fingerprint
+}
+
+// addOccurrence counts error in its issue and reopens resolved issue,
+// it tells whether issue was reopened. Error is sampled by its number in
+// issue
+func addOccurrence(issue *model.Issue, de *model.DeviceError) bool {
+	issue.Count++
+	issue.LastSeen = de.Date
+	issue.Severity = de.Severity
+	issue.Code = de.Code
+	issue.FirmwareVersion = de.FirmwareVersion
+	reopened := issue.State == model.ErrorResolved
+	if reopened {
+		applyErrorChange(issue, reopenChange(de.Date))
+	}
+	de.IssueId = issue.ID
+	de.Sampled = sampledOccurrence(issue.Count)
+	return reopened
+}
+
+// storedError tells whether error is stored, error with attachment is
+// stored out of sample
+func storedError(de *model.DeviceError) bool {
+	return de.Sampled || de.Attachment
+}
+
+// storedIDs lists ids of stored errors, errors which are not stored get
+// empty id
+func storedIDs(errs []*model.DeviceError) []string {
+	ids := make([]string, len(errs))
+	for i, de := range errs {
+		if storedError(de) {
+			ids[i] = de.ID.Hex()
+		}
+	}
+	return ids
+}
+
+// sampledOccurrence tells whether n-th occurrence of issue is stored
+func sampledOccurrence(n int) bool {
+	return n <= occurrenceCap || (n-occurrenceCap)%occurrenceSample == 0
+}
+
+// countOccurrences sums errors counted in their issues into issue counts,
+// counts go in order of their first error
+func countOccurrences(errs []*model.DeviceError) []model.IssueCount {
+	counts := []model.IssueCount{}
+	for _, de := range errs {
+		date := de.Date.Truncate(countPeriod)
+		i := 0
+		for i < len(counts) && (counts[i].IssueId != de.IssueId || !counts[i].Date.Equal(date)) {
+			i++
+		}
+		if i == len(counts) {
+			counts = append(counts, model.IssueCount{IssueId: de.IssueId,
+				DeviceNumber: de.DeviceNumber, ErrorName: de.ErrorName, Date: date})
+		}
+		counts[i].Count++
+	}
+	return counts
+}
+
+// laterDate returns the later of two dates, rollout counts errors of
+// device since the later of its update and start of current step
+func laterDate(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
+
+// reopenChange is recorded when resolved issue occurs again
+func reopenChange(date time.Time) model.ErrorChange {
+	return model.ErrorChange{Action: model.ActionReopen, Date: date}
+}
+
+// applyErrorChange moves issue to state of action and records change
+func applyErrorChange(issue *model.Issue, change model.ErrorChange) {
+	if state := model.ErrorActions[change.Action]; state != "" {
+		issue.State = state
+	}
+	if change.Action == model.ActionAssign {
+		issue.Assignee = change.Assignee
+	}
+	issue.History = append(issue.History, change)
+}
+
+// selectIssue tells whether issue is selected by id or error name
+func selectIssue(issue *model.Issue, sel model.IssueSelector) bool {
+	if sel.ID != "" {
+		return issue.ID.Hex() == sel.ID
+	}
+	return issue.ErrorName == sel.ErrorName
+}
+
+// listedIssue tells whether issue is shown in device list
+func listedIssue(issue *model.Issue, filter model.DeviceFilter) bool {
+	return filter.AllErrors || issue.State != model.ErrorResolved
+}
+
+// sortIssues orders issues by last occurrence, the latest first, issues
+// seen at the same time go the latest created first. At most limit of
+// them are kept, zero limit keeps all
+func sortIssues(issues []model.Issue, limit int) []model.Issue {
+	sort.Slice(issues, func(i, j int) bool {
+		if !issues[i].LastSeen.Equal(issues[j].LastSeen) {
+			return issues[i].LastSeen.After(issues[j].LastSeen)
+		}
+		return issues[i].ID > issues[j].ID
+	})
+	if limit > 0 && len(issues) > limit {
+		issues = issues[:limit]
+	}
+	return issues
+}
+
+// sortIssuesSeen orders issues by device number and issues of device like
+// sortIssues, up to limit issues are kept
+func sortIssuesSeen(issues []model.Issue, limit int) []model.Issue {
+	sort.Slice(issues, func(i, j int) bool {
+		if issues[i].DeviceNumber != issues[j].DeviceNumber {
+			return issues[i].DeviceNumber < issues[j].DeviceNumber
+		}
+		if !issues[i].LastSeen.Equal(issues[j].LastSeen) {
+			return issues[i].LastSeen.After(issues[j].LastSeen)
+		}
+		return issues[i].ID > issues[j].ID
+	})
+	if limit > 0 && len(issues) > limit {
+		issues = issues[:limit]
+	}
+	return issues
+}
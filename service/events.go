@@ -0,0 +1,199 @@
+package service
+
+import (
+	"encoding/json"
+	"iot-stats/model"
+	"iot-stats/utils"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// issueOpener is storage which tells issues opened by reported errors, it
+// is issues created by them and resolved issues they reopened. Issue is
+// opened by one report only however many devices report at once
+type issueOpener interface {
+	registerErrors(deviceNumber string,
+		des []model.DeviceErrorDto) ([]string, []model.Issue, error)
+}
+
+// EventService wraps storage and queues events for webhooks subscribed to
+// them when devices register, report errors opening issues and finish
+// firmware updates and when alerts fire or resolve. With mail alert
+// events are queued for mailing to admins subscribed to alerts too.
+// Storing doesn't fail when event can't be queued, failure is logged
+type EventService struct {
+	MongoInterface
+	mail bool
+}
+
+func NewEventService(ms MongoInterface, mail bool) *EventService {
+	return &EventService{MongoInterface: ms, mail: mail}
+}
+
+// RegisterDevice publishes registration of device which was not known
+func (e *EventService) RegisterDevice(deviceNumber string, registerDate time.Time) error {
+	_, err := e.MongoInterface.GetDeviceByNumber(deviceNumber)
+	known := err == nil
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	if err = e.MongoInterface.RegisterDevice(deviceNumber, registerDate); err != nil {
+		return err
+	}
+	if !known {
+		e.publish(model.EventDeviceRegistered, deviceNumber,
+			map[string]interface{}{"register-date": registerDate})
+	}
+	return nil
+}
+
+func (e *EventService) RegisterError(de *model.DeviceErrorDto) (string, error) {
+	ids, err := e.RegisterErrors(de.DeviceNumber, []model.DeviceErrorDto{*de})
+	if err != nil {
+		return "", err
+	}
+	return ids[0], nil
+}
+
+// RegisterErrors publishes issues which reports opened, repeat
+// occurrences of open issue are not published
+func (e *EventService) RegisterErrors(deviceNumber string,
+	des []model.DeviceErrorDto) ([]string, error) {
+	opener, ok := e.MongoInterface.(issueOpener)
+	if !ok {
+		return e.MongoInterface.RegisterErrors(deviceNumber, des)
+	}
+	ids, opened, err := opener.registerErrors(deviceNumber, des)
+	if err != nil {
+		return nil, err
+	}
+	for i := range opened {
+		opened[i].History = nil
+		e.publish(model.EventErrorReported, deviceNumber, &opened[i])
+	}
+	return ids, nil
+}
+
+// RegisterUpdate publishes update which succeeded or failed
+func (e *EventService) RegisterUpdate(us *model.UpdateStatusDto) error {
+	if err := e.MongoInterface.RegisterUpdate(us); err != nil {
+		return err
+	}
+	if us.State == model.UpdateSucceeded || us.State == model.UpdateFailed {
+		e.publish(model.EventUpdateFinished, us.DeviceNumber, us)
+	}
+	return nil
+}
+
+func (e *EventService) AddAlert(a *model.Alert) error {
+	if err := e.MongoInterface.AddAlert(a); err != nil {
+		return err
+	}
+	e.publish(model.EventAlertFired, a.DeviceNumber, a)
+	return nil
+}
+
+// UpdateAlert publishes alert which is resolved, alerts are resolved
+// only once
+func (e *EventService) UpdateAlert(a *model.Alert) error {
+	if err := e.MongoInterface.UpdateAlert(a); err != nil {
+		return err
+	}
+	if a.State == model.AlertResolved {
+		e.publish(model.EventAlertResolved, a.DeviceNumber, a)
+	}
+	return nil
+}
+
+// publish queues event for every enabled webhook subscribed to its type
+// and mails alert event to subscribers
+func (e *EventService) publish(eventType, deviceNumber string, data interface{}) {
+	payload, err := eventPayload(eventType, deviceNumber, data)
+	if err != nil {
+		utils.Log().Infoln("event", eventType, "err", err)
+		return
+	}
+	webhooks, err := e.MongoInterface.GetWebhooks()
+	if err != nil {
+		utils.Log().Infoln("event", eventType, "err", err)
+		return
+	}
+	err = e.MongoInterface.AddDeliveries(webhookDeliveries(*webhooks, eventType, payload))
+	if err != nil {
+		utils.Log().Infoln("event", eventType, "err", err)
+	}
+	if !e.mail || (eventType != model.EventAlertFired && eventType != model.EventAlertResolved) {
+		return
+	}
+	now := time.Now()
+	subscriptions, err := e.MongoInterface.GetSubscriptions()
+	if err != nil {
+		utils.Log().Infoln("event", eventType, "err", err)
+		return
+	}
+	mails := []model.Mail{}
+	for _, s := range *subscriptions {
+		if !s.Alerts || s.Email == "" {
+			continue
+		}
+		mails = append(mails, model.Mail{
+			To:         s.Email,
+			Event:      eventType,
+			Payload:    payload,
+			State:      model.DeliveryPending,
+			NextDate:   now,
+			CreateDate: now,
+		})
+	}
+	if err = e.MongoInterface.AddMails(mails); err != nil {
+		utils.Log().Infoln("event", eventType, "err", err)
+	}
+}
+
+// eventPayload encodes event of device with data
+func eventPayload(eventType, deviceNumber string, data interface{}) (string, error) {
+	payload, err := json.Marshal(&model.Event{
+		ID:           bson.NewObjectId(),
+		Type:         eventType,
+		DeviceNumber: deviceNumber,
+		Date:         time.Now(),
+		Data:         data,
+	})
+	return string(payload), err
+}
+
+// webhookDeliveries makes delivery of payload for every enabled webhook
+// subscribed to event type
+func webhookDeliveries(webhooks []model.Webhook, eventType,
+	payload string) []model.Delivery {
+	now := time.Now()
+	deliveries := []model.Delivery{}
+	for _, w := range webhooks {
+		if w.Disabled || !subscribed(&w, eventType) {
+			continue
+		}
+		deliveries = append(deliveries, model.Delivery{
+			WebhookId:  w.ID,
+			Event:      eventType,
+			Payload:    payload,
+			State:      model.DeliveryPending,
+			NextDate:   now,
+			CreateDate: now,
+		})
+	}
+	return deliveries
+}
+
+// subscribed tells whether webhook receives events of type
+func subscribed(w *model.Webhook, eventType string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, t := range w.Events {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
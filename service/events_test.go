@@ -0,0 +1,93 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"iot-stats/model"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventService(t *testing.T) {
+	ms := NewMemoryService()
+	es := NewEventService(ms, false)
+	all := &model.Webhook{URL: "http://example.com/all"}
+	alerts := &model.Webhook{URL: "http://example.com/alerts",
+		Events: []string{model.EventAlertFired, model.EventAlertResolved}}
+	disabled := &model.Webhook{URL: "http://example.com/off", Disabled: true}
+	for _, w := range []*model.Webhook{all, alerts, disabled} {
+		ms.AddWebhook(w)
+	}
+	now := time.Now()
+	es.RegisterDevice("1", now)
+	// Device registered again is not published
+	es.RegisterDevice("1", now)
+	// Errors are published when they open issue
+	for i := 0; i < 3; i++ {
+		es.RegisterError(&model.DeviceErrorDto{DeviceNumber: "1", ErrorName: "crash"})
+	}
+	es.RegisterErrors("1", []model.DeviceErrorDto{{ErrorName: "reboot"}, {ErrorName: "crash"},
+		{ErrorName: "reboot"}})
+	// Resolved issue is published again when it reopens
+	ms.ChangeIssues("1", model.IssueSelector{ErrorName: "crash"},
+		model.ErrorChange{Action: model.ActionResolve, Date: now})
+	es.RegisterError(&model.DeviceErrorDto{DeviceNumber: "1", ErrorName: "crash"})
+	es.RegisterUpdate(&model.UpdateStatusDto{DeviceNumber: "1",
+		State: model.UpdateDownloading})
+	es.RegisterUpdate(&model.UpdateStatusDto{DeviceNumber: "1",
+		State: model.UpdateSucceeded, CurrentVersion: "2.0"})
+	alert := &model.Alert{DeviceNumber: "1", State: model.AlertFiring}
+	es.AddAlert(alert)
+	es.UpdateAlert(alert)
+	alert.State = model.AlertResolved
+	es.UpdateAlert(alert)
+
+	deliveries, _ := ms.GetDeliveries(all.ID.Hex(), 0)
+	events := []string{}
+	for i := len(*deliveries) - 1; i >= 0; i-- {
+		events = append(events, (*deliveries)[i].Event)
+	}
+	assert.Equal(t, []string{model.EventDeviceRegistered, model.EventErrorReported,
+		model.EventErrorReported, model.EventErrorReported, model.EventUpdateFinished,
+		model.EventAlertFired, model.EventAlertResolved}, events)
+	event := struct {
+		Type         string      `json:"type"`
+		DeviceNumber string      `json:"device-number"`
+		Data         model.Issue `json:"data"`
+	}{}
+	published := []string{}
+	for _, i := range []int{5, 4, 3} {
+		assert.Nil(t, json.Unmarshal([]byte((*deliveries)[i].Payload), &event))
+		assert.Equal(t, model.EventErrorReported, event.Type)
+		assert.Equal(t, "1", event.DeviceNumber)
+		published = append(published, fmt.Sprint(event.Data.ErrorName, " ",
+			event.Data.Count, " ", event.Data.State))
+	}
+	assert.Equal(t, []string{"crash 1 open", "reboot 2 open", "crash 5 open"}, published)
+	deliveries, _ = ms.GetDeliveries(alerts.ID.Hex(), 0)
+	assert.Len(t, *deliveries, 2)
+	assert.Equal(t, model.DeliveryPending, (*deliveries)[0].State)
+	deliveries, _ = ms.GetDeliveries(disabled.ID.Hex(), 0)
+	assert.Len(t, *deliveries, 0)
+}
+
+func TestEventServiceMail(t *testing.T) {
+	ms := NewMemoryService()
+	ms.SetSubscription(&model.Subscription{Login: "admin", Email: "admin@example.com",
+		Alerts: true})
+	ms.SetSubscription(&model.Subscription{Login: "digest", Email: "digest@example.com",
+		Digest: model.DigestDaily})
+	alert := &model.Alert{DeviceNumber: "1", State: model.AlertFiring}
+	NewEventService(ms, false).AddAlert(alert)
+	mails, _ := ms.GetDueMails(time.Now(), 0)
+	assert.Len(t, *mails, 0)
+	es := NewEventService(ms, true)
+	es.AddAlert(alert)
+	es.RegisterDevice("1", time.Now())
+	mails, _ = ms.GetDueMails(time.Now(), 0)
+	assert.Len(t, *mails, 1)
+	assert.Equal(t, "admin@example.com", (*mails)[0].To)
+	assert.Equal(t, model.EventAlertFired, (*mails)[0].Event)
+}
@@ -0,0 +1,1320 @@
+package service
+
+import (
+	"errors"
+	"iot-stats/model"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// MemoryService keeps all data in process memory. It is meant for local
+// runs and tests, everything is lost when the process exits.
+type MemoryService struct {
+	mu            sync.RWMutex
+	devices       []model.Device
+	errors        []model.DeviceError
+	issues        []model.Issue
+	issueCounts   []model.IssueCount
+	attachments   []model.Attachment
+	firmware      []model.Firmware
+	rollouts      []model.Rollout
+	updates       []model.UpdateEvent
+	downloads     []model.DownloadStats
+	samples       []model.Sample
+	rollups       []model.Rollup
+	rules         []model.Rule
+	alerts        []model.Alert
+	webhooks      []model.Webhook
+	deliveries    []model.Delivery
+	mails         []model.Mail
+	cookies       map[string]time.Time
+	users         map[string]model.Credentials
+	subscriptions map[string]model.Subscription
+
+	statusEvents []model.StatusEvent
+
+	// rollout id -> device number -> date of update
+	rolloutDevices map[string]map[string]time.Time
+}
+
+func NewMemoryService() *MemoryService {
+	m := &MemoryService{
+		cookies:        make(map[string]time.Time),
+		users:          make(map[string]model.Credentials),
+		subscriptions:  make(map[string]model.Subscription),
+		rolloutDevices: make(map[string]map[string]time.Time),
+	}
+	return m
+}
+
+// Connect does nothing, memory storage is always available
+func (m *MemoryService) Connect() error {
+	return nil
+}
+
+// GetAllDevices find list of devices matching filter joined with their
+// issues
+func (m *MemoryService) GetAllDevices(skip int, limit int,
+	filter model.DeviceFilter) (*[]model.DeviceDto, error) {
+	if skip < 0 || limit < 0 {
+		return nil, errors.New("skip and limit must not be negative")
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	info := []model.DeviceDto{}
+	matched := 0
+	for i := 0; i < len(m.devices) && len(info) < limit; i++ {
+		device := m.devices[i]
+		if !matchDevice(&device, filter) {
+			continue
+		}
+		if matched++; matched <= skip {
+			continue
+		}
+		dto := model.DeviceDto{
+			DeviceNumber:    device.DeviceNumber,
+			RegisterDate:    device.RegisterDate,
+			FirmwareVersion: device.FirmwareVersion,
+			UpdateState:     device.UpdateState,
+			Status:          device.Status,
+			LastSeen:        device.LastSeen,
+			Uptime:          device.Uptime,
+			Issues:          m.deviceIssues(device.ID, filter, maxListedIssues),
+		}
+		info = append(info, dto)
+	}
+	return &info, nil
+}
+
+func (m *MemoryService) GetDevicesCount(filter model.DeviceFilter) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	n := 0
+	for i := range m.devices {
+		if matchDevice(&m.devices[i], filter) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// GetStats aggregates fleet stats in time window, top limits lists of
+// most frequent errors and devices with most errors
+func (m *MemoryService) GetStats(from, to time.Time, top int) (*model.Stats, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	b := newStatsBuilder(from, to)
+	lastSeen := make(map[string]time.Time)
+	for _, device := range m.devices {
+		b.device(device.RegisterDate)
+		if !device.LastSeen.Before(from) {
+			lastSeen[device.DeviceNumber] = device.LastSeen
+		}
+	}
+	events := []model.StatusEvent{}
+	for _, event := range m.statusEvents {
+		if b.inWindow(event.Date) {
+			events = append(events, event)
+		}
+	}
+	b.presence(lastSeen, events)
+	for i := range m.issueCounts {
+		b.issueCount(&m.issueCounts[i])
+	}
+	for _, event := range m.updates {
+		b.activity(event.DeviceNumber, event.Date)
+	}
+	for _, s := range m.samples {
+		b.activity(s.DeviceNumber, s.Date)
+	}
+	return b.build(top), nil
+}
+
+func (m *MemoryService) RegisterDevice(deviceNumber string,
+	registerDate time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if i := m.deviceIndex(deviceNumber); i >= 0 {
+		m.devices[i].RegisterDate = registerDate
+		return nil
+	}
+	m.devices = append(m.devices, model.Device{
+		ID:           bson.NewObjectId(),
+		DeviceNumber: deviceNumber,
+		RegisterDate: registerDate,
+	})
+	return nil
+}
+
+// RegisterError counts error in its issue, id of error is returned when
+// it is stored
+func (m *MemoryService) RegisterError(de *model.DeviceErrorDto) (string, error) {
+	ids, err := m.RegisterErrors(de.DeviceNumber, []model.DeviceErrorDto{*de})
+	if err != nil {
+		return "", err
+	}
+	return ids[0], nil
+}
+
+// RegisterErrors counts errors of device in their issues, sampled errors
+// are stored and their ids are returned in order of reports
+func (m *MemoryService) RegisterErrors(deviceNumber string,
+	des []model.DeviceErrorDto) ([]string, error) {
+	ids, _, err := m.registerErrors(deviceNumber, des)
+	return ids, err
+}
+
+func (m *MemoryService) registerErrors(deviceNumber string,
+	des []model.DeviceErrorDto) ([]string, []model.Issue, error) {
+	device, err := m.GetDeviceByNumber(deviceNumber)
+	if err != nil {
+		return nil, nil, err
+	}
+	errs := newDeviceErrors(des, device)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	opened := []int{}
+	for _, deviceError := range errs {
+		i := 0
+		for i < len(m.issues) && !issueOf(&m.issues[i], deviceError) {
+			i++
+		}
+		created := i == len(m.issues)
+		if created {
+			m.issues = append(m.issues, *newIssue(deviceError))
+		}
+		if addOccurrence(&m.issues[i], deviceError) || created {
+			opened = append(opened, i)
+		}
+		if storedError(deviceError) {
+			m.errors = append(m.errors, *deviceError)
+		}
+	}
+	m.addIssueCounts(countOccurrences(errs))
+	issues := make([]model.Issue, len(opened))
+	for j, i := range opened {
+		issues[j] = copyIssue(&m.issues[i])
+	}
+	return storedIDs(errs), issues, nil
+}
+
+// addIssueCounts adds counts to counts of the same issue and minute
+func (m *MemoryService) addIssueCounts(counts []model.IssueCount) {
+	for _, c := range counts {
+		i := len(m.issueCounts) - 1
+		for i >= 0 && (m.issueCounts[i].IssueId != c.IssueId ||
+			!m.issueCounts[i].Date.Equal(c.Date)) {
+			i--
+		}
+		if i < 0 {
+			m.issueCounts = append(m.issueCounts, c)
+		} else {
+			m.issueCounts[i].Count += c.Count
+		}
+	}
+}
+
+// GetDeviceError finds stored error by id
+func (m *MemoryService) GetDeviceError(id string) (*model.DeviceError, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for i := range m.errors {
+		if m.errors[i].ID.Hex() == id {
+			de := m.errors[i]
+			return &de, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// ChangeIssues applies change to selected issues of device and records
+// it, number of changed issues is returned
+func (m *MemoryService) ChangeIssues(deviceNumber string, sel model.IssueSelector,
+	change model.ErrorChange) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.deviceIndex(deviceNumber) < 0 {
+		return 0, ErrNotFound
+	}
+	n := 0
+	for i := range m.issues {
+		issue := &m.issues[i]
+		if issue.DeviceNumber == deviceNumber && selectIssue(issue, sel) {
+			applyErrorChange(issue, change)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// GetIssues finds issues of device matching filter, the latest seen first
+func (m *MemoryService) GetIssues(deviceNumber string,
+	filter model.DeviceFilter) (*[]model.Issue, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	i := m.deviceIndex(deviceNumber)
+	if i < 0 {
+		return nil, ErrNotFound
+	}
+	issues := m.deviceIssues(m.devices[i].ID, filter, 0)
+	return &issues, nil
+}
+
+// deviceIssues lists issues of device matching filter, the latest seen
+// first
+func (m *MemoryService) deviceIssues(deviceID bson.ObjectId, filter model.DeviceFilter,
+	limit int) []model.Issue {
+	issues := []model.Issue{}
+	for i := range m.issues {
+		issue := &m.issues[i]
+		if issue.DeviceId == deviceID && listedIssue(issue, filter) {
+			issues = append(issues, copyIssue(issue))
+		}
+	}
+	return sortIssues(issues, limit)
+}
+
+// GetOccurrences finds stored occurrences of issue of device, the latest
+// first
+func (m *MemoryService) GetOccurrences(deviceNumber string,
+	issueID string) (*[]model.DeviceErrorDto, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	found := false
+	for i := range m.issues {
+		issue := &m.issues[i]
+		found = found || issue.DeviceNumber == deviceNumber && issue.ID.Hex() == issueID
+	}
+	if !found {
+		return nil, ErrNotFound
+	}
+	occurrences := []model.DeviceErrorDto{}
+	for i := len(m.errors) - 1; i >= 0 && len(occurrences) < maxListedOccurrences; i-- {
+		if de := &m.errors[i]; de.IssueId.Hex() == issueID {
+			occurrences = append(occurrences, errorDto(de))
+		}
+	}
+	return &occurrences, nil
+}
+
+func (m *MemoryService) AddAttachment(a *model.Attachment) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.attachments = append(m.attachments, *a)
+	return nil
+}
+
+func (m *MemoryService) GetAttachment(id string) (*model.Attachment, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, a := range m.attachments {
+		if a.ID.Hex() == id {
+			return &a, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// GetAttachments finds attachments of error in order of upload
+func (m *MemoryService) GetAttachments(errorID string) (*[]model.Attachment, error) {
+	return m.findAttachments(func(a *model.Attachment) bool {
+		return a.ErrorId.Hex() == errorID
+	}), nil
+}
+
+// GetAttachmentsBefore finds attachments uploaded before date
+func (m *MemoryService) GetAttachmentsBefore(before time.Time) (*[]model.Attachment,
+	error) {
+	return m.findAttachments(func(a *model.Attachment) bool {
+		return a.Date.Before(before)
+	}), nil
+}
+
+func (m *MemoryService) findAttachments(match func(a *model.Attachment) bool) *[]model.Attachment {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	attachments := []model.Attachment{}
+	for i := range m.attachments {
+		if match(&m.attachments[i]) {
+			attachments = append(attachments, m.attachments[i])
+		}
+	}
+	return &attachments
+}
+
+func (m *MemoryService) DeleteAttachment(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.attachments {
+		if m.attachments[i].ID.Hex() == id {
+			m.attachments = append(m.attachments[:i], m.attachments[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// RegisterUpdate stores firmware update event and keeps last state and
+// running firmware version on device
+func (m *MemoryService) RegisterUpdate(us *model.UpdateStatusDto) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.deviceIndex(us.DeviceNumber)
+	if i < 0 {
+		return ErrNotFound
+	}
+	event := model.UpdateEvent{
+		DeviceNumber:   us.DeviceNumber,
+		DeviceId:       m.devices[i].ID,
+		State:          us.State,
+		TargetVersion:  us.TargetVersion,
+		CurrentVersion: us.CurrentVersion,
+		Reason:         us.Reason,
+		Date:           time.Now(),
+	}
+	m.updates = append(m.updates, event)
+	m.devices[i].UpdateState = event.State
+	m.devices[i].UpdateDate = event.Date
+	if event.CurrentVersion != "" {
+		m.devices[i].FirmwareVersion = event.CurrentVersion
+	}
+	return nil
+}
+
+// GetUpdateEvents returns firmware update events of device, newest first
+func (m *MemoryService) GetUpdateEvents(deviceNumber string) (*[]model.UpdateEvent,
+	error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	events := []model.UpdateEvent{}
+	for i := len(m.updates) - 1; i >= 0; i-- {
+		if m.updates[i].DeviceNumber == deviceNumber {
+			events = append(events, m.updates[i])
+		}
+	}
+	return &events, nil
+}
+
+func (m *MemoryService) GetDeviceByNumber(deviceNumber string) (*model.Device, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	i := m.deviceIndex(deviceNumber)
+	if i < 0 {
+		return nil, ErrNotFound
+	}
+	device := m.devices[i]
+	return &device, nil
+}
+
+// RegisterHeartbeat marks device online and records transition when it
+// was not online before
+func (m *MemoryService) RegisterHeartbeat(deviceNumber string, uptime int64,
+	date time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.deviceIndex(deviceNumber)
+	if i < 0 {
+		return ErrNotFound
+	}
+	device := &m.devices[i]
+	if device.Status != model.StatusOnline {
+		m.statusEvents = append(m.statusEvents, model.StatusEvent{
+			DeviceNumber: deviceNumber,
+			DeviceId:     device.ID,
+			Status:       model.StatusOnline,
+			Date:         date,
+		})
+	}
+	device.Status = model.StatusOnline
+	device.LastSeen = date
+	if uptime > 0 {
+		device.Uptime = uptime
+	}
+	return nil
+}
+
+// MarkOffline marks online devices not seen since time offline, numbers
+// of marked devices are returned
+func (m *MemoryService) MarkOffline(before time.Time) (*[]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	numbers := []string{}
+	now := time.Now()
+	for i := range m.devices {
+		device := &m.devices[i]
+		if device.Status != model.StatusOnline || !device.LastSeen.Before(before) {
+			continue
+		}
+		device.Status = model.StatusOffline
+		m.statusEvents = append(m.statusEvents, model.StatusEvent{
+			DeviceNumber: device.DeviceNumber,
+			DeviceId:     device.ID,
+			Status:       model.StatusOffline,
+			Date:         now,
+		})
+		numbers = append(numbers, device.DeviceNumber)
+	}
+	return &numbers, nil
+}
+
+// GetStatusEvents returns online and offline transitions of device,
+// newest first
+func (m *MemoryService) GetStatusEvents(deviceNumber string) (*[]model.StatusEvent,
+	error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	events := []model.StatusEvent{}
+	for i := len(m.statusEvents) - 1; i >= 0; i-- {
+		if m.statusEvents[i].DeviceNumber == deviceNumber {
+			events = append(events, m.statusEvents[i])
+		}
+	}
+	return &events, nil
+}
+
+// SetDeviceSecret stores hash of device credential and lifts revocation
+func (m *MemoryService) SetDeviceSecret(deviceNumber string, secretHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.deviceIndex(deviceNumber)
+	if i < 0 {
+		return ErrNotFound
+	}
+	m.devices[i].SecretHash = secretHash
+	m.devices[i].SecretRevoked = false
+	return nil
+}
+
+// RevokeDeviceSecret drops device credential, device can't register again
+// until credential is rotated
+func (m *MemoryService) RevokeDeviceSecret(deviceNumber string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.deviceIndex(deviceNumber)
+	if i < 0 {
+		return ErrNotFound
+	}
+	m.devices[i].SecretHash = ""
+	m.devices[i].SecretRevoked = true
+	return nil
+}
+
+// AssignFirmware pins device to firmware, empty id removes assignment
+func (m *MemoryService) AssignFirmware(deviceNumber string, firmwareID string) error {
+	if firmwareID != "" && !bson.IsObjectIdHex(firmwareID) {
+		return ErrNotFound
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.deviceIndex(deviceNumber)
+	if i < 0 {
+		return ErrNotFound
+	}
+	m.devices[i].Firmware = ""
+	if firmwareID != "" {
+		m.devices[i].Firmware = bson.ObjectIdHex(firmwareID)
+	}
+	return nil
+}
+
+func (m *MemoryService) AddFirmware(fw *model.Firmware) error {
+	if fw.ID == "" {
+		fw.ID = bson.NewObjectId()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.firmware = append(m.firmware, *fw)
+	return nil
+}
+
+func (m *MemoryService) GetFirmware(id string) (*model.Firmware, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, fw := range m.firmware {
+		if fw.ID.Hex() == id {
+			return &fw, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// GetFirmwareList returns all firmware, newest first
+func (m *MemoryService) GetFirmwareList() (*[]model.Firmware, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	list := make([]model.Firmware, 0, len(m.firmware))
+	for i := len(m.firmware) - 1; i >= 0; i-- {
+		list = append(list, m.firmware[i])
+	}
+	return &list, nil
+}
+
+// GetLatestFirmware returns last uploaded firmware for hardware model
+// and channel
+func (m *MemoryService) GetLatestFirmware(hardwareModel, channel string) (*model.Firmware,
+	error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for i := len(m.firmware) - 1; i >= 0; i-- {
+		fw := m.firmware[i]
+		if fw.HardwareModel == hardwareModel && fw.Channel == channel && !fw.Held {
+			return &fw, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// RecordDownload adds served bytes to download stats of device
+func (m *MemoryService) RecordDownload(deviceNumber string, firmwareID string,
+	bytes int64) error {
+	if !bson.IsObjectIdHex(firmwareID) {
+		return ErrNotFound
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := bson.ObjectIdHex(firmwareID)
+	i := 0
+	for i < len(m.downloads) &&
+		(m.downloads[i].DeviceNumber != deviceNumber || m.downloads[i].Firmware != id) {
+		i++
+	}
+	if i == len(m.downloads) {
+		m.downloads = append(m.downloads, model.DownloadStats{
+			DeviceNumber: deviceNumber,
+			Firmware:     id,
+		})
+	}
+	m.downloads[i].Downloads++
+	m.downloads[i].Bytes += bytes
+	m.downloads[i].LastDate = time.Now()
+	return nil
+}
+
+// GetDownloads returns download stats of device, latest first
+func (m *MemoryService) GetDownloads(deviceNumber string) (*[]model.DownloadStats,
+	error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	stats := []model.DownloadStats{}
+	for _, ds := range m.downloads {
+		if ds.DeviceNumber == deviceNumber {
+			stats = append(stats, ds)
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].LastDate.After(stats[j].LastDate)
+	})
+	return &stats, nil
+}
+
+func (m *MemoryService) SetFirmwareHeld(id string, held bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.firmware {
+		if m.firmware[i].ID.Hex() == id {
+			m.firmware[i].Held = held
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *MemoryService) SetDeviceGroup(deviceNumber string, group string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.deviceIndex(deviceNumber)
+	if i < 0 {
+		return ErrNotFound
+	}
+	m.devices[i].Group = group
+	return nil
+}
+
+func (m *MemoryService) AddRollout(r *model.Rollout) error {
+	if r.ID == "" {
+		r.ID = bson.NewObjectId()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rollouts = append(m.rollouts, copyRollout(r))
+	return nil
+}
+
+// UpdateRollout stores rollout unless it was updated since it was read
+func (m *MemoryService) UpdateRollout(r *model.Rollout) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.rollouts {
+		if m.rollouts[i].ID == r.ID {
+			if m.rollouts[i].Revision != r.Revision {
+				return ErrConflict
+			}
+			r.Revision++
+			m.rollouts[i] = copyRollout(r)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *MemoryService) GetRollout(id string) (*model.Rollout, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for i := range m.rollouts {
+		if m.rollouts[i].ID.Hex() == id {
+			r := copyRollout(&m.rollouts[i])
+			return &r, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// GetRollouts returns all rollouts, newest first
+func (m *MemoryService) GetRollouts() (*[]model.Rollout, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	list := make([]model.Rollout, 0, len(m.rollouts))
+	for i := len(m.rollouts) - 1; i >= 0; i-- {
+		list = append(list, copyRollout(&m.rollouts[i]))
+	}
+	return &list, nil
+}
+
+// AddRolloutDevice records device as updated by rollout, date of first
+// record is kept
+func (m *MemoryService) AddRolloutDevice(rolloutID string, deviceNumber string) error {
+	if deviceNumber == "" {
+		return ErrNotFound
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	members, ok := m.rolloutDevices[rolloutID]
+	if !ok {
+		members = make(map[string]time.Time)
+		m.rolloutDevices[rolloutID] = members
+	}
+	if _, ok := members[deviceNumber]; !ok {
+		members[deviceNumber] = time.Now()
+	}
+	return nil
+}
+
+func (m *MemoryService) IsRolloutDevice(rolloutID string, deviceNumber string) (bool,
+	error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.rolloutDevices[rolloutID][deviceNumber]
+	return ok, nil
+}
+
+// GetRolloutStats counts devices updated by rollout and errors they
+// reported since minute of update or of since, whichever is later
+func (m *MemoryService) GetRolloutStats(rolloutID string, since time.Time) (int, int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	members := m.rolloutDevices[rolloutID]
+	errs := 0
+	for _, c := range m.issueCounts {
+		date, ok := members[c.DeviceNumber]
+		if ok && !c.Date.Before(laterDate(date, since).Truncate(countPeriod)) {
+			errs += c.Count
+		}
+	}
+	return len(members), errs, nil
+}
+
+// CountErrors counts errors named errorName each device reported in
+// minutes starting in [from, to), occurrences which were not stored are
+// counted too
+func (m *MemoryService) CountErrors(errorName string, from, to time.Time) (map[string]int,
+	error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	counts := make(map[string]int)
+	for _, c := range m.issueCounts {
+		if c.ErrorName == errorName && !c.Date.Before(from) && c.Date.Before(to) {
+			counts[c.DeviceNumber] += c.Count
+		}
+	}
+	return counts, nil
+}
+
+// GetOfflineDevices finds offline devices last seen before time
+func (m *MemoryService) GetOfflineDevices(before time.Time) (*[]model.Device, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	devices := []model.Device{}
+	for _, device := range m.devices {
+		if device.Status == model.StatusOffline && device.LastSeen.Before(before) {
+			devices = append(devices, device)
+		}
+	}
+	return &devices, nil
+}
+
+func (m *MemoryService) AddRule(r *model.Rule) error {
+	if r.ID == "" {
+		r.ID = bson.NewObjectId()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rules = append(m.rules, *r)
+	return nil
+}
+
+func (m *MemoryService) UpdateRule(r *model.Rule) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.rules {
+		if m.rules[i].ID == r.ID {
+			m.rules[i] = *r
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *MemoryService) GetRule(id string) (*model.Rule, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for i := range m.rules {
+		if m.rules[i].ID.Hex() == id {
+			r := m.rules[i]
+			return &r, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// GetRules returns all rules, oldest first
+func (m *MemoryService) GetRules() (*[]model.Rule, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	rules := append([]model.Rule{}, m.rules...)
+	return &rules, nil
+}
+
+func (m *MemoryService) DeleteRule(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.rules {
+		if m.rules[i].ID.Hex() == id {
+			m.rules = append(m.rules[:i], m.rules[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *MemoryService) AddAlert(a *model.Alert) error {
+	if a.ID == "" {
+		a.ID = bson.NewObjectId()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.alerts = append(m.alerts, *a)
+	return nil
+}
+
+func (m *MemoryService) UpdateAlert(a *model.Alert) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.alerts {
+		if m.alerts[i].ID == a.ID {
+			m.alerts[i] = *a
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// GetAlerts returns alerts in state, or in any state when it is empty,
+// newest first. Limit 0 returns every alert
+func (m *MemoryService) GetAlerts(state string, limit int) (*[]model.Alert, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	alerts := []model.Alert{}
+	for i := len(m.alerts) - 1; i >= 0; i-- {
+		if limit > 0 && len(alerts) == limit {
+			break
+		}
+		if state == "" || m.alerts[i].State == state {
+			alerts = append(alerts, m.alerts[i])
+		}
+	}
+	return &alerts, nil
+}
+
+func (m *MemoryService) AddWebhook(w *model.Webhook) error {
+	if w.ID == "" {
+		w.ID = bson.NewObjectId()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.webhooks = append(m.webhooks, copyWebhook(w))
+	return nil
+}
+
+func (m *MemoryService) GetWebhook(id string) (*model.Webhook, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for i := range m.webhooks {
+		if m.webhooks[i].ID.Hex() == id {
+			w := copyWebhook(&m.webhooks[i])
+			return &w, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// GetWebhooks returns all webhooks, oldest first
+func (m *MemoryService) GetWebhooks() (*[]model.Webhook, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	webhooks := make([]model.Webhook, 0, len(m.webhooks))
+	for i := range m.webhooks {
+		webhooks = append(webhooks, copyWebhook(&m.webhooks[i]))
+	}
+	return &webhooks, nil
+}
+
+func (m *MemoryService) DeleteWebhook(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.webhooks {
+		if m.webhooks[i].ID.Hex() == id {
+			m.webhooks = append(m.webhooks[:i], m.webhooks[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// AddDeliveries queues deliveries of events
+func (m *MemoryService) AddDeliveries(deliveries []model.Delivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range deliveries {
+		if deliveries[i].ID == "" {
+			deliveries[i].ID = bson.NewObjectId()
+		}
+		m.deliveries = append(m.deliveries, deliveries[i])
+	}
+	return nil
+}
+
+func (m *MemoryService) UpdateDelivery(d *model.Delivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.deliveries {
+		if m.deliveries[i].ID == d.ID {
+			m.deliveries[i] = *d
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// GetDueDeliveries returns pending deliveries to attempt at now, the
+// longest waiting first
+func (m *MemoryService) GetDueDeliveries(now time.Time, limit int) (*[]model.Delivery,
+	error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	deliveries := []model.Delivery{}
+	for _, d := range m.deliveries {
+		if d.State == model.DeliveryPending && !d.NextDate.After(now) {
+			deliveries = append(deliveries, d)
+		}
+	}
+	sort.SliceStable(deliveries, func(i, j int) bool {
+		return deliveries[i].NextDate.Before(deliveries[j].NextDate)
+	})
+	if limit > 0 && len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+	return &deliveries, nil
+}
+
+// GetDeliveries returns deliveries of webhook, newest first
+func (m *MemoryService) GetDeliveries(webhookID string, limit int) (*[]model.Delivery,
+	error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	deliveries := []model.Delivery{}
+	for i := len(m.deliveries) - 1; i >= 0; i-- {
+		if limit > 0 && len(deliveries) == limit {
+			break
+		}
+		if m.deliveries[i].WebhookId.Hex() == webhookID {
+			deliveries = append(deliveries, m.deliveries[i])
+		}
+	}
+	return &deliveries, nil
+}
+
+// DeleteDeliveries removes delivered and failed deliveries queued before
+// time
+func (m *MemoryService) DeleteDeliveries(before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kept := m.deliveries[:0]
+	for _, d := range m.deliveries {
+		if d.State == model.DeliveryPending || !d.CreateDate.Before(before) {
+			kept = append(kept, d)
+		}
+	}
+	m.deliveries = kept
+	return nil
+}
+
+// SetSubscription stores subscription of admin replacing previous one
+func (m *MemoryService) SetSubscription(s *model.Subscription) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.subscriptions[s.Login] = *s
+	return nil
+}
+
+func (m *MemoryService) GetSubscription(login string) (*model.Subscription, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s, ok := m.subscriptions[login]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &s, nil
+}
+
+// GetSubscriptions returns subscriptions of all admins ordered by login
+func (m *MemoryService) GetSubscriptions() (*[]model.Subscription, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	subscriptions := make([]model.Subscription, 0, len(m.subscriptions))
+	for _, s := range m.subscriptions {
+		subscriptions = append(subscriptions, s)
+	}
+	sort.Slice(subscriptions, func(i, j int) bool {
+		return subscriptions[i].Login < subscriptions[j].Login
+	})
+	return &subscriptions, nil
+}
+
+// SetDigestDate sets when digest was last mailed to admin keeping the
+// rest of subscription as it is
+func (m *MemoryService) SetDigestDate(login string, date time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.subscriptions[login]
+	if !ok {
+		return ErrNotFound
+	}
+	s.DigestDate = date
+	m.subscriptions[login] = s
+	return nil
+}
+
+// AddMails queues mails
+func (m *MemoryService) AddMails(mails []model.Mail) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range mails {
+		if mails[i].ID == "" {
+			mails[i].ID = bson.NewObjectId()
+		}
+		m.mails = append(m.mails, mails[i])
+	}
+	return nil
+}
+
+func (m *MemoryService) UpdateMail(mail *model.Mail) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.mails {
+		if m.mails[i].ID == mail.ID {
+			m.mails[i] = *mail
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// GetDueMails returns pending mails to send at now, the longest waiting
+// first
+func (m *MemoryService) GetDueMails(now time.Time, limit int) (*[]model.Mail, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	mails := []model.Mail{}
+	for _, mail := range m.mails {
+		if mail.State == model.DeliveryPending && !mail.NextDate.After(now) {
+			mails = append(mails, mail)
+		}
+	}
+	sort.SliceStable(mails, func(i, j int) bool {
+		return mails[i].NextDate.Before(mails[j].NextDate)
+	})
+	if limit > 0 && len(mails) > limit {
+		mails = mails[:limit]
+	}
+	return &mails, nil
+}
+
+// GetIssuesSeen finds issues of every device last seen in [from, to)
+// ordered by device number, issues of device are ordered by last seen,
+// the latest first
+func (m *MemoryService) GetIssuesSeen(from, to time.Time, limit int) (*[]model.Issue, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	issues := []model.Issue{}
+	for i := range m.issues {
+		issue := &m.issues[i]
+		if !issue.LastSeen.Before(from) && issue.LastSeen.Before(to) {
+			issues = append(issues, copyIssue(issue))
+		}
+	}
+	issues = sortIssuesSeen(issues, limit)
+	return &issues, nil
+}
+
+func (m *MemoryService) GetCookieExp(login string) (*time.Time, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	expire, ok := m.cookies[login]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &expire, nil
+}
+
+func (m *MemoryService) SetCookieExp(login string, expireTime time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cookies[login] = expireTime
+	return nil
+}
+
+func (m *MemoryService) SetCreds(creds model.Credentials) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.users[creds.Login] = creds
+	return nil
+}
+
+func (m *MemoryService) GetCreds(login string) (*model.Credentials, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	creds, ok := m.users[login]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &creds, nil
+}
+
+// copyIssue copies issue so that its history is not shared with stored
+// one
+func copyIssue(issue *model.Issue) model.Issue {
+	c := *issue
+	c.History = append([]model.ErrorChange(nil), issue.History...)
+	return c
+}
+
+// copyRollout copies rollout with its steps, so stored rollout does not
+// share memory with caller
+func copyRollout(r *model.Rollout) model.Rollout {
+	c := *r
+	c.Steps = append([]model.RolloutStep(nil), r.Steps...)
+	return c
+}
+
+func copyWebhook(w *model.Webhook) model.Webhook {
+	c := *w
+	c.Events = append([]string(nil), w.Events...)
+	return c
+}
+
+// deviceIndex returns position of device in the devices slice or -1,
+// caller must hold the lock
+func (m *MemoryService) deviceIndex(deviceNumber string) int {
+	for i := range m.devices {
+		if m.devices[i].DeviceNumber == deviceNumber {
+			return i
+		}
+	}
+	return -1
+}
+
+// AddSamples stores batch of metric samples
+func (m *MemoryService) AddSamples(samples []model.Sample) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.samples = append(m.samples, samples...)
+	return nil
+}
+
+// GetSamples finds samples of device metric taken in [from, to)
+func (m *MemoryService) GetSamples(deviceNumber, metric string, from,
+	to time.Time) (*[]model.Sample, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	samples := []model.Sample{}
+	for _, s := range m.samples {
+		if s.DeviceNumber == deviceNumber && s.Metric == metric &&
+			!s.Date.Before(from) && s.Date.Before(to) {
+			samples = append(samples, s)
+		}
+	}
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].Date.Before(samples[j].Date)
+	})
+	return &samples, nil
+}
+
+// GetAllSamples finds samples of every device and metric taken in
+// [from, to)
+func (m *MemoryService) GetAllSamples(from, to time.Time) (*[]model.Sample, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	samples := []model.Sample{}
+	for _, s := range m.samples {
+		if !s.Date.Before(from) && s.Date.Before(to) {
+			samples = append(samples, s)
+		}
+	}
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].Date.Before(samples[j].Date)
+	})
+	return &samples, nil
+}
+
+// GetMetricSamples finds samples of metric of every device taken in
+// [from, to)
+func (m *MemoryService) GetMetricSamples(metric string, from,
+	to time.Time) (*[]model.Sample, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	samples := []model.Sample{}
+	for _, s := range m.samples {
+		if s.Metric == metric && !s.Date.Before(from) && s.Date.Before(to) {
+			samples = append(samples, s)
+		}
+	}
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].Date.Before(samples[j].Date)
+	})
+	return &samples, nil
+}
+
+// DeleteSamples removes samples taken before time
+func (m *MemoryService) DeleteSamples(before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kept := m.samples[:0]
+	for _, s := range m.samples {
+		if !s.Date.Before(before) {
+			kept = append(kept, s)
+		}
+	}
+	m.samples = kept
+	return nil
+}
+
+// SetRollups stores rollups replacing ones of the same bucket
+func (m *MemoryService) SetRollups(rollups []model.Rollup) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	index := make(map[model.Rollup]int, len(m.rollups))
+	for i, r := range m.rollups {
+		index[rollupKey(r)] = i
+	}
+	for _, r := range rollups {
+		if i, ok := index[rollupKey(r)]; ok {
+			m.rollups[i] = r
+			continue
+		}
+		index[rollupKey(r)] = len(m.rollups)
+		m.rollups = append(m.rollups, r)
+	}
+	return nil
+}
+
+// GetRollups finds rollups of device metric with buckets starting in
+// [from, to)
+func (m *MemoryService) GetRollups(deviceNumber, metric, resolution string, from,
+	to time.Time) (*[]model.Rollup, error) {
+	return m.findRollups(func(r *model.Rollup) bool {
+		return r.DeviceNumber == deviceNumber && r.Metric == metric &&
+			r.Resolution == resolution && !r.Date.Before(from) && r.Date.Before(to)
+	}), nil
+}
+
+// GetAllRollups finds rollups of every device and metric with buckets
+// starting in [from, to)
+func (m *MemoryService) GetAllRollups(resolution string, from,
+	to time.Time) (*[]model.Rollup, error) {
+	return m.findRollups(func(r *model.Rollup) bool {
+		return r.Resolution == resolution && !r.Date.Before(from) && r.Date.Before(to)
+	}), nil
+}
+
+// GetMetricRollups finds rollups of metric of every device with buckets
+// starting in [from, to)
+func (m *MemoryService) GetMetricRollups(metric, resolution string, from,
+	to time.Time) (*[]model.Rollup, error) {
+	return m.findRollups(func(r *model.Rollup) bool {
+		return r.Metric == metric && r.Resolution == resolution &&
+			!r.Date.Before(from) && r.Date.Before(to)
+	}), nil
+}
+
+// LastRollup returns start of the latest bucket of resolution, zero time
+// when there are no rollups of resolution
+func (m *MemoryService) LastRollup(resolution string) (time.Time, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	last := time.Time{}
+	for _, r := range m.rollups {
+		if r.Resolution == resolution && r.Date.After(last) {
+			last = r.Date
+		}
+	}
+	return last, nil
+}
+
+// DeleteRollups removes rollups of resolution with buckets starting
+// before time
+func (m *MemoryService) DeleteRollups(resolution string, before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kept := m.rollups[:0]
+	for _, r := range m.rollups {
+		if r.Resolution != resolution || !r.Date.Before(before) {
+			kept = append(kept, r)
+		}
+	}
+	m.rollups = kept
+	return nil
+}
+
+func (m *MemoryService) findRollups(match func(r *model.Rollup) bool) *[]model.Rollup {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	rollups := []model.Rollup{}
+	for i := range m.rollups {
+		if match(&m.rollups[i]) {
+			rollups = append(rollups, m.rollups[i])
+		}
+	}
+	sort.SliceStable(rollups, func(i, j int) bool {
+		return rollups[i].Date.Before(rollups[j].Date)
+	})
+	return &rollups
+}
+
+// rollupKey keeps fields which identify bucket of rollup
+func rollupKey(r model.Rollup) model.Rollup {
+	return model.Rollup{DeviceNumber: r.DeviceNumber, Metric: r.Metric,
+		Resolution: r.Resolution, Date: r.Date.UTC()}
+}
@@ -1,7 +1,9 @@
 package service
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"iot-stats/model"
 	"net"
 	"time"
@@ -24,30 +26,134 @@ func (c *Config) GetAddr() string {
 	return url
 }
 
+// ErrNotFound is returned by storage backends when requested document
+// does not exist
+var ErrNotFound = mgo.ErrNotFound
+
+// ErrConflict is returned when document was changed since it was read
+var ErrConflict = errors.New("document was changed meanwhile")
+
 type MongoInterface interface {
 	Connect() error
-	GetAllDevices(skip int, limit int) (*[]model.DeviceDto, error)
-	GetDevicesCount() (int, error)
+	GetAllDevices(skip int, limit int, filter model.DeviceFilter) (*[]model.DeviceDto, error)
+	GetDevicesCount(filter model.DeviceFilter) (int, error)
+	GetStats(from, to time.Time, top int) (*model.Stats, error)
 	RegisterDevice(deviceNumber string,
 		registerDate time.Time) error
-	RegisterError(de *model.DeviceErrorDto) error
+	RegisterError(de *model.DeviceErrorDto) (string, error)
+	RegisterErrors(deviceNumber string, des []model.DeviceErrorDto) ([]string, error)
+	GetDeviceError(id string) (*model.DeviceError, error)
+	ChangeIssues(deviceNumber string, sel model.IssueSelector,
+		change model.ErrorChange) (int, error)
+	GetIssues(deviceNumber string, filter model.DeviceFilter) (*[]model.Issue, error)
+	GetOccurrences(deviceNumber string, issueID string) (*[]model.DeviceErrorDto, error)
+	AddAttachment(a *model.Attachment) error
+	GetAttachment(id string) (*model.Attachment, error)
+	GetAttachments(errorID string) (*[]model.Attachment, error)
+	GetAttachmentsBefore(before time.Time) (*[]model.Attachment, error)
+	DeleteAttachment(id string) error
+	RegisterUpdate(us *model.UpdateStatusDto) error
+	GetUpdateEvents(deviceNumber string) (*[]model.UpdateEvent, error)
 	GetDeviceByNumber(deviceNumber string) (*model.Device, error)
+	RegisterHeartbeat(deviceNumber string, uptime int64, date time.Time) error
+	MarkOffline(before time.Time) (*[]string, error)
+	GetStatusEvents(deviceNumber string) (*[]model.StatusEvent, error)
+	SetDeviceSecret(deviceNumber string, secretHash string) error
+	RevokeDeviceSecret(deviceNumber string) error
+	AssignFirmware(deviceNumber string, firmwareID string) error
+	AddFirmware(fw *model.Firmware) error
+	GetFirmware(id string) (*model.Firmware, error)
+	GetFirmwareList() (*[]model.Firmware, error)
+	GetLatestFirmware(hardwareModel, channel string) (*model.Firmware, error)
+	RecordDownload(deviceNumber string, firmwareID string, bytes int64) error
+	GetDownloads(deviceNumber string) (*[]model.DownloadStats, error)
+	SetFirmwareHeld(id string, held bool) error
+	SetDeviceGroup(deviceNumber string, group string) error
+	AddRollout(r *model.Rollout) error
+	UpdateRollout(r *model.Rollout) error
+	GetRollout(id string) (*model.Rollout, error)
+	GetRollouts() (*[]model.Rollout, error)
+	AddRolloutDevice(rolloutID string, deviceNumber string) error
+	IsRolloutDevice(rolloutID string, deviceNumber string) (bool, error)
+	GetRolloutStats(rolloutID string, since time.Time) (updated int, errors int, err error)
+	CountErrors(errorName string, from, to time.Time) (map[string]int, error)
+	GetOfflineDevices(before time.Time) (*[]model.Device, error)
+	AddRule(r *model.Rule) error
+	UpdateRule(r *model.Rule) error
+	GetRule(id string) (*model.Rule, error)
+	GetRules() (*[]model.Rule, error)
+	DeleteRule(id string) error
+	AddAlert(a *model.Alert) error
+	UpdateAlert(a *model.Alert) error
+	GetAlerts(state string, limit int) (*[]model.Alert, error)
+	AddWebhook(w *model.Webhook) error
+	GetWebhook(id string) (*model.Webhook, error)
+	GetWebhooks() (*[]model.Webhook, error)
+	DeleteWebhook(id string) error
+	AddDeliveries(deliveries []model.Delivery) error
+	UpdateDelivery(d *model.Delivery) error
+	GetDueDeliveries(now time.Time, limit int) (*[]model.Delivery, error)
+	GetDeliveries(webhookID string, limit int) (*[]model.Delivery, error)
+	DeleteDeliveries(before time.Time) error
+	SetSubscription(s *model.Subscription) error
+	GetSubscription(login string) (*model.Subscription, error)
+	GetSubscriptions() (*[]model.Subscription, error)
+	SetDigestDate(login string, date time.Time) error
+	AddMails(mails []model.Mail) error
+	UpdateMail(mail *model.Mail) error
+	GetDueMails(now time.Time, limit int) (*[]model.Mail, error)
+	GetIssuesSeen(from, to time.Time, limit int) (*[]model.Issue, error)
 	GetCookieExp(login string) (*time.Time, error)
 	SetCookieExp(login string, expireTime time.Time) error
 	SetCreds(creds model.Credentials) error
 	GetCreds(login string) (*model.Credentials, error)
 }
 
+// TelemetryInterface stores time series of device metrics and their
+// rollups, samples and rollups are returned in time order. Time windows
+// include start and exclude end
+type TelemetryInterface interface {
+	AddSamples(samples []model.Sample) error
+	GetSamples(deviceNumber, metric string, from, to time.Time) (*[]model.Sample, error)
+	GetAllSamples(from, to time.Time) (*[]model.Sample, error)
+	GetMetricSamples(metric string, from, to time.Time) (*[]model.Sample, error)
+	DeleteSamples(before time.Time) error
+	SetRollups(rollups []model.Rollup) error
+	GetRollups(deviceNumber, metric, resolution string, from,
+		to time.Time) (*[]model.Rollup, error)
+	GetAllRollups(resolution string, from, to time.Time) (*[]model.Rollup, error)
+	GetMetricRollups(metric, resolution string, from, to time.Time) (*[]model.Rollup, error)
+	LastRollup(resolution string) (time.Time, error)
+	DeleteRollups(resolution string, before time.Time) error
+}
+
 type MongoService struct {
 	cfg *Config
 	db  *mgo.Database
 }
 
 const (
-	deviceCollection = "devices"
-	cookieCollection = "cookies"
-	userCollection   = "users"
-	errorCollection  = "errors"
+	deviceCollection       = "devices"
+	cookieCollection       = "cookies"
+	userCollection         = "users"
+	errorCollection        = "errors"
+	issueCollection        = "issues"
+	issueCountCollection   = "issue_counts"
+	attachmentCollection   = "attachments"
+	firmwareCollection     = "firmware"
+	rolloutCollection      = "rollouts"
+	rolloutDevices         = "rollout_devices"
+	updateCollection       = "updates"
+	downloadCollection     = "downloads"
+	sampleCollection       = "telemetry"
+	rollupCollection       = "rollups"
+	statusCollection       = "status_events"
+	ruleCollection         = "rules"
+	alertCollection        = "alerts"
+	webhookCollection      = "webhooks"
+	deliveryCollection     = "deliveries"
+	subscriptionCollection = "subscriptions"
+	mailCollection         = "mails"
 )
 
 func NewMongoService(cfg *Config) *MongoService {
@@ -62,19 +168,92 @@ func (m *MongoService) Connect() error {
 		return err
 	}
 	m.db = session.DB(m.cfg.Database)
+	if err = m.ensureIndexes(); err != nil {
+		return err
+	}
+	return m.migrateErrors()
+}
+
+// mongoIndexes are indexes queries rely on. Unique index of issues keeps
+// concurrent reports of new issue from making it twice
+var mongoIndexes = []struct {
+	collection string
+	index      mgo.Index
+}{
+	{issueCollection, mgo.Index{Key: []string{"device_id", "error_name", "fingerprint"},
+		Unique: true}},
+	{issueCountCollection, mgo.Index{Key: []string{"issue_id", "date"}, Unique: true}},
+	{issueCountCollection, mgo.Index{Key: []string{"date"}}},
+	{issueCountCollection, mgo.Index{Key: []string{"device_number", "date"}}},
+	{issueCollection, mgo.Index{Key: []string{"last_seen"}}},
+	{deliveryCollection, mgo.Index{Key: []string{"create_date"}}},
+	{sampleCollection, mgo.Index{Key: []string{"metric", "date"}}},
+	{rollupCollection, mgo.Index{Key: []string{"resolution", "metric", "date"}}},
+}
+
+func (m *MongoService) ensureIndexes() error {
+	for _, i := range mongoIndexes {
+		if err := m.db.C(i.collection).EnsureIndex(i.index); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-// GetAllDevices find list of devices
-func (m *MongoService) GetAllDevices(skip int, limit int) (*[]model.DeviceDto,
-	error) {
+// migrateErrors groups errors stored before issues were introduced into
+// issues, each of them is counted as occurrence of open issue
+func (m *MongoService) migrateErrors() error {
+	errorStore := m.db.C(errorCollection)
+	issueStore := m.db.C(issueCollection)
+	for {
+		errs := []model.DeviceError{}
+		err := errorStore.Find(bson.M{"issue_id": bson.M{"$exists": false}}).
+			Sort("date").Limit(1000).All(&errs)
+		if err != nil || len(errs) == 0 {
+			return err
+		}
+		for i := range errs {
+			de := &errs[i]
+			issue := model.Issue{}
+			_, err = issueStore.Find(bson.M{"device_id": de.DeviceId,
+				"error_name": de.ErrorName, "fingerprint": de.Fingerprint}).Apply(mgo.Change{
+				Update: bson.M{
+					"$setOnInsert": bson.M{"device_number": de.DeviceNumber,
+						"state": model.ErrorOpen},
+					"$min": bson.M{"first_seen": de.Date},
+					"$max": bson.M{"last_seen": de.Date},
+					"$inc": bson.M{"count": 1},
+				},
+				Upsert:    true,
+				ReturnNew: true,
+			}, &issue)
+			if err != nil {
+				return err
+			}
+			de.IssueId = issue.ID
+			if err = m.addIssueCounts(countOccurrences([]*model.DeviceError{de})); err != nil {
+				return err
+			}
+			err = errorStore.UpdateId(de.ID, bson.M{"$set": bson.M{"issue_id": issue.ID,
+				"sampled": true}})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// GetAllDevices find list of devices matching filter joined with their
+// issues
+func (m *MongoService) GetAllDevices(skip int, limit int,
+	filter model.DeviceFilter) (*[]model.DeviceDto, error) {
 	deviceStore := m.db.C(deviceCollection)
-	info := make([]model.DeviceDto, limit, limit)
+	info := []model.DeviceDto{}
 	err := deviceStore.Pipe([]bson.M{
-		bson.M{"$lookup": bson.M{"from": errorCollection, "localField": "_id",
-			"foreignField": "device_id", "as": errorCollection}},
-		bson.M{"$limit": limit},
+		bson.M{"$match": deviceQuery(filter)},
 		bson.M{"$skip": skip},
+		bson.M{"$limit": limit},
+		bson.M{"$lookup": issueLookup(filter)},
 	}).All(&info)
 	if err != nil {
 		return nil, err
@@ -82,15 +261,167 @@ func (m *MongoService) GetAllDevices(skip int, limit int) (*[]model.DeviceDto,
 	return &info, nil
 }
 
-func (m *MongoService) GetDevicesCount() (int, error) {
+func (m *MongoService) GetDevicesCount(filter model.DeviceFilter) (int, error) {
 	deviceStore := m.db.C(deviceCollection)
-	n, err := deviceStore.Find(bson.M{}).Count()
+	n, err := deviceStore.Find(deviceQuery(filter)).Count()
 	if err != nil {
 		return -1, err
 	}
 	return n, nil
 }
 
+// deviceQuery selects devices matching filter
+func deviceQuery(filter model.DeviceFilter) bson.M {
+	query := bson.M{}
+	if filter.Status != "" {
+		query["status"] = filter.Status
+	}
+	return query
+}
+
+// issueLookup joins devices with their issues seen last, resolved issues
+// are joined only when filter asks for all errors
+func issueLookup(filter model.DeviceFilter) bson.M {
+	return bson.M{
+		"from": issueCollection,
+		"let":  bson.M{"device": "$_id"},
+		"pipeline": []bson.M{
+			{"$match": issueQuery(bson.M{
+				"$expr": bson.M{"$eq": []string{"$device_id", "$$device"}},
+			}, filter)},
+			{"$sort": bson.D{{Name: "last_seen", Value: -1}, {Name: "_id", Value: -1}}},
+			{"$limit": maxListedIssues},
+		},
+		"as": issueCollection,
+	}
+}
+
+// issueQuery narrows query of issues to ones listed by filter
+func issueQuery(query bson.M, filter model.DeviceFilter) bson.M {
+	if !filter.AllErrors {
+		query["state"] = bson.M{"$ne": model.ErrorResolved}
+	}
+	return query
+}
+
+// matchDevice tells whether device matches filter, it is used by
+// backends which can't query
+func matchDevice(device *model.Device, filter model.DeviceFilter) bool {
+	return filter.Status == "" || device.Status == filter.Status
+}
+
+// GetStats aggregates fleet stats in time window, top limits lists of
+// most frequent errors and devices with most errors
+func (m *MongoService) GetStats(from, to time.Time, top int) (*model.Stats, error) {
+	b := newStatsBuilder(from, to)
+	window := bson.M{"$gte": from, "$lt": to}
+	deviceStore := m.db.C(deviceCollection)
+	before, err := deviceStore.Find(bson.M{"register_date": bson.M{"$lt": from}}).Count()
+	if err != nil {
+		return nil, err
+	}
+	b.before = before
+	counts := []statsCount{}
+	err = deviceStore.Pipe([]bson.M{
+		{"$match": bson.M{"register_date": window}},
+		{"$group": bson.M{"_id": dateFormat("%Y-%m-%d", "$register_date"),
+			"count": bson.M{"$sum": 1}}},
+	}).All(&counts)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range counts {
+		if d, err := time.Parse("2006-01-02", c.ID); err == nil {
+			b.newDevices[d] = c.Count
+		}
+	}
+	// Device is active on day it sent anything and on days it was online
+	seen := []model.Device{}
+	err = deviceStore.Find(bson.M{"last_seen": bson.M{"$gte": from}}).
+		Select(bson.M{"device_number": 1, "last_seen": 1}).All(&seen)
+	if err != nil {
+		return nil, err
+	}
+	lastSeen := make(map[string]time.Time)
+	for _, device := range seen {
+		lastSeen[device.DeviceNumber] = device.LastSeen
+	}
+	events := []model.StatusEvent{}
+	err = m.db.C(statusCollection).Find(bson.M{"date": window}).Sort("date", "_id").
+		All(&events)
+	if err != nil {
+		return nil, err
+	}
+	b.presence(lastSeen, events)
+	for _, collection := range []string{issueCountCollection, updateCollection,
+		sampleCollection} {
+		days := []struct {
+			ID struct {
+				Day    string `bson:"day"`
+				Device string `bson:"device"`
+			} `bson:"_id"`
+		}{}
+		err = m.db.C(collection).Pipe([]bson.M{
+			{"$match": bson.M{"date": window}},
+			{"$group": bson.M{"_id": bson.M{"day": dateFormat("%Y-%m-%d", "$date"),
+				"device": "$device_number"}}},
+		}).All(&days)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range days {
+			if date, err := time.Parse("2006-01-02", d.ID.Day); err == nil {
+				b.activeOn(d.ID.Device, date)
+			}
+		}
+	}
+	countStore := m.db.C(issueCountCollection)
+	counts = []statsCount{}
+	err = countStore.Pipe([]bson.M{
+		{"$match": bson.M{"date": window}},
+		{"$group": bson.M{"_id": dateFormat("%Y-%m-%dT%H", "$date"),
+			"count": bson.M{"$sum": "$count"}}},
+	}).All(&counts)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range counts {
+		if h, err := time.Parse("2006-01-02T15", c.ID); err == nil {
+			b.errors[h] = c.Count
+		}
+	}
+	for field, into := range map[string]map[string]int{
+		"$error_name":    b.errorNames,
+		"$device_number": b.deviceErrors,
+	} {
+		counts = []statsCount{}
+		err = countStore.Pipe([]bson.M{
+			{"$match": bson.M{"date": window}},
+			{"$group": bson.M{"_id": field, "count": bson.M{"$sum": "$count"}}},
+			{"$sort": bson.D{{Name: "count", Value: -1}, {Name: "_id", Value: 1}}},
+			{"$limit": top},
+		}).All(&counts)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range counts {
+			into[c.ID] = c.Count
+		}
+	}
+	return b.build(top), nil
+}
+
+// statsCount is result of grouping stage counting documents
+type statsCount struct {
+	ID    string `bson:"_id"`
+	Count int    `bson:"count"`
+}
+
+// dateFormat formats date field in UTC for grouping
+func dateFormat(format, field string) bson.M {
+	return bson.M{"$dateToString": bson.M{"format": format, "date": field}}
+}
+
 func (m *MongoService) RegisterDevice(deviceNumber string,
 	registerDate time.Time) error {
 	deviceStore := m.db.C(deviceCollection)
@@ -102,22 +433,320 @@ func (m *MongoService) RegisterDevice(deviceNumber string,
 	return nil
 }
 
-func (m *MongoService) RegisterError(de *model.DeviceErrorDto) error {
-	device, err := m.GetDeviceByNumber(de.DeviceNumber)
+// RegisterError counts error in its issue, id of error is returned when
+// it is stored
+func (m *MongoService) RegisterError(de *model.DeviceErrorDto) (string, error) {
+	ids, err := m.RegisterErrors(de.DeviceNumber, []model.DeviceErrorDto{*de})
+	if err != nil {
+		return "", err
+	}
+	return ids[0], nil
+}
+
+// RegisterErrors counts errors of device in their issues, each issue is
+// updated once and sampled errors are inserted together. Ids of stored
+// errors are returned in order of reports
+func (m *MongoService) RegisterErrors(deviceNumber string,
+	des []model.DeviceErrorDto) ([]string, error) {
+	ids, _, err := m.registerErrors(deviceNumber, des)
+	return ids, err
+}
+
+func (m *MongoService) registerErrors(deviceNumber string,
+	des []model.DeviceErrorDto) ([]string, []model.Issue, error) {
+	device, err := m.GetDeviceByNumber(deviceNumber)
+	if err != nil {
+		return nil, nil, err
+	}
+	errs := newDeviceErrors(des, device)
+	issueStore := m.db.C(issueCollection)
+	stored := []interface{}{}
+	opened := []model.Issue{}
+	for _, group := range groupByIssue(errs) {
+		first, last := group[0], group[len(group)-1]
+		issue := model.Issue{}
+		query := issueStore.Find(bson.M{"device_id": device.ID,
+			"error_name": first.ErrorName, "fingerprint": first.Fingerprint})
+		change := mgo.Change{
+			Update: bson.M{
+				"$setOnInsert": bson.M{"device_number": device.DeviceNumber,
+					"first_seen": first.Date, "state": model.ErrorOpen},
+				"$set": bson.M{"last_seen": last.Date,
+					"severity": last.Severity, "code": last.Code,
+					"firmware_version": last.FirmwareVersion},
+				"$inc": bson.M{"count": len(group)},
+			},
+			Upsert:    true,
+			ReturnNew: true,
+		}
+		// Upsert which lost race of inserting new issue updates it
+		if _, err = query.Apply(change, &issue); mgo.IsDup(err) {
+			_, err = query.Apply(change, &issue)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		// Issue is opened by report which inserted it or which reopened it
+		// when resolved, concurrent reports don't open it again
+		opens := issue.Count == len(group)
+		if issue.State == model.ErrorResolved {
+			change := reopenChange(first.Date)
+			err = issueStore.Update(bson.M{"_id": issue.ID, "state": model.ErrorResolved},
+				bson.M{"$set": bson.M{"state": model.ErrorOpen},
+					"$push": bson.M{"history": change}})
+			if err == nil {
+				applyErrorChange(&issue, change)
+				opens = true
+			} else if err != mgo.ErrNotFound {
+				return nil, nil, err
+			}
+		}
+		if opens {
+			opened = append(opened, issue)
+		}
+		n := issue.Count - len(group)
+		for _, de := range group {
+			n++
+			de.IssueId = issue.ID
+			de.Sampled = sampledOccurrence(n)
+			if storedError(de) {
+				stored = append(stored, de)
+			}
+		}
+	}
+	if err = m.addIssueCounts(countOccurrences(errs)); err != nil {
+		return nil, nil, err
+	}
+	if len(stored) > 0 {
+		if err = m.db.C(errorCollection).Insert(stored...); err != nil {
+			return nil, nil, err
+		}
+	}
+	return storedIDs(errs), opened, nil
+}
+
+// addIssueCounts adds counts to stored counts of the same issue and minute
+func (m *MongoService) addIssueCounts(counts []model.IssueCount) error {
+	countStore := m.db.C(issueCountCollection)
+	for _, c := range counts {
+		selector := bson.M{"issue_id": c.IssueId, "date": c.Date}
+		update := bson.M{
+			"$setOnInsert": bson.M{"device_number": c.DeviceNumber,
+				"error_name": c.ErrorName},
+			"$inc": bson.M{"count": c.Count},
+		}
+		_, err := countStore.Upsert(selector, update)
+		if mgo.IsDup(err) {
+			_, err = countStore.Upsert(selector, update)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetDeviceError finds stored error by id
+func (m *MongoService) GetDeviceError(id string) (*model.DeviceError, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrNotFound
+	}
+	de := model.DeviceError{}
+	if err := m.db.C(errorCollection).FindId(bson.ObjectIdHex(id)).One(&de); err != nil {
+		return nil, err
+	}
+	return &de, nil
+}
+
+// ChangeIssues applies change to selected issues of device and records
+// it, number of changed issues is returned
+func (m *MongoService) ChangeIssues(deviceNumber string, sel model.IssueSelector,
+	change model.ErrorChange) (int, error) {
+	device, err := m.GetDeviceByNumber(deviceNumber)
+	if err != nil {
+		return 0, err
+	}
+	query := bson.M{"device_id": device.ID}
+	if sel.ID != "" {
+		if !bson.IsObjectIdHex(sel.ID) {
+			return 0, nil
+		}
+		query["_id"] = bson.ObjectIdHex(sel.ID)
+	} else {
+		query["error_name"] = sel.ErrorName
+	}
+	update := bson.M{"$push": bson.M{"history": change}}
+	set := bson.M{}
+	if state := model.ErrorActions[change.Action]; state != "" {
+		set["state"] = state
+	}
+	if change.Action == model.ActionAssign {
+		set["assignee"] = change.Assignee
+	}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	info, err := m.db.C(issueCollection).UpdateAll(query, update)
+	if err != nil {
+		return 0, err
+	}
+	return info.Updated, nil
+}
+
+// GetIssues finds issues of device matching filter, the latest seen first
+func (m *MongoService) GetIssues(deviceNumber string,
+	filter model.DeviceFilter) (*[]model.Issue, error) {
+	device, err := m.GetDeviceByNumber(deviceNumber)
+	if err != nil {
+		return nil, err
+	}
+	issues := []model.Issue{}
+	err = m.db.C(issueCollection).Find(issueQuery(bson.M{"device_id": device.ID}, filter)).
+		Sort("-last_seen", "-_id").All(&issues)
+	if err != nil {
+		return nil, err
+	}
+	return &issues, nil
+}
+
+// GetOccurrences finds stored occurrences of issue of device, the latest
+// first
+func (m *MongoService) GetOccurrences(deviceNumber string,
+	issueID string) (*[]model.DeviceErrorDto, error) {
+	if !bson.IsObjectIdHex(issueID) {
+		return nil, ErrNotFound
+	}
+	id := bson.ObjectIdHex(issueID)
+	n, err := m.db.C(issueCollection).Find(bson.M{"_id": id,
+		"device_number": deviceNumber}).Count()
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, ErrNotFound
+	}
+	occurrences := []model.DeviceErrorDto{}
+	err = m.db.C(errorCollection).Find(bson.M{"issue_id": id}).Sort("-date").
+		Limit(maxListedOccurrences).All(&occurrences)
+	if err != nil {
+		return nil, err
+	}
+	return &occurrences, nil
+}
+
+func (m *MongoService) AddAttachment(a *model.Attachment) error {
+	return m.db.C(attachmentCollection).Insert(a)
+}
+
+func (m *MongoService) GetAttachment(id string) (*model.Attachment, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrNotFound
+	}
+	a := model.Attachment{}
+	if err := m.db.C(attachmentCollection).FindId(bson.ObjectIdHex(id)).One(&a); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// GetAttachments finds attachments of error in order of upload
+func (m *MongoService) GetAttachments(errorID string) (*[]model.Attachment, error) {
+	attachments := []model.Attachment{}
+	if !bson.IsObjectIdHex(errorID) {
+		return &attachments, nil
+	}
+	err := m.db.C(attachmentCollection).Find(bson.M{"error_id": bson.ObjectIdHex(errorID)}).
+		Sort("date").All(&attachments)
+	if err != nil {
+		return nil, err
+	}
+	return &attachments, nil
+}
+
+// GetAttachmentsBefore finds attachments uploaded before date
+func (m *MongoService) GetAttachmentsBefore(before time.Time) (*[]model.Attachment, error) {
+	attachments := []model.Attachment{}
+	err := m.db.C(attachmentCollection).Find(bson.M{"date": bson.M{"$lt": before}}).
+		All(&attachments)
+	if err != nil {
+		return nil, err
+	}
+	return &attachments, nil
+}
+
+func (m *MongoService) DeleteAttachment(id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrNotFound
+	}
+	return m.db.C(attachmentCollection).RemoveId(bson.ObjectIdHex(id))
+}
+
+// PutBlob stores attachment content in GridFS
+func (m *MongoService) PutBlob(name string, r io.Reader) (int64, error) {
+	file, err := m.db.GridFS(attachmentCollection).Create(name)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(file, r)
+	if err != nil {
+		file.Abort()
+		file.Close()
+		return 0, err
+	}
+	return n, file.Close()
+}
+
+func (m *MongoService) OpenBlob(name string) (Blob, error) {
+	file, err := m.db.GridFS(attachmentCollection).Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (m *MongoService) DeleteBlob(name string) error {
+	return m.db.GridFS(attachmentCollection).Remove(name)
+}
+
+// RegisterUpdate stores firmware update event and keeps last state and
+// running firmware version on device
+func (m *MongoService) RegisterUpdate(us *model.UpdateStatusDto) error {
+	device, err := m.GetDeviceByNumber(us.DeviceNumber)
 	if err != nil {
 		return err
 	}
-	deviceError := &model.DeviceError{
-		ErrorName:    de.ErrorName,
-		DeviceNumber: de.DeviceNumber,
-		Date:         time.Now(),
-		DeviceId:     device.ID,
+	event := &model.UpdateEvent{
+		DeviceNumber:   us.DeviceNumber,
+		DeviceId:       device.ID,
+		State:          us.State,
+		TargetVersion:  us.TargetVersion,
+		CurrentVersion: us.CurrentVersion,
+		Reason:         us.Reason,
+		Date:           time.Now(),
 	}
-	errorStore := m.db.C(errorCollection)
-	if err := errorStore.Insert(deviceError); err != nil {
+	updateStore := m.db.C(updateCollection)
+	if err := updateStore.Insert(event); err != nil {
 		return err
 	}
-	return nil
+	set := bson.M{"update_state": event.State, "update_date": event.Date}
+	if event.CurrentVersion != "" {
+		set["firmware_version"] = event.CurrentVersion
+	}
+	deviceStore := m.db.C(deviceCollection)
+	return deviceStore.UpdateId(device.ID, bson.M{"$set": set})
+}
+
+// GetUpdateEvents returns firmware update events of device, newest first
+func (m *MongoService) GetUpdateEvents(deviceNumber string) (*[]model.UpdateEvent,
+	error) {
+	updateStore := m.db.C(updateCollection)
+	events := []model.UpdateEvent{}
+	err := updateStore.Find(bson.M{"device_number": deviceNumber}).
+		Sort("-date").All(&events)
+	if err != nil {
+		return nil, err
+	}
+	return &events, nil
 }
 
 func (m *MongoService) GetDeviceByNumber(deviceNumber string) (*model.Device, error) {
@@ -130,6 +759,599 @@ func (m *MongoService) GetDeviceByNumber(deviceNumber string) (*model.Device, er
 	return device, nil
 }
 
+// RegisterHeartbeat marks device online and records transition when it
+// was not online before
+func (m *MongoService) RegisterHeartbeat(deviceNumber string, uptime int64,
+	date time.Time) error {
+	deviceStore := m.db.C(deviceCollection)
+	set := bson.M{"status": model.StatusOnline, "last_seen": date}
+	if uptime > 0 {
+		set["uptime"] = uptime
+	}
+	old := &model.Device{}
+	_, err := deviceStore.Find(bson.M{"device_number": deviceNumber}).
+		Apply(mgo.Change{Update: bson.M{"$set": set}}, old)
+	if err != nil {
+		return err
+	}
+	if old.Status == model.StatusOnline {
+		return nil
+	}
+	return m.db.C(statusCollection).Insert(&model.StatusEvent{
+		DeviceNumber: deviceNumber,
+		DeviceId:     old.ID,
+		Status:       model.StatusOnline,
+		Date:         date,
+	})
+}
+
+// MarkOffline marks online devices not seen since time offline, numbers
+// of marked devices are returned
+func (m *MongoService) MarkOffline(before time.Time) (*[]string, error) {
+	deviceStore := m.db.C(deviceCollection)
+	query := bson.M{"status": model.StatusOnline, "last_seen": bson.M{"$lt": before}}
+	devices := []model.Device{}
+	if err := deviceStore.Find(query).All(&devices); err != nil {
+		return nil, err
+	}
+	numbers := []string{}
+	now := time.Now()
+	for _, device := range devices {
+		// Device may have sent heartbeat since it was found
+		err := deviceStore.Update(bson.M{"_id": device.ID, "status": model.StatusOnline,
+			"last_seen": bson.M{"$lt": before}},
+			bson.M{"$set": bson.M{"status": model.StatusOffline}})
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		err = m.db.C(statusCollection).Insert(&model.StatusEvent{
+			DeviceNumber: device.DeviceNumber,
+			DeviceId:     device.ID,
+			Status:       model.StatusOffline,
+			Date:         now,
+		})
+		if err != nil {
+			return nil, err
+		}
+		numbers = append(numbers, device.DeviceNumber)
+	}
+	return &numbers, nil
+}
+
+// GetStatusEvents returns online and offline transitions of device,
+// newest first
+func (m *MongoService) GetStatusEvents(deviceNumber string) (*[]model.StatusEvent,
+	error) {
+	events := []model.StatusEvent{}
+	err := m.db.C(statusCollection).Find(bson.M{"device_number": deviceNumber}).
+		Sort("-date").All(&events)
+	if err != nil {
+		return nil, err
+	}
+	return &events, nil
+}
+
+// SetDeviceSecret stores hash of device credential and lifts revocation
+func (m *MongoService) SetDeviceSecret(deviceNumber string, secretHash string) error {
+	deviceStore := m.db.C(deviceCollection)
+	colQuerier := bson.M{"device_number": deviceNumber}
+	change := bson.M{"$set": bson.M{"secret_hash": secretHash},
+		"$unset": bson.M{"secret_revoked": ""}}
+	return deviceStore.Update(colQuerier, change)
+}
+
+// RevokeDeviceSecret drops device credential, device can't register again
+// until credential is rotated
+func (m *MongoService) RevokeDeviceSecret(deviceNumber string) error {
+	deviceStore := m.db.C(deviceCollection)
+	colQuerier := bson.M{"device_number": deviceNumber}
+	change := bson.M{"$set": bson.M{"secret_revoked": true},
+		"$unset": bson.M{"secret_hash": ""}}
+	return deviceStore.Update(colQuerier, change)
+}
+
+// AssignFirmware pins device to firmware, empty id removes assignment
+func (m *MongoService) AssignFirmware(deviceNumber string, firmwareID string) error {
+	deviceStore := m.db.C(deviceCollection)
+	colQuerier := bson.M{"device_number": deviceNumber}
+	change := bson.M{"$unset": bson.M{"firmware": ""}}
+	if firmwareID != "" {
+		if !bson.IsObjectIdHex(firmwareID) {
+			return ErrNotFound
+		}
+		change = bson.M{"$set": bson.M{"firmware": bson.ObjectIdHex(firmwareID)}}
+	}
+	return deviceStore.Update(colQuerier, change)
+}
+
+func (m *MongoService) AddFirmware(fw *model.Firmware) error {
+	if fw.ID == "" {
+		fw.ID = bson.NewObjectId()
+	}
+	firmwareStore := m.db.C(firmwareCollection)
+	if err := firmwareStore.Insert(fw); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *MongoService) GetFirmware(id string) (*model.Firmware, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrNotFound
+	}
+	firmwareStore := m.db.C(firmwareCollection)
+	fw := &model.Firmware{}
+	if err := firmwareStore.FindId(bson.ObjectIdHex(id)).One(fw); err != nil {
+		return nil, err
+	}
+	return fw, nil
+}
+
+// GetFirmwareList returns all firmware, newest first
+func (m *MongoService) GetFirmwareList() (*[]model.Firmware, error) {
+	firmwareStore := m.db.C(firmwareCollection)
+	list := []model.Firmware{}
+	if err := firmwareStore.Find(bson.M{}).Sort("-upload_date").All(&list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// GetLatestFirmware returns last uploaded firmware for hardware model
+// and channel, firmware held by rollout is skipped
+func (m *MongoService) GetLatestFirmware(hardwareModel, channel string) (*model.Firmware,
+	error) {
+	firmwareStore := m.db.C(firmwareCollection)
+	fw := &model.Firmware{}
+	err := firmwareStore.Find(bson.M{"hardware_model": hardwareModel,
+		"channel": channel, "held": bson.M{"$ne": true}}).Sort("-upload_date").One(fw)
+	if err != nil {
+		return nil, err
+	}
+	return fw, nil
+}
+
+// RecordDownload adds served bytes to download stats of device
+func (m *MongoService) RecordDownload(deviceNumber string, firmwareID string,
+	bytes int64) error {
+	if !bson.IsObjectIdHex(firmwareID) {
+		return ErrNotFound
+	}
+	downloadStore := m.db.C(downloadCollection)
+	colQuerier := bson.M{"device_number": deviceNumber,
+		"firmware": bson.ObjectIdHex(firmwareID)}
+	change := bson.M{"$inc": bson.M{"downloads": 1, "bytes": bytes},
+		"$set": bson.M{"last_date": time.Now()}}
+	if _, err := downloadStore.Upsert(colQuerier, change); err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetDownloads returns download stats of device, latest first
+func (m *MongoService) GetDownloads(deviceNumber string) (*[]model.DownloadStats,
+	error) {
+	downloadStore := m.db.C(downloadCollection)
+	stats := []model.DownloadStats{}
+	err := downloadStore.Find(bson.M{"device_number": deviceNumber}).
+		Sort("-last_date").All(&stats)
+	if err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+func (m *MongoService) SetFirmwareHeld(id string, held bool) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrNotFound
+	}
+	firmwareStore := m.db.C(firmwareCollection)
+	return firmwareStore.UpdateId(bson.ObjectIdHex(id),
+		bson.M{"$set": bson.M{"held": held}})
+}
+
+func (m *MongoService) SetDeviceGroup(deviceNumber string, group string) error {
+	deviceStore := m.db.C(deviceCollection)
+	colQuerier := bson.M{"device_number": deviceNumber}
+	change := bson.M{"$set": bson.M{"group": group}}
+	if group == "" {
+		change = bson.M{"$unset": bson.M{"group": ""}}
+	}
+	return deviceStore.Update(colQuerier, change)
+}
+
+func (m *MongoService) AddRollout(r *model.Rollout) error {
+	if r.ID == "" {
+		r.ID = bson.NewObjectId()
+	}
+	rolloutStore := m.db.C(rolloutCollection)
+	if err := rolloutStore.Insert(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+// UpdateRollout stores rollout unless it was updated since it was read
+func (m *MongoService) UpdateRollout(r *model.Rollout) error {
+	rolloutStore := m.db.C(rolloutCollection)
+	revision := interface{}(r.Revision)
+	if r.Revision == 0 {
+		// Rollouts created before revisions have none
+		revision = bson.M{"$in": []interface{}{0, nil}}
+	}
+	next := *r
+	next.Revision++
+	err := rolloutStore.Update(bson.M{"_id": r.ID, "revision": revision}, &next)
+	if err == mgo.ErrNotFound {
+		if n, err := rolloutStore.FindId(r.ID).Count(); err != nil {
+			return err
+		} else if n > 0 {
+			return ErrConflict
+		}
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	r.Revision = next.Revision
+	return nil
+}
+
+func (m *MongoService) GetRollout(id string) (*model.Rollout, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrNotFound
+	}
+	rolloutStore := m.db.C(rolloutCollection)
+	r := &model.Rollout{}
+	if err := rolloutStore.FindId(bson.ObjectIdHex(id)).One(r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetRollouts returns all rollouts, newest first
+func (m *MongoService) GetRollouts() (*[]model.Rollout, error) {
+	rolloutStore := m.db.C(rolloutCollection)
+	list := []model.Rollout{}
+	if err := rolloutStore.Find(bson.M{}).Sort("-create_date").All(&list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// AddRolloutDevice records device as updated by rollout, date of first
+// record is kept
+func (m *MongoService) AddRolloutDevice(rolloutID string, deviceNumber string) error {
+	if !bson.IsObjectIdHex(rolloutID) || deviceNumber == "" {
+		return ErrNotFound
+	}
+	memberStore := m.db.C(rolloutDevices)
+	colQuerier := bson.M{"rollout": bson.ObjectIdHex(rolloutID),
+		"device_number": deviceNumber}
+	change := bson.M{"$setOnInsert": bson.M{"date": time.Now()}}
+	if _, err := memberStore.Upsert(colQuerier, change); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *MongoService) IsRolloutDevice(rolloutID string, deviceNumber string) (bool,
+	error) {
+	if !bson.IsObjectIdHex(rolloutID) {
+		return false, nil
+	}
+	memberStore := m.db.C(rolloutDevices)
+	n, err := memberStore.Find(bson.M{"rollout": bson.ObjectIdHex(rolloutID),
+		"device_number": deviceNumber}).Count()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// GetRolloutStats counts devices updated by rollout and errors they
+// reported since minute of update or of since, whichever is later
+func (m *MongoService) GetRolloutStats(rolloutID string, since time.Time) (int, int, error) {
+	if !bson.IsObjectIdHex(rolloutID) {
+		return 0, 0, ErrNotFound
+	}
+	memberStore := m.db.C(rolloutDevices)
+	start := bson.M{"$max": []interface{}{"$date", since}}
+	stats := struct {
+		Updated int `bson:"updated"`
+		Errors  int `bson:"errors"`
+	}{}
+	err := memberStore.Pipe([]bson.M{
+		bson.M{"$match": bson.M{"rollout": bson.ObjectIdHex(rolloutID)}},
+		bson.M{"$lookup": bson.M{
+			"from": issueCountCollection,
+			"let": bson.M{"number": "$device_number",
+				"date": bson.M{"$subtract": []interface{}{start, bson.M{"$mod": []interface{}{
+					bson.M{"$toLong": start}, int64(countPeriod / time.Millisecond)}}}}},
+			"pipeline": []bson.M{
+				bson.M{"$match": bson.M{"$expr": bson.M{"$and": []bson.M{
+					bson.M{"$eq": []string{"$device_number", "$$number"}},
+					bson.M{"$gte": []string{"$date", "$$date"}},
+				}}}},
+				bson.M{"$group": bson.M{"_id": nil, "n": bson.M{"$sum": "$count"}}},
+			},
+			"as": "errors"}},
+		bson.M{"$group": bson.M{"_id": nil, "updated": bson.M{"$sum": 1},
+			"errors": bson.M{"$sum": bson.M{"$sum": "$errors.n"}}}},
+	}).One(&stats)
+	if err != nil && err != mgo.ErrNotFound {
+		return 0, 0, err
+	}
+	return stats.Updated, stats.Errors, nil
+}
+
+// CountErrors counts errors named errorName each device reported in
+// minutes starting in [from, to), occurrences which were not stored are
+// counted too
+func (m *MongoService) CountErrors(errorName string, from, to time.Time) (map[string]int,
+	error) {
+	counts := []statsCount{}
+	err := m.db.C(issueCountCollection).Pipe([]bson.M{
+		{"$match": bson.M{"error_name": errorName,
+			"date": bson.M{"$gte": from, "$lt": to}}},
+		{"$group": bson.M{"_id": "$device_number", "count": bson.M{"$sum": "$count"}}},
+	}).All(&counts)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]int, len(counts))
+	for _, c := range counts {
+		if c.Count > 0 {
+			result[c.ID] = c.Count
+		}
+	}
+	return result, nil
+}
+
+// GetOfflineDevices finds offline devices last seen before time
+func (m *MongoService) GetOfflineDevices(before time.Time) (*[]model.Device, error) {
+	devices := []model.Device{}
+	err := m.db.C(deviceCollection).Find(bson.M{"status": model.StatusOffline,
+		"last_seen": bson.M{"$lt": before}}).All(&devices)
+	if err != nil {
+		return nil, err
+	}
+	return &devices, nil
+}
+
+func (m *MongoService) AddRule(r *model.Rule) error {
+	if r.ID == "" {
+		r.ID = bson.NewObjectId()
+	}
+	return m.db.C(ruleCollection).Insert(r)
+}
+
+func (m *MongoService) UpdateRule(r *model.Rule) error {
+	return m.db.C(ruleCollection).UpdateId(r.ID, r)
+}
+
+func (m *MongoService) GetRule(id string) (*model.Rule, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrNotFound
+	}
+	r := &model.Rule{}
+	if err := m.db.C(ruleCollection).FindId(bson.ObjectIdHex(id)).One(r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetRules returns all rules, oldest first
+func (m *MongoService) GetRules() (*[]model.Rule, error) {
+	rules := []model.Rule{}
+	if err := m.db.C(ruleCollection).Find(bson.M{}).Sort("_id").All(&rules); err != nil {
+		return nil, err
+	}
+	return &rules, nil
+}
+
+func (m *MongoService) DeleteRule(id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrNotFound
+	}
+	return m.db.C(ruleCollection).RemoveId(bson.ObjectIdHex(id))
+}
+
+func (m *MongoService) AddAlert(a *model.Alert) error {
+	if a.ID == "" {
+		a.ID = bson.NewObjectId()
+	}
+	return m.db.C(alertCollection).Insert(a)
+}
+
+func (m *MongoService) UpdateAlert(a *model.Alert) error {
+	return m.db.C(alertCollection).UpdateId(a.ID, a)
+}
+
+// GetAlerts returns alerts in state, or in any state when it is empty,
+// newest first. Limit 0 returns every alert
+func (m *MongoService) GetAlerts(state string, limit int) (*[]model.Alert, error) {
+	query := bson.M{}
+	if state != "" {
+		query["state"] = state
+	}
+	alerts := []model.Alert{}
+	err := m.db.C(alertCollection).Find(query).Sort("-start_date", "-_id").
+		Limit(limit).All(&alerts)
+	if err != nil {
+		return nil, err
+	}
+	return &alerts, nil
+}
+
+func (m *MongoService) AddWebhook(w *model.Webhook) error {
+	if w.ID == "" {
+		w.ID = bson.NewObjectId()
+	}
+	return m.db.C(webhookCollection).Insert(w)
+}
+
+func (m *MongoService) GetWebhook(id string) (*model.Webhook, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrNotFound
+	}
+	w := &model.Webhook{}
+	if err := m.db.C(webhookCollection).FindId(bson.ObjectIdHex(id)).One(w); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// GetWebhooks returns all webhooks, oldest first
+func (m *MongoService) GetWebhooks() (*[]model.Webhook, error) {
+	webhooks := []model.Webhook{}
+	if err := m.db.C(webhookCollection).Find(bson.M{}).Sort("_id").All(&webhooks); err != nil {
+		return nil, err
+	}
+	return &webhooks, nil
+}
+
+func (m *MongoService) DeleteWebhook(id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrNotFound
+	}
+	return m.db.C(webhookCollection).RemoveId(bson.ObjectIdHex(id))
+}
+
+// AddDeliveries queues deliveries of events
+func (m *MongoService) AddDeliveries(deliveries []model.Delivery) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+	docs := make([]interface{}, len(deliveries))
+	for i := range deliveries {
+		if deliveries[i].ID == "" {
+			deliveries[i].ID = bson.NewObjectId()
+		}
+		docs[i] = &deliveries[i]
+	}
+	return m.db.C(deliveryCollection).Insert(docs...)
+}
+
+func (m *MongoService) UpdateDelivery(d *model.Delivery) error {
+	return m.db.C(deliveryCollection).UpdateId(d.ID, d)
+}
+
+// GetDueDeliveries returns pending deliveries to attempt at now, the
+// longest waiting first
+func (m *MongoService) GetDueDeliveries(now time.Time, limit int) (*[]model.Delivery,
+	error) {
+	deliveries := []model.Delivery{}
+	err := m.db.C(deliveryCollection).Find(bson.M{"state": model.DeliveryPending,
+		"next_date": bson.M{"$lte": now}}).Sort("next_date", "_id").Limit(limit).All(&deliveries)
+	if err != nil {
+		return nil, err
+	}
+	return &deliveries, nil
+}
+
+// GetDeliveries returns deliveries of webhook, newest first
+func (m *MongoService) GetDeliveries(webhookID string, limit int) (*[]model.Delivery,
+	error) {
+	if !bson.IsObjectIdHex(webhookID) {
+		return &[]model.Delivery{}, nil
+	}
+	deliveries := []model.Delivery{}
+	err := m.db.C(deliveryCollection).Find(bson.M{"webhook_id": bson.ObjectIdHex(webhookID)}).
+		Sort("-_id").Limit(limit).All(&deliveries)
+	if err != nil {
+		return nil, err
+	}
+	return &deliveries, nil
+}
+
+// DeleteDeliveries removes delivered and failed deliveries queued before
+// time
+func (m *MongoService) DeleteDeliveries(before time.Time) error {
+	_, err := m.db.C(deliveryCollection).RemoveAll(bson.M{
+		"state":       bson.M{"$ne": model.DeliveryPending},
+		"create_date": bson.M{"$lt": before},
+	})
+	return err
+}
+
+// SetSubscription stores subscription of admin replacing previous one
+func (m *MongoService) SetSubscription(s *model.Subscription) error {
+	_, err := m.db.C(subscriptionCollection).UpsertId(s.Login, s)
+	return err
+}
+
+func (m *MongoService) GetSubscription(login string) (*model.Subscription, error) {
+	s := &model.Subscription{}
+	if err := m.db.C(subscriptionCollection).FindId(login).One(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// GetSubscriptions returns subscriptions of all admins ordered by login
+func (m *MongoService) GetSubscriptions() (*[]model.Subscription, error) {
+	subscriptions := []model.Subscription{}
+	err := m.db.C(subscriptionCollection).Find(bson.M{}).Sort("_id").All(&subscriptions)
+	if err != nil {
+		return nil, err
+	}
+	return &subscriptions, nil
+}
+
+// SetDigestDate sets when digest was last mailed to admin keeping the
+// rest of subscription as it is
+func (m *MongoService) SetDigestDate(login string, date time.Time) error {
+	return m.db.C(subscriptionCollection).UpdateId(login,
+		bson.M{"$set": bson.M{"digest_date": date}})
+}
+
+// AddMails queues mails
+func (m *MongoService) AddMails(mails []model.Mail) error {
+	if len(mails) == 0 {
+		return nil
+	}
+	docs := make([]interface{}, len(mails))
+	for i := range mails {
+		if mails[i].ID == "" {
+			mails[i].ID = bson.NewObjectId()
+		}
+		docs[i] = &mails[i]
+	}
+	return m.db.C(mailCollection).Insert(docs...)
+}
+
+func (m *MongoService) UpdateMail(mail *model.Mail) error {
+	return m.db.C(mailCollection).UpdateId(mail.ID, mail)
+}
+
+// GetDueMails returns pending mails to send at now, the longest waiting
+// first
+func (m *MongoService) GetDueMails(now time.Time, limit int) (*[]model.Mail, error) {
+	mails := []model.Mail{}
+	err := m.db.C(mailCollection).Find(bson.M{"state": model.DeliveryPending,
+		"next_date": bson.M{"$lte": now}}).Sort("next_date", "_id").Limit(limit).All(&mails)
+	if err != nil {
+		return nil, err
+	}
+	return &mails, nil
+}
+
+// GetIssuesSeen finds issues of every device last seen in [from, to)
+// ordered by device number, issues of device are ordered by last seen,
+// the latest first
+func (m *MongoService) GetIssuesSeen(from, to time.Time, limit int) (*[]model.Issue, error) {
+	issues := []model.Issue{}
+	err := m.db.C(issueCollection).Find(bson.M{
+		"last_seen": bson.M{"$gte": from, "$lt": to},
+	}).Sort("device_number", "-last_seen", "-_id").Limit(limit).All(&issues)
+	if err != nil {
+		return nil, err
+	}
+	return &issues, nil
+}
+
 func (m *MongoService) GetCookieExp(login string) (*time.Time, error) {
 	sessionStore := m.db.C(cookieCollection)
 	cookie := model.Cookie{}
@@ -167,3 +1389,152 @@ func (m *MongoService) GetCreds(login string) (*model.Credentials, error) {
 	}
 	return &creds, nil
 }
+
+// AddSamples stores batch of metric samples
+func (m *MongoService) AddSamples(samples []model.Sample) error {
+	if len(samples) == 0 {
+		return nil
+	}
+	docs := make([]interface{}, len(samples))
+	for i := range samples {
+		docs[i] = &samples[i]
+	}
+	return m.db.C(sampleCollection).Insert(docs...)
+}
+
+// GetSamples finds samples of device metric taken in [from, to)
+func (m *MongoService) GetSamples(deviceNumber, metric string, from,
+	to time.Time) (*[]model.Sample, error) {
+	samples := []model.Sample{}
+	err := m.db.C(sampleCollection).Find(bson.M{
+		"device_number": deviceNumber,
+		"metric":        metric,
+		"date":          bson.M{"$gte": from, "$lt": to},
+	}).Sort("date").All(&samples)
+	if err != nil {
+		return nil, err
+	}
+	return &samples, nil
+}
+
+// GetAllSamples finds samples of every device and metric taken in
+// [from, to)
+func (m *MongoService) GetAllSamples(from, to time.Time) (*[]model.Sample, error) {
+	samples := []model.Sample{}
+	err := m.db.C(sampleCollection).Find(bson.M{
+		"date": bson.M{"$gte": from, "$lt": to},
+	}).Sort("date").All(&samples)
+	if err != nil {
+		return nil, err
+	}
+	return &samples, nil
+}
+
+// GetMetricSamples finds samples of metric of every device taken in
+// [from, to)
+func (m *MongoService) GetMetricSamples(metric string, from,
+	to time.Time) (*[]model.Sample, error) {
+	samples := []model.Sample{}
+	err := m.db.C(sampleCollection).Find(bson.M{
+		"metric": metric,
+		"date":   bson.M{"$gte": from, "$lt": to},
+	}).Sort("date").All(&samples)
+	if err != nil {
+		return nil, err
+	}
+	return &samples, nil
+}
+
+// DeleteSamples removes samples taken before time
+func (m *MongoService) DeleteSamples(before time.Time) error {
+	_, err := m.db.C(sampleCollection).RemoveAll(bson.M{"date": bson.M{"$lt": before}})
+	return err
+}
+
+// SetRollups stores rollups replacing ones of the same bucket
+func (m *MongoService) SetRollups(rollups []model.Rollup) error {
+	rollupStore := m.db.C(rollupCollection)
+	for i := range rollups {
+		r := &rollups[i]
+		_, err := rollupStore.Upsert(bson.M{
+			"device_number": r.DeviceNumber,
+			"metric":        r.Metric,
+			"resolution":    r.Resolution,
+			"date":          r.Date,
+		}, r)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetRollups finds rollups of device metric with buckets starting in
+// [from, to)
+func (m *MongoService) GetRollups(deviceNumber, metric, resolution string, from,
+	to time.Time) (*[]model.Rollup, error) {
+	rollups := []model.Rollup{}
+	err := m.db.C(rollupCollection).Find(bson.M{
+		"device_number": deviceNumber,
+		"metric":        metric,
+		"resolution":    resolution,
+		"date":          bson.M{"$gte": from, "$lt": to},
+	}).Sort("date").All(&rollups)
+	if err != nil {
+		return nil, err
+	}
+	return &rollups, nil
+}
+
+// GetAllRollups finds rollups of every device and metric with buckets
+// starting in [from, to)
+func (m *MongoService) GetAllRollups(resolution string, from,
+	to time.Time) (*[]model.Rollup, error) {
+	rollups := []model.Rollup{}
+	err := m.db.C(rollupCollection).Find(bson.M{
+		"resolution": resolution,
+		"date":       bson.M{"$gte": from, "$lt": to},
+	}).Sort("date").All(&rollups)
+	if err != nil {
+		return nil, err
+	}
+	return &rollups, nil
+}
+
+// GetMetricRollups finds rollups of metric of every device with buckets
+// starting in [from, to)
+func (m *MongoService) GetMetricRollups(metric, resolution string, from,
+	to time.Time) (*[]model.Rollup, error) {
+	rollups := []model.Rollup{}
+	err := m.db.C(rollupCollection).Find(bson.M{
+		"resolution": resolution,
+		"metric":     metric,
+		"date":       bson.M{"$gte": from, "$lt": to},
+	}).Sort("date").All(&rollups)
+	if err != nil {
+		return nil, err
+	}
+	return &rollups, nil
+}
+
+// LastRollup returns start of the latest bucket of resolution, zero time
+// when there are no rollups of resolution
+func (m *MongoService) LastRollup(resolution string) (time.Time, error) {
+	rollup := model.Rollup{}
+	err := m.db.C(rollupCollection).Find(bson.M{"resolution": resolution}).
+		Sort("-date").One(&rollup)
+	if err == mgo.ErrNotFound {
+		return time.Time{}, nil
+	}
+	return rollup.Date, err
+}
+
+// DeleteRollups removes rollups of resolution with buckets starting
+// before time
+func (m *MongoService) DeleteRollups(resolution string, before time.Time) error {
+	_, err := m.db.C(rollupCollection).RemoveAll(bson.M{
+		"resolution": resolution,
+		"date":       bson.M{"$lt": before},
+	})
+	return err
+}
@@ -0,0 +1,177 @@
+package service
+
+import (
+	"iot-stats/model"
+	"sort"
+	"time"
+)
+
+const (
+	day  = 24 * time.Hour
+	hour = time.Hour
+)
+
+// statsBuilder collects counters backends aggregated for fleet stats and
+// turns them into model.Stats with every day and hour of window present
+type statsBuilder struct {
+	from, to time.Time
+	// devices registered before window
+	before       int
+	newDevices   map[time.Time]int
+	active       map[time.Time]map[string]bool
+	errors       map[time.Time]int
+	errorNames   map[string]int
+	deviceErrors map[string]int
+}
+
+func newStatsBuilder(from, to time.Time) *statsBuilder {
+	return &statsBuilder{
+		from:         from,
+		to:           to,
+		newDevices:   make(map[time.Time]int),
+		active:       make(map[time.Time]map[string]bool),
+		errors:       make(map[time.Time]int),
+		errorNames:   make(map[string]int),
+		deviceErrors: make(map[string]int),
+	}
+}
+
+func (b *statsBuilder) inWindow(t time.Time) bool {
+	return !t.Before(b.from) && t.Before(b.to)
+}
+
+// device counts device registered at date
+func (b *statsBuilder) device(registerDate time.Time) {
+	if registerDate.Before(b.from) {
+		b.before++
+	} else if registerDate.Before(b.to) {
+		b.newDevices[truncateUTC(registerDate, day)]++
+	}
+}
+
+// activity marks device active on day of date
+func (b *statsBuilder) activity(deviceNumber string, date time.Time) {
+	if b.inWindow(date) {
+		b.activeOn(deviceNumber, truncateUTC(date, day))
+	}
+}
+
+// activeOn marks device active on day starting at d
+func (b *statsBuilder) activeOn(deviceNumber string, d time.Time) {
+	if b.active[d] == nil {
+		b.active[d] = make(map[string]bool)
+	}
+	b.active[d][deviceNumber] = true
+}
+
+// presence marks devices active on every day of window they were online,
+// from transition to online until transition to offline or until device
+// was last seen. Events are transitions in window in time order, device
+// seen in window without transition in it was online since before window
+func (b *statsBuilder) presence(lastSeen map[string]time.Time, events []model.StatusEvent) {
+	transitions := make(map[string][]model.StatusEvent)
+	for _, e := range events {
+		transitions[e.DeviceNumber] = append(transitions[e.DeviceNumber], e)
+	}
+	for number := range lastSeen {
+		if _, ok := transitions[number]; !ok {
+			transitions[number] = nil
+		}
+	}
+	for number, events := range transitions {
+		seen := lastSeen[number]
+		online := len(events) == 0 && b.inWindow(seen) ||
+			len(events) > 0 && events[0].Status == model.StatusOffline
+		since := b.from
+		for _, e := range events {
+			if e.Status == model.StatusOnline && !online {
+				online, since = true, e.Date
+			} else if e.Status == model.StatusOffline && online {
+				online = false
+				b.activeBetween(number, since, e.Date)
+			}
+		}
+		if online {
+			b.activeBetween(number, since, seen)
+		}
+		b.activity(number, seen)
+	}
+}
+
+// activeBetween marks device active on every day of window from one date
+// to another
+func (b *statsBuilder) activeBetween(deviceNumber string, from, to time.Time) {
+	if from.Before(b.from) {
+		from = b.from
+	}
+	if !to.Before(b.to) {
+		to = b.to.Add(-time.Nanosecond)
+	}
+	for d := truncateUTC(from, day); !d.After(to); d = d.Add(day) {
+		b.activeOn(deviceNumber, d)
+	}
+}
+
+// issueCount counts occurrences of issue in window, device becomes active
+func (b *statsBuilder) issueCount(c *model.IssueCount) {
+	if !b.inWindow(c.Date) {
+		return
+	}
+	b.errors[truncateUTC(c.Date, hour)] += c.Count
+	b.errorNames[c.ErrorName] += c.Count
+	b.deviceErrors[c.DeviceNumber] += c.Count
+	b.activity(c.DeviceNumber, c.Date)
+}
+
+func (b *statsBuilder) build(top int) *model.Stats {
+	stats := &model.Stats{
+		From:       b.from,
+		To:         b.to,
+		Days:       []model.DayStats{},
+		Hours:      []model.HourStats{},
+		TopErrors:  []model.ErrorNameCount{},
+		TopDevices: []model.DeviceErrorCount{},
+	}
+	total := b.before
+	for d := truncateUTC(b.from, day); d.Before(b.to); d = d.Add(day) {
+		total += b.newDevices[d]
+		stats.Days = append(stats.Days, model.DayStats{
+			Date:   d,
+			Total:  total,
+			Active: len(b.active[d]),
+			New:    b.newDevices[d],
+		})
+	}
+	stats.Devices = total
+	for h := truncateUTC(b.from, hour); h.Before(b.to); h = h.Add(hour) {
+		stats.Hours = append(stats.Hours, model.HourStats{Date: h, Errors: b.errors[h]})
+	}
+	for name, n := range b.errorNames {
+		stats.TopErrors = append(stats.TopErrors, model.ErrorNameCount{
+			ErrorName: name, Count: n})
+	}
+	sort.Slice(stats.TopErrors, func(i, j int) bool {
+		a, b := stats.TopErrors[i], stats.TopErrors[j]
+		return a.Count > b.Count || a.Count == b.Count && a.ErrorName < b.ErrorName
+	})
+	for number, n := range b.deviceErrors {
+		stats.TopDevices = append(stats.TopDevices, model.DeviceErrorCount{
+			DeviceNumber: number, Errors: n})
+	}
+	sort.Slice(stats.TopDevices, func(i, j int) bool {
+		a, b := stats.TopDevices[i], stats.TopDevices[j]
+		return a.Errors > b.Errors || a.Errors == b.Errors && a.DeviceNumber < b.DeviceNumber
+	})
+	if len(stats.TopErrors) > top {
+		stats.TopErrors = stats.TopErrors[:top]
+	}
+	if len(stats.TopDevices) > top {
+		stats.TopDevices = stats.TopDevices[:top]
+	}
+	return stats
+}
+
+// truncateUTC returns start of day or hour t falls in, in UTC
+func truncateUTC(t time.Time, d time.Duration) time.Time {
+	return t.UTC().Truncate(d)
+}
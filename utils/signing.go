@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+)
+
+const signingKeyType = "PRIVATE KEY"
+
+// GenerateSigningKey creates Ed25519 key and stores it PEM encoded in
+// file, existing key is kept in file with .old suffix
+func GenerateSigningKey(path string) (ed25519.PublicKey, error) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = os.Stat(path); err == nil {
+		if err = os.Rename(path, path+".old"); err != nil {
+			return nil, err
+		}
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: signingKeyType, Bytes: der})
+	if err = ioutil.WriteFile(path, data, 0600); err != nil {
+		return nil, err
+	}
+	return pub, nil
+}
+
+// LoadSigningKey reads Ed25519 key written by GenerateSigningKey
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != signingKeyType {
+		return nil, errors.New("no signing key in " + path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("signing key in " + path + " is not Ed25519 key")
+	}
+	return edKey, nil
+}
+
+// KeyID is short fingerprint of public key, it tells devices which key
+// signed manifest
+func KeyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
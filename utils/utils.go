@@ -1,7 +1,9 @@
 package utils
 
 import (
+	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
 )
 
@@ -12,3 +14,17 @@ func GenerateHash(password string) string {
 	hash = base64.URLEncoding.EncodeToString(sha.Sum(nil))
 	return hash
 }
+
+// GenerateSecret returns random url safe string made of n random bytes
+func GenerateSecret(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// CheckHash compares secret with stored hash in constant time
+func CheckHash(secret, hash string) bool {
+	return subtle.ConstantTimeCompare([]byte(GenerateHash(secret)), []byte(hash)) == 1
+}